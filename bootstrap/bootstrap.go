@@ -1,13 +1,19 @@
 package bootstrap
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/sky-uk/etcd-bootstrap/cloud"
 	"github.com/sky-uk/etcd-bootstrap/etcd"
+	"github.com/sky-uk/etcd-bootstrap/metrics"
+	"github.com/sky-uk/etcd-bootstrap/report"
 )
 
 // Bootstrapper bootstraps an etcd process by generating a set of Etcd flags for discovery.
@@ -15,7 +21,21 @@ type Bootstrapper struct {
 	cloudAPI        CloudAPI
 	etcdAPI         EtcdAPI
 	protocol        string
-	additionalFlags []string
+	peerPort        int
+	clientPort      int
+	learner         bool
+	removalPolicy   RemovalPolicy
+	preflightPolicy PreflightPolicy
+	lockPolicy      LockPolicy
+	dataDir         string
+	staleDataAction StaleDataAction
+	readDataDir     func(string) (etcd.DataDir, error)
+	snapshotAPI     SnapshotAPI
+	outputFormat    OutputFormat
+	fileOptions     FileOptions
+	clientTLS       *TLSConfig
+	peerTLS         *TLSConfig
+	report          *report.Report
 }
 
 type clusterState string
@@ -28,22 +48,60 @@ const (
 	existingCluster clusterState = "existing"
 )
 
+const (
+	defaultPeerPort   = 2380
+	defaultClientPort = 2379
+)
+
 // CloudAPI returns instance information for the etcd cluster from cloud APIs.
 type CloudAPI interface {
 	// GetInstances returns all the non-terminated instances that will be part of the etcd cluster.
-	GetInstances() ([]cloud.Instance, error)
+	GetInstances(context.Context) ([]cloud.Instance, error)
 	// GetLocalInstance returns the local machine instance.
-	GetLocalInstance() (cloud.Instance, error)
+	GetLocalInstance(context.Context) (cloud.Instance, error)
 	// GetLocalIP returns the IP of a local interface to listen on. This should be an externally accessible IP,
 	// and may be the same as the endpoint returned in GetLocalInstance but this is not required.
-	GetLocalIP() (string, error)
+	GetLocalIP(context.Context) (string, error)
 }
 
 // EtcdAPI returns information from the etcd cluster API.
 type EtcdAPI interface {
-	Members() ([]etcd.Member, error)
-	AddMemberByPeerURL(string) error
-	RemoveMemberByName(string) error
+	Members(context.Context) ([]etcd.Member, error)
+	AddMemberByPeerURL(context.Context, string) error
+	RemoveMemberByName(context.Context, string) error
+	// RemoveMember removes a member by its ID, which unlike its name is unique even before the member has started.
+	RemoveMember(context.Context, uint64) error
+	// AddLearnerByPeerURL adds a non-voting learner member by its peer URL.
+	AddLearnerByPeerURL(context.Context, string) error
+	// PromoteLearnerByPeerURL promotes a learner to a voting member. It returns etcd.ErrLearnerNotReady
+	// if the learner hasn't caught up with the leader yet.
+	PromoteLearnerByPeerURL(context.Context, string) error
+	// ClusterID returns the ID of the live cluster.
+	ClusterID(context.Context) (uint64, error)
+	// MemberHealthy returns true if the member's client endpoint is reachable.
+	MemberHealthy(context.Context, etcd.Member) bool
+	// Lock acquires a lock held in etcd, waiting up to the timeout. The lock expires after the TTL if its holder
+	// dies. It returns a function to release the lock.
+	Lock(ctx context.Context, holder string, timeout, ttl time.Duration) (func() error, error)
+	// ProbeInstance checks if etcd is running on an instance, without needing a working cluster.
+	ProbeInstance(context.Context, cloud.Instance) etcd.InstanceStatus
+	// Leader returns the ID of the cluster leader, asking the members.
+	Leader(context.Context, []etcd.Member) (uint64, error)
+}
+
+// RemovalPolicy limits which old members are removed when reconciling the cluster with the cloud instances.
+// Regardless of the policy, members are never removed if the remaining voting members would lose quorum.
+type RemovalPolicy struct {
+	// MaxRemovals is the most members that will be removed in a single run. Zero means no limit.
+	MaxRemovals int
+	// RequireUnhealthy only allows removing members whose client endpoint is unreachable.
+	RequireUnhealthy bool
+}
+
+// DefaultRemovalPolicy removes at most a single unhealthy member per run.
+var DefaultRemovalPolicy = RemovalPolicy{
+	MaxRemovals:      1,
+	RequireUnhealthy: true,
 }
 
 // Option for configuring the bootstrapper.
@@ -68,28 +126,118 @@ func WithTLS(serverCA, serverCert, serverKey, peerCA, peerCert, peerKey string)
 			}
 		}
 
-		flags := []string{
-			"ETCD_CLIENT_CERT_AUTH=true",
-			"ETCD_TRUSTED_CA_FILE=" + serverCA,
-			"ETCD_CERT_FILE=" + serverCert,
-			"ETCD_KEY_FILE=" + serverKey,
-			"ETCD_PEER_CLIENT_CERT_AUTH=true",
-			"ETCD_PEER_TRUSTED_CA_FILE=" + peerCA,
-			"ETCD_PEER_CERT_FILE=" + peerCert,
-			"ETCD_PEER_KEY_FILE=" + peerKey,
+		b.clientTLS = &TLSConfig{
+			CertFile:       serverCert,
+			KeyFile:        serverKey,
+			ClientCertAuth: true,
+			TrustedCAFile:  serverCA,
+		}
+		b.peerTLS = &TLSConfig{
+			CertFile:       peerCert,
+			KeyFile:        peerKey,
+			ClientCertAuth: true,
+			TrustedCAFile:  peerCA,
 		}
-		b.additionalFlags = append(b.additionalFlags, flags...)
 		b.protocol = "https"
 		return nil
 	}
 }
 
+// WithPeerPort sets the port etcd listens on and advertises for peer communication.
+func WithPeerPort(port int) Option {
+	return func(b *Bootstrapper) error {
+		if err := validatePort(port); err != nil {
+			return fmt.Errorf("invalid peer port: %w", err)
+		}
+		b.peerPort = port
+		return nil
+	}
+}
+
+// WithClientPort sets the port etcd listens on and advertises for client communication. Instances which
+// publish their own client port, such as those discovered via an SRV record, take precedence over this.
+func WithClientPort(port int) Option {
+	return func(b *Bootstrapper) error {
+		if err := validatePort(port); err != nil {
+			return fmt.Errorf("invalid client port: %w", err)
+		}
+		b.clientPort = port
+		return nil
+	}
+}
+
+// WithLearner adds new members to an existing cluster as non-voting learners, so that adding a replacement
+// node doesn't reduce the cluster's fault tolerance before it has synced. Learners must be promoted afterwards
+// with PromoteLocalInstance.
+func WithLearner() Option {
+	return func(b *Bootstrapper) error {
+		b.learner = true
+		return nil
+	}
+}
+
+// WithRemovalPolicy sets the policy for removing old members, which defaults to DefaultRemovalPolicy. This guards
+// against removing healthy members when the cloud API temporarily returns fewer instances than really exist.
+func WithRemovalPolicy(policy RemovalPolicy) Option {
+	return func(b *Bootstrapper) error {
+		if policy.MaxRemovals < 0 {
+			return fmt.Errorf("max removals must not be negative, but was %d", policy.MaxRemovals)
+		}
+		b.removalPolicy = policy
+		return nil
+	}
+}
+
+// WithOutputFormat sets the format of the generated etcd config, which defaults to EnvFormat.
+func WithOutputFormat(format OutputFormat) Option {
+	return func(b *Bootstrapper) error {
+		if _, err := ParseOutputFormat(string(format)); err != nil {
+			return err
+		}
+		b.outputFormat = format
+		return nil
+	}
+}
+
+// WithFileOptions sets how the generated config file is written, which defaults to DefaultFileOptions.
+func WithFileOptions(opts FileOptions) Option {
+	return func(b *Bootstrapper) error {
+		if opts.Mode&^os.ModePerm != 0 {
+			return fmt.Errorf("file mode %v must only contain permission bits", opts.Mode)
+		}
+		b.fileOptions = opts
+		return nil
+	}
+}
+
+// WithReport records what bootstrapping found and did in the report.
+func WithReport(r *report.Report) Option {
+	return func(b *Bootstrapper) error {
+		b.report = r
+		return nil
+	}
+}
+
+func validatePort(port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("%d is not between 1 and 65535", port)
+	}
+	return nil
+}
+
 // New creates a new bootstrapper.
 func New(cloudAPI CloudAPI, etcdAPI EtcdAPI, opts ...Option) (*Bootstrapper, error) {
 	bootstrapper := &Bootstrapper{
-		cloudAPI: cloudAPI,
-		etcdAPI:  etcdAPI,
-		protocol: "http",
+		cloudAPI:        cloudAPI,
+		etcdAPI:         etcdAPI,
+		protocol:        "http",
+		peerPort:        defaultPeerPort,
+		clientPort:      defaultClientPort,
+		removalPolicy:   DefaultRemovalPolicy,
+		preflightPolicy: DefaultPreflightPolicy,
+		lockPolicy:      DefaultLockPolicy,
+		outputFormat:    EnvFormat,
+		fileOptions:     DefaultFileOptions,
 	}
 	for _, opt := range opts {
 		if err := opt(bootstrapper); err != nil {
@@ -99,65 +247,108 @@ func New(cloudAPI CloudAPI, etcdAPI EtcdAPI, opts ...Option) (*Bootstrapper, err
 	return bootstrapper, nil
 }
 
-// GenerateEtcdFlagsFile writes etcd flag data to a file.
-// It's intended to be sourced in startup scripts.
-func (b *Bootstrapper) GenerateEtcdFlagsFile(outputFilename string) error {
-	log.Infof("Writing environment variables to %s", outputFilename)
-	etcdFlags, err := b.GenerateEtcdFlags()
+// GenerateEtcdFlagsFile writes etcd flag data to a file, in the configured output format.
+// With the default format it's intended to be sourced in startup scripts.
+func (b *Bootstrapper) GenerateEtcdFlagsFile(ctx context.Context, outputFilename string) error {
+	log.Infof("Writing etcd %s config to %s", b.outputFormat, outputFilename)
+	etcdFlags, err := b.GenerateEtcdFlags(ctx)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(outputFilename, []byte(etcdFlags), 0644)
+	if err := writeFile(outputFilename, []byte(etcdFlags), b.fileOptions); err != nil {
+		return err
+	}
+	b.report.SetConfig(outputFilename, string(b.outputFormat), etcdFlags)
+	return nil
+}
+
+// GenerateEtcdFlags returns a string containing the generated etcd flags, in the configured output format.
+func (b *Bootstrapper) GenerateEtcdFlags(ctx context.Context) (string, error) {
+	start := time.Now()
+	config, err := b.GenerateEtcdConfig(ctx)
+	metrics.ObserveGenerate(start, err)
+	b.report.Time("generate", start)
+	if err != nil {
+		return "", err
+	}
+	return b.format(config)
 }
 
-// GenerateEtcdFlags returns a string containing the generated etcd flags.
-func (b *Bootstrapper) GenerateEtcdFlags() (string, error) {
+// GenerateEtcdConfig reconciles the etcd members with the cloud instances if needed, and returns the
+// configuration etcd should start with.
+func (b *Bootstrapper) GenerateEtcdConfig(ctx context.Context) (*EtcdConfig, error) {
 	log.Infof("Generating etcd cluster flags")
 
-	clusterExists, err := b.clusterExists()
+	clusterExists, err := b.clusterExists(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if !clusterExists {
 		log.Info("No cluster found - treating as an initial node in the new cluster")
-		return b.createEtcdConfigForNewCluster()
+		metrics.RecordDecision(metrics.NewCluster)
+		b.report.SetDecision(string(metrics.NewCluster))
+		config, err := b.createEtcdConfigForNewCluster(ctx)
+		if err != nil {
+			return nil, err
+		}
+		restore, err := b.shouldRestore()
+		if err != nil {
+			return nil, err
+		}
+		if restore {
+			if err := b.restoreSnapshot(config); err != nil {
+				return nil, err
+			}
+		}
+		return config, nil
+	}
+
+	if err := b.checkDataDir(ctx); err != nil {
+		return nil, err
 	}
 
-	nodeExistsInCluster, err := b.nodeExistsInCluster()
+	nodeExistsInCluster, err := b.nodeExistsInCluster(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if nodeExistsInCluster {
 		// etcd expects the cluster state to be set to `new` when the node is already part of the cluster.
 		log.Info("Node already exists in cluster - treating as an existing node in a new cluster")
-		return b.createEtcdConfigForNewCluster()
+		metrics.RecordDecision(metrics.Rejoin)
+		b.report.SetDecision(string(metrics.Rejoin))
+		return b.createEtcdConfigForNewCluster(ctx)
 	}
 
 	log.Info("Node does not exist yet in cluster - joining as a new node")
-	if err := b.reconcileMembers(); err != nil {
-		return "", err
-	}
-	return b.createEtcdConfigForExistingCluster()
-}
-
-func (b *Bootstrapper) clusterExists() (bool, error) {
-	m, err := b.etcdAPI.Members()
+	metrics.RecordDecision(metrics.ExistingCluster)
+	b.report.SetDecision(string(metrics.ExistingCluster))
+	// Hold the lock until the members have been reconciled, so that nodes joining at the same time don't
+	// remove each other's members, or add theirs while another is being added.
+	start := time.Now()
+	unlock, err := b.lockMembership(ctx)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	defer unlock()
+	b.report.Time("lock", start)
+	start = time.Now()
+	if err := b.reconcileMembers(ctx); err != nil {
+		return nil, err
 	}
-	return len(m) > 0, nil
+	b.report.Time("reconcile", start)
+	return b.createEtcdConfigForExistingCluster(ctx)
 }
 
 // nodeExistsInCluster checks whether the local instance has joined the etcd cluster.
 // It does this by seeing if the local instance name already exists in the etcd cluster.
 // Checking the peerURL is not sufficient - as this only shows the cluster is ready to
 // accept the node, not that it has joined yet.
-func (b *Bootstrapper) nodeExistsInCluster() (bool, error) {
-	members, err := b.etcdAPI.Members()
+func (b *Bootstrapper) nodeExistsInCluster(ctx context.Context) (bool, error) {
+	members, err := b.etcdAPI.Members(ctx)
 	if err != nil {
 		return false, err
 	}
-	localInstance, err := b.cloudAPI.GetLocalInstance()
+	localInstance, err := b.cloudAPI.GetLocalInstance(ctx)
 	if err != nil {
 		return false, err
 	}
@@ -179,16 +370,16 @@ func (b *Bootstrapper) nodeExistsInCluster() (bool, error) {
 // cluster URL list. This is okay however, as etcd seems to only validate these URLs
 // when the cluster state is set to "existing" and when bootstrapping a new cluster. For an
 // existing node it seems to be ignored.
-func (b *Bootstrapper) createEtcdConfigForNewCluster() (string, error) {
-	instances, err := b.cloudAPI.GetInstances()
+func (b *Bootstrapper) createEtcdConfigForNewCluster(ctx context.Context) (*EtcdConfig, error) {
+	instances, err := b.cloudAPI.GetInstances(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	var initialClusterURLs []string
 	for _, instance := range instances {
 		initialClusterURLs = append(initialClusterURLs, b.peerURL(instance.Endpoint))
 	}
-	return b.createEtcdConfig(newCluster, initialClusterURLs)
+	return b.createEtcdConfig(ctx, newCluster, initialClusterURLs)
 }
 
 // createEtcdConfigForExistingCluster sets the cluster state flag to "existing", and uses the member
@@ -200,72 +391,89 @@ func (b *Bootstrapper) createEtcdConfigForNewCluster() (string, error) {
 //
 // The local node must also be included in the initial cluster list, which should happen if its
 // peerURL was added in the reconcile step.
-func (b *Bootstrapper) createEtcdConfigForExistingCluster() (string, error) {
-	members, err := b.etcdAPI.Members()
+func (b *Bootstrapper) createEtcdConfigForExistingCluster(ctx context.Context) (*EtcdConfig, error) {
+	members, err := b.etcdAPI.Members(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	b.report.SetMembersAfter(members)
 	var initialClusterURLs []string
 	for _, member := range members {
 		initialClusterURLs = append(initialClusterURLs, member.PeerURL)
 	}
-	return b.createEtcdConfig(existingCluster, initialClusterURLs)
+	return b.createEtcdConfig(ctx, existingCluster, initialClusterURLs)
 }
 
 // createEtcdConfig creates all of the flags to be used by `etcd` itself.
 //
 // Use the [clustering guide](https://etcd.io/docs/v3.4.0/op-guide/clustering/) for details on what
 // these flags mean.
-func (b *Bootstrapper) createEtcdConfig(state clusterState, initialPeerURLs []string) (string, error) {
+func (b *Bootstrapper) createEtcdConfig(ctx context.Context, state clusterState, initialPeerURLs []string) (*EtcdConfig, error) {
 	// Should be "new" in all cases except when joining an existing cluster, when it should be "existing".
-	envs := []string{"ETCD_INITIAL_CLUSTER_STATE=" + string(state)}
+	config := &EtcdConfig{InitialClusterState: string(state)}
 
 	// Construct the format "name=peerURL" for all of the "initial" nodes in the cluster.
 	// "initial" simply means the nodes that have already joined the cluster. It doesn't necessarily
 	// mean the very initial nodes - the naming is confusing, unfortunately.
-	initialClusterValue, err := b.initialClusterFlagValue(initialPeerURLs)
+	initialClusterValue, err := b.initialClusterFlagValue(ctx, initialPeerURLs)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	envs = append(envs, fmt.Sprintf("ETCD_INITIAL_CLUSTER=%s", initialClusterValue))
+	config.InitialCluster = initialClusterValue
 
 	// The name should be unique across the cluster and should match the name used in INITIAL_CLUSTER.
 	// This value will also be stored in etcd itself once the node has joined the cluster.
 	// In theory this value doesn't need to be unique, but it is used both by etcd-bootstrap and also
 	// by some of etcd's own discovery mechanisms, where it is assumed to be unique.
 	// etcd will also generate a unique ID for the node when it joins.
-	local, err := b.cloudAPI.GetLocalInstance()
+	local, err := b.cloudAPI.GetLocalInstance(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	envs = append(envs, fmt.Sprintf("ETCD_NAME=%s", local.Name))
+	b.report.SetLocalInstance(local)
+	config.Name = local.Name
 
 	// Advertise using the URL that other nodes and clients use to connect to this node.
 	// This should typically be the domain name for this node, or IP if not using domain names.
-	envs = append(envs, fmt.Sprintf("ETCD_INITIAL_ADVERTISE_PEER_URLS=%s", b.peerURL(local.Endpoint)))
-	envs = append(envs, fmt.Sprintf("ETCD_ADVERTISE_CLIENT_URLS=%s", b.clientURL(local.Endpoint)))
+	// The client port may be published by the cloud provider, in which case it's used for both advertising and listening.
+	clientPort := b.clientPortFor(local)
+	config.InitialAdvertisePeerURLs = b.peerURL(local.Endpoint)
+	config.AdvertiseClientURLs = b.url(local.Endpoint, clientPort)
 
 	// Since we listen on the network interface, we have to specify an IP address here so etcd
 	// knows what to bind to.
-	localIP, err := b.cloudAPI.GetLocalIP()
+	localIP, err := b.cloudAPI.GetLocalIP(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	config.ListenPeerURLs = b.peerURL(localIP)
+	config.ListenClientURLs = b.url(localIP, clientPort)
+	if localIP != "127.0.0.1" {
+		// Also listen on localhost, unless the instance is already using it, e.g. when testing locally.
+		config.ListenClientURLs += "," + b.url("127.0.0.1", clientPort)
 	}
-	envs = append(envs, fmt.Sprintf("ETCD_LISTEN_PEER_URLS=%s", b.peerURL(localIP)))
-	envs = append(envs, fmt.Sprintf("ETCD_LISTEN_CLIENT_URLS=%s,%s", b.clientURL(localIP), b.clientURL("127.0.0.1")))
 
-	// Add any additional flags. Currently this is only used to add the TLS specific flags which add certs and things.
-	for _, flag := range b.additionalFlags {
-		envs = append(envs, flag)
+	// Add the TLS certs and things, if enabled.
+	config.ClientTLS = b.clientTLS
+	config.PeerTLS = b.peerTLS
+	return config, nil
+}
+
+// format serializes the config in the configured output format.
+func (b *Bootstrapper) format(config *EtcdConfig) (string, error) {
+	format := b.outputFormat
+	if format == "" {
+		format = EnvFormat
 	}
-	return strings.Join(envs, "\n") + "\n", nil
+	return config.Format(format)
 }
 
-func (b *Bootstrapper) initialClusterFlagValue(initialPeerURLs []string) (string, error) {
-	instances, err := b.cloudAPI.GetInstances()
+func (b *Bootstrapper) initialClusterFlagValue(ctx context.Context, initialPeerURLs []string) (string, error) {
+	instances, err := b.cloudAPI.GetInstances(ctx)
 	if err != nil {
 		return "", err
 	}
+	b.report.SetInstances(instances)
 	var initialCluster []string
 	// This looks up the node name from the peer URL via a reverse lookup on the instances.
 	for _, instance := range instances {
@@ -279,11 +487,23 @@ func (b *Bootstrapper) initialClusterFlagValue(initialPeerURLs []string) (string
 }
 
 func (b *Bootstrapper) peerURL(host string) string {
-	return fmt.Sprintf("%s://%s:2380", b.protocol, host)
+	return b.url(host, b.peerPort)
 }
 
 func (b *Bootstrapper) clientURL(host string) string {
-	return fmt.Sprintf("%s://%s:2379", b.protocol, host)
+	return b.url(host, b.clientPort)
+}
+
+func (b *Bootstrapper) url(host string, port int) string {
+	return fmt.Sprintf("%s://%s", b.protocol, net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// clientPortFor returns the client port published by the instance, or the configured client port if it has none.
+func (b *Bootstrapper) clientPortFor(instance cloud.Instance) int {
+	if instance.ClientPort != 0 {
+		return instance.ClientPort
+	}
+	return b.clientPort
 }
 
 func contains(strings []string, value string) bool {
@@ -294,3 +514,15 @@ func contains(strings []string, value string) bool {
 	}
 	return false
 }
+
+// sleep waits for the duration, returning early with an error if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -1,9 +1,11 @@
 package bootstrap
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/sky-uk/etcd-bootstrap/cloud"
 	"github.com/sky-uk/etcd-bootstrap/etcd"
@@ -56,14 +58,23 @@ var _ = Describe("Bootstrap", func() {
 			},
 		}
 		etcdAPIMock = &EtcdAPIMock{
-			MembersMock:      &Members{},
-			AddMemberMock:    &AddMember{},
-			RemoveMemberMock: &RemoveMember{},
+			MembersMock:        &Members{},
+			AddMemberMock:      &AddMember{},
+			RemoveMemberMock:   &RemoveMember{},
+			AddLearnerMock:     &AddMember{},
+			PromoteLearnerMock: &PromoteLearner{},
+			MemberHealthyMock:  &MemberHealthy{},
+			ProbeInstanceMock:  &ProbeInstance{},
+			ClusterIDMock:      &ClusterID{},
+			LockMock:           &Lock{},
+			LeaderMock:         &Leader{},
 		}
 		bootstrapper = &Bootstrapper{
-			cloudAPI: cloudAPIMock,
-			etcdAPI:  etcdAPIMock,
-			protocol: "http",
+			cloudAPI:   cloudAPIMock,
+			etcdAPI:    etcdAPIMock,
+			protocol:   "http",
+			peerPort:   2380,
+			clientPort: 2379,
 		}
 	})
 
@@ -72,6 +83,15 @@ var _ = Describe("Bootstrap", func() {
 		Expect(bootstrapper.clientURL(localIP)).To(Equal(localListenClientURL))
 	})
 
+	It("brackets IPv6 hosts in URLs", func() {
+		Expect(bootstrapper.peerURL("fd00::1")).To(Equal("http://[fd00::1]:2380"))
+	})
+
+	It("rejects invalid ports", func() {
+		Expect(WithPeerPort(0)(bootstrapper)).ToNot(Succeed())
+		Expect(WithClientPort(65536)(bootstrapper)).ToNot(Succeed())
+	})
+
 	It("fails when it cannot get etcd members", func() {
 		cloudAPIMock.GetInstancesMock.GetInstancesOutput = []cloud.Instance{
 			{
@@ -80,7 +100,7 @@ var _ = Describe("Bootstrap", func() {
 			},
 		}
 		etcdAPIMock.MembersMock.Err = fmt.Errorf("failed to get etcd members")
-		_, err := bootstrapper.GenerateEtcdFlags()
+		_, err := bootstrapper.GenerateEtcdFlags(context.Background())
 		Expect(err).To(Not(Succeed()))
 	})
 
@@ -93,22 +113,23 @@ var _ = Describe("Bootstrap", func() {
 		}
 		etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
 			{
+				ID:      1,
 				Name:    localInstanceID,
 				PeerURL: localAdvertisePeerURL,
 			},
 			{
+				ID:      2,
 				Name:    "test-remove-instance-id-1",
 				PeerURL: "http://etcd-remove-me:2380",
 			},
 		}
 
 		By("Expecting to receive a call to remove a test instance")
-		nameToRemove := "test-remove-instance-id-1"
-		etcdAPIMock.RemoveMemberMock.ExpectedInput = &nameToRemove
+		etcdAPIMock.RemoveMemberMock.ExpectedID = &[]uint64{2}[0]
 
 		By("Returning an error when trying to remove an etcd member")
 		etcdAPIMock.RemoveMemberMock.Err = fmt.Errorf("failed to remove etcd members")
-		_, err := bootstrapper.GenerateEtcdFlags()
+		_, err := bootstrapper.GenerateEtcdFlags(context.Background())
 
 		By("Do not fail as it may be down to an etcd quorum issue")
 		Expect(err).To(BeNil())
@@ -138,7 +159,7 @@ var _ = Describe("Bootstrap", func() {
 		By("Returning an error when attempting to add the local instance to the etcd API")
 		etcdAPIMock.AddMemberMock.ExpectedInput = &localAdvertisePeerURL
 		etcdAPIMock.AddMemberMock.Err = fmt.Errorf("failed to add etcd member")
-		_, err := bootstrapper.GenerateEtcdFlags()
+		_, err := bootstrapper.GenerateEtcdFlags(context.Background())
 		Expect(err).ToNot(Succeed())
 	})
 
@@ -165,7 +186,7 @@ var _ = Describe("Bootstrap", func() {
 		})
 
 		It("should create etcd flags for initializing a new cluster", func() {
-			etcdFlags, err := bootstrapper.GenerateEtcdFlags()
+			etcdFlags, err := bootstrapper.GenerateEtcdFlags(context.Background())
 			flags := strings.Split(etcdFlags, "\n")
 			Expect(err).To(BeNil())
 			Expect(flags).To(ContainElement("ETCD_INITIAL_CLUSTER_STATE=new"))
@@ -181,6 +202,75 @@ var _ = Describe("Bootstrap", func() {
 			Expect(flags).To(ContainElement(fmt.Sprintf("ETCD_LISTEN_CLIENT_URLS=%v,%v",
 				localListenClientURL, bootstrapper.clientURL("127.0.0.1"))))
 		})
+
+		It("waits for the cluster when an instance already has data", func() {
+			bootstrapper.preflightPolicy = PreflightPolicy{Timeout: time.Second, RetryInterval: 10 * time.Millisecond}
+			etcdAPIMock.ProbeInstanceMock.Statuses = map[string]etcd.InstanceStatus{
+				"test-new-cluster-instance-id-1": {Reachable: true, Running: true, HasData: true},
+			}
+			etcdAPIMock.MembersMock.Outputs = [][]etcd.Member{{}, {}}
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
+				{Name: "test-new-cluster-instance-id-1", PeerURL: "http://test-new-cluster-endpoint-1:2380"},
+				{Name: "test-new-cluster-instance-id-2", PeerURL: "http://test-new-cluster-endpoint-2:2380"},
+			}
+			etcdAPIMock.AddMemberMock.ExpectedInput = &localAdvertisePeerURL
+
+			etcdFlags, err := bootstrapper.GenerateEtcdFlags(context.Background())
+			Expect(err).To(BeNil())
+			Expect(strings.Split(etcdFlags, "\n")).To(ContainElement("ETCD_INITIAL_CLUSTER_STATE=existing"))
+			Expect(etcdAPIMock.AddMemberMock.Called).To(BeTrue())
+			Expect(etcdAPIMock.ProbeInstanceMock.Calls).To(Equal(6))
+		})
+
+		It("never starts a new cluster when an instance already has data", func() {
+			bootstrapper.preflightPolicy = PreflightPolicy{
+				Timeout:       50 * time.Millisecond,
+				RetryInterval: 10 * time.Millisecond,
+				Force:         true,
+			}
+			etcdAPIMock.ProbeInstanceMock.Statuses = map[string]etcd.InstanceStatus{
+				"test-new-cluster-instance-id-2": {Reachable: true, Running: true, Healthy: true},
+			}
+
+			_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("test-new-cluster-instance-id-2"))
+			Expect(etcdAPIMock.ProbeInstanceMock.Calls).To(BeNumerically(">", 3))
+		})
+
+		It("refuses to start a new cluster when an instance is unreachable", func() {
+			etcdAPIMock.ProbeInstanceMock.Statuses = map[string]etcd.InstanceStatus{
+				"test-new-cluster-instance-id-1": {Err: fmt.Errorf("i/o timeout")},
+			}
+
+			_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("test-new-cluster-instance-id-1"))
+		})
+
+		It("refuses to start a new cluster with fewer instances than the cluster size", func() {
+			bootstrapper.preflightPolicy.ClusterSize = 5
+
+			_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("3 of the expected 5"))
+		})
+
+		It("starts a partial new cluster when forced", func() {
+			bootstrapper.preflightPolicy = PreflightPolicy{ClusterSize: 5, Force: true}
+			etcdAPIMock.ProbeInstanceMock.Statuses = map[string]etcd.InstanceStatus{
+				"test-new-cluster-instance-id-1": {Err: fmt.Errorf("i/o timeout")},
+			}
+
+			etcdFlags, err := bootstrapper.GenerateEtcdFlags(context.Background())
+			Expect(err).To(BeNil())
+			Expect(strings.Split(etcdFlags, "\n")).To(ContainElement("ETCD_INITIAL_CLUSTER_STATE=new"))
+		})
+
+		It("rejects an invalid preflight policy", func() {
+			Expect(WithPreflightPolicy(PreflightPolicy{Timeout: -time.Second})(bootstrapper)).ToNot(Succeed())
+			Expect(WithPreflightPolicy(PreflightPolicy{ClusterSize: -1})(bootstrapper)).ToNot(Succeed())
+		})
 	})
 
 	Describe("an existing cluster", func() {
@@ -219,7 +309,7 @@ var _ = Describe("Bootstrap", func() {
 		})
 
 		It("should create etcd flags for joining an existing cluster", func() {
-			etcdFlags, err := bootstrapper.GenerateEtcdFlags()
+			etcdFlags, err := bootstrapper.GenerateEtcdFlags(context.Background())
 			flags := strings.Split(etcdFlags, "\n")
 			Expect(err).To(BeNil())
 			Expect(flags).To(ContainElement("ETCD_INITIAL_CLUSTER_STATE=new"))
@@ -257,14 +347,17 @@ var _ = Describe("Bootstrap", func() {
 			By("Returning a list of etcd members that contains too many members but does not include the local instance")
 			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
 				{
+					ID:      1,
 					Name:    "test-existing-cluster-old-instance-id-1",
 					PeerURL: "http://endpoint-1:2380",
 				},
 				{
+					ID:      2,
 					Name:    "test-existing-cluster-instance-id-2",
 					PeerURL: "http://endpoint-2:2380",
 				},
 				{
+					ID:      3,
 					Name:    "test-existing-cluster-instance-id-3",
 					PeerURL: "http://endpoint-3:2380",
 				},
@@ -272,10 +365,9 @@ var _ = Describe("Bootstrap", func() {
 		})
 
 		It("should remove the prior node and add the local node", func() {
-			oldInstanceID := "test-existing-cluster-old-instance-id-1"
-			etcdAPIMock.RemoveMemberMock.ExpectedInput = &oldInstanceID
+			etcdAPIMock.RemoveMemberMock.ExpectedID = &[]uint64{1}[0]
 			etcdAPIMock.AddMemberMock.ExpectedInput = &localAdvertisePeerURL
-			etcdFlags, err := bootstrapper.GenerateEtcdFlags()
+			etcdFlags, err := bootstrapper.GenerateEtcdFlags(context.Background())
 			Expect(err).To(BeNil())
 			Expect(etcdAPIMock.RemoveMemberMock.Called).To(BeTrue())
 			Expect(etcdAPIMock.AddMemberMock.Called).To(BeTrue())
@@ -290,6 +382,38 @@ var _ = Describe("Bootstrap", func() {
 			Expect(flags).To(ContainElement("ETCD_LISTEN_PEER_URLS=" + localListenPeerURL))
 			Expect(flags).To(ContainElement(fmt.Sprintf("ETCD_LISTEN_CLIENT_URLS=%v,%v", localListenClientURL, bootstrapper.clientURL("127.0.0.1"))))
 		})
+		It("holds the membership lock while changing the members", func() {
+			bootstrapper.lockPolicy = DefaultLockPolicy
+			etcdAPIMock.RemoveMemberMock.ExpectedID = &[]uint64{1}[0]
+			etcdAPIMock.AddMemberMock.ExpectedInput = &localAdvertisePeerURL
+			_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+			Expect(err).To(BeNil())
+			Expect(etcdAPIMock.LockMock.Holders).To(Equal([]string{localInstanceID + " (" + localEndpoint + ")"}))
+			Expect(etcdAPIMock.LockMock.Unlocked).To(Equal(1))
+		})
+
+		It("doesn't change the members without the membership lock", func() {
+			bootstrapper.lockPolicy = DefaultLockPolicy
+			etcdAPIMock.LockMock.Err = fmt.Errorf("timed out waiting for the lock")
+			_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+			Expect(err).ToNot(BeNil())
+			Expect(etcdAPIMock.RemoveMemberMock.Called).To(BeFalse())
+			Expect(etcdAPIMock.AddMemberMock.Called).To(BeFalse())
+		})
+
+		It("doesn't lock when locking is disabled", func() {
+			etcdAPIMock.RemoveMemberMock.ExpectedID = &[]uint64{1}[0]
+			etcdAPIMock.AddMemberMock.ExpectedInput = &localAdvertisePeerURL
+			_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+			Expect(err).To(BeNil())
+			Expect(etcdAPIMock.LockMock.Holders).To(BeEmpty())
+		})
+
+		It("rejects an invalid lock policy", func() {
+			Expect(WithLockPolicy(LockPolicy{Timeout: -time.Second})(bootstrapper)).ToNot(Succeed())
+			Expect(WithLockPolicy(LockPolicy{Timeout: time.Minute, TTL: time.Millisecond})(bootstrapper)).ToNot(Succeed())
+			Expect(WithLockPolicy(LockPolicy{})(bootstrapper)).To(Succeed())
+		})
 	})
 
 	Describe("an existing cluster that is partially initialised", func() {
@@ -329,7 +453,7 @@ var _ = Describe("Bootstrap", func() {
 		})
 
 		It("should add the local instance and generate etcd flags including the local instance", func() {
-			etcdFlags, err := bootstrapper.GenerateEtcdFlags()
+			etcdFlags, err := bootstrapper.GenerateEtcdFlags(context.Background())
 			Expect(err).To(BeNil())
 
 			flags := strings.Split(etcdFlags, "\n")
@@ -346,6 +470,477 @@ var _ = Describe("Bootstrap", func() {
 		})
 	})
 
+	Describe("removing old members", func() {
+		JustBeforeEach(func() {
+			Expect(WithRemovalPolicy(DefaultRemovalPolicy)(bootstrapper)).To(Succeed())
+			cloudAPIMock.GetInstancesMock.GetInstancesOutput = []cloud.Instance{
+				{
+					Name:     localInstanceID,
+					Endpoint: localEndpoint,
+				},
+				{
+					Name:     "test-existing-cluster-instance-id-1",
+					Endpoint: "endpoint-1",
+				},
+				{
+					Name:     "test-existing-cluster-instance-id-4",
+					Endpoint: "endpoint-4",
+				},
+			}
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
+				{
+					ID:      1,
+					Name:    "test-existing-cluster-instance-id-1",
+					PeerURL: "http://endpoint-1:2380",
+				},
+				{
+					ID:      2,
+					Name:    "test-existing-cluster-old-instance-id-2",
+					PeerURL: "http://endpoint-2:2380",
+				},
+				{
+					ID:      3,
+					Name:    "test-existing-cluster-old-instance-id-3",
+					PeerURL: "http://endpoint-3:2380",
+				},
+				{
+					ID:      4,
+					Name:    "test-existing-cluster-instance-id-4",
+					PeerURL: "http://endpoint-4:2380",
+				},
+			}
+			etcdAPIMock.AddMemberMock.ExpectedInput = &localAdvertisePeerURL
+		})
+
+		It("skips members that are still healthy", func() {
+			_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+			Expect(err).To(BeNil())
+			Expect(etcdAPIMock.RemoveMemberMock.Called).To(BeFalse())
+		})
+
+		It("removes healthy members when the policy allows it", func() {
+			Expect(WithRemovalPolicy(RemovalPolicy{MaxRemovals: 1})(bootstrapper)).To(Succeed())
+			etcdAPIMock.RemoveMemberMock.ExpectedID = &[]uint64{2}[0]
+			_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+			Expect(err).To(BeNil())
+			Expect(etcdAPIMock.RemoveMemberMock.Called).To(BeTrue())
+		})
+
+		It("removes a stale unstarted member by its ID, leaving one which is joining", func() {
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
+				{ID: 1, Name: "test-existing-cluster-instance-id-1", PeerURL: "http://endpoint-1:2380"},
+				{ID: 4, PeerURL: "http://endpoint-4:2380"},
+				{ID: 5, PeerURL: "http://endpoint-5:2380"},
+			}
+			etcdAPIMock.MemberHealthyMock.Unhealthy = []string{"http://endpoint-5:2380"}
+			etcdAPIMock.RemoveMemberMock.ExpectedID = &[]uint64{5}[0]
+			_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+			Expect(err).To(BeNil())
+			Expect(etcdAPIMock.RemoveMemberMock.Called).To(BeTrue())
+		})
+
+		It("removes no more than the maximum number of members", func() {
+			etcdAPIMock.MemberHealthyMock.Unhealthy = []string{"http://endpoint-3:2380"}
+			Expect(WithRemovalPolicy(RemovalPolicy{MaxRemovals: 1})(bootstrapper)).To(Succeed())
+			removals, err := bootstrapper.planMemberRemovals(context.Background())
+			Expect(err).To(BeNil())
+			Expect(removals).To(HaveLen(2))
+			Expect(removals[0].remove).To(BeTrue())
+			Expect(removals[1].remove).To(BeFalse())
+			Expect(removals[1].reason).To(ContainSubstring("maximum"))
+		})
+
+		It("refuses to remove members if the remaining members would lose quorum", func() {
+			etcdAPIMock.MemberHealthyMock.Unhealthy = []string{
+				"http://endpoint-1:2380", "http://endpoint-2:2380", "http://endpoint-3:2380"}
+			Expect(WithRemovalPolicy(RemovalPolicy{})(bootstrapper)).To(Succeed())
+			removals, err := bootstrapper.planMemberRemovals(context.Background())
+			Expect(err).To(BeNil())
+			Expect(removals).To(HaveLen(2))
+			for _, removal := range removals {
+				Expect(removal.remove).To(BeFalse())
+				Expect(removal.reason).To(ContainSubstring("quorum"))
+			}
+		})
+
+		It("removes unhealthy members while the remaining members have quorum", func() {
+			etcdAPIMock.MemberHealthyMock.Unhealthy = []string{"http://endpoint-2:2380", "http://endpoint-3:2380"}
+			Expect(WithRemovalPolicy(RemovalPolicy{RequireUnhealthy: true})(bootstrapper)).To(Succeed())
+			removals, err := bootstrapper.planMemberRemovals(context.Background())
+			Expect(err).To(BeNil())
+			Expect(removals).To(HaveLen(2))
+			Expect(removals[0].remove).To(BeTrue())
+			Expect(removals[1].remove).To(BeTrue())
+		})
+
+		It("does not count learners towards quorum", func() {
+			etcdAPIMock.MemberHealthyMock.Unhealthy = []string{"http://endpoint-2:2380", "http://endpoint-3:2380"}
+			etcdAPIMock.MembersMock.MembersOutput[3].IsLearner = true
+			Expect(WithRemovalPolicy(RemovalPolicy{RequireUnhealthy: true})(bootstrapper)).To(Succeed())
+			removals, err := bootstrapper.planMemberRemovals(context.Background())
+			Expect(err).To(BeNil())
+			Expect(removals).To(HaveLen(2))
+			for _, removal := range removals {
+				Expect(removal.remove).To(BeFalse())
+				Expect(removal.reason).To(ContainSubstring("quorum"))
+			}
+		})
+
+		It("rejects a negative removal limit", func() {
+			Expect(WithRemovalPolicy(RemovalPolicy{MaxRemovals: -1})(bootstrapper)).ToNot(Succeed())
+		})
+	})
+
+	Describe("Plan()", func() {
+		JustBeforeEach(func() {
+			cloudAPIMock.GetInstancesMock.GetInstancesOutput = []cloud.Instance{
+				{
+					Name:     localInstanceID,
+					Endpoint: localEndpoint,
+				},
+				{
+					Name:     "test-existing-cluster-instance-id-2",
+					Endpoint: "endpoint-2",
+				},
+				{
+					Name:     "test-existing-cluster-instance-id-3",
+					Endpoint: "endpoint-3",
+				},
+			}
+		})
+
+		It("plans a new cluster", func() {
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{}
+			plan, err := bootstrapper.Plan(context.Background())
+			Expect(err).To(BeNil())
+			Expect(plan.ClusterState).To(Equal("new"))
+			Expect(plan.Instances).To(HaveLen(3))
+			Expect(plan.LocalInstance.Name).To(Equal(localInstanceID))
+			Expect(plan.Removals).To(BeEmpty())
+			Expect(plan.AddPeerURL).To(BeEmpty())
+			Expect(strings.Split(plan.Flags, "\n")).To(ContainElement("ETCD_INITIAL_CLUSTER_STATE=new"))
+		})
+
+		It("plans replacing a node without changing the members", func() {
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
+				{
+					ID:      1,
+					Name:    "test-existing-cluster-old-instance-id-1",
+					PeerURL: "http://endpoint-1:2380",
+				},
+				{
+					ID:      2,
+					Name:    "test-existing-cluster-instance-id-2",
+					PeerURL: "http://endpoint-2:2380",
+				},
+				{
+					ID:      3,
+					Name:    "test-existing-cluster-instance-id-3",
+					PeerURL: "http://endpoint-3:2380",
+				},
+			}
+			plan, err := bootstrapper.Plan(context.Background())
+			Expect(err).To(BeNil())
+			Expect(etcdAPIMock.RemoveMemberMock.Called).To(BeFalse())
+			Expect(etcdAPIMock.AddMemberMock.Called).To(BeFalse())
+
+			Expect(plan.ClusterState).To(Equal("existing"))
+			Expect(plan.Members).To(HaveLen(3))
+			Expect(plan.Removals).To(Equal([]PlannedRemoval{{
+				Name:    "test-existing-cluster-old-instance-id-1",
+				PeerURL: "http://endpoint-1:2380",
+				Remove:  true,
+			}}))
+			Expect(plan.AddPeerURL).To(Equal(localAdvertisePeerURL))
+			flags := strings.Split(plan.Flags, "\n")
+			Expect(flags).To(ContainElement("ETCD_INITIAL_CLUSTER_STATE=existing"))
+			Expect(flags).To(ContainElement(fmt.Sprintf("ETCD_INITIAL_CLUSTER=%s=%s,%s=%s,%s=%s",
+				localInstanceID, localAdvertisePeerURL,
+				"test-existing-cluster-instance-id-2", "http://endpoint-2:2380",
+				"test-existing-cluster-instance-id-3", "http://endpoint-3:2380")))
+
+			text := plan.String()
+			Expect(text).To(ContainSubstring("remove test-existing-cluster-old-instance-id-1 (http://endpoint-1:2380)"))
+			Expect(text).To(ContainSubstring("add " + localAdvertisePeerURL + " as a member"))
+		})
+	})
+
+	Describe("learner mode", func() {
+		JustBeforeEach(func() {
+			Expect(WithLearner()(bootstrapper)).To(Succeed())
+			cloudAPIMock.GetInstancesMock.GetInstancesOutput = []cloud.Instance{
+				{
+					Name:     localInstanceID,
+					Endpoint: localEndpoint,
+				},
+				{
+					Name:     "test-existing-cluster-instance-id-1",
+					Endpoint: "endpoint-1",
+				},
+			}
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
+				{
+					Name:    "test-existing-cluster-instance-id-1",
+					PeerURL: "http://endpoint-1:2380",
+				},
+			}
+		})
+
+		It("adds the local instance as a learner instead of a voting member", func() {
+			etcdAPIMock.AddLearnerMock.ExpectedInput = &localAdvertisePeerURL
+			etcdFlags, err := bootstrapper.GenerateEtcdFlags(context.Background())
+			Expect(err).To(BeNil())
+			Expect(etcdAPIMock.AddLearnerMock.Called).To(BeTrue())
+			Expect(etcdAPIMock.AddMemberMock.Called).To(BeFalse())
+			Expect(strings.Split(etcdFlags, "\n")).To(ContainElement("ETCD_INITIAL_CLUSTER_STATE=existing"))
+		})
+
+		It("fails when it cannot add the local instance as a learner", func() {
+			etcdAPIMock.AddLearnerMock.ExpectedInput = &localAdvertisePeerURL
+			etcdAPIMock.AddLearnerMock.Err = fmt.Errorf("failed to add learner")
+			_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+			Expect(err).ToNot(Succeed())
+		})
+	})
+
+	Describe("PromoteLocalInstance()", func() {
+		It("promotes the local instance once the learner is ready", func() {
+			etcdAPIMock.PromoteLearnerMock.ExpectedInput = &localAdvertisePeerURL
+			etcdAPIMock.PromoteLearnerMock.Errs = []error{
+				fmt.Errorf("%w: still syncing", etcd.ErrLearnerNotReady),
+				fmt.Errorf("connection refused"),
+				nil,
+			}
+			Expect(bootstrapper.PromoteLocalInstance(context.Background(), time.Second, time.Millisecond)).To(Succeed())
+			Expect(etcdAPIMock.PromoteLearnerMock.Calls).To(Equal(3))
+		})
+
+		It("gives up after the timeout", func() {
+			etcdAPIMock.PromoteLearnerMock.ExpectedInput = &localAdvertisePeerURL
+			etcdAPIMock.PromoteLearnerMock.Err = etcd.ErrLearnerNotReady
+			err := bootstrapper.PromoteLocalInstance(context.Background(), 10*time.Millisecond, time.Millisecond)
+			Expect(err).ToNot(Succeed())
+			Expect(etcdAPIMock.PromoteLearnerMock.Calls).To(BeNumerically(">", 1))
+		})
+	})
+
+	Describe("ClusterStatus()", func() {
+		JustBeforeEach(func() {
+			cloudAPIMock.GetInstancesMock.GetInstancesOutput = []cloud.Instance{
+				{
+					Name:     "test-instance-id-1",
+					Endpoint: "endpoint-1",
+				},
+				{
+					Name:     "test-instance-id-2",
+					Endpoint: "endpoint-2",
+				},
+				{
+					Name:     "test-instance-id-3",
+					Endpoint: "endpoint-3",
+				},
+			}
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
+				{
+					ID:      1,
+					Name:    "test-instance-id-1",
+					PeerURL: "http://endpoint-1:2380",
+				},
+				{
+					ID:      2,
+					PeerURL: "http://endpoint-2:2380",
+				},
+				{
+					ID:      4,
+					Name:    "test-old-instance-id-4",
+					PeerURL: "http://endpoint-4:2380",
+				},
+			}
+			etcdAPIMock.MemberHealthyMock.Unhealthy = []string{"http://endpoint-2:2380", "http://endpoint-4:2380"}
+			etcdAPIMock.LeaderMock.ID = 1
+		})
+
+		It("joins the members with the cloud instances", func() {
+			status, err := bootstrapper.ClusterStatus(context.Background())
+			Expect(err).To(BeNil())
+			Expect(status.Members).To(HaveLen(3))
+			Expect(status.Members[0].Instance.Name).To(Equal("test-instance-id-1"))
+			Expect(status.Members[0].Healthy).To(BeTrue())
+			Expect(status.Members[0].Leader).To(BeTrue())
+			Expect(status.Members[1].Instance.Name).To(Equal("test-instance-id-2"), "matched by peer URL")
+			Expect(status.Members[2].Instance).To(BeNil())
+			Expect(status.Leader).To(Equal("test-instance-id-1"))
+			Expect(status.InstancesNotMembers).To(Equal([]cloud.Instance{{Name: "test-instance-id-3", Endpoint: "endpoint-3"}}))
+			Expect(status.MembersNotInstances).To(HaveLen(1))
+			Expect(status.MembersNotInstances[0].Name).To(Equal("test-old-instance-id-4"))
+		})
+
+		It("reports the cluster has no quorum", func() {
+			status, err := bootstrapper.ClusterStatus(context.Background())
+			Expect(err).To(BeNil())
+			Expect(status.Voters).To(Equal(3))
+			Expect(status.HealthyVoters).To(Equal(1))
+			Expect(status.Quorum).To(Equal(2))
+			Expect(status.HasQuorum).To(BeFalse())
+			Expect(status.String()).To(ContainSubstring("has NO quorum, 1 of 3 voting members healthy, 2 needed"))
+		})
+
+		It("still reports the members without a leader", func() {
+			etcdAPIMock.LeaderMock.Err = fmt.Errorf("no members have started")
+			status, err := bootstrapper.ClusterStatus(context.Background())
+			Expect(err).To(BeNil())
+			Expect(status.Members).To(HaveLen(3))
+			Expect(status.Leader).To(BeEmpty())
+		})
+	})
+
+	Describe("RemoveMember()", func() {
+		JustBeforeEach(func() {
+			cloudAPIMock.GetInstancesMock.GetInstancesOutput = []cloud.Instance{
+				{
+					Name:     "test-instance-id-1",
+					Endpoint: "endpoint-1",
+				},
+				{
+					Name:     "test-instance-id-2",
+					Endpoint: "endpoint-2",
+				},
+			}
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
+				{
+					Name:    "test-instance-id-1",
+					PeerURL: "http://endpoint-1:2380",
+				},
+				{
+					Name:    "test-instance-id-2",
+					PeerURL: "http://endpoint-2:2380",
+				},
+				{
+					Name:    "test-old-instance-id-3",
+					PeerURL: "http://endpoint-3:2380",
+				},
+			}
+			Expect(WithLockPolicy(DefaultLockPolicy)(bootstrapper)).To(Succeed())
+		})
+
+		It("removes a member which isn't a cloud instance while holding the lock", func() {
+			name := "test-old-instance-id-3"
+			etcdAPIMock.RemoveMemberMock.ExpectedInput = &name
+			Expect(bootstrapper.RemoveMember(context.Background(), name, false)).To(Succeed())
+			Expect(etcdAPIMock.RemoveMemberMock.Called).To(BeTrue())
+			Expect(etcdAPIMock.LockMock.Holders).To(ConsistOf(HavePrefix("etcd-bootstrap remove " + name)))
+			Expect(etcdAPIMock.LockMock.Unlocked).To(Equal(1))
+		})
+
+		It("fails if the member doesn't exist", func() {
+			Expect(bootstrapper.RemoveMember(context.Background(), "test-missing", false)).
+				To(MatchError(ContainSubstring("not a member")))
+		})
+
+		It("refuses to remove a member which is still a cloud instance unless forced", func() {
+			name := "test-instance-id-2"
+			Expect(bootstrapper.RemoveMember(context.Background(), name, false)).
+				To(MatchError(ContainSubstring("still a cloud instance")))
+			Expect(etcdAPIMock.RemoveMemberMock.Called).To(BeFalse())
+
+			etcdAPIMock.RemoveMemberMock.ExpectedInput = &name
+			Expect(bootstrapper.RemoveMember(context.Background(), name, true)).To(Succeed())
+		})
+
+		It("refuses to remove a member if the rest would lose quorum", func() {
+			etcdAPIMock.MemberHealthyMock.Unhealthy = []string{"http://endpoint-2:2380"}
+			Expect(bootstrapper.RemoveMember(context.Background(), "test-old-instance-id-3", false)).
+				To(MatchError(ContainSubstring("healthy quorum")))
+			Expect(etcdAPIMock.RemoveMemberMock.Called).To(BeFalse())
+		})
+	})
+
+	Describe("AddInstance()", func() {
+		JustBeforeEach(func() {
+			cloudAPIMock.GetInstancesMock.GetInstancesOutput = []cloud.Instance{
+				{
+					Name:     "test-instance-id-1",
+					Endpoint: "endpoint-1",
+				},
+				{
+					Name:     "test-instance-id-2",
+					Endpoint: "endpoint-2",
+				},
+			}
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
+				{
+					Name:    "test-instance-id-1",
+					PeerURL: "http://endpoint-1:2380",
+				},
+			}
+		})
+
+		It("adds the instance's peer URL", func() {
+			peerURL := "http://endpoint-2:2380"
+			etcdAPIMock.AddMemberMock.ExpectedInput = &peerURL
+			Expect(bootstrapper.AddInstance(context.Background(), "test-instance-id-2")).To(Succeed())
+			Expect(etcdAPIMock.AddMemberMock.Called).To(BeTrue())
+		})
+
+		It("adds the instance as a learner", func() {
+			Expect(WithLearner()(bootstrapper)).To(Succeed())
+			peerURL := "http://endpoint-2:2380"
+			etcdAPIMock.AddLearnerMock.ExpectedInput = &peerURL
+			Expect(bootstrapper.AddInstance(context.Background(), "test-instance-id-2")).To(Succeed())
+			Expect(etcdAPIMock.AddLearnerMock.Called).To(BeTrue())
+		})
+
+		It("does nothing if the instance is already a member", func() {
+			Expect(bootstrapper.AddInstance(context.Background(), "test-instance-id-1")).To(Succeed())
+			Expect(etcdAPIMock.AddMemberMock.Called).To(BeFalse())
+		})
+
+		It("fails if the instance doesn't exist", func() {
+			Expect(bootstrapper.AddInstance(context.Background(), "test-missing")).
+				To(MatchError(ContainSubstring("not a cloud instance")))
+		})
+	})
+
+	Describe("custom ports", func() {
+		JustBeforeEach(func() {
+			Expect(WithPeerPort(12380)(bootstrapper)).To(Succeed())
+			Expect(WithClientPort(12379)(bootstrapper)).To(Succeed())
+			cloudAPIMock.GetInstancesMock.GetInstancesOutput = []cloud.Instance{
+				{
+					Name:     localInstanceID,
+					Endpoint: localEndpoint,
+				},
+				{
+					Name:     "test-new-cluster-instance-id-1",
+					Endpoint: "endpoint-1",
+				},
+			}
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{}
+		})
+
+		It("uses the configured ports for all urls", func() {
+			etcdFlags, err := bootstrapper.GenerateEtcdFlags(context.Background())
+			Expect(err).To(BeNil())
+			flags := strings.Split(etcdFlags, "\n")
+			Expect(flags).To(ContainElement(fmt.Sprintf("ETCD_INITIAL_CLUSTER=%s=%s,%s=%s",
+				localInstanceID, "http://test-local-endpoint:12380",
+				"test-new-cluster-instance-id-1", "http://endpoint-1:12380")))
+			Expect(flags).To(ContainElement("ETCD_INITIAL_ADVERTISE_PEER_URLS=http://test-local-endpoint:12380"))
+			Expect(flags).To(ContainElement("ETCD_ADVERTISE_CLIENT_URLS=http://test-local-endpoint:12379"))
+			Expect(flags).To(ContainElement("ETCD_LISTEN_PEER_URLS=http://192.168.100.1:12380"))
+			Expect(flags).To(ContainElement("ETCD_LISTEN_CLIENT_URLS=http://192.168.100.1:12379,http://127.0.0.1:12379"))
+		})
+
+		It("prefers the client port published by the local instance", func() {
+			cloudAPIMock.GetLocalInstanceMock.GetLocalInstance.ClientPort = 22379
+			etcdFlags, err := bootstrapper.GenerateEtcdFlags(context.Background())
+			Expect(err).To(BeNil())
+			flags := strings.Split(etcdFlags, "\n")
+			Expect(flags).To(ContainElement("ETCD_ADVERTISE_CLIENT_URLS=http://test-local-endpoint:22379"))
+			Expect(flags).To(ContainElement("ETCD_LISTEN_CLIENT_URLS=http://192.168.100.1:22379,http://127.0.0.1:22379"))
+		})
+	})
+
 	Describe("TLS new cluster", func() {
 		var (
 			serverCA   = "server-ca.pem"
@@ -383,7 +978,7 @@ var _ = Describe("Bootstrap", func() {
 		})
 
 		It("adds the required TLS flags", func() {
-			etcdFlags, err := bootstrapper.GenerateEtcdFlags()
+			etcdFlags, err := bootstrapper.GenerateEtcdFlags(context.Background())
 			Expect(err).To(BeNil())
 			flags := strings.Split(etcdFlags, "\n")
 			Expect(flags).To(ContainElement("ETCD_INITIAL_CLUSTER_STATE=new"))
@@ -412,37 +1007,60 @@ var _ = Describe("Bootstrap", func() {
 
 // EtcdAPIMock for mocking calls to the etcd cluster package client
 type EtcdAPIMock struct {
-	MembersMock      *Members
-	RemoveMemberMock *RemoveMember
-	AddMemberMock    *AddMember
+	MembersMock        *Members
+	RemoveMemberMock   *RemoveMember
+	AddMemberMock      *AddMember
+	AddLearnerMock     *AddMember
+	PromoteLearnerMock *PromoteLearner
+	MemberHealthyMock  *MemberHealthy
+	ProbeInstanceMock  *ProbeInstance
+	ClusterIDMock      *ClusterID
+	LockMock           *Lock
+	LeaderMock         *Leader
 }
 
-// Members sets the expected output for Members() on EtcdCluster
+// Members sets the expected output for Members() on EtcdCluster. Outputs are returned in order for successive
+// calls, after which MembersOutput is returned.
 type Members struct {
+	Outputs       [][]etcd.Member
 	MembersOutput []etcd.Member
 	Err           error
 }
 
 // Members mocks the etcd cluster package client
-func (t EtcdAPIMock) Members() ([]etcd.Member, error) {
+func (t EtcdAPIMock) Members(context.Context) ([]etcd.Member, error) {
+	if len(t.MembersMock.Outputs) > 0 {
+		members := t.MembersMock.Outputs[0]
+		t.MembersMock.Outputs = t.MembersMock.Outputs[1:]
+		return members, t.MembersMock.Err
+	}
 	return t.MembersMock.MembersOutput, t.MembersMock.Err
 }
 
-// RemoveMember sets the expected input for RemoveMember() on EtcdCluster
+// RemoveMember sets the expected input for RemoveMemberByName() and RemoveMember() on EtcdCluster
 type RemoveMember struct {
 	Called        bool
 	ExpectedInput *string
+	ExpectedID    *uint64
 	Err           error
 }
 
 // RemoveMemberByName mocks the etcd cluster package client
-func (t EtcdAPIMock) RemoveMemberByName(name string) error {
+func (t EtcdAPIMock) RemoveMemberByName(_ context.Context, name string) error {
 	t.RemoveMemberMock.Called = true
 	Expect(t.RemoveMemberMock.ExpectedInput).To(Not(BeNil()), "unexpected RemoveMember call with %q", name)
 	Expect(*t.RemoveMemberMock.ExpectedInput).To(Equal(name), "unexpected RemoveMember call")
 	return t.RemoveMemberMock.Err
 }
 
+// RemoveMember mocks the etcd cluster package client
+func (t EtcdAPIMock) RemoveMember(_ context.Context, id uint64) error {
+	t.RemoveMemberMock.Called = true
+	Expect(t.RemoveMemberMock.ExpectedID).To(Not(BeNil()), "unexpected RemoveMember call with %x", id)
+	Expect(*t.RemoveMemberMock.ExpectedID).To(Equal(id), "unexpected RemoveMember call")
+	return t.RemoveMemberMock.Err
+}
+
 // AddMember sets the expected input for AddMember() on EtcdCluster
 type AddMember struct {
 	Called        bool
@@ -451,13 +1069,105 @@ type AddMember struct {
 }
 
 // AddMemberByPeerURL mocks the etcd cluster package client
-func (t EtcdAPIMock) AddMemberByPeerURL(peerURL string) error {
+func (t EtcdAPIMock) AddMemberByPeerURL(_ context.Context, peerURL string) error {
 	t.AddMemberMock.Called = true
 	Expect(t.AddMemberMock.ExpectedInput).To(Not(BeNil()), "unexpected AddMember call with %q", peerURL)
 	Expect(*t.AddMemberMock.ExpectedInput).To(Equal(peerURL), "unexpected AddMember call")
 	return t.AddMemberMock.Err
 }
 
+// AddLearnerByPeerURL mocks the etcd cluster package client
+func (t EtcdAPIMock) AddLearnerByPeerURL(_ context.Context, peerURL string) error {
+	t.AddLearnerMock.Called = true
+	Expect(t.AddLearnerMock.ExpectedInput).To(Not(BeNil()), "unexpected AddLearner call with %q", peerURL)
+	Expect(*t.AddLearnerMock.ExpectedInput).To(Equal(peerURL), "unexpected AddLearner call")
+	return t.AddLearnerMock.Err
+}
+
+// PromoteLearner sets the expected input for PromoteLearner() on EtcdCluster. Errs are returned in order
+// for successive calls, after which Err is returned.
+type PromoteLearner struct {
+	Calls         int
+	ExpectedInput *string
+	Errs          []error
+	Err           error
+}
+
+// PromoteLearnerByPeerURL mocks the etcd cluster package client
+func (t EtcdAPIMock) PromoteLearnerByPeerURL(_ context.Context, peerURL string) error {
+	t.PromoteLearnerMock.Calls++
+	Expect(t.PromoteLearnerMock.ExpectedInput).To(Not(BeNil()), "unexpected PromoteLearner call with %q", peerURL)
+	Expect(*t.PromoteLearnerMock.ExpectedInput).To(Equal(peerURL), "unexpected PromoteLearner call")
+	if len(t.PromoteLearnerMock.Errs) > 0 {
+		err := t.PromoteLearnerMock.Errs[0]
+		t.PromoteLearnerMock.Errs = t.PromoteLearnerMock.Errs[1:]
+		return err
+	}
+	return t.PromoteLearnerMock.Err
+}
+
+// MemberHealthy sets the output for MemberHealthy() on EtcdCluster. Members are healthy unless their peer URL
+// is in Unhealthy.
+type MemberHealthy struct {
+	Unhealthy []string
+}
+
+// MemberHealthy mocks the etcd cluster package client
+func (t EtcdAPIMock) MemberHealthy(_ context.Context, member etcd.Member) bool {
+	for _, peerURL := range t.MemberHealthyMock.Unhealthy {
+		if peerURL == member.PeerURL {
+			return false
+		}
+	}
+	return true
+}
+
+// ClusterID sets the output for ClusterID() on EtcdCluster
+type ClusterID struct {
+	ClusterID uint64
+	Err       error
+}
+
+// ClusterID mocks the etcd cluster package client
+func (t EtcdAPIMock) ClusterID(context.Context) (uint64, error) {
+	return t.ClusterIDMock.ClusterID, t.ClusterIDMock.Err
+}
+
+// Lock records calls to Lock() on EtcdCluster
+type Lock struct {
+	Holders  []string
+	Unlocked int
+	Err      error
+}
+
+// Lock mocks the etcd cluster package client
+func (t EtcdAPIMock) Lock(_ context.Context, holder string, timeout, ttl time.Duration) (func() error, error) {
+	t.LockMock.Holders = append(t.LockMock.Holders, holder)
+	if t.LockMock.Err != nil {
+		return nil, t.LockMock.Err
+	}
+	return func() error {
+		t.LockMock.Unlocked++
+		return nil
+	}, nil
+}
+
+// ProbeInstance sets the output for ProbeInstance() on EtcdCluster. Instances not in Statuses are reachable
+// but not running etcd.
+type ProbeInstance struct {
+	Statuses map[string]etcd.InstanceStatus
+	Calls    int
+}
+
+// ProbeInstance mocks the etcd cluster package client
+func (t EtcdAPIMock) ProbeInstance(_ context.Context, instance cloud.Instance) etcd.InstanceStatus {
+	t.ProbeInstanceMock.Calls++
+	if status, ok := t.ProbeInstanceMock.Statuses[instance.Name]; ok {
+		return status
+	}
+	return etcd.InstanceStatus{Reachable: true}
+}
+
 // CloudAPIMock for mocking calls to an etcd-bootstrap cloud provider
 type CloudAPIMock struct {
 	GetInstancesMock     *GetInstances
@@ -472,7 +1182,7 @@ type GetInstances struct {
 }
 
 // GetInstances mocks the etcd-bootstrap cloud provider
-func (t CloudAPIMock) GetInstances() ([]cloud.Instance, error) {
+func (t CloudAPIMock) GetInstances(context.Context) ([]cloud.Instance, error) {
 	return t.GetInstancesMock.GetInstancesOutput, t.GetInstancesMock.Error
 }
 
@@ -483,7 +1193,7 @@ type GetLocalInstance struct {
 }
 
 // GetLocalInstance mocks the etcd-bootstrap cloud provider
-func (t CloudAPIMock) GetLocalInstance() (cloud.Instance, error) {
+func (t CloudAPIMock) GetLocalInstance(context.Context) (cloud.Instance, error) {
 	return t.GetLocalInstanceMock.GetLocalInstance, t.GetLocalInstanceMock.Error
 }
 
@@ -492,6 +1202,17 @@ type GetLocalIP struct {
 	Error   error
 }
 
-func (t CloudAPIMock) GetLocalIP() (string, error) {
+func (t CloudAPIMock) GetLocalIP(context.Context) (string, error) {
 	return t.GetLocalIPMock.LocalIP, t.GetLocalIPMock.Error
 }
+
+// Leader sets the output for Leader() on EtcdCluster
+type Leader struct {
+	ID  uint64
+	Err error
+}
+
+// Leader mocks the etcd cluster package client
+func (t EtcdAPIMock) Leader(context.Context, []etcd.Member) (uint64, error) {
+	return t.LeaderMock.ID, t.LeaderMock.Err
+}
@@ -0,0 +1,148 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// OutputFormat is the format the generated etcd config is written in.
+type OutputFormat string
+
+const (
+	// EnvFormat is a KEY=value file of etcd environment variables, intended to be sourced by shell scripts.
+	EnvFormat OutputFormat = "env"
+	// SystemdFormat is a KEY="value" file of etcd environment variables, quoted for a systemd EnvironmentFile.
+	SystemdFormat OutputFormat = "systemd"
+	// YAMLFormat is an etcd configuration file, for use with etcd's --config-file flag.
+	YAMLFormat OutputFormat = "yaml"
+	// JSONFormat is the same document as YAMLFormat, encoded as JSON.
+	JSONFormat OutputFormat = "json"
+	// ArgsFormat is the etcd command line flags, one --flag=value per line.
+	ArgsFormat OutputFormat = "args"
+)
+
+// OutputFormats are all of the supported output formats.
+var OutputFormats = []OutputFormat{EnvFormat, SystemdFormat, YAMLFormat, JSONFormat, ArgsFormat}
+
+// EtcdConfig is the generated etcd configuration. The field names match etcd's configuration file.
+type EtcdConfig struct {
+	Name                string `json:"name" yaml:"name"`
+	InitialClusterState string `json:"initial-cluster-state" yaml:"initial-cluster-state"`
+	InitialCluster      string `json:"initial-cluster" yaml:"initial-cluster"`
+	// InitialClusterToken is only set when restoring a snapshot.
+	InitialClusterToken      string `json:"initial-cluster-token,omitempty" yaml:"initial-cluster-token,omitempty"`
+	InitialAdvertisePeerURLs string `json:"initial-advertise-peer-urls" yaml:"initial-advertise-peer-urls"`
+	AdvertiseClientURLs      string `json:"advertise-client-urls" yaml:"advertise-client-urls"`
+	ListenPeerURLs           string `json:"listen-peer-urls" yaml:"listen-peer-urls"`
+	ListenClientURLs         string `json:"listen-client-urls" yaml:"listen-client-urls"`
+	// ClientTLS and PeerTLS are only set when TLS is enabled.
+	ClientTLS *TLSConfig `json:"client-transport-security,omitempty" yaml:"client-transport-security,omitempty"`
+	PeerTLS   *TLSConfig `json:"peer-transport-security,omitempty" yaml:"peer-transport-security,omitempty"`
+}
+
+// TLSConfig is the etcd transport security for either client or peer communication.
+type TLSConfig struct {
+	CertFile       string `json:"cert-file" yaml:"cert-file"`
+	KeyFile        string `json:"key-file" yaml:"key-file"`
+	ClientCertAuth bool   `json:"client-cert-auth" yaml:"client-cert-auth"`
+	TrustedCAFile  string `json:"trusted-ca-file" yaml:"trusted-ca-file"`
+}
+
+// ParseOutputFormat checks the format is supported.
+func ParseOutputFormat(format string) (OutputFormat, error) {
+	for _, f := range OutputFormats {
+		if string(f) == format {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported output format %q, options are: %v", format, OutputFormats)
+}
+
+// setting is a single etcd flag.
+type setting struct {
+	flag, value string
+}
+
+// settings returns the config as etcd flags, in the order they are written out.
+func (c *EtcdConfig) settings() []setting {
+	settings := []setting{
+		{"initial-cluster-state", c.InitialClusterState},
+		{"initial-cluster", c.InitialCluster},
+		{"name", c.Name},
+		{"initial-advertise-peer-urls", c.InitialAdvertisePeerURLs},
+		{"advertise-client-urls", c.AdvertiseClientURLs},
+		{"listen-peer-urls", c.ListenPeerURLs},
+		{"listen-client-urls", c.ListenClientURLs},
+	}
+	if c.InitialClusterToken != "" {
+		settings = append(settings, setting{"initial-cluster-token", c.InitialClusterToken})
+	}
+	if c.ClientTLS != nil {
+		settings = append(settings,
+			setting{"client-cert-auth", strconv.FormatBool(c.ClientTLS.ClientCertAuth)},
+			setting{"trusted-ca-file", c.ClientTLS.TrustedCAFile},
+			setting{"cert-file", c.ClientTLS.CertFile},
+			setting{"key-file", c.ClientTLS.KeyFile},
+		)
+	}
+	if c.PeerTLS != nil {
+		settings = append(settings,
+			setting{"peer-client-cert-auth", strconv.FormatBool(c.PeerTLS.ClientCertAuth)},
+			setting{"peer-trusted-ca-file", c.PeerTLS.TrustedCAFile},
+			setting{"peer-cert-file", c.PeerTLS.CertFile},
+			setting{"peer-key-file", c.PeerTLS.KeyFile},
+		)
+	}
+	return settings
+}
+
+// envName converts an etcd flag to its environment variable, e.g. initial-cluster to ETCD_INITIAL_CLUSTER.
+func envName(flag string) string {
+	return "ETCD_" + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+// systemdQuote quotes a value for a systemd EnvironmentFile, which unescapes backslashes and double quotes
+// inside double quoted values.
+func systemdQuote(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return `"` + value + `"`
+}
+
+// Format serializes the config.
+func (c *EtcdConfig) Format(format OutputFormat) (string, error) {
+	var lines []string
+	switch format {
+	case EnvFormat:
+		for _, s := range c.settings() {
+			lines = append(lines, fmt.Sprintf("%s=%s", envName(s.flag), s.value))
+		}
+	case SystemdFormat:
+		for _, s := range c.settings() {
+			lines = append(lines, fmt.Sprintf("%s=%s", envName(s.flag), systemdQuote(s.value)))
+		}
+	case ArgsFormat:
+		for _, s := range c.settings() {
+			lines = append(lines, fmt.Sprintf("--%s=%s", s.flag, s.value))
+		}
+	case YAMLFormat:
+		out, err := yaml.Marshal(c)
+		if err != nil {
+			return "", fmt.Errorf("unable to encode etcd config as YAML: %w", err)
+		}
+		return string(out), nil
+	case JSONFormat:
+		out, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("unable to encode etcd config as JSON: %w", err)
+		}
+		return string(out) + "\n", nil
+	default:
+		return "", fmt.Errorf("unsupported output format %q", format)
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
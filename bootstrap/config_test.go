@@ -0,0 +1,108 @@
+package bootstrap
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/yaml.v2"
+)
+
+var _ = Describe("EtcdConfig", func() {
+	var config *EtcdConfig
+
+	BeforeEach(func() {
+		config = &EtcdConfig{
+			Name:                     "node-1",
+			InitialClusterState:      "new",
+			InitialCluster:           "node-1=https://10.0.0.1:2380,node-2=https://10.0.0.2:2380",
+			InitialAdvertisePeerURLs: "https://10.0.0.1:2380",
+			AdvertiseClientURLs:      "https://10.0.0.1:2379",
+			ListenPeerURLs:           "https://10.0.0.1:2380",
+			ListenClientURLs:         "https://10.0.0.1:2379,https://127.0.0.1:2379",
+			ClientTLS: &TLSConfig{
+				CertFile:       "/etc/etcd/server.pem",
+				KeyFile:        "/etc/etcd/server-key.pem",
+				ClientCertAuth: true,
+				TrustedCAFile:  "/etc/etcd/ca.pem",
+			},
+			PeerTLS: &TLSConfig{
+				CertFile:       `/etc/etcd/my "peer".pem`,
+				KeyFile:        "/etc/etcd/peer-key.pem",
+				ClientCertAuth: true,
+				TrustedCAFile:  `C:\etcd\peer-ca.pem`,
+			},
+		}
+	})
+
+	It("formats environment variables", func() {
+		out, err := config.Format(EnvFormat)
+		Expect(err).To(BeNil())
+		Expect(out).To(Equal(`ETCD_INITIAL_CLUSTER_STATE=new
+ETCD_INITIAL_CLUSTER=node-1=https://10.0.0.1:2380,node-2=https://10.0.0.2:2380
+ETCD_NAME=node-1
+ETCD_INITIAL_ADVERTISE_PEER_URLS=https://10.0.0.1:2380
+ETCD_ADVERTISE_CLIENT_URLS=https://10.0.0.1:2379
+ETCD_LISTEN_PEER_URLS=https://10.0.0.1:2380
+ETCD_LISTEN_CLIENT_URLS=https://10.0.0.1:2379,https://127.0.0.1:2379
+ETCD_CLIENT_CERT_AUTH=true
+ETCD_TRUSTED_CA_FILE=/etc/etcd/ca.pem
+ETCD_CERT_FILE=/etc/etcd/server.pem
+ETCD_KEY_FILE=/etc/etcd/server-key.pem
+ETCD_PEER_CLIENT_CERT_AUTH=true
+ETCD_PEER_TRUSTED_CA_FILE=C:\etcd\peer-ca.pem
+ETCD_PEER_CERT_FILE=/etc/etcd/my "peer".pem
+ETCD_PEER_KEY_FILE=/etc/etcd/peer-key.pem
+`))
+	})
+
+	It("quotes values for systemd", func() {
+		out, err := config.Format(SystemdFormat)
+		Expect(err).To(BeNil())
+		Expect(out).To(ContainSubstring("ETCD_NAME=\"node-1\"\n"))
+		Expect(out).To(ContainSubstring(`ETCD_PEER_CERT_FILE="/etc/etcd/my \"peer\".pem"` + "\n"))
+		Expect(out).To(ContainSubstring(`ETCD_PEER_TRUSTED_CA_FILE="C:\\etcd\\peer-ca.pem"` + "\n"))
+	})
+
+	It("formats command line flags", func() {
+		out, err := config.Format(ArgsFormat)
+		Expect(err).To(BeNil())
+		Expect(out).To(HavePrefix("--initial-cluster-state=new\n--initial-cluster=node-1="))
+		Expect(out).To(ContainSubstring("--peer-client-cert-auth=true\n"))
+	})
+
+	It("formats an etcd config file", func() {
+		out, err := config.Format(YAMLFormat)
+		Expect(err).To(BeNil())
+		var parsed map[string]interface{}
+		Expect(yaml.Unmarshal([]byte(out), &parsed)).To(Succeed())
+		Expect(parsed).To(HaveKeyWithValue("name", "node-1"))
+		Expect(parsed).To(HaveKeyWithValue("listen-client-urls", "https://10.0.0.1:2379,https://127.0.0.1:2379"))
+		Expect(parsed).To(HaveKey("client-transport-security"))
+		peerTLS := parsed["peer-transport-security"].(map[interface{}]interface{})
+		Expect(peerTLS).To(HaveKeyWithValue("client-cert-auth", true))
+	})
+
+	It("formats JSON matching the config file", func() {
+		out, err := config.Format(JSONFormat)
+		Expect(err).To(BeNil())
+		var parsed EtcdConfig
+		Expect(json.Unmarshal([]byte(out), &parsed)).To(Succeed())
+		Expect(&parsed).To(Equal(config))
+	})
+
+	It("leaves out TLS when it's disabled", func() {
+		config.ClientTLS = nil
+		config.PeerTLS = nil
+		out, err := config.Format(YAMLFormat)
+		Expect(err).To(BeNil())
+		Expect(out).ToNot(ContainSubstring("transport-security"))
+	})
+
+	It("rejects unknown formats", func() {
+		_, err := ParseOutputFormat("toml")
+		Expect(err).ToNot(BeNil())
+		_, err = config.Format("toml")
+		Expect(err).ToNot(BeNil())
+	})
+})
@@ -0,0 +1,172 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/etcd"
+	"github.com/sky-uk/etcd-bootstrap/report"
+)
+
+// StaleDataAction is what to do with a local data dir which belongs to a member that isn't part of the live cluster.
+type StaleDataAction string
+
+const (
+	// StaleDataFail fails bootstrapping, leaving the data dir for an operator to deal with.
+	StaleDataFail StaleDataAction = "fail"
+	// StaleDataMove renames the data dir with a .stale-<time> suffix, so the local instance rejoins as a new member.
+	StaleDataMove StaleDataAction = "move"
+	// StaleDataRemove deletes the data dir, so the local instance rejoins as a new member.
+	StaleDataRemove StaleDataAction = "remove"
+)
+
+// StaleDataActions are all the supported actions.
+var StaleDataActions = []StaleDataAction{StaleDataFail, StaleDataMove, StaleDataRemove}
+
+// ParseStaleDataAction returns the action with the given name.
+func ParseStaleDataAction(action string) (StaleDataAction, error) {
+	for _, a := range StaleDataActions {
+		if string(a) == action {
+			return a, nil
+		}
+	}
+	return "", fmt.Errorf("unknown stale data action %q, must be one of %v", action, StaleDataActions)
+}
+
+// WithDataDir checks the member and cluster IDs stored in the local etcd data dir against the live cluster. If they
+// don't match, e.g. a volume was reattached after its member was removed, etcd would fail to start, so the data dir
+// is dealt with according to the action.
+func WithDataDir(dataDir string, action StaleDataAction) Option {
+	return func(b *Bootstrapper) error {
+		if _, err := ParseStaleDataAction(string(action)); err != nil {
+			return err
+		}
+		b.dataDir = dataDir
+		b.staleDataAction = action
+		b.readDataDir = etcd.ReadDataDir
+		return nil
+	}
+}
+
+// DataDirPlan is the result of checking the local data dir against the live cluster.
+type DataDirPlan struct {
+	Path      string `json:"path"`
+	MemberID  string `json:"memberID,omitempty"`
+	ClusterID string `json:"clusterID,omitempty"`
+	// Stale explains why the data dir can't be reused, if it can't.
+	Stale  string          `json:"stale,omitempty"`
+	Action StaleDataAction `json:"action,omitempty"`
+}
+
+// planDataDir checks if the local data dir can be reused with the live cluster, without modifying it. It returns
+// nil if no data dir is configured.
+func (b *Bootstrapper) planDataDir(ctx context.Context, members []etcd.Member) (*DataDirPlan, error) {
+	if b.dataDir == "" {
+		return nil, nil
+	}
+	plan := &DataDirPlan{Path: b.dataDir}
+	data, err := b.readDataDir(b.dataDir)
+	if errors.Is(err, etcd.ErrNoData) {
+		return plan, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to inspect data dir %s: %w", b.dataDir, err)
+	}
+	plan.MemberID = fmt.Sprintf("%x", data.MemberID)
+	plan.ClusterID = fmt.Sprintf("%x", data.ClusterID)
+
+	clusterID, err := b.etcdAPI.ClusterID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	member, found := findMemberID(members, data.MemberID)
+	if clusterID != data.ClusterID {
+		plan.Stale = fmt.Sprintf("it belongs to cluster %x, not the live cluster %x", data.ClusterID, clusterID)
+	} else if !found {
+		plan.Stale = fmt.Sprintf("its member %x has been removed from the cluster", data.MemberID)
+	} else {
+		// The member is still live, but the volume may have been reattached to a replacement instance. Starting it
+		// there would run the old member under a new identity, which reconciling would then remove.
+		local, err := b.cloudAPI.GetLocalInstance(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if member.Name != "" && member.Name != local.Name {
+			plan.Stale = fmt.Sprintf("its member %x is named %s, not %s", member.ID, member.Name, local.Name)
+		} else if peerURL := b.peerURL(local.Endpoint); member.PeerURL != peerURL {
+			plan.Stale = fmt.Sprintf("its member %x has peer URL %s, not %s", member.ID, member.PeerURL, peerURL)
+		}
+	}
+	if plan.Stale != "" {
+		plan.Action = b.staleDataAction
+	}
+	return plan, nil
+}
+
+// checkDataDir makes sure etcd will be able to start with the local data dir, moving or removing it if it's stale
+// and the stale data action allows it.
+func (b *Bootstrapper) checkDataDir(ctx context.Context) error {
+	members, err := b.etcdAPI.Members(ctx)
+	if err != nil {
+		return err
+	}
+	plan, err := b.planDataDir(ctx, members)
+	if err != nil || plan == nil {
+		return err
+	}
+	if plan.MemberID == "" {
+		log.Infof("Data dir %s has no etcd data", plan.Path)
+		return nil
+	}
+	if plan.Stale == "" {
+		log.Infof("Reusing data dir %s of member %s in cluster %s", plan.Path, plan.MemberID, plan.ClusterID)
+		return nil
+	}
+
+	if plan.Action != StaleDataMove && plan.Action != StaleDataRemove {
+		return fmt.Errorf("etcd would fail to start with data dir %s, as %s. It must be moved aside or removed "+
+			"to rejoin the cluster as a new member", plan.Path, plan.Stale)
+	}
+
+	// Without the data, the local instance can only rejoin as a new member, which needs any member with its name
+	// to be removed first.
+	local, err := b.cloudAPI.GetLocalInstance(ctx)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if member.Name == local.Name {
+			return fmt.Errorf("data dir %s can't be reused, as %s, but member %x is still named %s. "+
+				"It must be removed for the local instance to rejoin", plan.Path, plan.Stale, member.ID, local.Name)
+		}
+	}
+
+	if plan.Action == StaleDataMove {
+		stalePath := fmt.Sprintf("%s.stale-%s", plan.Path, time.Now().UTC().Format("20060102T150405Z"))
+		log.Warnf("Moving data dir %s to %s, as %s", plan.Path, stalePath, plan.Stale)
+		if err := os.Rename(plan.Path, stalePath); err != nil {
+			return fmt.Errorf("unable to move stale data dir %s: %w", plan.Path, err)
+		}
+		b.report.AddAction(report.Action{Type: report.MoveDataDir, Target: plan.Path, Detail: plan.Stale})
+		return nil
+	}
+	log.Warnf("Removing data dir %s, as %s", plan.Path, plan.Stale)
+	if err := os.RemoveAll(plan.Path); err != nil {
+		return fmt.Errorf("unable to remove stale data dir %s: %w", plan.Path, err)
+	}
+	b.report.AddAction(report.Action{Type: report.RemoveDataDir, Target: plan.Path, Detail: plan.Stale})
+	return nil
+}
+
+func findMemberID(members []etcd.Member, id uint64) (etcd.Member, bool) {
+	for _, member := range members {
+		if member.ID == id {
+			return member, true
+		}
+	}
+	return etcd.Member{}, false
+}
@@ -0,0 +1,198 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/etcd"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Data dir", func() {
+	var (
+		cloudAPIMock *CloudAPIMock
+		etcdAPIMock  *EtcdAPIMock
+		bootstrapper *Bootstrapper
+		tmpDir       string
+		dataDir      string
+		localData    etcd.DataDir
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "datadir-test")
+		Expect(err).To(BeNil())
+		dataDir = filepath.Join(tmpDir, "etcd")
+		Expect(os.MkdirAll(filepath.Join(dataDir, "member"), 0700)).To(Succeed())
+		localData = etcd.DataDir{MemberID: 0xa1, ClusterID: 0xc1}
+
+		cloudAPIMock = &CloudAPIMock{
+			GetInstancesMock: &GetInstances{GetInstancesOutput: []cloud.Instance{
+				{Name: "local", Endpoint: "local-endpoint"},
+				{Name: "etcd-2", Endpoint: "endpoint-2"},
+			}},
+			GetLocalInstanceMock: &GetLocalInstance{GetLocalInstance: cloud.Instance{Name: "local", Endpoint: "local-endpoint"}},
+			GetLocalIPMock:       &GetLocalIP{LocalIP: "192.168.100.1"},
+		}
+		etcdAPIMock = &EtcdAPIMock{
+			MembersMock: &Members{MembersOutput: []etcd.Member{
+				{ID: 0xa1, Name: "local", PeerURL: "http://local-endpoint:2380"},
+				{ID: 0xa2, Name: "etcd-2", PeerURL: "http://endpoint-2:2380"},
+			}},
+			AddMemberMock:     &AddMember{},
+			RemoveMemberMock:  &RemoveMember{},
+			MemberHealthyMock: &MemberHealthy{},
+			ProbeInstanceMock: &ProbeInstance{},
+			ClusterIDMock:     &ClusterID{ClusterID: 0xc1},
+		}
+		bootstrapper = &Bootstrapper{
+			cloudAPI:        cloudAPIMock,
+			etcdAPI:         etcdAPIMock,
+			protocol:        "http",
+			peerPort:        2380,
+			clientPort:      2379,
+			dataDir:         dataDir,
+			staleDataAction: StaleDataFail,
+			readDataDir: func(dir string) (etcd.DataDir, error) {
+				Expect(dir).To(Equal(dataDir))
+				return localData, nil
+			},
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	// removeLocalMember makes the local data dir stale, as if the member was removed while the node was away.
+	removeLocalMember := func() {
+		etcdAPIMock.MembersMock.MembersOutput = etcdAPIMock.MembersMock.MembersOutput[1:]
+		etcdAPIMock.AddMemberMock.ExpectedInput = &[]string{"http://local-endpoint:2380"}[0]
+	}
+
+	It("reuses the data dir of a current member", func() {
+		flags, err := bootstrapper.GenerateEtcdFlags(context.Background())
+		Expect(err).To(BeNil())
+		Expect(strings.Split(flags, "\n")).To(ContainElement("ETCD_INITIAL_CLUSTER_STATE=new"))
+		Expect(dataDir).To(BeADirectory())
+	})
+
+	It("ignores a data dir without etcd data", func() {
+		bootstrapper.readDataDir = func(string) (etcd.DataDir, error) { return etcd.DataDir{}, etcd.ErrNoData }
+		removeLocalMember()
+		_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+		Expect(err).To(BeNil())
+		Expect(etcdAPIMock.AddMemberMock.Called).To(BeTrue())
+	})
+
+	It("fails if the member has been removed", func() {
+		removeLocalMember()
+		_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("member a1 has been removed"))
+		Expect(etcdAPIMock.AddMemberMock.Called).To(BeFalse())
+		Expect(dataDir).To(BeADirectory())
+	})
+
+	It("fails if the data belongs to another cluster", func() {
+		localData.ClusterID = 0xc2
+		_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("cluster c2, not the live cluster c1"))
+	})
+
+	It("moves a stale data dir aside and rejoins", func() {
+		bootstrapper.staleDataAction = StaleDataMove
+		removeLocalMember()
+		flags, err := bootstrapper.GenerateEtcdFlags(context.Background())
+		Expect(err).To(BeNil())
+		Expect(strings.Split(flags, "\n")).To(ContainElement("ETCD_INITIAL_CLUSTER_STATE=existing"))
+		Expect(etcdAPIMock.AddMemberMock.Called).To(BeTrue())
+		Expect(dataDir).ToNot(BeADirectory())
+		moved, err := filepath.Glob(dataDir + ".stale-*")
+		Expect(err).To(BeNil())
+		Expect(moved).To(HaveLen(1))
+		Expect(filepath.Join(moved[0], "member")).To(BeADirectory())
+	})
+
+	It("removes a stale data dir and rejoins", func() {
+		bootstrapper.staleDataAction = StaleDataRemove
+		removeLocalMember()
+		_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+		Expect(err).To(BeNil())
+		Expect(dataDir).ToNot(BeADirectory())
+	})
+
+	It("leaves a stale data dir if a member still has the local name", func() {
+		bootstrapper.staleDataAction = StaleDataRemove
+		localData.MemberID = 0xa9
+		_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("member a1 is still named local"))
+		Expect(dataDir).To(BeADirectory())
+	})
+
+	It("fails if the member is live under another instance's name", func() {
+		etcdAPIMock.MembersMock.MembersOutput[0].Name = "replaced"
+		_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("member a1 is named replaced, not local"))
+		Expect(etcdAPIMock.RemoveMemberMock.Called).To(BeFalse())
+		Expect(dataDir).To(BeADirectory())
+	})
+
+	It("fails if the member is live under another peer URL", func() {
+		etcdAPIMock.MembersMock.MembersOutput[0].PeerURL = "http://old-endpoint:2380"
+		_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("member a1 has peer URL http://old-endpoint:2380, not http://local-endpoint:2380"))
+		Expect(dataDir).To(BeADirectory())
+	})
+
+	It("moves aside the data dir of a member reattached to a replacement instance", func() {
+		bootstrapper.staleDataAction = StaleDataMove
+		etcdAPIMock.MembersMock.MembersOutput[0] = etcd.Member{ID: 0xa1, Name: "replaced", PeerURL: "http://old-endpoint:2380"}
+		etcdAPIMock.AddMemberMock.ExpectedInput = &[]string{"http://local-endpoint:2380"}[0]
+		etcdAPIMock.RemoveMemberMock.ExpectedID = &[]uint64{0xa1}[0]
+		flags, err := bootstrapper.GenerateEtcdFlags(context.Background())
+		Expect(err).To(BeNil())
+		Expect(strings.Split(flags, "\n")).To(ContainElement("ETCD_INITIAL_CLUSTER_STATE=existing"))
+		Expect(etcdAPIMock.RemoveMemberMock.Called).To(BeTrue())
+		Expect(etcdAPIMock.AddMemberMock.Called).To(BeTrue())
+		Expect(dataDir).ToNot(BeADirectory())
+	})
+
+	It("plans without changing the data dir", func() {
+		bootstrapper.staleDataAction = StaleDataMove
+		removeLocalMember()
+		plan, err := bootstrapper.Plan(context.Background())
+		Expect(err).To(BeNil())
+		Expect(plan.DataDir).To(Equal(&DataDirPlan{
+			Path:      dataDir,
+			MemberID:  "a1",
+			ClusterID: "c1",
+			Stale:     "its member a1 has been removed from the cluster",
+			Action:    StaleDataMove,
+		}))
+		Expect(plan.String()).To(ContainSubstring("move the data dir aside"))
+		Expect(dataDir).To(BeADirectory())
+		Expect(etcdAPIMock.AddMemberMock.Called).To(BeFalse())
+	})
+
+	It("fails if the data dir can't be read", func() {
+		bootstrapper.readDataDir = func(string) (etcd.DataDir, error) { return etcd.DataDir{}, fmt.Errorf("corrupt") }
+		_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("rejects an unknown stale data action", func() {
+		Expect(WithDataDir(dataDir, "wipe")(bootstrapper)).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,104 @@
+package bootstrap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FileOptions control how the generated config file is written.
+type FileOptions struct {
+	// Mode is the permissions of the file.
+	Mode os.FileMode
+	// UID and GID set the owner of the file. -1 leaves it as the current user or group.
+	UID, GID int
+	// Backup keeps the previous version of the file with a .bak suffix, so it can be compared with the new one.
+	Backup bool
+}
+
+// DefaultFileOptions writes a file readable by everyone, owned by the current user.
+var DefaultFileOptions = FileOptions{
+	Mode: 0644,
+	UID:  -1,
+	GID:  -1,
+}
+
+// writeFile atomically replaces the file with data. The data is written to a temporary file in the same directory,
+// which is synced and then renamed over the original, so readers only ever see a complete file.
+func writeFile(filename string, data []byte, opts FileOptions) (err error) {
+	dir := filepath.Dir(filename)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		return fmt.Errorf("unable to write %s: %w", tmp.Name(), err)
+	}
+	// Set the permissions before the file is moved into place, so it's never readable by anyone else.
+	if err := tmp.Chmod(opts.Mode); err != nil {
+		return fmt.Errorf("unable to set mode of %s: %w", tmp.Name(), err)
+	}
+	if opts.UID != -1 || opts.GID != -1 {
+		if err := tmp.Chown(opts.UID, opts.GID); err != nil {
+			return fmt.Errorf("unable to set owner of %s: %w", tmp.Name(), err)
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("unable to sync %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to close %s: %w", tmp.Name(), err)
+	}
+
+	if opts.Backup {
+		if err := backupFile(filename); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return fmt.Errorf("unable to replace %s: %w", filename, err)
+	}
+
+	// Sync the directory too, so the rename survives a crash.
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("unable to sync %s: %w", dir, err)
+	}
+	return nil
+}
+
+// backupFile copies the file to filename.bak, keeping its permissions. It does nothing if the file doesn't exist.
+func backupFile(filename string) error {
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to back up %s: %w", filename, err)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("unable to back up %s: %w", filename, err)
+	}
+	backup := filename + ".bak"
+	// Remove any previous backup, as WriteFile won't change the permissions of an existing file.
+	if err := os.Remove(backup); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove old backup %s: %w", backup, err)
+	}
+	if err := ioutil.WriteFile(backup, data, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("unable to back up %s: %w", filename, err)
+	}
+	return nil
+}
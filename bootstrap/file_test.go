@@ -0,0 +1,89 @@
+package bootstrap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("writeFile", func() {
+	var (
+		dir      string
+		filename string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "etcd-bootstrap")
+		Expect(err).To(BeNil())
+		filename = filepath.Join(dir, "etcd-bootstrap.conf")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	expectFiles := func(names ...string) {
+		files, err := ioutil.ReadDir(dir)
+		Expect(err).To(BeNil())
+		var actual []string
+		for _, f := range files {
+			actual = append(actual, f.Name())
+		}
+		Expect(actual).To(ConsistOf(names))
+	}
+
+	It("writes the file with the given mode", func() {
+		Expect(writeFile(filename, []byte("ETCD_NAME=a\n"), FileOptions{Mode: 0600, UID: -1, GID: -1})).To(Succeed())
+		data, err := ioutil.ReadFile(filename)
+		Expect(err).To(BeNil())
+		Expect(string(data)).To(Equal("ETCD_NAME=a\n"))
+		info, err := os.Stat(filename)
+		Expect(err).To(BeNil())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		expectFiles("etcd-bootstrap.conf")
+	})
+
+	It("sets the owner", func() {
+		opts := FileOptions{Mode: 0644, UID: os.Getuid(), GID: os.Getgid()}
+		Expect(writeFile(filename, []byte("ETCD_NAME=a\n"), opts)).To(Succeed())
+	})
+
+	It("replaces an existing file", func() {
+		Expect(ioutil.WriteFile(filename, []byte("ETCD_NAME=old\n"), 0644)).To(Succeed())
+		Expect(writeFile(filename, []byte("ETCD_NAME=new\n"), DefaultFileOptions)).To(Succeed())
+		data, err := ioutil.ReadFile(filename)
+		Expect(err).To(BeNil())
+		Expect(string(data)).To(Equal("ETCD_NAME=new\n"))
+		expectFiles("etcd-bootstrap.conf")
+	})
+
+	It("keeps a backup of the previous file", func() {
+		opts := DefaultFileOptions
+		opts.Backup = true
+		By("Not backing up when there is no previous file")
+		Expect(writeFile(filename, []byte("ETCD_NAME=old\n"), opts)).To(Succeed())
+		expectFiles("etcd-bootstrap.conf")
+
+		Expect(writeFile(filename, []byte("ETCD_NAME=new\n"), opts)).To(Succeed())
+		expectFiles("etcd-bootstrap.conf", "etcd-bootstrap.conf.bak")
+		data, err := ioutil.ReadFile(filename + ".bak")
+		Expect(err).To(BeNil())
+		Expect(string(data)).To(Equal("ETCD_NAME=old\n"))
+	})
+
+	It("cleans up the temporary file if it fails", func() {
+		By("Making the file a non-empty directory, so it can't be replaced")
+		Expect(os.Mkdir(filename, 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(filename, "keep"), []byte("keep"), 0644)).To(Succeed())
+		Expect(writeFile(filename, []byte("ETCD_NAME=new\n"), DefaultFileOptions)).ToNot(Succeed())
+		expectFiles("etcd-bootstrap.conf")
+	})
+
+	It("rejects modes with more than permission bits", func() {
+		Expect(WithFileOptions(FileOptions{Mode: os.ModeDir | 0755})(&Bootstrapper{})).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,68 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LockPolicy controls the lock held in etcd while reconciling the members, so that nodes which boot at the same
+// time don't change the membership concurrently.
+type LockPolicy struct {
+	// Timeout is how long to wait for the lock. Zero disables locking.
+	Timeout time.Duration
+	// TTL is how long the lock outlives its holder if it dies without releasing it.
+	TTL time.Duration
+}
+
+// DefaultLockPolicy waits up to five minutes for the lock.
+var DefaultLockPolicy = LockPolicy{
+	Timeout: 5 * time.Minute,
+	TTL:     time.Minute,
+}
+
+// WithLockPolicy sets the lock held while reconciling the members, which defaults to DefaultLockPolicy.
+func WithLockPolicy(policy LockPolicy) Option {
+	return func(b *Bootstrapper) error {
+		if policy.Timeout < 0 {
+			return fmt.Errorf("lock timeout must not be negative, but was %v", policy.Timeout)
+		}
+		// etcd leases have a granularity of a second.
+		if policy.Timeout > 0 && policy.TTL < time.Second {
+			return fmt.Errorf("lock TTL must be at least a second, but was %v", policy.TTL)
+		}
+		b.lockPolicy = policy
+		return nil
+	}
+}
+
+// lockMembership acquires the membership lock for the local instance, returning a function to release it.
+func (b *Bootstrapper) lockMembership(ctx context.Context) (func(), error) {
+	if b.lockPolicy.Timeout == 0 {
+		return func() {}, nil
+	}
+	local, err := b.cloudAPI.GetLocalInstance(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.lockMembershipAs(ctx, fmt.Sprintf("%s (%s)", local.Name, local.Endpoint))
+}
+
+// lockMembershipAs acquires the membership lock for the holder, which is shown to nodes waiting for the lock.
+func (b *Bootstrapper) lockMembershipAs(ctx context.Context, holder string) (func(), error) {
+	if b.lockPolicy.Timeout == 0 {
+		return func() {}, nil
+	}
+	unlock, err := b.etcdAPI.Lock(ctx, holder, b.lockPolicy.Timeout, b.lockPolicy.TTL)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := unlock(); err != nil {
+			// The lock is released anyway when its lease expires.
+			log.Warnf("Unable to release the membership lock, it will expire after %v: %v", b.lockPolicy.TTL, err)
+		}
+	}, nil
+}
@@ -0,0 +1,296 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/etcd"
+	"github.com/sky-uk/etcd-bootstrap/metrics"
+	"github.com/sky-uk/etcd-bootstrap/report"
+)
+
+// ClusterStatus compares the etcd members with the cloud instances, to diagnose drift between them.
+type ClusterStatus struct {
+	Members []MemberStatus `json:"members"`
+	// Voters is the number of voting members, of which HealthyVoters are reachable. Quorum is how many healthy
+	// voters the cluster needs to make progress.
+	Voters        int  `json:"voters"`
+	HealthyVoters int  `json:"healthyVoters"`
+	Quorum        int  `json:"quorum"`
+	HasQuorum     bool `json:"hasQuorum"`
+	// Leader is the name of the leader, if there is one.
+	Leader string `json:"leader,omitempty"`
+	// InstancesNotMembers are the cloud instances which aren't etcd members.
+	InstancesNotMembers []cloud.Instance `json:"instancesNotMembers"`
+	// MembersNotInstances are the etcd members which aren't cloud instances.
+	MembersNotInstances []etcd.Member `json:"membersNotInstances"`
+}
+
+// MemberStatus is an etcd member along with its cloud instance.
+type MemberStatus struct {
+	etcd.Member
+	// Instance is the cloud instance with the member's name or peer URL, if there is one.
+	Instance *cloud.Instance `json:"instance,omitempty"`
+	Healthy  bool            `json:"healthy"`
+	Leader   bool            `json:"leader"`
+}
+
+// ClusterStatus returns the etcd members joined with the cloud instances, their health and the leader. It doesn't
+// modify the cluster.
+func (b *Bootstrapper) ClusterStatus(ctx context.Context) (*ClusterStatus, error) {
+	instances, err := b.cloudAPI.GetInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	members, err := b.etcdAPI.Members(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &ClusterStatus{
+		Members:             []MemberStatus{},
+		InstancesNotMembers: []cloud.Instance{},
+		MembersNotInstances: []etcd.Member{},
+	}
+	var leaderID uint64
+	if len(members) > 0 {
+		if leaderID, err = b.etcdAPI.Leader(ctx, members); err != nil {
+			log.Warnf("Unable to find the leader: %v", err)
+			leaderID = 0
+		}
+	}
+
+	matched := make(map[string]bool)
+	for _, member := range members {
+		memberStatus := MemberStatus{
+			Member:  member,
+			Healthy: b.etcdAPI.MemberHealthy(ctx, member),
+			Leader:  leaderID != 0 && member.ID == leaderID,
+		}
+		if instance, ok := b.instanceFor(instances, member); ok {
+			memberStatus.Instance = &instance
+			matched[instance.Name] = true
+		} else {
+			status.MembersNotInstances = append(status.MembersNotInstances, member)
+		}
+		if memberStatus.Leader {
+			status.Leader = member.Name
+		}
+		if !member.IsLearner {
+			status.Voters++
+			if memberStatus.Healthy {
+				status.HealthyVoters++
+			}
+		}
+		status.Members = append(status.Members, memberStatus)
+	}
+	for _, instance := range instances {
+		if !matched[instance.Name] {
+			status.InstancesNotMembers = append(status.InstancesNotMembers, instance)
+		}
+	}
+
+	status.Quorum = status.Voters/2 + 1
+	status.HasQuorum = status.Voters > 0 && status.HealthyVoters >= status.Quorum
+	return status, nil
+}
+
+// instanceFor finds the member's cloud instance, by its name or, if it hasn't started yet, its peer URL.
+func (b *Bootstrapper) instanceFor(instances []cloud.Instance, member etcd.Member) (cloud.Instance, bool) {
+	for _, instance := range instances {
+		if member.Name == instance.Name || member.PeerURL == b.peerURL(instance.Endpoint) {
+			return instance, true
+		}
+	}
+	return cloud.Instance{}, false
+}
+
+// String formats the status for people to read.
+func (s *ClusterStatus) String() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "Members:\n")
+	if len(s.Members) == 0 {
+		fmt.Fprintf(&out, "  none, the cluster doesn't exist or is unreachable\n")
+	}
+	for _, member := range s.Members {
+		fmt.Fprintf(&out, "  %s\n", member)
+	}
+
+	quorum := "has quorum"
+	if !s.HasQuorum {
+		quorum = "has NO quorum"
+	}
+	fmt.Fprintf(&out, "Quorum: %s, %d of %d voting members healthy, %d needed\n",
+		quorum, s.HealthyVoters, s.Voters, s.Quorum)
+	leader := s.Leader
+	if leader == "" {
+		leader = "none"
+	}
+	fmt.Fprintf(&out, "Leader: %s\n", leader)
+
+	fmt.Fprintf(&out, "Instances which aren't members:\n")
+	if len(s.InstancesNotMembers) == 0 {
+		fmt.Fprintf(&out, "  none\n")
+	}
+	for _, instance := range s.InstancesNotMembers {
+		fmt.Fprintf(&out, "  %s (%s)\n", instance.Name, instance.Endpoint)
+	}
+	fmt.Fprintf(&out, "Members which aren't instances:\n")
+	if len(s.MembersNotInstances) == 0 {
+		fmt.Fprintf(&out, "  none\n")
+	}
+	for _, member := range s.MembersNotInstances {
+		fmt.Fprintf(&out, "  %s (%s)\n", memberName(member), member.PeerURL)
+	}
+	return out.String()
+}
+
+// String formats the member for people to read.
+func (m MemberStatus) String() string {
+	var details []string
+	if m.IsLearner {
+		details = append(details, "learner")
+	}
+	if m.Leader {
+		details = append(details, "leader")
+	}
+	if m.Healthy {
+		details = append(details, "healthy")
+	} else {
+		details = append(details, "unhealthy")
+	}
+	if m.Instance != nil {
+		details = append(details, "instance "+m.Instance.Endpoint)
+	} else {
+		details = append(details, "no instance")
+	}
+	return fmt.Sprintf("%s (%s) %s", memberName(m.Member), m.PeerURL, strings.Join(details, ", "))
+}
+
+func memberName(member etcd.Member) string {
+	if member.Name == "" {
+		return "<not started>"
+	}
+	return member.Name
+}
+
+// RemoveMember removes the named member from the cluster, while holding the membership lock. Unless forced, it
+// refuses to remove a member which is still a cloud instance, or a voting member whose removal would leave the
+// cluster without a healthy quorum.
+func (b *Bootstrapper) RemoveMember(ctx context.Context, name string, force bool) error {
+	if err := b.requireCluster(ctx); err != nil {
+		return err
+	}
+	unlock, err := b.lockMembershipAs(ctx, operator("remove "+name))
+	if err != nil {
+		return fmt.Errorf("unable to acquire the membership lock: %w", err)
+	}
+	defer unlock()
+
+	members, err := b.etcdAPI.Members(ctx)
+	if err != nil {
+		return err
+	}
+	var member *etcd.Member
+	healthy := make(map[string]bool)
+	var voters []etcd.Member
+	for i := range members {
+		if members[i].Name == name {
+			member = &members[i]
+		}
+		healthy[members[i].PeerURL] = b.etcdAPI.MemberHealthy(ctx, members[i])
+		if !members[i].IsLearner {
+			voters = append(voters, members[i])
+		}
+	}
+	if member == nil {
+		return fmt.Errorf("%s is not a member of the cluster", name)
+	}
+
+	if !force {
+		instances, err := b.cloudAPI.GetInstances(ctx)
+		if err != nil {
+			return err
+		}
+		if instance, ok := b.instanceFor(instances, *member); ok {
+			return fmt.Errorf("%s is still a cloud instance at %s, so it would fail to rejoin if removed,"+
+				" use force to remove it anyway", name, instance.Endpoint)
+		}
+		if !member.IsLearner && !hasHealthyQuorum(voters, healthy, map[string]bool{}, *member) {
+			return fmt.Errorf("removing %s would leave the voting members without a healthy quorum,"+
+				" use force to remove it anyway", name)
+		}
+	}
+
+	log.Infof("Removing %s (%s) from etcd member list", name, member.PeerURL)
+	if err := b.etcdAPI.RemoveMemberByName(ctx, name); err != nil {
+		b.report.AddAction(report.Action{Type: report.RemoveMember, Target: name, Error: err.Error()})
+		return fmt.Errorf("unable to remove %s: %w", name, err)
+	}
+	metrics.RecordMemberRemoved()
+	b.report.AddAction(report.Action{Type: report.RemoveMember, Target: name, Detail: "removed by an operator"})
+	return nil
+}
+
+// AddInstance adds the named cloud instance to the cluster, as a learner if configured, while holding the
+// membership lock. The instance's etcd must then be started to join the cluster.
+func (b *Bootstrapper) AddInstance(ctx context.Context, name string) error {
+	instances, err := b.cloudAPI.GetInstances(ctx)
+	if err != nil {
+		return err
+	}
+	var instance *cloud.Instance
+	for i := range instances {
+		if instances[i].Name == name {
+			instance = &instances[i]
+		}
+	}
+	if instance == nil {
+		return fmt.Errorf("%s is not a cloud instance", name)
+	}
+
+	if err := b.requireCluster(ctx); err != nil {
+		return err
+	}
+	unlock, err := b.lockMembershipAs(ctx, operator("add "+name))
+	if err != nil {
+		return fmt.Errorf("unable to acquire the membership lock: %w", err)
+	}
+	defer unlock()
+
+	members, err := b.etcdAPI.Members(ctx)
+	if err != nil {
+		return err
+	}
+	if !b.needsAdding(members, *instance) {
+		log.Infof("%s is already a member of the cluster", name)
+		return nil
+	}
+	return b.addInstance(ctx, *instance)
+}
+
+// requireCluster fails if the cluster has no members, so operators aren't left waiting for a lock which can't be
+// acquired.
+func (b *Bootstrapper) requireCluster(ctx context.Context) error {
+	members, err := b.etcdAPI.Members(ctx)
+	if err != nil {
+		return err
+	}
+	if len(members) == 0 {
+		return fmt.Errorf("the cluster doesn't exist or is unreachable")
+	}
+	return nil
+}
+
+// operator describes an operator's command as the membership lock holder.
+func operator(command string) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown host"
+	}
+	return fmt.Sprintf("etcd-bootstrap %s on %s", command, hostname)
+}
@@ -0,0 +1,210 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/etcd"
+)
+
+// Plan describes the membership changes and etcd flags that bootstrapping would produce.
+type Plan struct {
+	Instances     []cloud.Instance `json:"instances"`
+	LocalInstance cloud.Instance   `json:"localInstance"`
+	Members       []etcd.Member    `json:"members"`
+	// Removals are the members no longer in the cloud instances, including those the removal policy would skip.
+	Removals []PlannedRemoval `json:"removals"`
+	// AddPeerURL is the local peer URL that would be added to the cluster, if any.
+	AddPeerURL   string `json:"addPeerURL,omitempty"`
+	AddAsLearner bool   `json:"addAsLearner,omitempty"`
+	// DataDir is the check of the local data dir against the live cluster, if a data dir is configured.
+	DataDir *DataDirPlan `json:"dataDir,omitempty"`
+	// RestoreSnapshot is the snapshot the new cluster would be restored from, if any.
+	RestoreSnapshot string `json:"restoreSnapshot,omitempty"`
+	ClusterState    string `json:"clusterState"`
+	// Flags is the generated etcd config, in the configured output format.
+	Flags string `json:"flags"`
+}
+
+// PlannedRemoval is a member which isn't part of the cloud instances.
+type PlannedRemoval struct {
+	Name    string `json:"name"`
+	PeerURL string `json:"peerURL"`
+	Remove  bool   `json:"remove"`
+	// Reason explains why the member would not be removed.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Plan works out what GenerateEtcdFlags would do, without adding or removing any members.
+func (b *Bootstrapper) Plan(ctx context.Context) (*Plan, error) {
+	log.Infof("Planning etcd cluster flags")
+
+	instances, err := b.cloudAPI.GetInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	local, err := b.cloudAPI.GetLocalInstance(ctx)
+	if err != nil {
+		return nil, err
+	}
+	members, err := b.etcdAPI.Members(ctx)
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{
+		Instances:     instances,
+		LocalInstance: local,
+		Members:       members,
+		ClusterState:  string(newCluster),
+	}
+
+	clusterExists, err := b.clusterExists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nodeExistsInCluster := false
+	if clusterExists {
+		if plan.DataDir, err = b.planDataDir(ctx, members); err != nil {
+			return nil, err
+		}
+		if nodeExistsInCluster, err = b.nodeExistsInCluster(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if !clusterExists || nodeExistsInCluster {
+		config, err := b.createEtcdConfigForNewCluster(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !clusterExists {
+			restore, err := b.shouldRestore()
+			if err != nil {
+				return nil, err
+			}
+			if restore {
+				plan.RestoreSnapshot = b.snapshotAPI.String()
+			}
+		}
+		if plan.Flags, err = b.format(config); err != nil {
+			return nil, err
+		}
+		return plan, nil
+	}
+
+	// Joining an existing cluster, so work out the member list as it would be after reconciling.
+	plan.ClusterState = string(existingCluster)
+	removals, err := b.planMemberRemovals(ctx)
+	if err != nil {
+		return nil, err
+	}
+	removed := make(map[string]bool)
+	for _, removal := range removals {
+		plan.Removals = append(plan.Removals, PlannedRemoval{
+			Name:    removal.member.Name,
+			PeerURL: removal.member.PeerURL,
+			Remove:  removal.remove,
+			Reason:  removal.reason,
+		})
+		if removal.remove {
+			removed[removal.member.PeerURL] = true
+		}
+	}
+
+	var initialClusterURLs []string
+	for _, member := range members {
+		if !removed[member.PeerURL] {
+			initialClusterURLs = append(initialClusterURLs, member.PeerURL)
+		}
+	}
+	if b.needsAdding(members, local) {
+		plan.AddPeerURL = b.peerURL(local.Endpoint)
+		plan.AddAsLearner = b.learner
+		initialClusterURLs = append(initialClusterURLs, plan.AddPeerURL)
+	}
+
+	config, err := b.createEtcdConfig(ctx, existingCluster, initialClusterURLs)
+	if err != nil {
+		return nil, err
+	}
+	if plan.Flags, err = b.format(config); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// String formats the plan for people to read.
+func (p *Plan) String() string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "Instances:\n")
+	for _, instance := range p.Instances {
+		fmt.Fprintf(&s, "  %s (%s)\n", instance.Name, instance.Endpoint)
+	}
+	fmt.Fprintf(&s, "Local instance: %s (%s)\n", p.LocalInstance.Name, p.LocalInstance.Endpoint)
+
+	fmt.Fprintf(&s, "Members:\n")
+	if len(p.Members) == 0 {
+		fmt.Fprintf(&s, "  none, the cluster doesn't exist\n")
+	}
+	for _, member := range p.Members {
+		name := member.Name
+		if name == "" {
+			name = "<not started>"
+		}
+		learner := ""
+		if member.IsLearner {
+			learner = " learner"
+		}
+		fmt.Fprintf(&s, "  %s (%s)%s\n", name, member.PeerURL, learner)
+	}
+
+	if p.DataDir != nil {
+		fmt.Fprintf(&s, "Data dir: %s", p.DataDir.Path)
+		if p.DataDir.MemberID != "" {
+			fmt.Fprintf(&s, " (member %s in cluster %s)", p.DataDir.MemberID, p.DataDir.ClusterID)
+		}
+		fmt.Fprintf(&s, "\n")
+	}
+
+	fmt.Fprintf(&s, "Changes:\n")
+	if len(p.Removals) == 0 && p.AddPeerURL == "" && (p.DataDir == nil || p.DataDir.Stale == "") &&
+		p.RestoreSnapshot == "" {
+		fmt.Fprintf(&s, "  none\n")
+	}
+	if p.DataDir != nil && p.DataDir.Stale != "" {
+		switch p.DataDir.Action {
+		case StaleDataMove:
+			fmt.Fprintf(&s, "  move the data dir aside, as %s\n", p.DataDir.Stale)
+		case StaleDataRemove:
+			fmt.Fprintf(&s, "  remove the data dir, as %s\n", p.DataDir.Stale)
+		default:
+			fmt.Fprintf(&s, "  fail, as the data dir can't be reused: %s\n", p.DataDir.Stale)
+		}
+	}
+	if p.RestoreSnapshot != "" {
+		fmt.Fprintf(&s, "  restore snapshot %s into the data dir\n", p.RestoreSnapshot)
+	}
+	for _, removal := range p.Removals {
+		if removal.Remove {
+			fmt.Fprintf(&s, "  remove %s (%s)\n", removal.Name, removal.PeerURL)
+		} else {
+			fmt.Fprintf(&s, "  skip removing %s (%s): %s\n", removal.Name, removal.PeerURL, removal.Reason)
+		}
+	}
+	if p.AddPeerURL != "" {
+		kind := "member"
+		if p.AddAsLearner {
+			kind = "learner"
+		}
+		fmt.Fprintf(&s, "  add %s as a %s\n", p.AddPeerURL, kind)
+	}
+
+	fmt.Fprintf(&s, "Initial cluster state: %s\n", p.ClusterState)
+	fmt.Fprintf(&s, "Flags:\n")
+	for _, flag := range strings.Split(strings.TrimSuffix(p.Flags, "\n"), "\n") {
+		fmt.Fprintf(&s, "  %s\n", flag)
+	}
+	return s.String()
+}
@@ -0,0 +1,116 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+)
+
+// PreflightPolicy controls the checks made before starting a new cluster, when no etcd members could be listed.
+// An unreachable cluster looks the same as a missing one to the member list, so starting a new cluster without
+// these checks could split the cluster in two.
+type PreflightPolicy struct {
+	// Timeout is how long to keep retrying while the checks fail. Zero means the checks are only made once.
+	Timeout time.Duration
+	// RetryInterval is how long to wait between checks.
+	RetryInterval time.Duration
+	// ClusterSize is the number of instances expected in a new cluster. Zero means any number is accepted.
+	ClusterSize int
+	// Force starts a new cluster even if only some of the instances can be checked, or there are fewer than
+	// ClusterSize. A new cluster is never started if any instance already has cluster data.
+	Force bool
+}
+
+// DefaultPreflightPolicy retries the checks for up to a minute.
+var DefaultPreflightPolicy = PreflightPolicy{
+	Timeout:       time.Minute,
+	RetryInterval: 5 * time.Second,
+}
+
+// WithPreflightPolicy sets the checks made before starting a new cluster, which defaults to DefaultPreflightPolicy.
+func WithPreflightPolicy(policy PreflightPolicy) Option {
+	return func(b *Bootstrapper) error {
+		if policy.Timeout < 0 || policy.RetryInterval < 0 {
+			return fmt.Errorf("preflight timeout and retry interval must not be negative, but were %v and %v",
+				policy.Timeout, policy.RetryInterval)
+		}
+		if policy.ClusterSize < 0 {
+			return fmt.Errorf("cluster size must not be negative, but was %d", policy.ClusterSize)
+		}
+		b.preflightPolicy = policy
+		return nil
+	}
+}
+
+// clusterExists checks if there is an etcd cluster to join. If no members can be listed, it probes each
+// instance to make sure the cluster is really absent rather than unreachable, retrying until the preflight
+// timeout. It fails rather than report an absent cluster if that can't be confirmed.
+func (b *Bootstrapper) clusterExists(ctx context.Context) (bool, error) {
+	start := time.Now()
+	defer b.report.Time("preflight", start)
+	deadline := start.Add(b.preflightPolicy.Timeout)
+	for {
+		members, err := b.etcdAPI.Members(ctx)
+		if err != nil {
+			return false, err
+		}
+		if len(members) > 0 {
+			b.report.SetMembersBefore(members)
+			return true, nil
+		}
+
+		instances, err := b.cloudAPI.GetInstances(ctx)
+		if err != nil {
+			return false, err
+		}
+		err = b.checkClusterAbsent(ctx, instances)
+		if err == nil {
+			return false, nil
+		}
+		if time.Now().Add(b.preflightPolicy.RetryInterval).After(deadline) {
+			return false, fmt.Errorf("refusing to start a new cluster: %w", err)
+		}
+		log.Warnf("No etcd members found, but unable to confirm there is no cluster, will retry: %v", err)
+		if err := sleep(ctx, b.preflightPolicy.RetryInterval); err != nil {
+			return false, err
+		}
+	}
+}
+
+// checkClusterAbsent probes each instance, and returns an error unless it's safe to start a new cluster with them.
+func (b *Bootstrapper) checkClusterAbsent(ctx context.Context, instances []cloud.Instance) error {
+	var withData, unreachable []string
+	for _, instance := range instances {
+		status := b.etcdAPI.ProbeInstance(ctx, instance)
+		log.Debugf("Probed %s (%s): %+v", instance.Name, instance.Endpoint, status)
+		switch {
+		case status.Healthy || status.HasData:
+			withData = append(withData, instance.Name)
+		case !status.Reachable:
+			log.Infof("Unable to tell if etcd is running on %s (%s): %v", instance.Name, instance.Endpoint, status.Err)
+			unreachable = append(unreachable, instance.Name)
+		}
+	}
+
+	if len(withData) > 0 {
+		return fmt.Errorf("the etcd members couldn't be listed, but %v already have cluster data", withData)
+	}
+
+	var partial error
+	switch {
+	case len(unreachable) > 0:
+		partial = fmt.Errorf("unable to tell if etcd is running on %v", unreachable)
+	case b.preflightPolicy.ClusterSize > 0 && len(instances) < b.preflightPolicy.ClusterSize:
+		partial = fmt.Errorf("only found %d of the expected %d instances", len(instances), b.preflightPolicy.ClusterSize)
+	}
+	if partial != nil {
+		if !b.preflightPolicy.Force {
+			return partial
+		}
+		log.Warnf("Forcing a new cluster with a partial set of instances: %v", partial)
+	}
+	return nil
+}
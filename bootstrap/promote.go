@@ -0,0 +1,43 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/etcd"
+)
+
+// PromoteLocalInstance promotes the local instance from a learner to a voting member, once it has caught up
+// with the leader. It polls every interval until the promotion succeeds or the timeout expires. This is intended
+// to run alongside etcd after the local instance joined as a learner, see WithLearner.
+func (b *Bootstrapper) PromoteLocalInstance(ctx context.Context, timeout, interval time.Duration) error {
+	localInstance, err := b.cloudAPI.GetLocalInstance(ctx)
+	if err != nil {
+		return err
+	}
+	peerURL := b.peerURL(localInstance.Endpoint)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := b.etcdAPI.PromoteLearnerByPeerURL(ctx, peerURL)
+		if err == nil {
+			log.Infof("Local instance %s is a voting member", localInstance.Name)
+			return nil
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return fmt.Errorf("gave up promoting %s after %v: %w", localInstance.Name, timeout, err)
+		}
+		if errors.Is(err, etcd.ErrLearnerNotReady) {
+			log.Infof("Waiting for learner to catch up: %v", err)
+		} else {
+			// The local etcd may still be starting up, so keep trying.
+			log.Warnf("Unable to promote learner, will retry: %v", err)
+		}
+		if err := sleep(ctx, interval); err != nil {
+			return fmt.Errorf("gave up promoting %s: %w", localInstance.Name, err)
+		}
+	}
+}
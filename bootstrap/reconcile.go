@@ -1,31 +1,79 @@
 package bootstrap
 
 import (
+	"context"
 	"fmt"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/etcd"
+	"github.com/sky-uk/etcd-bootstrap/metrics"
+	"github.com/sky-uk/etcd-bootstrap/report"
 )
 
 // reconcileMembers uses the etcd API to remove any non-existing members and add new ones that
 // need to join. This is used primarily to handle node replacement.
-func (b *Bootstrapper) reconcileMembers() error {
-	if err := b.removeOldEtcdMembers(); err != nil {
+func (b *Bootstrapper) reconcileMembers(ctx context.Context) error {
+	if err := b.removeOldEtcdMembers(ctx); err != nil {
 		return err
 	}
-	return b.addLocalInstanceToEtcd()
+	return b.addLocalInstanceToEtcd(ctx)
+}
+
+// memberRemoval is the decision on whether to remove an etcd member that is no longer part of the cloud instances.
+type memberRemoval struct {
+	member etcd.Member
+	remove bool
+	// reason explains why the member was skipped.
+	reason string
 }
 
 // removeOldEtcdMembers removes any etcd members that are no longer part of the instances
 // returned by the cloud API. We assume if it's not part of the cloud instances then the actual
-// node VM has been removed.
-func (b *Bootstrapper) removeOldEtcdMembers() error {
-	members, err := b.etcdAPI.Members()
+// node VM has been removed, subject to the removal policy.
+func (b *Bootstrapper) removeOldEtcdMembers(ctx context.Context) error {
+	removals, err := b.planMemberRemovals(ctx)
 	if err != nil {
 		return err
 	}
-	instances, err := b.cloudAPI.GetInstances()
+
+	for _, removal := range removals {
+		member := removal.member
+		if !removal.remove {
+			log.Warnf("Not removing %s (%s) from etcd member list, even though it's not found in cloud provider: %s",
+				member.Name, member.PeerURL, removal.reason)
+			metrics.RecordMemberRemovalSkipped()
+			b.report.AddAction(report.Action{Type: report.SkipRemoval, Target: member.Name, Detail: removal.reason})
+			continue
+		}
+		log.Infof("Removing %s (%s) from etcd member list, not found in cloud provider", member.Name, member.PeerURL)
+		if err := b.etcdAPI.RemoveMember(ctx, member.ID); err != nil {
+			log.Warnf("Unable to remove old member. This may be due to temporary lack of quorum,"+
+				" will ignore: %v", err)
+			b.report.AddAction(report.Action{Type: report.RemoveMember, Target: member.Name, Error: err.Error()})
+			continue
+		}
+		metrics.RecordMemberRemoved()
+		b.report.AddAction(report.Action{Type: report.RemoveMember, Target: member.Name})
+	}
+
+	return nil
+}
+
+// planMemberRemovals decides which members missing from the cloud instances can be safely removed. It doesn't
+// modify the cluster.
+//
+// A member is only removed if it is allowed by the removal policy, and if the voting members remaining afterwards
+// would still have a healthy quorum. This protects the cluster if the cloud API temporarily returns a partial list
+// of instances.
+func (b *Bootstrapper) planMemberRemovals(ctx context.Context) ([]memberRemoval, error) {
+	members, err := b.etcdAPI.Members(ctx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	instances, err := b.cloudAPI.GetInstances(ctx)
+	if err != nil {
+		return nil, err
 	}
 	var instanceNames []string
 	var instanceURLs []string
@@ -34,23 +82,61 @@ func (b *Bootstrapper) removeOldEtcdMembers() error {
 		instanceURLs = append(instanceURLs, b.peerURL(instance.Endpoint))
 	}
 
+	healthy := make(map[string]bool)
+	var voters []etcd.Member
 	for _, member := range members {
-		if !contains(instanceNames, member.Name) {
-			// The etcd member name doesn't exist in the list of cloud instances.
-			if member.Name == "" && contains(instanceURLs, member.PeerURL) {
-				// A special case is when member.Name == "". This means the member is still initialising, so don't remove it.
-				// Unless the peerURL doesn't exist in the instance list either, in which case this node is no longer around.
-				continue
-			}
-			log.Infof("Removing %s (%s) from etcd member list, not found in cloud provider", member.Name, member.PeerURL)
-			if err := b.etcdAPI.RemoveMemberByName(member.Name); err != nil {
-				log.Warnf("Unable to remove old member. This may be due to temporary lack of quorum,"+
-					" will ignore: %v", err)
-			}
+		healthy[member.PeerURL] = b.etcdAPI.MemberHealthy(ctx, member)
+		if !member.IsLearner {
+			voters = append(voters, member)
 		}
 	}
 
-	return nil
+	var removals []memberRemoval
+	removed := make(map[string]bool)
+	for _, member := range members {
+		if contains(instanceNames, member.Name) {
+			continue
+		}
+		// The etcd member name doesn't exist in the list of cloud instances.
+		if member.Name == "" && contains(instanceURLs, member.PeerURL) {
+			// A special case is when member.Name == "". This means the member is still initialising, so don't remove it.
+			// Unless the peerURL doesn't exist in the instance list either, in which case this node is no longer around.
+			continue
+		}
+
+		removal := memberRemoval{member: member}
+		switch {
+		case b.removalPolicy.MaxRemovals > 0 && len(removed) >= b.removalPolicy.MaxRemovals:
+			removal.reason = fmt.Sprintf("already removing the maximum of %d members", b.removalPolicy.MaxRemovals)
+		case b.removalPolicy.RequireUnhealthy && healthy[member.PeerURL]:
+			removal.reason = "it is still healthy"
+		case !member.IsLearner && !hasHealthyQuorum(voters, healthy, removed, member):
+			removal.reason = "the remaining voting members would not have a healthy quorum"
+		default:
+			removal.remove = true
+			removed[member.PeerURL] = true
+		}
+		removals = append(removals, removal)
+	}
+
+	return removals, nil
+}
+
+// hasHealthyQuorum checks if enough of the voters would still be healthy to form a quorum, after removing the
+// member along with those already removed.
+func hasHealthyQuorum(voters []etcd.Member, healthy, removed map[string]bool, member etcd.Member) bool {
+	var remaining, remainingHealthy int
+	for _, voter := range voters {
+		if removed[voter.PeerURL] || voter.PeerURL == member.PeerURL {
+			continue
+		}
+		remaining++
+		if healthy[voter.PeerURL] {
+			remainingHealthy++
+		}
+	}
+	quorum := remaining/2 + 1
+	return remainingHealthy >= quorum
 }
 
 // addLocalInstanceToEtcd ensures the advertise peerURL is added to the existing cluster. This is required by
@@ -58,34 +144,56 @@ func (b *Bootstrapper) removeOldEtcdMembers() error {
 //
 // After the peerURL is added, the member will show up with a blank name when listing members from the etcd API.
 // Once it successfully joins the name will be set.
-func (b *Bootstrapper) addLocalInstanceToEtcd() error {
-	members, err := b.etcdAPI.Members()
+func (b *Bootstrapper) addLocalInstanceToEtcd(ctx context.Context) error {
+	members, err := b.etcdAPI.Members(ctx)
 	if err != nil {
 		return err
 	}
-	var memberNames []string
-	var memberURLs []string
-	for _, member := range members {
-		memberNames = append(memberNames, member.Name)
-		memberURLs = append(memberURLs, member.PeerURL)
-	}
-	localInstance, err := b.cloudAPI.GetLocalInstance()
+	localInstance, err := b.cloudAPI.GetLocalInstance(ctx)
 	if err != nil {
 		return err
 	}
 
-	if !contains(memberNames, localInstance.Name) &&
-		!contains(memberURLs, b.peerURL(localInstance.Endpoint)) {
-		// Don't add if the member name already exists - the local instance is already part of the cluster.
-		// Also don't re-add if the local instance's peerURL has already been added. This could happen
-		// if the node crashed or restarted before it registered.
+	if b.needsAdding(members, localInstance) {
+		return b.addInstance(ctx, localInstance)
+	}
 
-		log.Infof("Adding local instance %v to the etcd member list", localInstance)
-		localInstanceURL := b.peerURL(localInstance.Endpoint)
-		if err := b.etcdAPI.AddMemberByPeerURL(localInstanceURL); err != nil {
-			return fmt.Errorf("unexpected error when adding new member URL %s: %v", localInstanceURL, err)
+	return nil
+}
+
+// addInstance adds the instance's peer URL to the etcd member list, as a learner if configured.
+func (b *Bootstrapper) addInstance(ctx context.Context, instance cloud.Instance) error {
+	instanceURL := b.peerURL(instance.Endpoint)
+	if b.learner {
+		log.Infof("Adding instance %v to the etcd member list as a learner", instance)
+		if err := b.etcdAPI.AddLearnerByPeerURL(ctx, instanceURL); err != nil {
+			return fmt.Errorf("unexpected error when adding new learner URL %s: %v", instanceURL, err)
 		}
+		metrics.RecordMemberAdded(true)
+		b.report.AddAction(report.Action{Type: report.AddLearner, Target: instanceURL})
+		return nil
 	}
 
+	log.Infof("Adding instance %v to the etcd member list", instance)
+	if err := b.etcdAPI.AddMemberByPeerURL(ctx, instanceURL); err != nil {
+		return fmt.Errorf("unexpected error when adding new member URL %s: %v", instanceURL, err)
+	}
+	metrics.RecordMemberAdded(false)
+	b.report.AddAction(report.Action{Type: report.AddMember, Target: instanceURL})
 	return nil
 }
+
+// needsAdding checks if the local instance's peerURL still has to be added to the members.
+func (b *Bootstrapper) needsAdding(members []etcd.Member, localInstance cloud.Instance) bool {
+	var memberNames []string
+	var memberURLs []string
+	for _, member := range members {
+		memberNames = append(memberNames, member.Name)
+		memberURLs = append(memberURLs, member.PeerURL)
+	}
+	// Don't add if the member name already exists - the local instance is already part of the cluster.
+	// Also don't re-add if the local instance's peerURL has already been added. This could happen
+	// if the node crashed or restarted before it registered.
+	return !contains(memberNames, localInstance.Name) &&
+		!contains(memberURLs, b.peerURL(localInstance.Endpoint))
+}
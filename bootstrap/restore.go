@@ -0,0 +1,85 @@
+package bootstrap
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/etcd"
+	"github.com/sky-uk/etcd-bootstrap/report"
+	"github.com/sky-uk/etcd-bootstrap/snapshot"
+)
+
+// SnapshotAPI restores a new cluster from an etcd snapshot.
+type SnapshotAPI interface {
+	// Fetch downloads and verifies the snapshot.
+	Fetch() (snapshot.Info, error)
+	// Restore restores the snapshot into a data dir as a member of the initial cluster.
+	Restore(snapshot.RestoreConfig) error
+	String() string
+}
+
+// WithSnapshotRestore seeds a new cluster with the snapshot, instead of starting it empty. Each member restores the
+// snapshot into its data dir, which must be set with WithDataDir. Members with data already are left alone.
+//
+// The initial cluster token is derived from the snapshot's hash, so members which restored different snapshots get
+// different cluster IDs and refuse to form a cluster, rather than silently diverging.
+func WithSnapshotRestore(snapshotAPI SnapshotAPI) Option {
+	return func(b *Bootstrapper) error {
+		b.snapshotAPI = snapshotAPI
+		return nil
+	}
+}
+
+// shouldRestore checks if the snapshot should be restored into the data dir, for a new cluster.
+func (b *Bootstrapper) shouldRestore() (bool, error) {
+	if b.snapshotAPI == nil {
+		return false, nil
+	}
+	if b.dataDir == "" {
+		return false, fmt.Errorf("a data dir is needed to restore snapshot %s", b.snapshotAPI)
+	}
+	_, err := b.readDataDir(b.dataDir)
+	if errors.Is(err, etcd.ErrNoData) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to inspect data dir %s: %w", b.dataDir, err)
+	}
+	// Most likely the snapshot was already restored, and etcd was restarted before the cluster formed.
+	log.Infof("Not restoring snapshot %s, data dir %s already has etcd data", b.snapshotAPI, b.dataDir)
+	return false, nil
+}
+
+// restoreSnapshot restores the snapshot into the data dir, as the local member of the new cluster.
+func (b *Bootstrapper) restoreSnapshot(config *EtcdConfig) error {
+	info, err := b.snapshotAPI.Fetch()
+	if err != nil {
+		return err
+	}
+	config.InitialClusterToken = clusterToken(info)
+	log.Infof("Restoring snapshot %s at revision %d, with initial cluster token %s",
+		b.snapshotAPI, info.Revision, config.InitialClusterToken)
+	err = b.snapshotAPI.Restore(snapshot.RestoreConfig{
+		DataDir:        b.dataDir,
+		Name:           config.Name,
+		PeerURL:        config.InitialAdvertisePeerURLs,
+		InitialCluster: config.InitialCluster,
+		ClusterToken:   config.InitialClusterToken,
+	})
+	if err != nil {
+		return err
+	}
+	b.report.AddAction(report.Action{Type: report.RestoreSnapshot, Target: b.dataDir,
+		Detail: fmt.Sprintf("%s at revision %d", b.snapshotAPI, info.Revision)})
+	return nil
+}
+
+// clusterToken is the same for every member restoring the same snapshot.
+func clusterToken(info snapshot.Info) string {
+	sha := info.SHA256
+	if len(sha) > 16 {
+		sha = sha[:16]
+	}
+	return fmt.Sprintf("etcd-restore-%d-%s", info.Revision, sha)
+}
@@ -0,0 +1,131 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/etcd"
+	"github.com/sky-uk/etcd-bootstrap/snapshot"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Restoring a snapshot", func() {
+	var (
+		snapshotAPI  *SnapshotAPIMock
+		etcdAPIMock  *EtcdAPIMock
+		bootstrapper *Bootstrapper
+		hasData      bool
+	)
+
+	BeforeEach(func() {
+		hasData = false
+		snapshotAPI = &SnapshotAPIMock{info: snapshot.Info{SHA256: "0123456789abcdef0123", Revision: 42}}
+		etcdAPIMock = &EtcdAPIMock{
+			MembersMock:       &Members{},
+			ProbeInstanceMock: &ProbeInstance{},
+		}
+		bootstrapper = &Bootstrapper{
+			cloudAPI: &CloudAPIMock{
+				GetInstancesMock: &GetInstances{GetInstancesOutput: []cloud.Instance{
+					{Name: "etcd-1", Endpoint: "10.0.0.1"},
+					{Name: "etcd-2", Endpoint: "10.0.0.2"},
+				}},
+				GetLocalInstanceMock: &GetLocalInstance{GetLocalInstance: cloud.Instance{Name: "etcd-1", Endpoint: "10.0.0.1"}},
+				GetLocalIPMock:       &GetLocalIP{LocalIP: "10.0.0.1"},
+			},
+			etcdAPI:     etcdAPIMock,
+			protocol:    "http",
+			peerPort:    2380,
+			clientPort:  2379,
+			dataDir:     "/var/lib/etcd",
+			snapshotAPI: snapshotAPI,
+			readDataDir: func(string) (etcd.DataDir, error) {
+				if hasData {
+					return etcd.DataDir{MemberID: 1, ClusterID: 2}, nil
+				}
+				return etcd.DataDir{}, etcd.ErrNoData
+			},
+		}
+	})
+
+	It("restores the snapshot into the data dir of a new cluster", func() {
+		flags, err := bootstrapper.GenerateEtcdFlags(context.Background())
+		Expect(err).To(BeNil())
+		Expect(snapshotAPI.restored).To(Equal([]snapshot.RestoreConfig{{
+			DataDir:        "/var/lib/etcd",
+			Name:           "etcd-1",
+			PeerURL:        "http://10.0.0.1:2380",
+			InitialCluster: "etcd-1=http://10.0.0.1:2380,etcd-2=http://10.0.0.2:2380",
+			ClusterToken:   "etcd-restore-42-0123456789abcdef",
+		}}))
+		lines := strings.Split(flags, "\n")
+		Expect(lines).To(ContainElement("ETCD_INITIAL_CLUSTER_STATE=new"))
+		Expect(lines).To(ContainElement("ETCD_INITIAL_CLUSTER_TOKEN=etcd-restore-42-0123456789abcdef"))
+	})
+
+	It("doesn't restore over existing data", func() {
+		hasData = true
+		flags, err := bootstrapper.GenerateEtcdFlags(context.Background())
+		Expect(err).To(BeNil())
+		Expect(snapshotAPI.restored).To(BeEmpty())
+		Expect(flags).ToNot(ContainSubstring("TOKEN"))
+	})
+
+	It("doesn't restore into an existing cluster", func() {
+		etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{{Name: "etcd-1", PeerURL: "http://10.0.0.1:2380"}}
+		bootstrapper.dataDir = ""
+		_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+		Expect(err).To(BeNil())
+		Expect(snapshotAPI.restored).To(BeEmpty())
+	})
+
+	It("needs a data dir", func() {
+		bootstrapper.dataDir = ""
+		_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("fails if the snapshot can't be fetched", func() {
+		snapshotAPI.err = fmt.Errorf("hash mismatch")
+		_, err := bootstrapper.GenerateEtcdFlags(context.Background())
+		Expect(err).ToNot(BeNil())
+		Expect(snapshotAPI.restored).To(BeEmpty())
+	})
+
+	It("plans the restore without fetching the snapshot", func() {
+		plan, err := bootstrapper.Plan(context.Background())
+		Expect(err).To(BeNil())
+		Expect(plan.RestoreSnapshot).To(Equal("s3://backups/etcd.db"))
+		Expect(plan.String()).To(ContainSubstring("restore snapshot s3://backups/etcd.db"))
+		Expect(snapshotAPI.fetched).To(BeFalse())
+	})
+})
+
+// SnapshotAPIMock for mocking snapshot restores
+type SnapshotAPIMock struct {
+	info     snapshot.Info
+	err      error
+	fetched  bool
+	restored []snapshot.RestoreConfig
+}
+
+// Fetch mocks the snapshot package
+func (s *SnapshotAPIMock) Fetch() (snapshot.Info, error) {
+	s.fetched = true
+	return s.info, s.err
+}
+
+// Restore mocks the snapshot package
+func (s *SnapshotAPIMock) Restore(cfg snapshot.RestoreConfig) error {
+	s.restored = append(s.restored, cfg)
+	return nil
+}
+
+// String mocks the snapshot package
+func (s *SnapshotAPIMock) String() string {
+	return "s3://backups/etcd.db"
+}
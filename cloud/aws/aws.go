@@ -1,46 +1,55 @@
 package aws
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/retry"
 )
 
+// timeout is the deadline for each attempt at an AWS API call.
+const timeout = 10 * time.Second
+
 // awsASG interface to abstract away from AWS commands
 type awsASG interface {
-	DescribeAutoScalingInstances(a *autoscaling.DescribeAutoScalingInstancesInput) (*autoscaling.DescribeAutoScalingInstancesOutput, error)
-	DescribeAutoScalingGroups(a *autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error)
+	DescribeAutoScalingInstancesWithContext(ctx aws.Context, a *autoscaling.DescribeAutoScalingInstancesInput, opts ...request.Option) (*autoscaling.DescribeAutoScalingInstancesOutput, error)
+	DescribeAutoScalingGroupsWithContext(ctx aws.Context, a *autoscaling.DescribeAutoScalingGroupsInput, opts ...request.Option) (*autoscaling.DescribeAutoScalingGroupsOutput, error)
 }
 
 // awsEC2 interface to abstract away from AWS commands
 type awsEC2 interface {
-	DescribeInstances(e *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error)
+	DescribeInstancesWithContext(ctx aws.Context, e *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error)
 }
 
 // AWS returns the instances in the local auto scaling group.
 type AWS struct {
 	awsSession       *session.Session
+	retryPolicy      retry.Policy
 	identityDocument *ec2metadata.EC2InstanceIdentityDocument
 	instances        []cloud.Instance
 }
 
 // GetInstances will return the aws etcd instances
-func (m *AWS) GetInstances() ([]cloud.Instance, error) {
+func (m *AWS) GetInstances(ctx context.Context) ([]cloud.Instance, error) {
 	if m.instances == nil {
-		identityDoc, err := m.getIdentityDoc()
+		identityDoc, err := m.getIdentityDoc(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("unable to get local instance information: %w", err)
 		}
 		config := &aws.Config{Region: aws.String(identityDoc.Region)}
 		awsASGClient := autoscaling.New(m.awsSession, config)
 		awsEC2Client := ec2.New(m.awsSession, config)
-		instances, err := queryInstances(identityDoc, awsASGClient, awsEC2Client)
+		instances, err := queryInstances(ctx, m.retryPolicy, identityDoc, awsASGClient, awsEC2Client)
 		if err != nil {
 			return nil, fmt.Errorf("unable to query ASG: %w", err)
 		}
@@ -51,8 +60,8 @@ func (m *AWS) GetInstances() ([]cloud.Instance, error) {
 }
 
 // GetLocalInstance will get the aws instance etcd bootstrap is running on
-func (m *AWS) GetLocalInstance() (cloud.Instance, error) {
-	identityDoc, err := m.getIdentityDoc()
+func (m *AWS) GetLocalInstance(ctx context.Context) (cloud.Instance, error) {
+	identityDoc, err := m.getIdentityDoc(ctx)
 	if err != nil {
 		return cloud.Instance{}, err
 	}
@@ -63,45 +72,61 @@ func (m *AWS) GetLocalInstance() (cloud.Instance, error) {
 }
 
 // GetLocalIP returns the local instance's PrivateIP.
-func (m *AWS) GetLocalIP() (string, error) {
-	localInstance, err := m.GetLocalInstance()
+func (m *AWS) GetLocalIP(ctx context.Context) (string, error) {
+	localInstance, err := m.GetLocalInstance(ctx)
 	if err != nil {
 		return "", err
 	}
 	return localInstance.Endpoint, nil
 }
 
-func (m *AWS) getIdentityDoc() (*ec2metadata.EC2InstanceIdentityDocument, error) {
+func (m *AWS) getIdentityDoc(ctx context.Context) (*ec2metadata.EC2InstanceIdentityDocument, error) {
 	if m.identityDocument == nil {
-		meta := ec2metadata.New(m.awsSession)
-		identityDoc, err := meta.GetInstanceIdentityDocument()
+		identityDoc, err := getIdentityDoc(ctx, m.retryPolicy, m.awsSession)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get AWS local instance data: %v", err)
+			return nil, err
 		}
-		m.identityDocument = &identityDoc
+		m.identityDocument = identityDoc
 	}
 	return m.identityDocument, nil
 }
 
-// NewAWS returns the Members this local instance belongs to.
-func NewAWS() (*AWS, error) {
+// getIdentityDoc gets the local instance's identity document from the metadata service.
+func getIdentityDoc(ctx context.Context, policy retry.Policy, awsSession *session.Session) (*ec2metadata.EC2InstanceIdentityDocument, error) {
+	meta := ec2metadata.New(awsSession)
+	var identityDoc ec2metadata.EC2InstanceIdentityDocument
+	err := do(ctx, policy, "get AWS local instance data", func(context.Context) error {
+		var err error
+		identityDoc, err = meta.GetInstanceIdentityDocument()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get AWS local instance data: %w", err)
+	}
+	return &identityDoc, nil
+}
+
+// NewAWS returns the Members this local instance belongs to. Calls to AWS are retried according to the policy.
+func NewAWS(retryPolicy retry.Policy) (*AWS, error) {
 	awsSession, err := session.NewSession()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create new AWS session: %v", err)
 	}
 	return &AWS{
-		awsSession: awsSession,
+		awsSession:  awsSession,
+		retryPolicy: retryPolicy,
 	}, nil
 }
 
-func queryInstances(identity *ec2metadata.EC2InstanceIdentityDocument, awsASGClient awsASG, awsEC2Client awsEC2) ([]cloud.Instance, error) {
+func queryInstances(ctx context.Context, policy retry.Policy, identity *ec2metadata.EC2InstanceIdentityDocument,
+	awsASGClient awsASG, awsEC2Client awsEC2) ([]cloud.Instance, error) {
 	instanceID := identity.InstanceID
-	asgName, err := getASGName(instanceID, awsASGClient)
+	asgName, err := getASGName(ctx, policy, instanceID, awsASGClient)
 	if err != nil {
 		return nil, err
 	}
 
-	instanceIDs, err := getASGInstanceIDs(asgName, awsASGClient)
+	instanceIDs, err := getASGInstanceIDs(ctx, policy, asgName, awsASGClient)
 	if err != nil {
 		return nil, err
 	}
@@ -117,7 +142,12 @@ func queryInstances(identity *ec2metadata.EC2InstanceIdentityDocument, awsASGCli
 		},
 	}
 
-	out, err := awsEC2Client.DescribeInstances(req)
+	var out *ec2.DescribeInstancesOutput
+	err = do(ctx, policy, "describe ASG instances", func(ctx context.Context) error {
+		var err error
+		out, err = awsEC2Client.DescribeInstancesWithContext(ctx, req)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -135,11 +165,16 @@ func queryInstances(identity *ec2metadata.EC2InstanceIdentityDocument, awsASGCli
 	return instances, nil
 }
 
-func getASGName(instanceID string, a awsASG) (string, error) {
+func getASGName(ctx context.Context, policy retry.Policy, instanceID string, a awsASG) (string, error) {
 	req := &autoscaling.DescribeAutoScalingInstancesInput{
 		InstanceIds: aws.StringSlice([]string{instanceID}),
 	}
-	out, err := a.DescribeAutoScalingInstances(req)
+	var out *autoscaling.DescribeAutoScalingInstancesOutput
+	err := do(ctx, policy, "describe AWS ASG instances", func(ctx context.Context) error {
+		var err error
+		out, err = a.DescribeAutoScalingInstancesWithContext(ctx, req)
+		return err
+	})
 	if err != nil {
 		return "", fmt.Errorf("failed to describe AWS ASG instances: %v", err)
 	}
@@ -149,12 +184,16 @@ func getASGName(instanceID string, a awsASG) (string, error) {
 	return *out.AutoScalingInstances[0].AutoScalingGroupName, nil
 }
 
-func getASGInstanceIDs(asgName string, awsASG awsASG) ([]string, error) {
+func getASGInstanceIDs(ctx context.Context, policy retry.Policy, asgName string, awsASG awsASG) ([]string, error) {
 	req := &autoscaling.DescribeAutoScalingGroupsInput{
 		AutoScalingGroupNames: aws.StringSlice([]string{asgName}),
 	}
-	out, err := awsASG.DescribeAutoScalingGroups(req)
-
+	var out *autoscaling.DescribeAutoScalingGroupsOutput
+	err := do(ctx, policy, "describe AWS ASG groups", func(ctx context.Context) error {
+		var err error
+		out, err = awsASG.DescribeAutoScalingGroupsWithContext(ctx, req)
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to describe AWS ASG groups: %v", err)
 	}
@@ -169,3 +208,26 @@ func getASGInstanceIDs(asgName string, awsASG awsASG) ([]string, error) {
 	}
 	return instanceIDs, nil
 }
+
+// do calls fn with a timeout for each attempt, retrying throttling and transient errors according to the policy.
+func do(ctx context.Context, policy retry.Policy, name string, fn func(context.Context) error) error {
+	return retry.Do(ctx, policy, name, isRetryable, func(ctx context.Context) error {
+		ctx, cancelFn := context.WithTimeout(ctx, timeout)
+		defer cancelFn()
+		return fn(ctx)
+	})
+}
+
+// isRetryable checks for throttling, server errors and other errors the AWS SDK considers transient. The SDK
+// retries these itself a few times, but not for long enough to ride out sustained throttling.
+func isRetryable(err error) bool {
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) && failure.StatusCode() >= 500 {
+		return true
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return request.IsErrorThrottle(awsErr) || request.IsErrorRetryable(awsErr)
+	}
+	return retry.Network(err)
+}
@@ -1,10 +1,12 @@
 package aws
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -12,6 +14,7 @@ import (
 	. "github.com/onsi/gomega"
 	"github.com/sky-uk/etcd-bootstrap/cloud"
 	"github.com/sky-uk/etcd-bootstrap/mock"
+	"github.com/sky-uk/etcd-bootstrap/retry"
 )
 
 // TestAWSProvider to register the test suite
@@ -64,18 +67,18 @@ var _ = Describe("AWS Provider", func() {
 		})
 
 		It("runs GetInstances successfully", func() {
-			Expect(awsProvider.GetInstances()).To(Equal(testInstances))
+			Expect(awsProvider.GetInstances(context.Background())).To(Equal(testInstances))
 		})
 
 		It("run GetLocalInstance successfully", func() {
-			Expect(awsProvider.GetLocalInstance()).To(Equal(cloud.Instance{
+			Expect(awsProvider.GetLocalInstance(context.Background())).To(Equal(cloud.Instance{
 				Name:     localInstanceID,
 				Endpoint: localPrivateIP,
 			}))
 		})
 
 		It("returns the local IP as the local private IP", func() {
-			Expect(awsProvider.GetLocalIP()).To(Equal(localPrivateIP))
+			Expect(awsProvider.GetLocalIP(context.Background())).To(Equal(localPrivateIP))
 		})
 	})
 
@@ -145,50 +148,64 @@ var _ = Describe("AWS Provider", func() {
 
 		It("queryInstances fails when getASGName errors", func() {
 			awsASGClient.MockDescribeAutoScalingInstances.Err = fmt.Errorf("failed to describe autoscaling instances")
-			_, err := queryInstances(identityDoc, awsASGClient, awsEC2Client)
+			_, err := queryInstances(context.Background(), retry.Policy{}, identityDoc, awsASGClient, awsEC2Client)
 			Expect(err).ToNot(BeNil())
 		})
 
 		It("queryInstances fails when getASGInstanceIDs errors", func() {
 			awsASGClient.MockDescribeAutoScalingGroups.Err = fmt.Errorf("failed to describe autoscaling groups")
-			_, err := queryInstances(identityDoc, awsASGClient, awsEC2Client)
+			_, err := queryInstances(context.Background(), retry.Policy{}, identityDoc, awsASGClient, awsEC2Client)
 			Expect(err).ToNot(BeNil())
 		})
 
 		It("queryInstances fails when DescribeInstances errors", func() {
 			awsEC2Client.MockDescribeInstances.Err = fmt.Errorf("failed to describe instances")
-			_, err := queryInstances(identityDoc, awsASGClient, awsEC2Client)
+			_, err := queryInstances(context.Background(), retry.Policy{}, identityDoc, awsASGClient, awsEC2Client)
 			Expect(err).ToNot(BeNil())
 		})
 
 		It("queryInstances returns correct instance array", func() {
-			instances, err := queryInstances(identityDoc, awsASGClient, awsEC2Client)
+			instances, err := queryInstances(context.Background(), retry.Policy{}, identityDoc, awsASGClient, awsEC2Client)
 			Expect(err).To(BeNil())
 			Expect(instances).To(Equal(testInstances))
 		})
 
 		It("getASGName fails when there are more than 1 autoscaling groups returned for an instance", func() {
 			awsASGClient.MockDescribeAutoScalingInstances.DescribeAutoScalingInstancesOutput.AutoScalingInstances = []*autoscaling.InstanceDetails{{}, {}}
-			_, err := getASGName(localInstanceID, awsASGClient)
+			_, err := getASGName(context.Background(), retry.Policy{}, localInstanceID, awsASGClient)
 			Expect(err).ToNot(BeNil())
 		})
 
 		It("getASGName fails when there are 0 autoscaling groups returned for an instance", func() {
 			awsASGClient.MockDescribeAutoScalingInstances.DescribeAutoScalingInstancesOutput.AutoScalingInstances = []*autoscaling.InstanceDetails{}
-			_, err := getASGName(localInstanceID, awsASGClient)
+			_, err := getASGName(context.Background(), retry.Policy{}, localInstanceID, awsASGClient)
 			Expect(err).ToNot(BeNil())
 		})
 
 		It("getASGInstanceIDs fails when there are more than 1 autoscaling groups returned", func() {
 			awsASGClient.MockDescribeAutoScalingGroups.DescribeAutoScalingGroupsOutput.AutoScalingGroups = []*autoscaling.Group{{}, {}}
-			_, err := getASGInstanceIDs(autoscalingGroupName, awsASGClient)
+			_, err := getASGInstanceIDs(context.Background(), retry.Policy{}, autoscalingGroupName, awsASGClient)
 			Expect(err).ToNot(BeNil())
 		})
 
 		It("getASGInstanceIDs fails when there are 0 autoscaling groups returned", func() {
 			awsASGClient.MockDescribeAutoScalingGroups.DescribeAutoScalingGroupsOutput.AutoScalingGroups = []*autoscaling.Group{}
-			_, err := getASGInstanceIDs(autoscalingGroupName, awsASGClient)
+			_, err := getASGInstanceIDs(context.Background(), retry.Policy{}, autoscalingGroupName, awsASGClient)
 			Expect(err).ToNot(BeNil())
 		})
 	})
+
+	Context("isRetryable()", func() {
+		It("retries throttling and server errors", func() {
+			Expect(isRetryable(awserr.New("Throttling", "Rate exceeded", nil))).To(BeTrue())
+			Expect(isRetryable(awserr.New("RequestLimitExceeded", "Request limit exceeded", nil))).To(BeTrue())
+			Expect(isRetryable(awserr.NewRequestFailure(awserr.New("InternalFailure", "oops", nil), 500, "id"))).To(BeTrue())
+			Expect(isRetryable(fmt.Errorf("unable to query ASG: %w", awserr.New("Throttling", "Rate exceeded", nil)))).To(BeTrue())
+		})
+
+		It("doesn't retry client errors", func() {
+			Expect(isRetryable(awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, "id"))).To(BeFalse())
+			Expect(isRetryable(awserr.New("ValidationError", "invalid", nil))).To(BeFalse())
+		})
+	})
 })
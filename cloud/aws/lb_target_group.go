@@ -1,67 +1,134 @@
 package aws
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/elbv2"
+	log "github.com/sirupsen/logrus"
 	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/retry"
 )
 
+// How often to check if the local target is healthy.
+const targetHealthPollInterval = 5 * time.Second
+
 // LBTargetGroupRegistrationProviderConfig contains configuration when creating a default LBTargetGroupRegistrationProvider
 type LBTargetGroupRegistrationProviderConfig struct {
+	// TargetGroupName or TargetGroupARN identifies the target group, with the ARN taking precedence.
 	TargetGroupName string
+	TargetGroupARN  string
+	// Port of the targets. If it isn't set, an instance's own client port is used if it has one, otherwise the
+	// target group's port.
+	Port int
+	// AllAvailabilityZones registers the targets in all availability zones, which is required for IP addresses
+	// outside the target group's VPC.
+	AllAvailabilityZones bool
+	// WaitForHealthy, if set, waits up to this long for the local instance's target to be healthy after registering.
+	WaitForHealthy time.Duration
+	// MaxDeregistrations caps how many targets are deregistered per update, if set. The rest are left for later
+	// updates, so a partial list of instances can't empty the target group in one go.
+	MaxDeregistrations int
+	// ForceDeregistration deregisters targets which aren't instances even if they're passing health checks, which
+	// are otherwise left alone as they may still be serving.
+	ForceDeregistration bool
+	// ManagedCIDRs and ManagedPorts, if set, limit the targets which are deregistered to those with IPs in one of the
+	// CIDRs and one of the ports, so a target group can be shared with other clusters.
+	ManagedCIDRs []string
+	ManagedPorts []int
+	// RetryPolicy is how calls to AWS are retried.
+	RetryPolicy retry.Policy
 }
 
 // elb interface to abstract away from AWS commands
 type elb interface {
-	// DescribeTargetGroups returns information about an aws elb target group
-	DescribeTargetGroups(e *elbv2.DescribeTargetGroupsInput) (*elbv2.DescribeTargetGroupsOutput, error)
-	// RegisterTargets registers instance or ip targets with an aws elb target group
-	RegisterTargets(e *elbv2.RegisterTargetsInput) (*elbv2.RegisterTargetsOutput, error)
-	// DescribeTargetHealth returns information about the health of an aws elb target
-	DescribeTargetHealth(e *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error)
-	// DeregisterTargets deregisters instance or ip targets from an aws elb target group
-	DeregisterTargets(e *elbv2.DeregisterTargetsInput) (*elbv2.DeregisterTargetsOutput, error)
+	// DescribeTargetGroupsWithContext returns information about an aws elb target group
+	DescribeTargetGroupsWithContext(ctx aws.Context, e *elbv2.DescribeTargetGroupsInput, opts ...request.Option) (*elbv2.DescribeTargetGroupsOutput, error)
+	// RegisterTargetsWithContext registers instance or ip targets with an aws elb target group
+	RegisterTargetsWithContext(ctx aws.Context, e *elbv2.RegisterTargetsInput, opts ...request.Option) (*elbv2.RegisterTargetsOutput, error)
+	// DescribeTargetHealthWithContext returns information about the health of an aws elb target
+	DescribeTargetHealthWithContext(ctx aws.Context, e *elbv2.DescribeTargetHealthInput, opts ...request.Option) (*elbv2.DescribeTargetHealthOutput, error)
+	// DeregisterTargetsWithContext deregisters instance or ip targets from an aws elb target group
+	DeregisterTargetsWithContext(ctx aws.Context, e *elbv2.DeregisterTargetsInput, opts ...request.Option) (*elbv2.DeregisterTargetsOutput, error)
+	// WaitUntilTargetInServiceWithContext waits for aws elb targets to be healthy
+	WaitUntilTargetInServiceWithContext(ctx aws.Context, e *elbv2.DescribeTargetHealthInput, opts ...request.WaiterOption) error
 }
 
 // LBTargetGroupRegistrationProvider contains an aws elb client and a target group name used for registering etcd
 // cluster information with an aws elb target group
 type LBTargetGroupRegistrationProvider struct {
 	targetGroupName string
+	targetGroupARN  string
+	port            int
+	allZones        bool
+	waitForHealthy  time.Duration
+	maxDeregister   int
+	forceDeregister bool
+	managedCIDRs    []*net.IPNet
+	managedPorts    []int
+	localIP         string
 	elb             elb
+	retryPolicy     retry.Policy
 }
 
 // NewLBTargetGroupRegistrationProvider returns a default LBTargetGroupRegistrationProvider and initiates a new aws elb
 // client
-func NewLBTargetGroupRegistrationProvider(c *LBTargetGroupRegistrationProviderConfig) (*LBTargetGroupRegistrationProvider, error) {
+func NewLBTargetGroupRegistrationProvider(ctx context.Context, c *LBTargetGroupRegistrationProviderConfig) (*LBTargetGroupRegistrationProvider, error) {
 	awsSession, err := session.NewSession()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create new AWS session: %v", err)
 	}
 
-	meta := ec2metadata.New(awsSession)
-	identityDoc, err := meta.GetInstanceIdentityDocument()
+	var managedCIDRs []*net.IPNet
+	for _, cidr := range c.ManagedCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid managed CIDR: %v", err)
+		}
+		managedCIDRs = append(managedCIDRs, ipNet)
+	}
+
+	identityDoc, err := getIdentityDoc(ctx, c.RetryPolicy, awsSession)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get AWS local instance data: %v", err)
+		return nil, err
 	}
 	config := &aws.Config{Region: aws.String(identityDoc.Region)}
 	elbClient := elbv2.New(awsSession, config)
 
 	return &LBTargetGroupRegistrationProvider{
 		targetGroupName: c.TargetGroupName,
+		targetGroupARN:  c.TargetGroupARN,
+		port:            c.Port,
+		allZones:        c.AllAvailabilityZones,
+		waitForHealthy:  c.WaitForHealthy,
+		maxDeregister:   c.MaxDeregistrations,
+		forceDeregister: c.ForceDeregistration,
+		managedCIDRs:    managedCIDRs,
+		managedPorts:    c.ManagedPorts,
+		localIP:         identityDoc.PrivateIP,
 		elb:             elbClient,
+		retryPolicy:     c.RetryPolicy,
 	}, nil
 }
 
 // Update will update the aws lb target group with the discovered etcd instances
-func (l LBTargetGroupRegistrationProvider) Update(instances []cloud.Instance) error {
-	targetGroups, err := l.elb.DescribeTargetGroups(&elbv2.DescribeTargetGroupsInput{
-		Names: []*string{
-			aws.String(l.targetGroupName),
-		},
+func (l LBTargetGroupRegistrationProvider) Update(ctx context.Context, instances []cloud.Instance) error {
+	describeInput := &elbv2.DescribeTargetGroupsInput{Names: []*string{aws.String(l.targetGroupName)}}
+	targetGroup := l.targetGroupName
+	if l.targetGroupARN != "" {
+		describeInput = &elbv2.DescribeTargetGroupsInput{TargetGroupArns: []*string{aws.String(l.targetGroupARN)}}
+		targetGroup = l.targetGroupARN
+	}
+	var targetGroups *elbv2.DescribeTargetGroupsOutput
+	err := do(ctx, l.retryPolicy, "describe target group "+targetGroup, func(ctx context.Context) error {
+		var err error
+		targetGroups, err = l.elb.DescribeTargetGroupsWithContext(ctx, describeInput)
+		return err
 	})
 	if err != nil {
 		return fmt.Errorf("unable to describe loadbalancer target groups: %v", err)
@@ -73,10 +140,20 @@ func (l LBTargetGroupRegistrationProvider) Update(instances []cloud.Instance) er
 	}
 
 	var targets []*elbv2.TargetDescription
+	var localTarget *elbv2.TargetDescription
 	for _, instance := range instances {
-		targets = append(targets, &elbv2.TargetDescription{
-			Id: aws.String(instance.Endpoint),
-		})
+		target := l.target(instance)
+		targets = append(targets, target)
+		if instance.Endpoint == l.localIP {
+			localTarget = target
+		}
+	}
+
+	// The targets are listed before registering the instances, so the guard against deregistering all the targets
+	// only counts the ones which were already there.
+	existingTargets, err := l.getExistingLBTargets(ctx, targetGroupARN)
+	if err != nil {
+		return err
 	}
 
 	registerEtcdInstances := &elbv2.RegisterTargetsInput{
@@ -84,22 +161,18 @@ func (l LBTargetGroupRegistrationProvider) Update(instances []cloud.Instance) er
 		Targets:        targets,
 	}
 
-	if _, err := l.elb.RegisterTargets(registerEtcdInstances); err != nil {
-		return fmt.Errorf("unable to register etcd instances with loadbalancer target group: %v", err)
-	}
-
-	targetsToRemove := []*elbv2.TargetDescription{}
-
-	existingTargets, err := l.getExistingLBTargets(targetGroupARN)
-	if err != nil {
+	// Registering and deregistering targets are idempotent, so they can safely be retried.
+	err = do(ctx, l.retryPolicy, "register targets", func(ctx context.Context) error {
+		_, err := l.elb.RegisterTargetsWithContext(ctx, registerEtcdInstances)
 		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to register etcd instances with loadbalancer target group: %v", err)
 	}
 
-	for _, target := range existingTargets {
-		if !contains(instances, target) {
-			targetsToRemove = append(targetsToRemove, target)
-		}
-	}
+	// Targets registered without a port use the target group's port.
+	defaultPort := aws.Int64Value(targetGroups.TargetGroups[0].Port)
+	targetsToRemove := l.targetsToDeregister(targets, existingTargets, defaultPort)
 
 	if len(targetsToRemove) > 0 {
 		deregisterEtcdInstances := &elbv2.DeregisterTargetsInput{
@@ -107,29 +180,149 @@ func (l LBTargetGroupRegistrationProvider) Update(instances []cloud.Instance) er
 			Targets:        targetsToRemove,
 		}
 
-		_, err = l.elb.DeregisterTargets(deregisterEtcdInstances)
+		err = do(ctx, l.retryPolicy, "deregister targets", func(ctx context.Context) error {
+			_, err := l.elb.DeregisterTargetsWithContext(ctx, deregisterEtcdInstances)
+			return err
+		})
 		if err != nil {
 			return fmt.Errorf("unable to deregister etcd instances from loadbalancer target group: %v", err)
 		}
 	}
 
+	if l.waitForHealthy > 0 {
+		return l.waitUntilHealthy(ctx, targetGroupARN, localTarget)
+	}
 	return nil
 }
 
-func (l LBTargetGroupRegistrationProvider) getExistingLBTargets(targetGroupARN *string) ([]*elbv2.TargetDescription, error) {
-	existingTargets, err := l.elb.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{
+// target is the instance's target description.
+func (l LBTargetGroupRegistrationProvider) target(instance cloud.Instance) *elbv2.TargetDescription {
+	target := &elbv2.TargetDescription{
+		Id: aws.String(instance.Endpoint),
+	}
+	if l.port != 0 {
+		target.Port = aws.Int64(int64(l.port))
+	} else if instance.ClientPort != 0 {
+		target.Port = aws.Int64(int64(instance.ClientPort))
+	}
+	if l.allZones {
+		target.AvailabilityZone = aws.String("all")
+	}
+	return target
+}
+
+// waitUntilHealthy waits for the local instance's target to pass the target group's health checks.
+func (l LBTargetGroupRegistrationProvider) waitUntilHealthy(ctx context.Context, targetGroupARN *string,
+	localTarget *elbv2.TargetDescription) error {
+	if localTarget == nil {
+		log.Infof("The local instance %s isn't one of the targets, so not waiting for it to be healthy", l.localIP)
+		return nil
+	}
+	log.Infof("Waiting up to %v for the local target %s to be healthy", l.waitForHealthy, *localTarget.Id)
+	ctx, cancel := context.WithTimeout(ctx, l.waitForHealthy)
+	defer cancel()
+	input := &elbv2.DescribeTargetHealthInput{
 		TargetGroupArn: targetGroupARN,
-	})
+		Targets:        []*elbv2.TargetDescription{localTarget},
+	}
+	err := l.elb.WaitUntilTargetInServiceWithContext(ctx, input,
+		request.WithWaiterDelay(request.ConstantWaiterDelay(targetHealthPollInterval)),
+		request.WithWaiterMaxAttempts(int(l.waitForHealthy/targetHealthPollInterval)+1))
 	if err != nil {
-		return nil, fmt.Errorf("unable to describe loadbalancer target health: %v", err)
+		return fmt.Errorf("local target %s didn't become healthy within %v: %v", *localTarget.Id, l.waitForHealthy,
+			err)
 	}
+	log.Infof("The local target %s is healthy", *localTarget.Id)
+	return nil
+}
 
-	targetDescriptions := []*elbv2.TargetDescription{}
-	for _, target := range existingTargets.TargetHealthDescriptions {
-		targetDescriptions = append(targetDescriptions, target.Target)
+// targetsToDeregister returns the managed targets which aren't instances, guarding against deregistering targets
+// which may still be serving because the instances are incomplete.
+func (l LBTargetGroupRegistrationProvider) targetsToDeregister(targets []*elbv2.TargetDescription,
+	existingTargets []*elbv2.TargetHealthDescription, defaultPort int64) []*elbv2.TargetDescription {
+	managed := 0
+	var stale []*elbv2.TargetHealthDescription
+	for _, existing := range existingTargets {
+		if !l.manages(existing.Target) {
+			continue
+		}
+		managed++
+		if !containsTarget(targets, existing.Target, defaultPort) {
+			stale = append(stale, existing)
+		}
+	}
+	if len(stale) > 0 && len(stale) == managed {
+		log.Warnf("Not deregistering any of the %d targets, as none of them are instances, so the instances may be "+
+			"incomplete", len(stale))
+		return nil
 	}
 
-	return targetDescriptions, nil
+	var targetsToRemove []*elbv2.TargetDescription
+	for _, existing := range stale {
+		target := targetName(existing.Target)
+		if !l.forceDeregister && existing.TargetHealth != nil &&
+			aws.StringValue(existing.TargetHealth.State) == elbv2.TargetHealthStateEnumHealthy {
+			log.Warnf("Not deregistering target %s, which isn't an instance but is still healthy, force "+
+				"deregistration to remove it", target)
+			continue
+		}
+		if l.maxDeregister > 0 && len(targetsToRemove) >= l.maxDeregister {
+			log.Warnf("Not deregistering target %s until a later update, as at most %d targets are deregistered "+
+				"at a time", target, l.maxDeregister)
+			continue
+		}
+		log.Infof("Deregistering target %s, as it isn't an instance", target)
+		targetsToRemove = append(targetsToRemove, existing.Target)
+	}
+	return targetsToRemove
+}
+
+// manages checks if the target is in one of the managed CIDRs and on one of the managed ports, if they're set.
+func (l LBTargetGroupRegistrationProvider) manages(target *elbv2.TargetDescription) bool {
+	if len(l.managedCIDRs) > 0 {
+		ip := net.ParseIP(aws.StringValue(target.Id))
+		inCIDR := false
+		for _, cidr := range l.managedCIDRs {
+			if ip != nil && cidr.Contains(ip) {
+				inCIDR = true
+			}
+		}
+		if !inCIDR {
+			return false
+		}
+	}
+	if len(l.managedPorts) > 0 {
+		for _, port := range l.managedPorts {
+			if int64(port) == aws.Int64Value(target.Port) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func targetName(target *elbv2.TargetDescription) string {
+	if target.Port == nil {
+		return *target.Id
+	}
+	return fmt.Sprintf("%s:%d", *target.Id, *target.Port)
+}
+
+func (l LBTargetGroupRegistrationProvider) getExistingLBTargets(ctx context.Context, targetGroupARN *string) ([]*elbv2.TargetHealthDescription, error) {
+	var existingTargets *elbv2.DescribeTargetHealthOutput
+	err := do(ctx, l.retryPolicy, "describe target health", func(ctx context.Context) error {
+		var err error
+		existingTargets, err = l.elb.DescribeTargetHealthWithContext(ctx, &elbv2.DescribeTargetHealthInput{
+			TargetGroupArn: targetGroupARN,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to describe loadbalancer target health: %v", err)
+	}
+
+	return existingTargets.TargetHealthDescriptions, nil
 }
 
 func getTargetGroupARN(targetGroups *elbv2.DescribeTargetGroupsOutput) (*string, error) {
@@ -142,9 +335,14 @@ func getTargetGroupARN(targetGroups *elbv2.DescribeTargetGroupsOutput) (*string,
 	return targetGroups.TargetGroups[0].TargetGroupArn, nil
 }
 
-func contains(instances []cloud.Instance, targetDescription *elbv2.TargetDescription) bool {
-	for _, i := range instances {
-		if i.Endpoint == *targetDescription.Id {
+// containsTarget checks if the existing target is one of the targets, on the same port.
+func containsTarget(targets []*elbv2.TargetDescription, existing *elbv2.TargetDescription, defaultPort int64) bool {
+	for _, target := range targets {
+		port := defaultPort
+		if target.Port != nil {
+			port = *target.Port
+		}
+		if *target.Id == *existing.Id && (existing.Port == nil || port == *existing.Port) {
 			return true
 		}
 	}
@@ -1,8 +1,11 @@
 package aws
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/elbv2"
@@ -80,19 +83,19 @@ var _ = Describe("Loadbalancer Target Group Registration Provider", func() {
 
 	Context("Update()", func() {
 		It("passes when DescribeTargetGroups, DescribeTargetHealth, RegisterTargets and DeRegisterTargets return expected values with instances", func() {
-			Expect(registrationProvider.Update(testInstances)).To(BeNil())
+			Expect(registrationProvider.Update(context.Background(), testInstances)).To(BeNil())
 		})
 
 		It("passes when DescribeTargetGroups, DescribeTargetHealth, RegisterTargets and DeRegisterTargets return expected values with no instances", func() {
 			elbClient.MockRegisterTargets.ExpectedInput.Targets = nil
 			registrationProvider.elb = elbClient
-			Expect(registrationProvider.Update([]cloud.Instance{})).To(BeNil())
+			Expect(registrationProvider.Update(context.Background(), []cloud.Instance{})).To(BeNil())
 		})
 
 		It("fails when DescribeTargetGroups errors", func() {
 			elbClient.MockDescribeTargetGroups.Err = fmt.Errorf("failed to describe target group")
 			registrationProvider.elb = elbClient
-			Expect(registrationProvider.Update(testInstances)).ToNot(BeNil())
+			Expect(registrationProvider.Update(context.Background(), testInstances)).ToNot(BeNil())
 		})
 
 		It("fails when there are more than 1 target groups returned", func() {
@@ -100,7 +103,7 @@ var _ = Describe("Loadbalancer Target Group Registration Provider", func() {
 				TargetGroups: []*elbv2.TargetGroup{{}, {}},
 			}
 			registrationProvider.elb = elbClient
-			Expect(registrationProvider.Update(testInstances)).ToNot(BeNil())
+			Expect(registrationProvider.Update(context.Background(), testInstances)).ToNot(BeNil())
 		})
 
 		It("fails when there are 0 target groups returned", func() {
@@ -108,13 +111,13 @@ var _ = Describe("Loadbalancer Target Group Registration Provider", func() {
 				TargetGroups: []*elbv2.TargetGroup{},
 			}
 			registrationProvider.elb = elbClient
-			Expect(registrationProvider.Update(testInstances)).ToNot(BeNil())
+			Expect(registrationProvider.Update(context.Background(), testInstances)).ToNot(BeNil())
 		})
 
 		It("fails when RegisterTargets errors", func() {
 			elbClient.MockRegisterTargets.Err = fmt.Errorf("failed to register targets")
 			registrationProvider.elb = elbClient
-			Expect(registrationProvider.Update(testInstances)).ToNot(BeNil())
+			Expect(registrationProvider.Update(context.Background(), testInstances)).ToNot(BeNil())
 		})
 
 		It("passes when there are targets to deregister", func() {
@@ -144,7 +147,207 @@ var _ = Describe("Loadbalancer Target Group Registration Provider", func() {
 			elbClient.MockDeregisterTargets.ExpectedInput.Targets = []*elbv2.TargetDescription{staleTarget}
 
 			registrationProvider.elb = elbClient
-			Expect(registrationProvider.Update(testInstances)).To(BeNil())
+			Expect(registrationProvider.Update(context.Background(), testInstances)).To(BeNil())
+		})
+	})
+
+	Context("Update() with target settings", func() {
+		targets := func(port int64, zone string) []*elbv2.TargetDescription {
+			var targets []*elbv2.TargetDescription
+			for _, instance := range testInstances {
+				target := &elbv2.TargetDescription{Id: aws.String(instance.Endpoint)}
+				if port != 0 {
+					target.Port = aws.Int64(port)
+				}
+				if zone != "" {
+					target.AvailabilityZone = aws.String(zone)
+				}
+				targets = append(targets, target)
+			}
+			return targets
+		}
+		existing := func(targets ...*elbv2.TargetDescription) {
+			var descriptions []*elbv2.TargetHealthDescription
+			for _, target := range targets {
+				descriptions = append(descriptions, &elbv2.TargetHealthDescription{Target: target})
+			}
+			elbClient.MockDescribeTargetHealth.DescribeTargetHealthOutput.TargetHealthDescriptions = descriptions
+		}
+
+		It("looks up the target group by ARN", func() {
+			registrationProvider.targetGroupARN = targetGroupARN
+			elbClient.MockDescribeTargetGroups.ExpectedInput = &elbv2.DescribeTargetGroupsInput{
+				TargetGroupArns: []*string{aws.String(targetGroupARN)},
+			}
+			registrationProvider.elb = elbClient
+			Expect(registrationProvider.Update(context.Background(), testInstances)).To(Succeed())
+		})
+
+		It("registers the targets on the configured port in all availability zones", func() {
+			registrationProvider.port = 12379
+			registrationProvider.allZones = true
+			elbClient.MockRegisterTargets.ExpectedInput.Targets = targets(12379, "all")
+			registrationProvider.elb = elbClient
+			Expect(registrationProvider.Update(context.Background(), testInstances)).To(Succeed())
+		})
+
+		It("registers the targets on the instances' client ports", func() {
+			instances := append([]cloud.Instance{}, testInstances...)
+			for i := range instances {
+				instances[i].ClientPort = 22379
+			}
+			elbClient.MockRegisterTargets.ExpectedInput.Targets = targets(22379, "")
+			registrationProvider.elb = elbClient
+			Expect(registrationProvider.Update(context.Background(), instances)).To(Succeed())
+		})
+
+		It("deregisters targets on other ports", func() {
+			registrationProvider.port = 12379
+			elbClient.MockDescribeTargetGroups.DescribeTargetGroupsOutput.TargetGroups[0].Port = aws.Int64(2379)
+			elbClient.MockRegisterTargets.ExpectedInput.Targets = targets(12379, "")
+			oldPort := &elbv2.TargetDescription{Id: aws.String("192.168.0.1"), Port: aws.Int64(2379)}
+			existing(append(targets(12379, ""), oldPort)...)
+			elbClient.MockDeregisterTargets.ExpectedInput.Targets = []*elbv2.TargetDescription{oldPort}
+			registrationProvider.elb = elbClient
+			Expect(registrationProvider.Update(context.Background(), testInstances)).To(Succeed())
+		})
+
+		It("keeps targets registered on the target group's port", func() {
+			elbClient.MockDescribeTargetGroups.DescribeTargetGroupsOutput.TargetGroups[0].Port = aws.Int64(2379)
+			existing(targets(2379, "")...)
+			registrationProvider.elb = elbClient
+			Expect(registrationProvider.Update(context.Background(), testInstances)).To(Succeed())
+		})
+
+		It("waits for the local target to be healthy", func() {
+			registrationProvider.waitForHealthy = time.Minute
+			registrationProvider.localIP = "192.168.0.2"
+			elbClient.MockWaitUntilInService.ExpectedInput = &elbv2.DescribeTargetHealthInput{
+				TargetGroupArn: aws.String(targetGroupARN),
+				Targets:        []*elbv2.TargetDescription{{Id: aws.String("192.168.0.2")}},
+			}
+			registrationProvider.elb = elbClient
+			Expect(registrationProvider.Update(context.Background(), testInstances)).To(Succeed())
+
+			By("Failing if it doesn't become healthy")
+			elbClient.MockWaitUntilInService.Err = fmt.Errorf("exceeded wait attempts")
+			registrationProvider.elb = elbClient
+			Expect(registrationProvider.Update(context.Background(), testInstances)).To(
+				MatchError(ContainSubstring("didn't become healthy")))
+		})
+
+		It("doesn't wait if the local instance isn't a target", func() {
+			registrationProvider.waitForHealthy = time.Minute
+			registrationProvider.localIP = "10.0.0.1"
+			elbClient.MockWaitUntilInService.Err = fmt.Errorf("shouldn't wait")
+			registrationProvider.elb = elbClient
+			Expect(registrationProvider.Update(context.Background(), testInstances)).To(Succeed())
+		})
+	})
+
+	Context("Update() deregistration guards", func() {
+		stale := []*elbv2.TargetDescription{
+			{Id: aws.String("10.0.0.1"), Port: aws.Int64(2379)},
+			{Id: aws.String("10.0.0.2"), Port: aws.Int64(2379)},
+			{Id: aws.String("10.1.0.1"), Port: aws.Int64(2379)},
+			{Id: aws.String("10.0.0.3"), Port: aws.Int64(12379)},
+		}
+		existing := func(targets []*elbv2.TargetDescription, healthy ...*elbv2.TargetDescription) {
+			var descriptions []*elbv2.TargetHealthDescription
+			for _, testInstance := range testInstances {
+				descriptions = append(descriptions, &elbv2.TargetHealthDescription{
+					Target: &elbv2.TargetDescription{Id: aws.String(testInstance.Endpoint), Port: aws.Int64(2379)},
+				})
+			}
+			for _, target := range targets {
+				description := &elbv2.TargetHealthDescription{Target: target}
+				for _, h := range healthy {
+					if h == target {
+						description.TargetHealth = &elbv2.TargetHealth{
+							State: aws.String(elbv2.TargetHealthStateEnumHealthy),
+						}
+					}
+				}
+				descriptions = append(descriptions, description)
+			}
+			elbClient.MockDescribeTargetHealth.DescribeTargetHealthOutput.TargetHealthDescriptions = descriptions
+		}
+		var deregistered bool
+		deregister := func(targets ...*elbv2.TargetDescription) {
+			deregistered = false
+			elbClient.MockDeregisterTargets.ExpectedInput.Targets = targets
+			elbClient.MockDeregisterTargets.Called = &deregistered
+			registrationProvider.elb = elbClient
+		}
+
+		BeforeEach(func() {
+			elbClient.MockDescribeTargetGroups.DescribeTargetGroupsOutput.TargetGroups[0].Port = aws.Int64(2379)
+		})
+
+		It("never deregisters all the targets", func() {
+			elbClient.MockDescribeTargetHealth.DescribeTargetHealthOutput.TargetHealthDescriptions =
+				[]*elbv2.TargetHealthDescription{{Target: stale[0]}, {Target: stale[1]}}
+			deregister()
+			Expect(registrationProvider.Update(context.Background(), testInstances)).To(Succeed())
+			Expect(deregistered).To(BeFalse())
+		})
+
+		It("never deregisters all the targets which existed before the instances were registered", func() {
+			var registered []*elbv2.TargetDescription
+			elbClient.MockRegisterTargets.Registered = &registered
+			elbClient.MockDescribeTargetHealth.Registered = &registered
+			elbClient.MockDescribeTargetHealth.DescribeTargetHealthOutput.TargetHealthDescriptions =
+				[]*elbv2.TargetHealthDescription{{Target: stale[0]}, {Target: stale[1]}}
+			deregister()
+			Expect(registrationProvider.Update(context.Background(), testInstances)).To(Succeed())
+			Expect(deregistered).To(BeFalse())
+			Expect(registered).To(HaveLen(len(testInstances)))
+		})
+
+		It("caps the number of targets deregistered at a time", func() {
+			registrationProvider.maxDeregister = 2
+			existing(stale)
+			deregister(stale[0], stale[1])
+			Expect(registrationProvider.Update(context.Background(), testInstances)).To(Succeed())
+			Expect(deregistered).To(BeTrue())
+		})
+
+		It("doesn't deregister healthy targets unless forced", func() {
+			existing(stale, stale[1], stale[3])
+			deregister(stale[0], stale[2])
+			Expect(registrationProvider.Update(context.Background(), testInstances)).To(Succeed())
+			Expect(deregistered).To(BeTrue())
+
+			By("Deregistering them when forced")
+			registrationProvider.forceDeregister = true
+			deregister(stale...)
+			Expect(registrationProvider.Update(context.Background(), testInstances)).To(Succeed())
+			Expect(deregistered).To(BeTrue())
+		})
+
+		It("only deregisters targets in the managed CIDRs and ports", func() {
+			_, cidr, err := net.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			registrationProvider.managedCIDRs = []*net.IPNet{cidr}
+			registrationProvider.managedPorts = []int{2379}
+			instance := cloud.Instance{Name: "test-instance-id-4", Endpoint: "10.0.0.4"}
+			current := &elbv2.TargetDescription{Id: aws.String(instance.Endpoint)}
+			elbClient.MockRegisterTargets.ExpectedInput.Targets = []*elbv2.TargetDescription{current}
+			existing(append(stale, &elbv2.TargetDescription{Id: aws.String(instance.Endpoint), Port: aws.Int64(2379)}))
+			deregister(stale[0], stale[1])
+			Expect(registrationProvider.Update(context.Background(), []cloud.Instance{instance})).To(Succeed())
+			Expect(deregistered).To(BeTrue())
+		})
+
+		It("doesn't count unmanaged targets when guarding against deregistering all the targets", func() {
+			_, cidr, err := net.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			registrationProvider.managedCIDRs = []*net.IPNet{cidr}
+			elbClient.MockDescribeTargetHealth.DescribeTargetHealthOutput.TargetHealthDescriptions =
+				[]*elbv2.TargetHealthDescription{{Target: stale[0]}, {Target: stale[2]}}
+			deregister()
+			Expect(registrationProvider.Update(context.Background(), testInstances)).To(Succeed())
+			Expect(deregistered).To(BeFalse())
 		})
 	})
 })
@@ -1,96 +1,574 @@
 package aws
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/route53"
 	log "github.com/sirupsen/logrus"
 	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/retry"
 )
 
+const (
+	// defaultTTL is the TTL of the records when none is configured.
+	defaultTTL = 300
+	// Route53 changes usually reach all its name servers within a minute, so this waits up to 5 minutes.
+	syncPollInterval = 5 * time.Second
+	syncPollAttempts = 60
+)
+
+// HealthCheckTypes are the Route53 health check types for each kind of health check, tcp of the client port, and
+// http or https of etcd's /health endpoint.
+var HealthCheckTypes = map[string]string{
+	"tcp":   route53.HealthCheckTypeTcp,
+	"http":  route53.HealthCheckTypeHttpStrMatch,
+	"https": route53.HealthCheckTypeHttpsStrMatch,
+}
+
 // Route53RegistrationProviderConfig contains configuration when creating a default Route53RegistrationProvider
+//
+// The records are A records for IPv4 endpoints and AAAA records for IPv6 endpoints. Instances with hostname
+// endpoints, such as SRV targets, are published as weighted CNAME records instead, one per instance, as a CNAME can
+// only have a single value.
 type Route53RegistrationProviderConfig struct {
 	ZoneID   string
 	Hostname string
+	// TTL of the records in seconds, which defaults to 300.
+	TTL int64
+	// WaitForSync waits for the changes to reach all of Route53's name servers, i.e. to be INSYNC, before Update
+	// returns.
+	WaitForSync bool
+	// NodeRecords also publishes an A or AAAA record for each instance, <name>.<hostname>, along with an RFC1464 TXT
+	// record of its name, which the SRV instance lookup uses. Hostname endpoints are already a name for the
+	// instance, so they don't get node records.
+	NodeRecords bool
+	// SRVRecords also publishes etcd's SRV records for the peer and client ports, targeting the node records,
+	// which are published too, or the hostname endpoints.
+	SRVRecords bool
+	// TLS publishes the SRV records for TLS, _etcd-server-ssl and _etcd-client-ssl, rather than _etcd-server and
+	// _etcd-client.
+	TLS bool
+	// PeerPort and ClientPort are the ports in the SRV records. An instance's own client port takes precedence.
+	PeerPort   int
+	ClientPort int
+	// HealthCheckType, if set, publishes the hostname as multivalue answer or weighted records, one per instance,
+	// each with a Route53 health check of the given type, so Route53 stops answering with instances which fail it. The health
+	// checks are of the client port, and of etcd's /health endpoint for the HTTP_STR_MATCH and HTTPS_STR_MATCH types.
+	HealthCheckType string
+	// RetryPolicy is how calls to AWS are retried.
+	RetryPolicy retry.Policy
 }
 
 // r53 interface to abstract away from AWS commands
 type r53 interface {
-	// GetHostedZone gets information about a given hosted zone from the aws route53 client
-	GetHostedZone(r *route53.GetHostedZoneInput) (*route53.GetHostedZoneOutput, error)
-	// ChangeResourceRecordSets will update a given hosted zone using the aws route53 client
-	ChangeResourceRecordSets(r *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error)
+	// GetHostedZoneWithContext gets information about a given hosted zone from the aws route53 client
+	GetHostedZoneWithContext(ctx aws.Context, r *route53.GetHostedZoneInput, opts ...request.Option) (*route53.GetHostedZoneOutput, error)
+	// ChangeResourceRecordSetsWithContext will update a given hosted zone using the aws route53 client
+	ChangeResourceRecordSetsWithContext(ctx aws.Context, r *route53.ChangeResourceRecordSetsInput, opts ...request.Option) (*route53.ChangeResourceRecordSetsOutput, error)
+	// ListResourceRecordSetsWithContext lists the record sets in a hosted zone using the aws route53 client
+	ListResourceRecordSetsWithContext(ctx aws.Context, r *route53.ListResourceRecordSetsInput, opts ...request.Option) (*route53.ListResourceRecordSetsOutput, error)
+	// CreateHealthCheckWithContext creates a health check using the aws route53 client
+	CreateHealthCheckWithContext(ctx aws.Context, r *route53.CreateHealthCheckInput, opts ...request.Option) (*route53.CreateHealthCheckOutput, error)
+	// DeleteHealthCheckWithContext deletes a health check using the aws route53 client
+	DeleteHealthCheckWithContext(ctx aws.Context, r *route53.DeleteHealthCheckInput, opts ...request.Option) (*route53.DeleteHealthCheckOutput, error)
+	// WaitUntilResourceRecordSetsChangedWithContext waits for a change to be INSYNC using the aws route53 client
+	WaitUntilResourceRecordSetsChangedWithContext(ctx aws.Context, r *route53.GetChangeInput, opts ...request.WaiterOption) error
 }
 
 // Route53RegistrationProvider contains an aws route53 client and information about the desired hosted zone the user
 // wants to update
 type Route53RegistrationProvider struct {
-	zoneID   string
-	hostname string
-	r53      r53
+	zoneID      string
+	hostname    string
+	ttl         int64
+	waitForSync bool
+	nodeRecords bool
+	srvRecords  bool
+	tls         bool
+	peerPort    int
+	clientPort  int
+	healthCheck string
+	r53         r53
+	retryPolicy retry.Policy
 }
 
 // NewRoute53RegistrationProvider returns a default Route53RegistrationProvider and initiates an new aws route53 client
-func NewRoute53RegistrationProvider(c *Route53RegistrationProviderConfig) (*Route53RegistrationProvider, error) {
+func NewRoute53RegistrationProvider(ctx context.Context, c *Route53RegistrationProviderConfig) (*Route53RegistrationProvider, error) {
 	awsSession, err := session.NewSession()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create new AWS session: %v", err)
 	}
 
-	meta := ec2metadata.New(awsSession)
-	identityDoc, err := meta.GetInstanceIdentityDocument()
+	identityDoc, err := getIdentityDoc(ctx, c.RetryPolicy, awsSession)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get AWS local instance data: %v", err)
+		return nil, err
 	}
 	config := &aws.Config{Region: aws.String(identityDoc.Region)}
 	r53Client := route53.New(awsSession, config)
 
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = defaultTTL
+	}
+
 	return &Route53RegistrationProvider{
-		zoneID:   c.ZoneID,
-		hostname: c.Hostname,
-		r53:      r53Client,
+		zoneID:      c.ZoneID,
+		hostname:    c.Hostname,
+		ttl:         ttl,
+		waitForSync: c.WaitForSync,
+		nodeRecords: c.NodeRecords || c.SRVRecords,
+		srvRecords:  c.SRVRecords,
+		tls:         c.TLS,
+		peerPort:    c.PeerPort,
+		clientPort:  c.ClientPort,
+		healthCheck: c.HealthCheckType,
+		r53:         r53Client,
+		retryPolicy: c.RetryPolicy,
 	}, nil
 }
 
-// Update will update the specified hostname in the route53 zone with discovered etcd ip addresses
-func (r Route53RegistrationProvider) Update(instances []cloud.Instance) error {
+// Update will update the specified hostname in the route53 zone with discovered etcd ip addresses, along with the
+// node and SRV records if enabled. All the records are changed in a single batch, which Route53 applies atomically.
+func (r Route53RegistrationProvider) Update(ctx context.Context, instances []cloud.Instance) error {
 	zoneInput := &route53.GetHostedZoneInput{Id: aws.String(r.zoneID)}
-	zone, err := r.r53.GetHostedZone(zoneInput)
+	var zone *route53.GetHostedZoneOutput
+	err := do(ctx, r.retryPolicy, "get hosted zone "+r.zoneID, func(ctx context.Context) error {
+		var err error
+		zone, err = r.r53.GetHostedZoneWithContext(ctx, zoneInput)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("unable to retrieve hosted zone - are you sure it exists?: %v", err)
 	}
 
-	fqdn := r.hostname + "." + *zone.HostedZone.Name
+	// Route53 names are lower case, so the existing records can be compared with it.
+	fqdn := strings.ToLower(r.hostname + "." + *zone.HostedZone.Name)
 
 	var resourceRecords []*route53.ResourceRecord
+	recordsByType := make(map[string][]*route53.ResourceRecord)
 	for _, instance := range instances {
-		resourceRecords = append(resourceRecords, &route53.ResourceRecord{Value: aws.String(instance.Endpoint)})
+		record := &route53.ResourceRecord{Value: aws.String(instance.Endpoint)}
+		resourceRecords = append(resourceRecords, record)
+		recordType := recordType(instance.Endpoint)
+		recordsByType[recordType] = append(recordsByType[recordType], record)
 	}
+	hostnames := len(recordsByType[route53.RRTypeCname]) > 0
+	if hostnames && len(recordsByType[route53.RRTypeCname]) < len(instances) {
+		return fmt.Errorf("instance endpoints must either all be IP addresses or all be hostnames, but were %v",
+			resourceRecords)
+	}
+	perInstance := r.healthCheck != "" || hostnames
 
-	change := &route53.Change{
-		Action: aws.String(route53.ChangeActionUpsert),
-		ResourceRecordSet: &route53.ResourceRecordSet{
-			Name: aws.String(fqdn),
-			Type: aws.String(route53.RRTypeA),
-			// Completely arbitrary amount that is not too long or too short.
-			TTL:             aws.Int64(300),
-			ResourceRecords: resourceRecords,
-		},
+	existing, err := r.listRecordSets(ctx, *zone.HostedZone.Id, fqdn)
+	if err != nil {
+		return err
+	}
+
+	var changes []*route53.Change
+	var created, unused []string
+	if perInstance {
+		if changes, created, unused, err = r.perInstanceChanges(ctx, fqdn, instances, existing); err != nil {
+			r.deleteHealthChecks(ctx, created)
+			return err
+		}
+	} else {
+		changes, unused = r.simpleChanges(fqdn, recordsByType, existing)
+	}
+	clusterChanges := len(changes)
+	if r.nodeRecords {
+		changes = append(changes, r.nodeRecordChanges(fqdn, instances, existing)...)
+	}
+	if r.srvRecords && len(instances) > 0 {
+		changes = append(changes, r.srvRecordChanges(fqdn, instances)...)
 	}
 
 	changeInput := &route53.ChangeResourceRecordSetsInput{
 		HostedZoneId: zone.HostedZone.Id,
-		ChangeBatch:  &route53.ChangeBatch{Changes: []*route53.Change{change}},
+		ChangeBatch:  &route53.ChangeBatch{Changes: changes},
 	}
 
-	if _, err := r.r53.ChangeResourceRecordSets(changeInput); err != nil {
+	// An upsert of the whole record set can safely be repeated.
+	var changeOutput *route53.ChangeResourceRecordSetsOutput
+	err = do(ctx, r.retryPolicy, "change resource record set "+fqdn, func(ctx context.Context) error {
+		var err error
+		changeOutput, err = r.r53.ChangeResourceRecordSetsWithContext(ctx, changeInput)
+		return err
+	})
+	if err != nil {
+		r.deleteHealthChecks(ctx, created)
 		return fmt.Errorf("unable to change resource record set: %v", err)
 	}
 
+	if r.waitForSync {
+		changeID := changeOutput.ChangeInfo.Id
+		log.Infof("Waiting for change %s to reach all Route53 name servers", *changeID)
+		err = r.r53.WaitUntilResourceRecordSetsChangedWithContext(ctx, &route53.GetChangeInput{Id: changeID},
+			request.WithWaiterDelay(request.ConstantWaiterDelay(syncPollInterval)),
+			request.WithWaiterMaxAttempts(syncPollAttempts))
+		if err != nil {
+			return fmt.Errorf("change %s to %q didn't reach INSYNC: %v", *changeID, fqdn, err)
+		}
+	}
+
 	log.Infof("Successfully set %q to %v", fqdn, resourceRecords)
+	if len(changes) > clusterChanges {
+		log.Infof("Successfully changed %d node and SRV record sets under %q", len(changes)-clusterChanges, fqdn)
+	}
+	// Health checks can only be deleted once no records use them.
+	r.deleteHealthChecks(ctx, unused)
 
 	return nil
 }
+
+// simpleChanges upserts a simple A record of the IPv4 addresses and AAAA record of the IPv6 addresses, and deletes
+// the simple records of a type which is no longer used, along with any records per instance which previously held
+// them. It returns the IDs of the health checks which are no longer used after the changes.
+func (r Route53RegistrationProvider) simpleChanges(fqdn string, recordsByType map[string][]*route53.ResourceRecord,
+	existing []*route53.ResourceRecordSet) (changes []*route53.Change, unused []string) {
+	ipv4, ipv6 := recordsByType[route53.RRTypeA], recordsByType[route53.RRTypeAaaa]
+	published := map[string]bool{
+		route53.RRTypeA:    len(ipv4) > 0 || len(ipv6) == 0,
+		route53.RRTypeAaaa: len(ipv6) > 0,
+	}
+	replacing := false
+	for _, recordSet := range existing {
+		if strings.ToLower(*recordSet.Name) != fqdn || !isAddressType(*recordSet.Type) {
+			continue
+		}
+		if recordSet.SetIdentifier != nil {
+			// Route53 doesn't allow simple and multivalue answer or weighted records with the same name.
+			replacing = true
+			changes = append(changes, deleteRecordSet(recordSet))
+			if recordSet.HealthCheckId != nil {
+				unused = append(unused, *recordSet.HealthCheckId)
+			}
+			continue
+		}
+		if !published[*recordSet.Type] {
+			log.Infof("Deleting the %s record %q, as no instances have an address of that type", *recordSet.Type, fqdn)
+			changes = append(changes, deleteRecordSet(recordSet))
+		}
+	}
+	if replacing {
+		log.Infof("Replacing the records per instance of %q with a single record", fqdn)
+	}
+
+	if published[route53.RRTypeA] {
+		changes = append(changes, r.upsert(fqdn, route53.RRTypeA, ipv4))
+	}
+	if published[route53.RRTypeAaaa] {
+		changes = append(changes, r.upsert(fqdn, route53.RRTypeAaaa, ipv6))
+	}
+	return changes, unused
+}
+
+// perInstanceChanges upserts a record for each instance, with its own health check if enabled, and deletes the
+// records of instances which have gone, along with any simple record which previously held all the instances. The
+// records are multivalue answer records for IP addresses, and equally weighted CNAME records for hostnames. It
+// returns the IDs of the health checks it created, and of those which are no longer used after the changes.
+func (r Route53RegistrationProvider) perInstanceChanges(ctx context.Context, fqdn string, instances []cloud.Instance,
+	existing []*route53.ResourceRecordSet) (changes []*route53.Change, created, unused []string, err error) {
+	current := make(map[string]*route53.ResourceRecordSet)
+	for _, recordSet := range existing {
+		if strings.ToLower(*recordSet.Name) != fqdn || !isAddressType(*recordSet.Type) {
+			continue
+		}
+		if recordSet.SetIdentifier == nil {
+			// Route53 doesn't allow simple and multivalue answer or weighted records with the same name.
+			log.Infof("Replacing the %s record %q with a record per instance", *recordSet.Type, fqdn)
+			changes = append(changes, deleteRecordSet(recordSet))
+			continue
+		}
+		current[*recordSet.SetIdentifier+"/"+*recordSet.Type] = recordSet
+	}
+
+	var upserts []*route53.Change
+	published := make(map[string]bool)
+	for _, instance := range instances {
+		recordType := recordType(instance.Endpoint)
+		key := instance.Name + "/" + recordType
+		published[key] = true
+		recordSet := current[key]
+		var healthCheckID *string
+		if r.healthCheck != "" {
+			if recordSet != nil && recordSet.HealthCheckId != nil && len(recordSet.ResourceRecords) == 1 &&
+				aws.StringValue(recordSet.ResourceRecords[0].Value) == instance.Endpoint {
+				healthCheckID = recordSet.HealthCheckId
+			} else {
+				id, err := r.createHealthCheck(ctx, instance)
+				if err != nil {
+					return nil, created, nil, err
+				}
+				created = append(created, id)
+				healthCheckID = aws.String(id)
+			}
+		}
+		if recordSet != nil && recordSet.HealthCheckId != nil &&
+			aws.StringValue(healthCheckID) != *recordSet.HealthCheckId {
+			unused = append(unused, *recordSet.HealthCheckId)
+		}
+
+		upsert := r.upsert(fqdn, recordType, []*route53.ResourceRecord{{Value: aws.String(instance.Endpoint)}})
+		upsert.ResourceRecordSet.SetIdentifier = aws.String(instance.Name)
+		upsert.ResourceRecordSet.HealthCheckId = healthCheckID
+		if recordType == route53.RRTypeCname {
+			upsert.ResourceRecordSet.Weight = aws.Int64(1)
+		} else {
+			upsert.ResourceRecordSet.MultiValueAnswer = aws.Bool(true)
+		}
+		upserts = append(upserts, upsert)
+	}
+
+	for _, recordSet := range existing {
+		if recordSet.SetIdentifier == nil {
+			continue
+		}
+		key := *recordSet.SetIdentifier + "/" + *recordSet.Type
+		if current[key] == recordSet && !published[key] {
+			log.Infof("Removing the %s record of %s, as the instance has gone or changed", *recordSet.Type,
+				*recordSet.SetIdentifier)
+			changes = append(changes, deleteRecordSet(recordSet))
+			if recordSet.HealthCheckId != nil {
+				unused = append(unused, *recordSet.HealthCheckId)
+			}
+		}
+	}
+	return append(changes, upserts...), created, unused, nil
+}
+
+// createHealthCheck creates a health check of the instance's client port.
+func (r Route53RegistrationProvider) createHealthCheck(ctx context.Context, instance cloud.Instance) (string, error) {
+	port := r.clientPort
+	if instance.ClientPort != 0 {
+		port = instance.ClientPort
+	}
+	config := &route53.HealthCheckConfig{
+		Port: aws.Int64(int64(port)),
+		Type: aws.String(r.healthCheck),
+	}
+	if recordType(instance.Endpoint) == route53.RRTypeCname {
+		config.FullyQualifiedDomainName = aws.String(instance.Endpoint)
+	} else {
+		config.IPAddress = aws.String(instance.Endpoint)
+	}
+	if r.healthCheck == route53.HealthCheckTypeHttpStrMatch || r.healthCheck == route53.HealthCheckTypeHttpsStrMatch {
+		config.ResourcePath = aws.String("/health")
+		config.SearchString = aws.String(`"health":"true"`)
+	}
+	// The caller reference makes retries idempotent, so it's the same for every attempt.
+	input := &route53.CreateHealthCheckInput{
+		CallerReference:   aws.String(fmt.Sprintf("etcd-bootstrap-%s-%d", instance.Endpoint, time.Now().UnixNano())),
+		HealthCheckConfig: config,
+	}
+	var output *route53.CreateHealthCheckOutput
+	err := do(ctx, r.retryPolicy, "create health check for "+instance.Endpoint, func(ctx context.Context) error {
+		var err error
+		output, err = r.r53.CreateHealthCheckWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to create health check for %s: %v", instance.Name, err)
+	}
+	log.Infof("Created health check %s for %s (%s:%d)", *output.HealthCheck.Id, instance.Name, instance.Endpoint,
+		port)
+	return *output.HealthCheck.Id, nil
+}
+
+// deleteHealthChecks deletes the health checks, logging rather than failing if they can't be, as they're no longer
+// used.
+func (r Route53RegistrationProvider) deleteHealthChecks(ctx context.Context, ids []string) {
+	for _, id := range ids {
+		input := &route53.DeleteHealthCheckInput{HealthCheckId: aws.String(id)}
+		err := do(ctx, r.retryPolicy, "delete health check "+id, func(ctx context.Context) error {
+			_, err := r.r53.DeleteHealthCheckWithContext(ctx, input)
+			var awsErr awserr.Error
+			if errors.As(err, &awsErr) && awsErr.Code() == route53.ErrCodeNoSuchHealthCheck {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			log.Warnf("Unable to delete unused health check %s: %v", id, err)
+			continue
+		}
+		log.Infof("Deleted unused health check %s", id)
+	}
+}
+
+// nodeRecordChanges upserts the A or AAAA, and TXT records of each instance with an IP endpoint, and deletes those
+// of instances which have gone or changed.
+func (r Route53RegistrationProvider) nodeRecordChanges(fqdn string, instances []cloud.Instance,
+	existing []*route53.ResourceRecordSet) []*route53.Change {
+	var changes []*route53.Change
+	current := make(map[string]bool)
+	for _, instance := range instances {
+		recordType := recordType(instance.Endpoint)
+		if recordType == route53.RRTypeCname {
+			continue
+		}
+		name := nodeName(instance, fqdn)
+		current[name+"/"+recordType] = true
+		current[name+"/"+route53.RRTypeTxt] = true
+		changes = append(changes,
+			r.upsert(name, recordType, []*route53.ResourceRecord{{Value: aws.String(instance.Endpoint)}}),
+			r.upsert(name, route53.RRTypeTxt, []*route53.ResourceRecord{{Value: aws.String(txtName(instance.Name))}}))
+	}
+
+	for _, recordSet := range nodeRecords(fqdn, existing) {
+		if !current[*recordSet.Name+"/"+*recordSet.Type] {
+			log.Infof("Removing %s record %q, as the instance has gone", *recordSet.Type, *recordSet.Name)
+			changes = append(changes, deleteRecordSet(recordSet))
+		}
+	}
+	return changes
+}
+
+// listRecordSets returns the record sets of the fqdn and the names under it.
+func (r Route53RegistrationProvider) listRecordSets(ctx context.Context, zoneID, fqdn string) (
+	[]*route53.ResourceRecordSet, error) {
+	var recordSets []*route53.ResourceRecordSet
+	input := &route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(zoneID),
+		StartRecordName: aws.String(fqdn),
+	}
+	// Record sets are listed in order with the labels reversed, so the names under the fqdn come straight after it.
+	for {
+		var output *route53.ListResourceRecordSetsOutput
+		err := do(ctx, r.retryPolicy, "list resource record sets under "+fqdn, func(ctx context.Context) error {
+			var err error
+			output, err = r.r53.ListResourceRecordSetsWithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to list resource record sets: %v", err)
+		}
+		done := false
+		for _, recordSet := range output.ResourceRecordSets {
+			name := strings.ToLower(*recordSet.Name)
+			if name != fqdn && !strings.HasSuffix(name, "."+fqdn) {
+				done = true
+				break
+			}
+			recordSets = append(recordSets, recordSet)
+		}
+		if done || !aws.BoolValue(output.IsTruncated) {
+			break
+		}
+		input.StartRecordName = output.NextRecordName
+		input.StartRecordType = output.NextRecordType
+		input.StartRecordIdentifier = output.NextRecordIdentifier
+	}
+	return recordSets, nil
+}
+
+// nodeRecords returns the A, AAAA and TXT record sets of the node records under the fqdn. Only names directly under the
+// fqdn with an RFC1464 name TXT record are node records, so other records are left alone.
+func nodeRecords(fqdn string, recordSets []*route53.ResourceRecordSet) []*route53.ResourceRecordSet {
+	nodes := make(map[string]bool)
+	for _, recordSet := range recordSets {
+		if isNodeName(*recordSet.Name, fqdn) && *recordSet.Type == route53.RRTypeTxt {
+			for _, record := range recordSet.ResourceRecords {
+				if strings.HasPrefix(aws.StringValue(record.Value), `"name=`) {
+					nodes[*recordSet.Name] = true
+				}
+			}
+		}
+	}
+	var records []*route53.ResourceRecordSet
+	for _, recordSet := range recordSets {
+		if nodes[*recordSet.Name] && (*recordSet.Type == route53.RRTypeA || *recordSet.Type == route53.RRTypeAaaa ||
+			*recordSet.Type == route53.RRTypeTxt) {
+			records = append(records, recordSet)
+		}
+	}
+	return records
+}
+
+// srvRecordChanges upserts etcd's SRV records for the peer and client ports, targeting the node records, or the
+// instances' hostnames.
+func (r Route53RegistrationProvider) srvRecordChanges(fqdn string, instances []cloud.Instance) []*route53.Change {
+	server, client := "_etcd-server._tcp.", "_etcd-client._tcp."
+	if r.tls {
+		server, client = "_etcd-server-ssl._tcp.", "_etcd-client-ssl._tcp."
+	}
+	var serverRecords, clientRecords []*route53.ResourceRecord
+	for _, instance := range instances {
+		target := nodeName(instance, fqdn)
+		if recordType(instance.Endpoint) == route53.RRTypeCname {
+			target = instance.Endpoint
+		}
+		clientPort := r.clientPort
+		if instance.ClientPort != 0 {
+			clientPort = instance.ClientPort
+		}
+		serverRecords = append(serverRecords, &route53.ResourceRecord{
+			Value: aws.String(fmt.Sprintf("0 0 %d %s", r.peerPort, target)),
+		})
+		clientRecords = append(clientRecords, &route53.ResourceRecord{
+			Value: aws.String(fmt.Sprintf("0 0 %d %s", clientPort, target)),
+		})
+	}
+	return []*route53.Change{
+		r.upsert(server+fqdn, route53.RRTypeSrv, serverRecords),
+		r.upsert(client+fqdn, route53.RRTypeSrv, clientRecords),
+	}
+}
+
+func deleteRecordSet(recordSet *route53.ResourceRecordSet) *route53.Change {
+	return &route53.Change{Action: aws.String(route53.ChangeActionDelete), ResourceRecordSet: recordSet}
+}
+
+func (r Route53RegistrationProvider) upsert(name, recordType string, records []*route53.ResourceRecord) *route53.Change {
+	return &route53.Change{
+		Action: aws.String(route53.ChangeActionUpsert),
+		ResourceRecordSet: &route53.ResourceRecordSet{
+			Name:            aws.String(name),
+			Type:            aws.String(recordType),
+			TTL:             aws.Int64(r.ttl),
+			ResourceRecords: records,
+		},
+	}
+}
+
+// recordType is the type of record for the endpoint, A for an IPv4 address, AAAA for an IPv6 address, otherwise
+// CNAME for a hostname.
+func recordType(endpoint string) string {
+	ip := net.ParseIP(endpoint)
+	switch {
+	case ip == nil:
+		return route53.RRTypeCname
+	case ip.To4() != nil:
+		return route53.RRTypeA
+	default:
+		return route53.RRTypeAaaa
+	}
+}
+
+func isAddressType(recordType string) bool {
+	return recordType == route53.RRTypeA || recordType == route53.RRTypeAaaa || recordType == route53.RRTypeCname
+}
+
+// nodeName is the instance's node record. Route53 names are lower case.
+func nodeName(instance cloud.Instance, fqdn string) string {
+	return strings.ToLower(instance.Name) + "." + fqdn
+}
+
+// isNodeName checks if the name is a single label directly under the fqdn.
+func isNodeName(name, fqdn string) bool {
+	label := strings.TrimSuffix(strings.ToLower(name), "."+fqdn)
+	return label != strings.ToLower(name) && label != "" && !strings.Contains(label, ".")
+}
+
+// txtName is the RFC1464 TXT record of the instance's name. Route53 requires TXT values to be quoted.
+func txtName(name string) string {
+	return fmt.Sprintf("%q", "name="+name)
+}
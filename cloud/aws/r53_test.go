@@ -1,6 +1,7 @@
 package aws
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
@@ -69,17 +70,25 @@ var _ = Describe("Route53 Registration Provider", func() {
 					HostedZoneId: aws.String(hostedZoneID),
 				},
 			},
+			MockListResourceRecordSets: mock.ListResourceRecordSets{
+				ExpectedInput: &route53.ListResourceRecordSetsInput{
+					HostedZoneId:    aws.String(hostedZoneID),
+					StartRecordName: aws.String(fmt.Sprintf("%v.%v", hostname, hostedZoneName)),
+				},
+				Outputs: []*route53.ListResourceRecordSetsOutput{{}},
+			},
 		}
 		registrationProvider = Route53RegistrationProvider{
 			zoneID:   hostedZoneID,
 			hostname: hostname,
+			ttl:      300,
 			r53:      r53Client,
 		}
 	})
 
 	Context("Update()", func() {
 		It("passes when DescribeTargetGroups and RegisterTargets return expected values with instances", func() {
-			Expect(registrationProvider.Update(testInstances)).To(BeNil())
+			Expect(registrationProvider.Update(context.Background(), testInstances)).To(BeNil())
 		})
 
 		It("passes when GetHostedZone and ChangeResourceRecordSets return expected values with no instances", func() {
@@ -93,19 +102,427 @@ var _ = Describe("Route53 Registration Provider", func() {
 					},
 				},
 			}
-			Expect(registrationProvider.Update([]cloud.Instance{})).To(BeNil())
+			Expect(registrationProvider.Update(context.Background(), []cloud.Instance{})).To(BeNil())
 		})
 
 		It("fails when GetHostedZone returns an error", func() {
 			r53Client.MockGetHostedZone.Err = fmt.Errorf("failed to get hosted zones")
 			registrationProvider.r53 = r53Client
-			Expect(registrationProvider.Update(testInstances))
+			Expect(registrationProvider.Update(context.Background(), testInstances))
 		})
 
 		It("fails when ChangeResourceRecordSets returns an error", func() {
 			r53Client.MockChangeResourceRecordSets.Err = fmt.Errorf("failed to get change resource record set")
 			registrationProvider.r53 = r53Client
-			Expect(registrationProvider.Update(testInstances))
+			Expect(registrationProvider.Update(context.Background(), testInstances))
+		})
+	})
+
+	Context("Update() with node and SRV records", func() {
+		fqdn := fmt.Sprintf("%v.%v", hostname, hostedZoneName)
+
+		recordSet := func(name, recordType string, values ...string) *route53.ResourceRecordSet {
+			var records []*route53.ResourceRecord
+			for _, value := range values {
+				records = append(records, &route53.ResourceRecord{Value: aws.String(value)})
+			}
+			return &route53.ResourceRecordSet{
+				Name:            aws.String(name),
+				Type:            aws.String(recordType),
+				TTL:             aws.Int64(300),
+				ResourceRecords: records,
+			}
+		}
+		change := func(action string, recordSet *route53.ResourceRecordSet) *route53.Change {
+			return &route53.Change{Action: aws.String(action), ResourceRecordSet: recordSet}
+		}
+		nodeChanges := func() []*route53.Change {
+			var changes []*route53.Change
+			for _, instance := range testInstances {
+				name := instance.Name + "." + fqdn
+				changes = append(changes,
+					change(route53.ChangeActionUpsert, recordSet(name, route53.RRTypeA, instance.Endpoint)),
+					change(route53.ChangeActionUpsert,
+						recordSet(name, route53.RRTypeTxt, fmt.Sprintf(`"name=%s"`, instance.Name))))
+			}
+			return changes
+		}
+
+		BeforeEach(func() {
+			r53Client.MockListResourceRecordSets = mock.ListResourceRecordSets{
+				ExpectedInput: &route53.ListResourceRecordSetsInput{
+					HostedZoneId:    aws.String(hostedZoneID),
+					StartRecordName: aws.String(fqdn),
+				},
+				Outputs: []*route53.ListResourceRecordSetsOutput{{}},
+			}
+			registrationProvider.nodeRecords = true
+			registrationProvider.peerPort = 2380
+			registrationProvider.clientPort = 2379
+		})
+
+		update := func(instances []cloud.Instance, changes ...*route53.Change) error {
+			r53Client.MockChangeResourceRecordSets.ExpectedInput.ChangeBatch.Changes = append(
+				r53Client.MockChangeResourceRecordSets.ExpectedInput.ChangeBatch.Changes, changes...)
+			registrationProvider.r53 = r53Client
+			return registrationProvider.Update(context.Background(), instances)
+		}
+
+		It("publishes an A and a name TXT record for each instance", func() {
+			Expect(update(testInstances, nodeChanges()...)).To(Succeed())
+		})
+
+		It("deletes the node records of instances which have gone, leaving other records alone", func() {
+			goneA := recordSet("test-instance-id-4."+fqdn, route53.RRTypeA, "192.168.0.4")
+			goneTXT := recordSet("test-instance-id-4."+fqdn, route53.RRTypeTxt, `"name=test-instance-id-4"`)
+			r53Client.MockListResourceRecordSets.Outputs = []*route53.ListResourceRecordSetsOutput{
+				{
+					ResourceRecordSets: []*route53.ResourceRecordSet{
+						recordSet(fqdn, route53.RRTypeA, "192.168.0.1"),
+						recordSet("other."+fqdn, route53.RRTypeA, "10.0.0.1"),
+						recordSet("test-instance-id-1."+fqdn, route53.RRTypeA, "192.168.0.1"),
+						recordSet("test-instance-id-1."+fqdn, route53.RRTypeTxt, `"name=test-instance-id-1"`),
+					},
+					IsTruncated:    aws.Bool(true),
+					NextRecordName: aws.String("test-instance-id-4." + fqdn),
+					NextRecordType: aws.String(route53.RRTypeA),
+				},
+				{
+					ResourceRecordSets: []*route53.ResourceRecordSet{
+						goneA,
+						goneTXT,
+						recordSet("unrelated."+hostedZoneName, route53.RRTypeTxt, `"name=unrelated"`),
+					},
+					IsTruncated:    aws.Bool(true),
+					NextRecordName: aws.String("zzz." + hostedZoneName),
+					NextRecordType: aws.String(route53.RRTypeA),
+				},
+			}
+			changes := append(nodeChanges(),
+				change(route53.ChangeActionDelete, goneA),
+				change(route53.ChangeActionDelete, goneTXT))
+			Expect(update(testInstances, changes...)).To(Succeed())
+		})
+
+		It("publishes SRV records targeting the node records", func() {
+			registrationProvider.srvRecords = true
+			instances := append([]cloud.Instance{}, testInstances...)
+			instances[2].ClientPort = 12379
+			changes := append(nodeChanges(),
+				change(route53.ChangeActionUpsert, recordSet("_etcd-server._tcp."+fqdn, route53.RRTypeSrv,
+					"0 0 2380 test-instance-id-1."+fqdn,
+					"0 0 2380 test-instance-id-2."+fqdn,
+					"0 0 2380 test-instance-id-3."+fqdn)),
+				change(route53.ChangeActionUpsert, recordSet("_etcd-client._tcp."+fqdn, route53.RRTypeSrv,
+					"0 0 2379 test-instance-id-1."+fqdn,
+					"0 0 2379 test-instance-id-2."+fqdn,
+					"0 0 12379 test-instance-id-3."+fqdn)))
+			Expect(update(instances, changes...)).To(Succeed())
+		})
+
+		It("publishes the TLS SRV records when TLS is enabled", func() {
+			registrationProvider.srvRecords = true
+			registrationProvider.tls = true
+			changes := append(nodeChanges(),
+				change(route53.ChangeActionUpsert, recordSet("_etcd-server-ssl._tcp."+fqdn, route53.RRTypeSrv,
+					"0 0 2380 test-instance-id-1."+fqdn,
+					"0 0 2380 test-instance-id-2."+fqdn,
+					"0 0 2380 test-instance-id-3."+fqdn)),
+				change(route53.ChangeActionUpsert, recordSet("_etcd-client-ssl._tcp."+fqdn, route53.RRTypeSrv,
+					"0 0 2379 test-instance-id-1."+fqdn,
+					"0 0 2379 test-instance-id-2."+fqdn,
+					"0 0 2379 test-instance-id-3."+fqdn)))
+			Expect(update(testInstances, changes...)).To(Succeed())
+		})
+
+		It("fails without changing any records when listing them fails", func() {
+			r53Client.MockListResourceRecordSets.Err = fmt.Errorf("failed to list resource record sets")
+			r53Client.MockChangeResourceRecordSets.Err = fmt.Errorf("records shouldn't be changed")
+			registrationProvider.r53 = r53Client
+			Expect(registrationProvider.Update(context.Background(), testInstances)).To(
+				MatchError(ContainSubstring("failed to list resource record sets")))
+		})
+	})
+
+	Context("Update() with health checks", func() {
+		fqdn := fmt.Sprintf("%v.%v", hostname, hostedZoneName)
+		var deleted []string
+
+		multiValue := func(instance cloud.Instance, healthCheckID string) *route53.ResourceRecordSet {
+			return &route53.ResourceRecordSet{
+				Name:             aws.String(fqdn),
+				Type:             aws.String(route53.RRTypeA),
+				SetIdentifier:    aws.String(instance.Name),
+				MultiValueAnswer: aws.Bool(true),
+				TTL:              aws.Int64(300),
+				HealthCheckId:    aws.String(healthCheckID),
+				ResourceRecords:  []*route53.ResourceRecord{{Value: aws.String(instance.Endpoint)}},
+			}
+		}
+		change := func(action string, recordSet *route53.ResourceRecordSet) *route53.Change {
+			return &route53.Change{Action: aws.String(action), ResourceRecordSet: recordSet}
+		}
+
+		BeforeEach(func() {
+			deleted = nil
+			configs := make(map[string]*route53.HealthCheckConfig)
+			ids := make(map[string]string)
+			for i, instance := range testInstances {
+				configs[instance.Endpoint] = &route53.HealthCheckConfig{
+					IPAddress:    aws.String(instance.Endpoint),
+					Port:         aws.Int64(2379),
+					Type:         aws.String(route53.HealthCheckTypeHttpStrMatch),
+					ResourcePath: aws.String("/health"),
+					SearchString: aws.String(`"health":"true"`),
+				}
+				ids[instance.Endpoint] = fmt.Sprintf("new-health-check-%d", i+1)
+			}
+			r53Client.MockCreateHealthCheck = mock.CreateHealthCheck{ExpectedConfigs: configs, IDs: ids}
+			r53Client.MockDeleteHealthCheck = mock.DeleteHealthCheck{Deleted: &deleted}
+			r53Client.MockListResourceRecordSets = mock.ListResourceRecordSets{
+				ExpectedInput: &route53.ListResourceRecordSetsInput{
+					HostedZoneId:    aws.String(hostedZoneID),
+					StartRecordName: aws.String(fqdn),
+				},
+				Outputs: []*route53.ListResourceRecordSetsOutput{{}},
+			}
+			registrationProvider.healthCheck = route53.HealthCheckTypeHttpStrMatch
+			registrationProvider.clientPort = 2379
+		})
+
+		update := func(changes ...*route53.Change) error {
+			r53Client.MockChangeResourceRecordSets.ExpectedInput.ChangeBatch.Changes = changes
+			registrationProvider.r53 = r53Client
+			return registrationProvider.Update(context.Background(), testInstances)
+		}
+
+		It("publishes a multivalue answer record with a health check for each instance", func() {
+			Expect(update(
+				change(route53.ChangeActionUpsert, multiValue(testInstances[0], "new-health-check-1")),
+				change(route53.ChangeActionUpsert, multiValue(testInstances[1], "new-health-check-2")),
+				change(route53.ChangeActionUpsert, multiValue(testInstances[2], "new-health-check-3")),
+			)).To(Succeed())
+			Expect(deleted).To(BeEmpty())
+		})
+
+		It("reuses health checks, and replaces the simple record and the records of instances which have gone", func() {
+			simple := &route53.ResourceRecordSet{
+				Name:            aws.String(fqdn),
+				Type:            aws.String(route53.RRTypeA),
+				TTL:             aws.Int64(300),
+				ResourceRecords: []*route53.ResourceRecord{{Value: aws.String("192.168.0.1")}},
+			}
+			moved := multiValue(cloud.Instance{Name: "test-instance-id-2", Endpoint: "192.168.0.20"}, "old-2")
+			gone := multiValue(cloud.Instance{Name: "test-instance-id-4", Endpoint: "192.168.0.4"}, "old-4")
+			r53Client.MockListResourceRecordSets.Outputs[0].ResourceRecordSets = []*route53.ResourceRecordSet{
+				simple,
+				multiValue(testInstances[0], "old-1"),
+				moved,
+				gone,
+			}
+
+			Expect(update(
+				change(route53.ChangeActionDelete, simple),
+				change(route53.ChangeActionDelete, gone),
+				change(route53.ChangeActionUpsert, multiValue(testInstances[0], "old-1")),
+				change(route53.ChangeActionUpsert, multiValue(testInstances[1], "new-health-check-2")),
+				change(route53.ChangeActionUpsert, multiValue(testInstances[2], "new-health-check-3")),
+			)).To(Succeed())
+			Expect(deleted).To(Equal([]string{"old-2", "old-4"}))
+		})
+
+		It("uses TCP health checks of the instance's client port", func() {
+			registrationProvider.healthCheck = route53.HealthCheckTypeTcp
+			instance := cloud.Instance{Name: "test-instance-id-1", Endpoint: "192.168.0.1", ClientPort: 12379}
+			r53Client.MockCreateHealthCheck.ExpectedConfigs[instance.Endpoint] = &route53.HealthCheckConfig{
+				IPAddress: aws.String(instance.Endpoint),
+				Port:      aws.Int64(12379),
+				Type:      aws.String(route53.HealthCheckTypeTcp),
+			}
+			r53Client.MockChangeResourceRecordSets.ExpectedInput.ChangeBatch.Changes = []*route53.Change{
+				change(route53.ChangeActionUpsert, multiValue(instance, "new-health-check-1")),
+			}
+			registrationProvider.r53 = r53Client
+			Expect(registrationProvider.Update(context.Background(), []cloud.Instance{instance})).To(Succeed())
+		})
+
+		It("deletes the health checks it created if the records can't be changed", func() {
+			r53Client.MockChangeResourceRecordSets.Err = fmt.Errorf("invalid change batch")
+			Expect(update(
+				change(route53.ChangeActionUpsert, multiValue(testInstances[0], "new-health-check-1")),
+				change(route53.ChangeActionUpsert, multiValue(testInstances[1], "new-health-check-2")),
+				change(route53.ChangeActionUpsert, multiValue(testInstances[2], "new-health-check-3")),
+			)).ToNot(Succeed())
+			Expect(deleted).To(Equal([]string{"new-health-check-1", "new-health-check-2", "new-health-check-3"}))
+		})
+
+		It("fails if a health check can't be created", func() {
+			r53Client.MockCreateHealthCheck.Err = fmt.Errorf("too many health checks")
+			registrationProvider.r53 = r53Client
+			Expect(registrationProvider.Update(context.Background(), testInstances)).To(
+				MatchError(ContainSubstring("too many health checks")))
+		})
+	})
+
+	Context("Update() with other record types and settings", func() {
+		fqdn := fmt.Sprintf("%v.%v", hostname, hostedZoneName)
+
+		recordSet := func(name, recordType string, values ...string) *route53.ResourceRecordSet {
+			var records []*route53.ResourceRecord
+			for _, value := range values {
+				records = append(records, &route53.ResourceRecord{Value: aws.String(value)})
+			}
+			return &route53.ResourceRecordSet{
+				Name:            aws.String(name),
+				Type:            aws.String(recordType),
+				TTL:             aws.Int64(300),
+				ResourceRecords: records,
+			}
+		}
+		change := func(action string, recordSet *route53.ResourceRecordSet) *route53.Change {
+			return &route53.Change{Action: aws.String(action), ResourceRecordSet: recordSet}
+		}
+		update := func(instances []cloud.Instance, changes ...*route53.Change) error {
+			r53Client.MockChangeResourceRecordSets.ExpectedInput.ChangeBatch.Changes = changes
+			registrationProvider.r53 = r53Client
+			return registrationProvider.Update(context.Background(), instances)
+		}
+		hostnameInstances := []cloud.Instance{
+			{Name: "etcd-1", Endpoint: "etcd-1.example.com", ClientPort: 2379},
+			{Name: "etcd-2", Endpoint: "etcd-2.example.com", ClientPort: 2379},
+		}
+		weighted := func(instance cloud.Instance) *route53.ResourceRecordSet {
+			recordSet := recordSet(fqdn, route53.RRTypeCname, instance.Endpoint)
+			recordSet.SetIdentifier = aws.String(instance.Name)
+			recordSet.Weight = aws.Int64(1)
+			return recordSet
+		}
+
+		BeforeEach(func() {
+			r53Client.MockListResourceRecordSets = mock.ListResourceRecordSets{
+				ExpectedInput: &route53.ListResourceRecordSetsInput{
+					HostedZoneId:    aws.String(hostedZoneID),
+					StartRecordName: aws.String(fqdn),
+				},
+				Outputs: []*route53.ListResourceRecordSetsOutput{{}},
+			}
+		})
+
+		It("uses the configured TTL", func() {
+			registrationProvider.ttl = 60
+			expected := recordSet(fqdn, route53.RRTypeA, "192.168.0.1", "192.168.0.2", "192.168.0.3")
+			expected.TTL = aws.Int64(60)
+			Expect(update(testInstances, change(route53.ChangeActionUpsert, expected))).To(Succeed())
+		})
+
+		It("publishes AAAA records for IPv6 endpoints", func() {
+			instances := []cloud.Instance{
+				{Name: "etcd-1", Endpoint: "192.168.0.1"},
+				{Name: "etcd-2", Endpoint: "fd00::2"},
+			}
+			Expect(update(instances,
+				change(route53.ChangeActionUpsert, recordSet(fqdn, route53.RRTypeA, "192.168.0.1")),
+				change(route53.ChangeActionUpsert, recordSet(fqdn, route53.RRTypeAaaa, "fd00::2")),
+			)).To(Succeed())
+		})
+
+		It("publishes AAAA node records for IPv6 endpoints", func() {
+			registrationProvider.nodeRecords = true
+			instance := cloud.Instance{Name: "etcd-1", Endpoint: "fd00::1"}
+			Expect(update([]cloud.Instance{instance},
+				change(route53.ChangeActionUpsert, recordSet(fqdn, route53.RRTypeAaaa, "fd00::1")),
+				change(route53.ChangeActionUpsert, recordSet("etcd-1."+fqdn, route53.RRTypeAaaa, "fd00::1")),
+				change(route53.ChangeActionUpsert, recordSet("etcd-1."+fqdn, route53.RRTypeTxt, `"name=etcd-1"`)),
+			)).To(Succeed())
+		})
+
+		It("publishes weighted CNAME records for hostname endpoints, replacing the A record", func() {
+			simple := recordSet(fqdn, route53.RRTypeA, "192.168.0.1")
+			r53Client.MockListResourceRecordSets.Outputs[0].ResourceRecordSets = []*route53.ResourceRecordSet{simple}
+			Expect(update(hostnameInstances,
+				change(route53.ChangeActionDelete, simple),
+				change(route53.ChangeActionUpsert, weighted(hostnameInstances[0])),
+				change(route53.ChangeActionUpsert, weighted(hostnameInstances[1])),
+			)).To(Succeed())
+		})
+
+		It("compares the hostname with the existing records in lower case", func() {
+			registrationProvider.hostname = "My-Test-ETCD-Cluster"
+			aaaa := recordSet(fqdn, route53.RRTypeAaaa, "fd00::1")
+			r53Client.MockListResourceRecordSets.Outputs[0].ResourceRecordSets = []*route53.ResourceRecordSet{aaaa}
+			Expect(update(testInstances,
+				change(route53.ChangeActionDelete, aaaa),
+				change(route53.ChangeActionUpsert,
+					recordSet(fqdn, route53.RRTypeA, "192.168.0.1", "192.168.0.2", "192.168.0.3")),
+			)).To(Succeed())
+		})
+
+		It("deletes the AAAA record when the instances only have IPv4 addresses", func() {
+			a := recordSet(fqdn, route53.RRTypeA, "192.168.0.1")
+			aaaa := recordSet(fqdn, route53.RRTypeAaaa, "fd00::2")
+			r53Client.MockListResourceRecordSets.Outputs[0].ResourceRecordSets = []*route53.ResourceRecordSet{a, aaaa}
+			Expect(update(testInstances,
+				change(route53.ChangeActionDelete, aaaa),
+				change(route53.ChangeActionUpsert,
+					recordSet(fqdn, route53.RRTypeA, "192.168.0.1", "192.168.0.2", "192.168.0.3")),
+			)).To(Succeed())
+		})
+
+		It("replaces the records per instance and their health checks with a single record", func() {
+			var deleted []string
+			r53Client.MockDeleteHealthCheck = mock.DeleteHealthCheck{Deleted: &deleted}
+			multiValue := recordSet(fqdn, route53.RRTypeA, "192.168.0.1")
+			multiValue.SetIdentifier = aws.String("test-instance-id-1")
+			multiValue.MultiValueAnswer = aws.Bool(true)
+			multiValue.HealthCheckId = aws.String("old-1")
+			gone := weighted(hostnameInstances[0])
+			r53Client.MockListResourceRecordSets.Outputs[0].ResourceRecordSets = []*route53.ResourceRecordSet{
+				multiValue,
+				gone,
+			}
+			Expect(update(testInstances,
+				change(route53.ChangeActionDelete, multiValue),
+				change(route53.ChangeActionDelete, gone),
+				change(route53.ChangeActionUpsert,
+					recordSet(fqdn, route53.RRTypeA, "192.168.0.1", "192.168.0.2", "192.168.0.3")),
+			)).To(Succeed())
+			Expect(deleted).To(Equal([]string{"old-1"}))
+		})
+
+		It("targets hostname endpoints directly from SRV records, without node records", func() {
+			registrationProvider.nodeRecords = true
+			registrationProvider.srvRecords = true
+			registrationProvider.peerPort = 2380
+			Expect(update(hostnameInstances,
+				change(route53.ChangeActionUpsert, weighted(hostnameInstances[0])),
+				change(route53.ChangeActionUpsert, weighted(hostnameInstances[1])),
+				change(route53.ChangeActionUpsert, recordSet("_etcd-server._tcp."+fqdn, route53.RRTypeSrv,
+					"0 0 2380 etcd-1.example.com", "0 0 2380 etcd-2.example.com")),
+				change(route53.ChangeActionUpsert, recordSet("_etcd-client._tcp."+fqdn, route53.RRTypeSrv,
+					"0 0 2379 etcd-1.example.com", "0 0 2379 etcd-2.example.com")),
+			)).To(Succeed())
+		})
+
+		It("fails if endpoints are a mix of IP addresses and hostnames", func() {
+			instances := append([]cloud.Instance{testInstances[0]}, hostnameInstances...)
+			Expect(update(instances)).To(MatchError(ContainSubstring("all be IP addresses or all be hostnames")))
+		})
+
+		It("waits for the change to be INSYNC when configured to", func() {
+			registrationProvider.waitForSync = true
+			r53Client.MockChangeResourceRecordSets.ChangeResourceRecordSetsOutput = &route53.ChangeResourceRecordSetsOutput{
+				ChangeInfo: &route53.ChangeInfo{Id: aws.String("test-change-id")},
+			}
+			r53Client.MockWaitUntilChanged = mock.WaitUntilChanged{
+				ExpectedInput: &route53.GetChangeInput{Id: aws.String("test-change-id")},
+			}
+			expected := change(route53.ChangeActionUpsert,
+				recordSet(fqdn, route53.RRTypeA, "192.168.0.1", "192.168.0.2", "192.168.0.3"))
+			Expect(update(testInstances, expected)).To(Succeed())
+
+			By("Failing if the change doesn't reach INSYNC")
+			r53Client.MockWaitUntilChanged.Err = fmt.Errorf("exceeded wait attempts")
+			Expect(update(testInstances, expected)).To(MatchError(ContainSubstring("didn't reach INSYNC")))
 		})
 	})
 })
@@ -3,10 +3,14 @@ package cloud
 // Instance represents a cloud instance which is intended to be part of an etcd cluster.
 type Instance struct {
 	// Name is the unique name to identify this instance in an etcd cluster.
-	Name string
+	Name string `json:"name"`
 
 	// Endpoint is the address to reach this instance from an etcd client.
 	// It is used to construct the peer and client URLs.
 	// It should be of the form `hostname` or `x.x.x.x`.
-	Endpoint string
+	Endpoint string `json:"endpoint"`
+
+	// ClientPort is the port etcd clients use to reach this instance, if the cloud provider publishes one.
+	// It is optional - when zero the configured client port is used instead.
+	ClientPort int `json:"clientPort,omitempty"`
 }
@@ -0,0 +1,222 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/retry"
+)
+
+const (
+	timeout = 5 * time.Second
+	// nameMeta is the service metadata holding the etcd instance name. If it's missing the node name is used.
+	nameMeta = "etcd-name"
+)
+
+// Config is the configuration for talking to Consul.
+type Config struct {
+	// Address of the Consul agent. If empty, CONSUL_HTTP_ADDR or the local agent is used.
+	Address string
+	// Datacenter to query. If empty, the agent's datacenter is used.
+	Datacenter string
+	// Service the etcd instances are registered as.
+	Service string
+	// Tags the service instances must all have.
+	Tags []string
+	// RetryPolicy is how calls to Consul are retried.
+	RetryPolicy retry.Policy
+}
+
+// catalog is the subset of the Consul catalog API used for looking up and registering instances.
+type catalog interface {
+	ServiceMultipleTags(service string, tags []string, q *api.QueryOptions) ([]*api.CatalogService, *api.QueryMeta, error)
+	Register(reg *api.CatalogRegistration, q *api.WriteOptions) (*api.WriteMeta, error)
+	Deregister(dereg *api.CatalogDeregistration, q *api.WriteOptions) (*api.WriteMeta, error)
+}
+
+// LocalResolver finds the IP address associated with the local instance.
+type LocalResolver interface {
+	GetLocalIP(context.Context) (string, error)
+}
+
+// Consul returns the instance information for an etcd cluster from a Consul service.
+type Consul struct {
+	service       string
+	tags          []string
+	datacenter    string
+	catalog       catalog
+	localResolver LocalResolver
+	retryPolicy   retry.Policy
+	// lookupHost is from net.LookupHost.
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+	// interfaceAddrs is from net.InterfaceAddrs.
+	interfaceAddrs func() ([]net.Addr, error)
+}
+
+func newCatalog(cfg *Config) (catalog, error) {
+	apiConfig := api.DefaultConfig()
+	if cfg.Address != "" {
+		apiConfig.Address = cfg.Address
+	}
+	client, err := api.NewClient(apiConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Consul client: %w", err)
+	}
+	return client.Catalog(), nil
+}
+
+// New returns a struct that will use the Consul catalog to look up etcd instances. If localResolver is nil, the local
+// instance is found by matching the instance addresses against the local interface IPs, so no cloud API is needed.
+func New(cfg *Config, localResolver LocalResolver) (*Consul, error) {
+	if cfg.Service == "" {
+		return nil, fmt.Errorf("a Consul service must be provided")
+	}
+	c, err := newCatalog(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Consul{
+		service:        cfg.Service,
+		tags:           cfg.Tags,
+		datacenter:     cfg.Datacenter,
+		catalog:        c,
+		localResolver:  localResolver,
+		retryPolicy:    cfg.RetryPolicy,
+		lookupHost:     net.DefaultResolver.LookupHost,
+		interfaceAddrs: net.InterfaceAddrs,
+	}, nil
+}
+
+// GetInstances returns the instances of the Consul service. The service port is used as the instance's client port.
+func (c *Consul) GetInstances(ctx context.Context) ([]cloud.Instance, error) {
+	var services []*api.CatalogService
+	err := do(ctx, c.retryPolicy, "lookup Consul service "+c.service, func(ctx context.Context) error {
+		var err error
+		q := (&api.QueryOptions{Datacenter: c.datacenter}).WithContext(ctx)
+		services, _, err = c.catalog.ServiceMultipleTags(c.service, c.tags, q)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to lookup Consul service %s with tags %v: %w", c.service, c.tags, err)
+	}
+
+	var instances []cloud.Instance
+	for _, service := range services {
+		instances = append(instances, instance(service))
+	}
+	return instances, nil
+}
+
+func instance(service *api.CatalogService) cloud.Instance {
+	name := service.ServiceMeta[nameMeta]
+	if name == "" {
+		name = service.Node
+	}
+	// The service address is optional, and defaults to the node's address.
+	endpoint := service.ServiceAddress
+	if endpoint == "" {
+		endpoint = service.Address
+	}
+	return cloud.Instance{
+		Name:       name,
+		Endpoint:   endpoint,
+		ClientPort: service.ServicePort,
+	}
+}
+
+// GetLocalInstance returns the instance whose address resolves to the local IP.
+func (c *Consul) GetLocalInstance(ctx context.Context) (cloud.Instance, error) {
+	instance, _, err := c.findLocalInstance(ctx)
+	return instance, err
+}
+
+// findLocalInstance returns the instance whose address resolves to one of the local IPs, along with that IP.
+func (c *Consul) findLocalInstance(ctx context.Context) (cloud.Instance, string, error) {
+	localIPs, err := c.localIPs(ctx)
+	if err != nil {
+		return cloud.Instance{}, "", err
+	}
+	instances, err := c.GetInstances(ctx)
+	if err != nil {
+		return cloud.Instance{}, "", err
+	}
+
+	for _, instance := range instances {
+		addrs := []string{instance.Endpoint}
+		if net.ParseIP(instance.Endpoint) == nil {
+			err = do(ctx, c.retryPolicy, "resolve "+instance.Endpoint, func(ctx context.Context) error {
+				var err error
+				addrs, err = c.lookupHost(ctx, instance.Endpoint)
+				return err
+			})
+			if err != nil {
+				return cloud.Instance{}, "", fmt.Errorf("unable to resolve %s: %w", instance.Endpoint, err)
+			}
+		}
+		for _, addr := range addrs {
+			for _, localIP := range localIPs {
+				if net.ParseIP(addr).Equal(net.ParseIP(localIP)) {
+					return instance, localIP, nil
+				}
+			}
+		}
+	}
+	return cloud.Instance{}, "", fmt.Errorf("none of the Consul service %s instances %v resolve to local IPs %v",
+		c.service, instances, localIPs)
+}
+
+// localIPs returns the IP from the LocalResolver, or the local interface IPs if there isn't one.
+func (c *Consul) localIPs(ctx context.Context) ([]string, error) {
+	if c.localResolver != nil {
+		localIP, err := c.localResolver.GetLocalIP(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to lookup local IP: %w", err)
+		}
+		return []string{localIP}, nil
+	}
+	addrs, err := c.interfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get local interface addresses: %w", err)
+	}
+	var ips []string
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP.String())
+		}
+	}
+	return ips, nil
+}
+
+// GetLocalIP returns the local IP delegating to the LocalResolver, or the local interface IP which the local
+// instance's address resolves to if there isn't one.
+func (c *Consul) GetLocalIP(ctx context.Context) (string, error) {
+	if c.localResolver != nil {
+		return c.localResolver.GetLocalIP(ctx)
+	}
+	_, localIP, err := c.findLocalInstance(ctx)
+	return localIP, err
+}
+
+// do calls fn with a timeout for each attempt, retrying transient errors according to the policy.
+func do(ctx context.Context, policy retry.Policy, name string, fn func(context.Context) error) error {
+	return retry.Do(ctx, policy, name, isRetryable, func(ctx context.Context) error {
+		ctx, cancelFn := context.WithTimeout(ctx, timeout)
+		defer cancelFn()
+		return fn(ctx)
+	})
+}
+
+// isRetryable checks for rate limiting, server errors such as no cluster leader, and network errors.
+func isRetryable(err error) bool {
+	var statusErr api.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code == http.StatusTooManyRequests || statusErr.Code >= 500
+	}
+	return retry.Network(err)
+}
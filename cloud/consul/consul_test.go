@@ -0,0 +1,284 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/retry"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestConsul(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Consul Suite")
+}
+
+var _ = Describe("Consul Instances", func() {
+	var (
+		stub   *stubCatalog
+		consul *Consul
+	)
+
+	BeforeEach(func() {
+		stub = &stubCatalog{services: []*api.CatalogService{
+			{Node: "etcd-1", Address: "10.0.0.1", ServicePort: 2379},
+			{Node: "node-2", Address: "10.0.0.2", ServiceAddress: "etcd-2.example.com", ServicePort: 12379,
+				ServiceMeta: map[string]string{nameMeta: "etcd-2"}},
+		}}
+		consul = &Consul{
+			service:       "etcd",
+			tags:          []string{"main"},
+			datacenter:    "dc1",
+			catalog:       stub,
+			localResolver: &stubLocalResolver{ip: "10.0.0.2"},
+			lookupHost: func(ctx context.Context, host string) ([]string, error) {
+				if host == "etcd-2.example.com" {
+					return []string{"10.0.0.2"}, nil
+				}
+				return nil, fmt.Errorf("unknown host %s", host)
+			},
+		}
+	})
+
+	It("returns the service instances", func() {
+		Expect(consul.GetInstances(context.Background())).To(Equal([]cloud.Instance{
+			{Name: "etcd-1", Endpoint: "10.0.0.1", ClientPort: 2379},
+			{Name: "etcd-2", Endpoint: "etcd-2.example.com", ClientPort: 12379},
+		}))
+		Expect(stub.queriedService).To(Equal("etcd"))
+		Expect(stub.queriedTags).To(Equal([]string{"main"}))
+		Expect(stub.queriedDatacenter).To(Equal("dc1"))
+	})
+
+	It("finds the local instance by resolving its address", func() {
+		Expect(consul.GetLocalInstance(context.Background())).To(Equal(
+			cloud.Instance{Name: "etcd-2", Endpoint: "etcd-2.example.com", ClientPort: 12379}))
+		Expect(consul.GetLocalIP(context.Background())).To(Equal("10.0.0.2"))
+	})
+
+	It("finds the local instance by the interface IPs without a local resolver", func() {
+		consul.localResolver = nil
+		consul.interfaceAddrs = func() ([]net.Addr, error) {
+			return []net.Addr{
+				&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+				&net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(24, 32)},
+			}, nil
+		}
+		Expect(consul.GetLocalInstance(context.Background())).To(Equal(
+			cloud.Instance{Name: "etcd-1", Endpoint: "10.0.0.1", ClientPort: 2379}))
+		Expect(consul.GetLocalIP(context.Background())).To(Equal("10.0.0.1"))
+	})
+
+	It("fails if no instance is local", func() {
+		consul.localResolver = &stubLocalResolver{ip: "10.0.0.3"}
+		_, err := consul.GetLocalInstance(context.Background())
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("fails if the lookup fails", func() {
+		stub.err = fmt.Errorf("consul is down")
+		_, err := consul.GetInstances(context.Background())
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("retries the lookup if Consul has a server error", func() {
+		consul.retryPolicy = retry.Policy{MaxAttempts: 3, InitialInterval: time.Millisecond}
+		stub.err = api.StatusError{Code: 500, Body: "No cluster leader"}
+		_, err := consul.GetInstances(context.Background())
+		Expect(err).ToNot(BeNil())
+		Expect(stub.lookups).To(Equal(3))
+	})
+
+	It("doesn't retry the lookup if access is denied", func() {
+		consul.retryPolicy = retry.Policy{MaxAttempts: 3, InitialInterval: time.Millisecond}
+		stub.err = api.StatusError{Code: 403, Body: "Permission denied"}
+		_, err := consul.GetInstances(context.Background())
+		Expect(err).ToNot(BeNil())
+		Expect(stub.lookups).To(Equal(1))
+	})
+})
+
+var _ = Describe("Consul RegistrationProvider", func() {
+	var (
+		stub     *stubCatalog
+		provider *RegistrationProvider
+	)
+
+	registered := func(name, address string, port int) *api.CatalogService {
+		return &api.CatalogService{
+			Node:           "etcd-" + name,
+			Address:        address,
+			NodeMeta:       map[string]string{externalNodeMeta: "true"},
+			ServiceID:      "etcd-main-" + name,
+			ServiceAddress: address,
+			ServicePort:    port,
+			ServiceTags:    []string{"main"},
+			ServiceMeta: map[string]string{
+				nameMeta:  name,
+				checkMeta: fmt.Sprintf("https://%s:%d/health every 10s", address, port),
+			},
+		}
+	}
+
+	BeforeEach(func() {
+		stub = &stubCatalog{}
+		provider = &RegistrationProvider{
+			service:       "etcd",
+			tags:          []string{"main"},
+			datacenter:    "dc1",
+			scheme:        "https",
+			clientPort:    2379,
+			checkInterval: defaultCheckInterval,
+			catalog:       stub,
+		}
+	})
+
+	It("registers each instance with a health check", func() {
+		Expect(provider.Update(context.Background(), []cloud.Instance{
+			{Name: "etcd-1", Endpoint: "10.0.0.1"},
+			{Name: "etcd-2", Endpoint: "fd00::2", ClientPort: 12379},
+		})).To(Succeed())
+		Expect(stub.registered).To(HaveLen(2))
+
+		reg := stub.registered[0]
+		Expect(reg.Node).To(Equal("etcd-etcd-1"))
+		Expect(reg.Datacenter).To(Equal("dc1"))
+		Expect(reg.NodeMeta).To(HaveKeyWithValue(externalNodeMeta, "true"))
+		Expect(reg.Service.Service).To(Equal("etcd"))
+		Expect(reg.Service.Port).To(Equal(2379))
+		Expect(reg.Service.Tags).To(Equal([]string{"main"}))
+		Expect(reg.Service.ID).To(Equal("etcd-main-etcd-1"))
+		Expect(reg.Check.ServiceID).To(Equal(reg.Service.ID))
+		Expect(reg.Check.Definition.HTTP).To(Equal("https://10.0.0.1:2379/health"))
+
+		Expect(stub.registered[1].Check.Definition.HTTP).To(Equal("https://[fd00::2]:12379/health"))
+	})
+
+	It("only registers instances which have changed", func() {
+		stub.services = []*api.CatalogService{
+			registered("etcd-1", "10.0.0.1", 2379),
+			registered("etcd-2", "10.0.0.2", 2379),
+		}
+		Expect(provider.Update(context.Background(), []cloud.Instance{
+			{Name: "etcd-1", Endpoint: "10.0.0.1"},
+			{Name: "etcd-2", Endpoint: "10.0.0.22"},
+		})).To(Succeed())
+		Expect(stub.registered).To(HaveLen(1))
+		Expect(stub.registered[0].Address).To(Equal("10.0.0.22"))
+		Expect(stub.deregistered).To(BeEmpty())
+	})
+
+	It("registers instances again if their health check has changed", func() {
+		stub.services = []*api.CatalogService{registered("etcd-1", "10.0.0.1", 2379)}
+		provider.checkInterval = 30 * time.Second
+		Expect(provider.Update(context.Background(), []cloud.Instance{{Name: "etcd-1", Endpoint: "10.0.0.1"}})).To(Succeed())
+		Expect(stub.registered).To(HaveLen(1))
+		Expect(stub.registered[0].Check.Definition.IntervalDuration).To(Equal(30 * time.Second))
+
+		stub.registered = nil
+		provider.checkInterval = defaultCheckInterval
+		provider.scheme = "http"
+		Expect(provider.Update(context.Background(), []cloud.Instance{{Name: "etcd-1", Endpoint: "10.0.0.1"}})).To(Succeed())
+		Expect(stub.registered).To(HaveLen(1))
+		Expect(stub.registered[0].Check.Definition.HTTP).To(Equal("http://10.0.0.1:2379/health"))
+	})
+
+	It("deregisters old instances it registered", func() {
+		agentNode := &api.CatalogService{Node: "agent-1", Address: "10.0.0.9", ServiceID: "etcd"}
+		stub.services = []*api.CatalogService{
+			registered("etcd-1", "10.0.0.1", 2379),
+			registered("etcd-old", "10.0.0.3", 2379),
+			agentNode,
+		}
+		Expect(provider.Update(context.Background(), []cloud.Instance{{Name: "etcd-1", Endpoint: "10.0.0.1"}})).To(Succeed())
+		Expect(stub.queriedTags).To(Equal([]string{"main"}))
+		Expect(stub.deregistered).To(Equal([]*api.CatalogDeregistration{
+			{Node: "etcd-etcd-old", ServiceID: "etcd-main-etcd-old", Datacenter: "dc1"},
+		}))
+	})
+
+	It("registers instances on their own node, not the agent node with the instance's name", func() {
+		agentNode := &api.CatalogService{
+			Node:           "etcd-1",
+			Address:        "10.0.0.1",
+			NodeMeta:       map[string]string{"consul-network-segment": ""},
+			ServiceID:      "etcd-main-etcd-1",
+			ServiceAddress: "10.0.0.1",
+			ServicePort:    2379,
+			ServiceTags:    []string{"main"},
+			ServiceMeta:    map[string]string{nameMeta: "etcd-1"},
+		}
+		stub.services = []*api.CatalogService{agentNode}
+		Expect(provider.Update(context.Background(), []cloud.Instance{{Name: "etcd-1", Endpoint: "10.0.0.1"}})).To(Succeed())
+		Expect(stub.registered).To(HaveLen(1))
+		Expect(stub.registered[0].Node).To(Equal("etcd-etcd-1"))
+		Expect(stub.registered[0].Check.Node).To(Equal("etcd-etcd-1"))
+		Expect(stub.deregistered).To(BeEmpty())
+	})
+
+	It("leaves the registrations of another cluster with different tags", func() {
+		events := registered("etcd-1", "10.0.0.1", 2381)
+		events.ServiceID = "etcd-main-events-etcd-1"
+		events.ServiceTags = []string{"main", "events"}
+		otherEvents := registered("etcd-9", "10.0.0.9", 2381)
+		otherEvents.ServiceID = "etcd-main-events-etcd-9"
+		otherEvents.ServiceTags = []string{"main", "events"}
+		stub.services = []*api.CatalogService{registered("etcd-1", "10.0.0.1", 2379), events, otherEvents}
+		Expect(provider.Update(context.Background(), []cloud.Instance{{Name: "etcd-1", Endpoint: "10.0.0.1"}})).To(Succeed())
+		Expect(stub.registered).To(BeEmpty())
+		Expect(stub.deregistered).To(BeEmpty())
+	})
+
+	It("fails if registering fails", func() {
+		stub.registerErr = fmt.Errorf("permission denied")
+		Expect(provider.Update(context.Background(), []cloud.Instance{{Name: "etcd-1", Endpoint: "10.0.0.1"}})).ToNot(Succeed())
+	})
+})
+
+type stubCatalog struct {
+	services          []*api.CatalogService
+	err               error
+	lookups           int
+	queriedService    string
+	queriedTags       []string
+	queriedDatacenter string
+	registered        []*api.CatalogRegistration
+	registerErr       error
+	deregistered      []*api.CatalogDeregistration
+}
+
+func (s *stubCatalog) ServiceMultipleTags(service string, tags []string, q *api.QueryOptions) ([]*api.CatalogService, *api.QueryMeta, error) {
+	s.lookups++
+	s.queriedService = service
+	s.queriedTags = tags
+	s.queriedDatacenter = q.Datacenter
+	return s.services, &api.QueryMeta{}, s.err
+}
+
+func (s *stubCatalog) Register(reg *api.CatalogRegistration, q *api.WriteOptions) (*api.WriteMeta, error) {
+	if s.registerErr != nil {
+		return nil, s.registerErr
+	}
+	s.registered = append(s.registered, reg)
+	return &api.WriteMeta{}, nil
+}
+
+func (s *stubCatalog) Deregister(dereg *api.CatalogDeregistration, q *api.WriteOptions) (*api.WriteMeta, error) {
+	s.deregistered = append(s.deregistered, dereg)
+	return &api.WriteMeta{}, nil
+}
+
+type stubLocalResolver struct {
+	ip string
+}
+
+func (s *stubLocalResolver) GetLocalIP(context.Context) (string, error) {
+	return s.ip, nil
+}
@@ -0,0 +1,224 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/retry"
+)
+
+const (
+	defaultClientPort    = 2379
+	defaultCheckInterval = 10 * time.Second
+	// externalNodeMeta marks nodes which aren't running a Consul agent, so consul-esm runs their health checks.
+	externalNodeMeta  = "external-node"
+	externalProbeMeta = "external-probe"
+	// checkMeta is the service metadata describing the health check it was registered with. The catalog doesn't
+	// return checks with the service, so this is how changes to the check are spotted.
+	checkMeta = "etcd-check"
+)
+
+// RegistrationProviderConfig contains configuration when creating a default RegistrationProvider.
+type RegistrationProviderConfig struct {
+	Config
+	// Scheme of the etcd client endpoints for health checks, either http or https.
+	Scheme string
+	// ClientPort is used for instances which don't have their own client port.
+	ClientPort int
+	// CheckInterval is how often the health of each instance is checked.
+	CheckInterval time.Duration
+}
+
+// RegistrationProvider registers the etcd client endpoints as a Consul service.
+type RegistrationProvider struct {
+	service       string
+	tags          []string
+	datacenter    string
+	scheme        string
+	clientPort    int
+	checkInterval time.Duration
+	catalog       catalog
+	retryPolicy   retry.Policy
+}
+
+// NewRegistrationProvider returns a RegistrationProvider using the Consul catalog.
+func NewRegistrationProvider(c *RegistrationProviderConfig) (*RegistrationProvider, error) {
+	if c.Service == "" {
+		return nil, fmt.Errorf("a Consul service must be provided")
+	}
+	cat, err := newCatalog(&c.Config)
+	if err != nil {
+		return nil, err
+	}
+	r := &RegistrationProvider{
+		service:       c.Service,
+		tags:          c.Tags,
+		datacenter:    c.Datacenter,
+		scheme:        c.Scheme,
+		clientPort:    c.ClientPort,
+		checkInterval: c.CheckInterval,
+		catalog:       cat,
+		retryPolicy:   c.RetryPolicy,
+	}
+	if r.scheme == "" {
+		r.scheme = "http"
+	}
+	if r.clientPort == 0 {
+		r.clientPort = defaultClientPort
+	}
+	if r.checkInterval == 0 {
+		r.checkInterval = defaultCheckInterval
+	}
+	return r, nil
+}
+
+// Update registers each instance as an external node providing the service, with an HTTP check of etcd's /health
+// endpoint. The external node is named after the service and the instance, so it never overwrites the node of a
+// Consul agent running on the instance. Checks on external nodes are run by consul-esm. Services previously registered by a provider with the same
+// service and tags, on nodes which are no longer instances, are deregistered. Other services on those nodes, e.g. of
+// another cluster on the same hosts, are left alone. Registering and deregistering are idempotent, so they can safely
+// be retried.
+func (r *RegistrationProvider) Update(ctx context.Context, instances []cloud.Instance) error {
+	var existing []*api.CatalogService
+	err := do(ctx, r.retryPolicy, "lookup Consul service "+r.service, func(ctx context.Context) error {
+		var err error
+		q := (&api.QueryOptions{Datacenter: r.datacenter}).WithContext(ctx)
+		existing, _, err = r.catalog.ServiceMultipleTags(r.service, r.tags, q)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to lookup Consul service %s: %w", r.service, err)
+	}
+	registered := make(map[string]*api.CatalogService)
+	for _, service := range existing {
+		if r.owns(service) {
+			registered[service.Node] = service
+		}
+	}
+
+	nodes := make(map[string]bool)
+	for _, instance := range instances {
+		reg := r.registration(instance)
+		nodes[reg.Node] = true
+		if current, ok := registered[reg.Node]; ok && r.upToDate(current, reg) {
+			continue
+		}
+		log.Infof("Registering %s (%s) as Consul service %s", instance.Name, instance.Endpoint, r.service)
+		err := do(ctx, r.retryPolicy, "register "+instance.Name, func(ctx context.Context) error {
+			_, err := r.catalog.Register(reg, (&api.WriteOptions{Datacenter: r.datacenter}).WithContext(ctx))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("unable to register %s with Consul: %w", instance.Name, err)
+		}
+	}
+
+	for node, service := range registered {
+		if nodes[node] {
+			continue
+		}
+		log.Infof("Deregistering %s from Consul service %s", node, r.service)
+		dereg := &api.CatalogDeregistration{Node: node, ServiceID: service.ServiceID, Datacenter: r.datacenter}
+		err := do(ctx, r.retryPolicy, "deregister "+node, func(ctx context.Context) error {
+			_, err := r.catalog.Deregister(dereg, (&api.WriteOptions{Datacenter: r.datacenter}).WithContext(ctx))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("unable to deregister %s from Consul: %w", node, err)
+		}
+	}
+	return nil
+}
+
+func (r *RegistrationProvider) registration(instance cloud.Instance) *api.CatalogRegistration {
+	port := r.clientPort
+	if instance.ClientPort != 0 {
+		port = instance.ClientPort
+	}
+	node := r.node(instance.Name)
+	serviceID := r.serviceID(instance.Name)
+	check := api.HealthCheckDefinition{
+		HTTP:             fmt.Sprintf("%s://%s/health", r.scheme, net.JoinHostPort(instance.Endpoint, strconv.Itoa(port))),
+		IntervalDuration: r.checkInterval,
+		TimeoutDuration:  timeout,
+	}
+	return &api.CatalogRegistration{
+		Node:       node,
+		Address:    instance.Endpoint,
+		Datacenter: r.datacenter,
+		NodeMeta: map[string]string{
+			externalNodeMeta:  "true",
+			externalProbeMeta: "true",
+		},
+		Service: &api.AgentService{
+			ID:      serviceID,
+			Service: r.service,
+			Tags:    r.tags,
+			Address: instance.Endpoint,
+			Port:    port,
+			Meta: map[string]string{
+				nameMeta:  instance.Name,
+				checkMeta: fmt.Sprintf("%s every %s", check.HTTP, check.IntervalDuration),
+			},
+		},
+		Check: &api.AgentCheck{
+			Node:       node,
+			CheckID:    "service:" + serviceID,
+			Name:       "etcd health",
+			ServiceID:  serviceID,
+			Definition: check,
+		},
+	}
+}
+
+// node is the external node of the instance. Registering a node replaces its address and metadata, and a Consul
+// agent's anti-entropy removes services it didn't register from its own node, so the instance name alone, which is
+// often the host name the agent runs as, can't be used.
+func (r *RegistrationProvider) node(name string) string {
+	return r.service + "-" + name
+}
+
+// serviceID is unique to the service and tags on each node, so several clusters can be registered on the same hosts.
+func (r *RegistrationProvider) serviceID(name string) string {
+	return strings.Join(append(append([]string{r.service}, r.tags...), name), "-")
+}
+
+// owns checks if the service was registered by a provider with the same service and tags.
+func (r *RegistrationProvider) owns(service *api.CatalogService) bool {
+	name := service.ServiceMeta[nameMeta]
+	return service.NodeMeta[externalNodeMeta] == "true" &&
+		name != "" &&
+		service.Node == r.node(name) &&
+		service.ServiceID == r.serviceID(name) &&
+		sameTags(service.ServiceTags, r.tags)
+}
+
+// upToDate checks if the registered service and its health check match the registration. Re-registering would
+// reset the status of the health check, so it's only done when something has changed.
+func (r *RegistrationProvider) upToDate(current *api.CatalogService, reg *api.CatalogRegistration) bool {
+	return current.ServiceID == reg.Service.ID &&
+		current.ServiceAddress == reg.Service.Address &&
+		current.ServicePort == reg.Service.Port &&
+		current.ServiceMeta[checkMeta] == reg.Service.Meta[checkMeta] &&
+		sameTags(current.ServiceTags, reg.Service.Tags)
+}
+
+func sameTags(a, b []string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return reflect.DeepEqual(a, b)
+}
@@ -2,15 +2,23 @@ package gcp
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/compute/metadata"
 	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/retry"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
 )
 
+// timeout is the deadline for each attempt at a GCP API call.
+const timeout = 10 * time.Second
+
 // Config is the configuration required to talk to GCP APIs to fetch a list of nodes
 type Config struct {
 	// ProjectID is the name of the project to query
@@ -19,6 +27,8 @@ type Config struct {
 	Environment string
 	// Role tag to filter by
 	Role string
+	// RetryPolicy is how calls to the GCP APIs are retried.
+	RetryPolicy retry.Policy
 }
 
 // Members of a GCP group.
@@ -28,33 +38,29 @@ type Members struct {
 }
 
 // GetInstances will return the gcp etcd instances
-func (m *Members) GetInstances() ([]cloud.Instance, error) {
+func (m *Members) GetInstances(context.Context) ([]cloud.Instance, error) {
 	return m.instances, nil
 }
 
 // GetLocalInstance will get the gcp instance etcd bootstrap is running on
-func (m *Members) GetLocalInstance() (cloud.Instance, error) {
+func (m *Members) GetLocalInstance(context.Context) (cloud.Instance, error) {
 	return m.instance, nil
 }
 
 // GetLocalIP returns the same value as the GetLocalInstance() endpoint.
-func (m *Members) GetLocalIP() (string, error) {
-	localInstance, _ := m.GetLocalInstance()
+func (m *Members) GetLocalIP(ctx context.Context) (string, error) {
+	localInstance, _ := m.GetLocalInstance(ctx)
 	return localInstance.Endpoint, nil
 }
 
 // NewGCP returns the Members matching the cfg.
-func NewGCP(cfg *Config) (*Members, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-
-	defer cancel()
-
+func NewGCP(ctx context.Context, cfg *Config) (*Members, error) {
 	c, err := newClient(ctx, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create GCP compute API client: %v", err)
 	}
 
-	instances, err := findAllInstances(c, cfg)
+	instances, err := findAllInstances(ctx, c, cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -100,8 +106,13 @@ func newClient(ctx context.Context, cfg *Config) (*compute.Service, error) {
 	return computeService, err
 }
 
-func findAllInstances(client *compute.Service, cfg *Config) ([]cloud.Instance, error) {
-	zones, err := client.Zones.List(cfg.ProjectID).Do()
+func findAllInstances(ctx context.Context, client *compute.Service, cfg *Config) ([]cloud.Instance, error) {
+	var zones *compute.ZoneList
+	err := do(ctx, cfg.RetryPolicy, "list zones", func(ctx context.Context) error {
+		var err error
+		zones, err = client.Zones.List(cfg.ProjectID).Context(ctx).Do()
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("unable to list zones for project %q: %v", cfg.ProjectID, err)
 	}
@@ -115,7 +126,12 @@ func findAllInstances(client *compute.Service, cfg *Config) ([]cloud.Instance, e
 			"status != TERMINATED",
 		}
 		byEnvironmentAndRole := fmt.Sprintf(strings.Join(filters, " AND "))
-		result, err := client.Instances.List(cfg.ProjectID, zone.Name).Filter(byEnvironmentAndRole).Do()
+		var result *compute.InstanceList
+		err := do(ctx, cfg.RetryPolicy, "list instances in zone "+zone.Name, func(ctx context.Context) error {
+			var err error
+			result, err = client.Instances.List(cfg.ProjectID, zone.Name).Filter(byEnvironmentAndRole).Context(ctx).Do()
+			return err
+		})
 		if err != nil {
 			return nil, fmt.Errorf("unable to list instances for project %q, zone %v: %v", cfg.ProjectID, zone, err)
 		}
@@ -136,3 +152,21 @@ func findAllInstances(client *compute.Service, cfg *Config) ([]cloud.Instance, e
 	}
 	return instances, nil
 }
+
+// do calls fn with a timeout for each attempt, retrying transient errors according to the policy.
+func do(ctx context.Context, policy retry.Policy, name string, fn func(context.Context) error) error {
+	return retry.Do(ctx, policy, name, isRetryable, func(ctx context.Context) error {
+		ctx, cancelFn := context.WithTimeout(ctx, timeout)
+		defer cancelFn()
+		return fn(ctx)
+	})
+}
+
+// isRetryable checks for rate limiting, server errors and network errors.
+func isRetryable(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500
+	}
+	return retry.Network(err)
+}
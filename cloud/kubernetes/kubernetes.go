@@ -0,0 +1,194 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/retry"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	timeout              = 5 * time.Second
+	defaultClusterDomain = "cluster.local"
+)
+
+// Config is the configuration for finding the etcd pods.
+type Config struct {
+	// Namespace of the pods.
+	Namespace string
+	// StatefulSet the pods belong to. Its selector and service name are used unless overridden.
+	StatefulSet string
+	// LabelSelector to find the pods, if not using the StatefulSet's selector.
+	LabelSelector string
+	// ServiceName is the headless service giving the pods stable DNS names.
+	ServiceName string
+	// ClusterDomain is the cluster's DNS domain, defaulting to cluster.local.
+	ClusterDomain string
+	// PodName is the name of the local pod, typically from the downward API.
+	PodName string
+	// PodIP is the IP of the local pod, typically from the downward API.
+	PodIP string
+	// RetryPolicy is how calls to the Kubernetes API are retried.
+	RetryPolicy retry.Policy
+}
+
+// Kubernetes returns the instance information for an etcd cluster running in Kubernetes pods.
+type Kubernetes struct {
+	client        kubernetes.Interface
+	namespace     string
+	statefulSet   string
+	selector      labels.Selector
+	serviceName   string
+	clusterDomain string
+	podName       string
+	podIP         string
+	retryPolicy   retry.Policy
+}
+
+// New returns a provider using the in-cluster Kubernetes API.
+func New(ctx context.Context, cfg *Config) (*Kubernetes, error) {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load in-cluster config: %w", err)
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Kubernetes client: %w", err)
+	}
+	return newKubernetes(ctx, client, cfg)
+}
+
+func newKubernetes(ctx context.Context, client kubernetes.Interface, cfg *Config) (*Kubernetes, error) {
+	if cfg.Namespace == "" || cfg.PodName == "" || cfg.PodIP == "" {
+		return nil, fmt.Errorf("namespace, pod name and pod IP must be provided")
+	}
+	k := &Kubernetes{
+		client:        client,
+		namespace:     cfg.Namespace,
+		statefulSet:   cfg.StatefulSet,
+		serviceName:   cfg.ServiceName,
+		clusterDomain: cfg.ClusterDomain,
+		podName:       cfg.PodName,
+		podIP:         cfg.PodIP,
+		retryPolicy:   cfg.RetryPolicy,
+	}
+	if k.clusterDomain == "" {
+		k.clusterDomain = defaultClusterDomain
+	}
+
+	if cfg.LabelSelector != "" {
+		selector, err := labels.Parse(cfg.LabelSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label selector %q: %w", cfg.LabelSelector, err)
+		}
+		k.selector = selector
+	}
+
+	if cfg.StatefulSet != "" {
+		var sts *appsv1.StatefulSet
+		err := k.do(ctx, "get StatefulSet "+cfg.StatefulSet, func(ctx context.Context) error {
+			var err error
+			sts, err = client.AppsV1().StatefulSets(cfg.Namespace).Get(ctx, cfg.StatefulSet, metav1.GetOptions{})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to get StatefulSet %s/%s: %w", cfg.Namespace, cfg.StatefulSet, err)
+		}
+		if k.selector == nil {
+			selector, err := metav1.LabelSelectorAsSelector(sts.Spec.Selector)
+			if err != nil {
+				return nil, fmt.Errorf("invalid selector on StatefulSet %s/%s: %w", cfg.Namespace, cfg.StatefulSet, err)
+			}
+			k.selector = selector
+		}
+		if k.serviceName == "" {
+			k.serviceName = sts.Spec.ServiceName
+		}
+	}
+
+	if k.selector == nil {
+		return nil, fmt.Errorf("either a StatefulSet or label selector must be provided")
+	}
+	if k.serviceName == "" {
+		return nil, fmt.Errorf("a service name must be provided")
+	}
+	return k, nil
+}
+
+// GetInstances returns the pods which aren't terminating.
+func (k *Kubernetes) GetInstances(ctx context.Context) ([]cloud.Instance, error) {
+	var pods *corev1.PodList
+	err := k.do(ctx, "list pods in "+k.namespace, func(ctx context.Context) error {
+		var err error
+		pods, err = k.client.CoreV1().Pods(k.namespace).List(ctx, metav1.ListOptions{LabelSelector: k.selector.String()})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pods in %s matching %s: %w", k.namespace, k.selector, err)
+	}
+
+	var instances []cloud.Instance
+	for _, pod := range pods.Items {
+		if !k.isMember(&pod) {
+			continue
+		}
+		instances = append(instances, k.instance(pod.Name))
+	}
+	return instances, nil
+}
+
+// isMember checks the pod belongs to the StatefulSet, if there is one, and is still running or about to.
+func (k *Kubernetes) isMember(pod *corev1.Pod) bool {
+	if k.statefulSet != "" {
+		owner := metav1.GetControllerOf(pod)
+		if owner == nil || owner.Kind != "StatefulSet" || owner.Name != k.statefulSet {
+			return false
+		}
+	}
+	if pod.DeletionTimestamp != nil {
+		return false
+	}
+	return pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed
+}
+
+// instance uses the pod's stable DNS name under the headless service as its endpoint.
+func (k *Kubernetes) instance(podName string) cloud.Instance {
+	return cloud.Instance{
+		Name:     podName,
+		Endpoint: fmt.Sprintf("%s.%s.%s.svc.%s", podName, k.serviceName, k.namespace, k.clusterDomain),
+	}
+}
+
+// GetLocalInstance returns the local pod.
+func (k *Kubernetes) GetLocalInstance(context.Context) (cloud.Instance, error) {
+	return k.instance(k.podName), nil
+}
+
+// GetLocalIP returns the local pod's IP.
+func (k *Kubernetes) GetLocalIP(context.Context) (string, error) {
+	return k.podIP, nil
+}
+
+// do calls fn with a timeout for each attempt, retrying transient errors according to the retry policy.
+func (k *Kubernetes) do(ctx context.Context, name string, fn func(context.Context) error) error {
+	return retry.Do(ctx, k.retryPolicy, name, isRetryable, func(ctx context.Context) error {
+		ctx, cancelFn := context.WithTimeout(ctx, timeout)
+		defer cancelFn()
+		return fn(ctx)
+	})
+}
+
+// isRetryable checks for throttling, timeouts and the API server being unavailable.
+func isRetryable(err error) bool {
+	return apierrors.IsTooManyRequests(err) || apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) ||
+		apierrors.IsServiceUnavailable(err) || apierrors.IsInternalError(err) || retry.Network(err)
+}
@@ -0,0 +1,167 @@
+package kubernetes
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/retry"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestKubernetes(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Kubernetes Suite")
+}
+
+var _ = Describe("Kubernetes Instances", func() {
+	var (
+		cfg     *Config
+		objects []runtime.Object
+	)
+
+	statefulSet := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "etcd", Namespace: "kube-system", UID: "sts-uid"},
+		Spec: appsv1.StatefulSetSpec{
+			ServiceName: "etcd-headless",
+			Selector:    &metav1.LabelSelector{MatchLabels: map[string]string{"app": "etcd"}},
+		},
+	}
+
+	pod := func(name string, labels map[string]string, owner string) *corev1.Pod {
+		p := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "kube-system", Labels: labels},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		}
+		if owner != "" {
+			controller := true
+			p.OwnerReferences = []metav1.OwnerReference{{
+				APIVersion: "apps/v1",
+				Kind:       "StatefulSet",
+				Name:       owner,
+				UID:        "sts-uid",
+				Controller: &controller,
+			}}
+		}
+		return p
+	}
+
+	BeforeEach(func() {
+		cfg = &Config{
+			Namespace:   "kube-system",
+			StatefulSet: "etcd",
+			PodName:     "etcd-0",
+			PodIP:       "10.1.0.5",
+		}
+		terminating := pod("etcd-2", map[string]string{"app": "etcd"}, "etcd")
+		now := metav1.NewTime(time.Now())
+		terminating.DeletionTimestamp = &now
+		failed := pod("etcd-3", map[string]string{"app": "etcd"}, "etcd")
+		failed.Status.Phase = corev1.PodFailed
+		objects = []runtime.Object{
+			statefulSet,
+			pod("etcd-0", map[string]string{"app": "etcd"}, "etcd"),
+			pod("etcd-1", map[string]string{"app": "etcd"}, "etcd"),
+			terminating,
+			failed,
+			pod("etcd-backup", map[string]string{"app": "etcd"}, ""),
+			pod("other-0", map[string]string{"app": "other"}, "other"),
+		}
+	})
+
+	It("uses the StatefulSet pods with stable DNS names", func() {
+		k, err := newKubernetes(context.Background(), fake.NewSimpleClientset(objects...), cfg)
+		Expect(err).To(BeNil())
+		Expect(k.GetInstances(context.Background())).To(Equal([]cloud.Instance{
+			{Name: "etcd-0", Endpoint: "etcd-0.etcd-headless.kube-system.svc.cluster.local"},
+			{Name: "etcd-1", Endpoint: "etcd-1.etcd-headless.kube-system.svc.cluster.local"},
+		}))
+		Expect(k.GetLocalInstance(context.Background())).To(Equal(
+			cloud.Instance{Name: "etcd-0", Endpoint: "etcd-0.etcd-headless.kube-system.svc.cluster.local"}))
+		Expect(k.GetLocalIP(context.Background())).To(Equal("10.1.0.5"))
+	})
+
+	It("uses a label selector and service name", func() {
+		cfg.StatefulSet = ""
+		cfg.LabelSelector = "app=etcd"
+		cfg.ServiceName = "etcd-peers"
+		cfg.ClusterDomain = "example.local"
+		k, err := newKubernetes(context.Background(), fake.NewSimpleClientset(objects...), cfg)
+		Expect(err).To(BeNil())
+		instances, err := k.GetInstances(context.Background())
+		Expect(err).To(BeNil())
+		var names []string
+		for _, instance := range instances {
+			names = append(names, instance.Name)
+		}
+		Expect(names).To(ConsistOf("etcd-0", "etcd-1", "etcd-backup"))
+		Expect(instances[0].Endpoint).To(Equal("etcd-0.etcd-peers.kube-system.svc.example.local"))
+	})
+
+	It("retries listing the pods when throttled", func() {
+		cfg.RetryPolicy = retry.Policy{MaxAttempts: 3, InitialInterval: time.Millisecond}
+		client := fake.NewSimpleClientset(objects...)
+		lists := 0
+		client.PrependReactor("list", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+			lists++
+			if lists == 1 {
+				return true, nil, apierrors.NewTooManyRequests("slow down", 0)
+			}
+			return false, nil, nil
+		})
+		k, err := newKubernetes(context.Background(), client, cfg)
+		Expect(err).To(BeNil())
+		instances, err := k.GetInstances(context.Background())
+		Expect(err).To(BeNil())
+		Expect(instances).To(HaveLen(2))
+		Expect(lists).To(Equal(2))
+	})
+
+	It("doesn't retry errors which aren't transient", func() {
+		cfg.RetryPolicy = retry.Policy{MaxAttempts: 3, InitialInterval: time.Millisecond}
+		client := fake.NewSimpleClientset(objects...)
+		lists := 0
+		client.PrependReactor("list", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+			lists++
+			return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "", nil)
+		})
+		k, err := newKubernetes(context.Background(), client, cfg)
+		Expect(err).To(BeNil())
+		_, err = k.GetInstances(context.Background())
+		Expect(err).ToNot(BeNil())
+		Expect(lists).To(Equal(1))
+	})
+
+	It("fails if the StatefulSet doesn't exist", func() {
+		cfg.StatefulSet = "missing"
+		_, err := newKubernetes(context.Background(), fake.NewSimpleClientset(objects...), cfg)
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("requires a way to find the pods", func() {
+		cfg.StatefulSet = ""
+		_, err := newKubernetes(context.Background(), fake.NewSimpleClientset(objects...), cfg)
+		Expect(err).ToNot(BeNil())
+
+		cfg.LabelSelector = "app=etcd"
+		_, err = newKubernetes(context.Background(), fake.NewSimpleClientset(objects...), cfg)
+		Expect(err).ToNot(BeNil(), "service name is required without a StatefulSet")
+	})
+
+	It("requires the local pod details", func() {
+		cfg.PodIP = ""
+		_, err := newKubernetes(context.Background(), fake.NewSimpleClientset(objects...), cfg)
+		Expect(err).ToNot(BeNil())
+	})
+})
@@ -1,6 +1,8 @@
 package noop
 
 import (
+	"context"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/sky-uk/etcd-bootstrap/cloud"
 )
@@ -9,7 +11,7 @@ import (
 type RegistrationProvider struct{}
 
 // Update is a noop.
-func (n RegistrationProvider) Update(instances []cloud.Instance) error {
+func (n RegistrationProvider) Update(ctx context.Context, instances []cloud.Instance) error {
 	log.Info("Registration provider set to noop")
 	return nil
 }
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/retry"
 )
 
 const (
@@ -15,19 +16,24 @@ const (
 	timeout = 5 * time.Second
 )
 
+// peerServices are etcd's SRV services for the peer port. Their targets' ports aren't client ports, so the configured
+// client port is used for them instead.
+var peerServices = map[string]bool{"etcd-server": true, "etcd-server-ssl": true}
+
 // SRV returns the instance information for an etcd cluster using an SRV record.
 type SRV struct {
 	domainName    string
 	service       string
 	localResolver LocalResolver
 	resolver      resolver
+	retryPolicy   retry.Policy
 	instances     []cloud.Instance
 	localInstance *cloud.Instance
 }
 
 // LocalResolver finds the IP address associated with the local instance.
 type LocalResolver interface {
-	GetLocalIP() (string, error)
+	GetLocalIP(context.Context) (string, error)
 }
 
 type resolver interface {
@@ -39,35 +45,42 @@ type resolver interface {
 	LookupHost(ctx context.Context, host string) (addrs []string, err error)
 }
 
-// New returns a struct that will use the SRV record to look up etcd instances.
-func New(domainName, service string, localResolver LocalResolver) *SRV {
+// New returns a struct that will use the SRV record to look up etcd instances. Lookups which time out or fail
+// temporarily are retried according to the policy.
+func New(domainName, service string, localResolver LocalResolver, retryPolicy retry.Policy) *SRV {
 	return &SRV{
 		domainName:    domainName,
 		service:       service,
 		localResolver: localResolver,
 		resolver:      &net.Resolver{},
+		retryPolicy:   retryPolicy,
 	}
 }
 
-// GetInstances returns the instances inside of the SRV record.
-func (s *SRV) GetInstances() ([]cloud.Instance, error) {
+// GetInstances returns the instances inside of the SRV record. The port of each SRV target is used as the
+// instance's client port, unless the service is one of etcd's peer services.
+func (s *SRV) GetInstances(ctx context.Context) ([]cloud.Instance, error) {
 	if s.instances == nil {
-		ctx, cancelFn := context.WithTimeout(context.Background(), timeout)
-		defer cancelFn()
-		_, addrs, err := s.resolver.LookupSRV(ctx, s.service, proto, s.domainName)
+		var addrs []*net.SRV
+		err := s.do(ctx, "lookup SRV for "+s.domainName, func(ctx context.Context) error {
+			var err error
+			_, addrs, err = s.resolver.LookupSRV(ctx, s.service, proto, s.domainName)
+			return err
+		})
 		if err != nil {
 			return nil, fmt.Errorf("unable to lookup SRV for _%s._%s.%s: %w", s.service, proto, s.domainName, err)
 		}
 		var instances []cloud.Instance
 		for _, addr := range addrs {
-			name, err := s.lookupTXTName(addr.Target)
+			name, err := s.lookupTXTName(ctx, addr.Target)
 			if err != nil {
 				return nil, fmt.Errorf("unable to lookup instance name for SRV target %s: %w", addr.Target, err)
 			}
-			instances = append(instances, cloud.Instance{
-				Endpoint: addr.Target,
-				Name:     name,
-			})
+			instance := cloud.Instance{Endpoint: addr.Target, Name: name}
+			if !peerServices[s.service] {
+				instance.ClientPort = int(addr.Port)
+			}
+			instances = append(instances, instance)
 		}
 		s.instances = instances
 	}
@@ -75,10 +88,13 @@ func (s *SRV) GetInstances() ([]cloud.Instance, error) {
 }
 
 // lookupTXTName looks for the name associated with the target, using RFC1464 conventions.
-func (s *SRV) lookupTXTName(target string) (string, error) {
-	ctx, cancelFn := context.WithTimeout(context.Background(), timeout)
-	defer cancelFn()
-	records, err := s.resolver.LookupTXT(ctx, target)
+func (s *SRV) lookupTXTName(ctx context.Context, target string) (string, error) {
+	var records []string
+	err := s.do(ctx, "lookup TXT for "+target, func(ctx context.Context) error {
+		var err error
+		records, err = s.resolver.LookupTXT(ctx, target)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
@@ -95,30 +111,33 @@ func (s *SRV) lookupTXTName(target string) (string, error) {
 	return "", fmt.Errorf("no TXT record with `name=` attribute found for %s", target)
 }
 
-func (s *SRV) lookupInstanceAddresses(instances []cloud.Instance) (map[cloud.Instance][]string, error) {
+func (s *SRV) lookupInstanceAddresses(ctx context.Context, instances []cloud.Instance) (map[cloud.Instance][]string, error) {
 	instanceAddrs := make(map[cloud.Instance][]string)
 	for _, instance := range instances {
-		ctx, cancelFn := context.WithTimeout(context.Background(), timeout)
-		defer cancelFn()
-		addrs, err := s.resolver.LookupHost(ctx, instance.Endpoint)
+		var addrs []string
+		err := s.do(ctx, "resolve "+instance.Endpoint, func(ctx context.Context) error {
+			var err error
+			addrs, err = s.resolver.LookupHost(ctx, instance.Endpoint)
+			return err
+		})
 		if err != nil {
-			return nil, fmt.Errorf("unable to resolve target %s: %w", instance, err)
+			return nil, fmt.Errorf("unable to resolve target %s: %w", instance.Endpoint, err)
 		}
 		instanceAddrs[instance] = addrs
 	}
 	return instanceAddrs, nil
 }
 
-func (s *SRV) findLocalInstance() (cloud.Instance, error) {
-	localIP, err := s.localResolver.GetLocalIP()
+func (s *SRV) findLocalInstance(ctx context.Context) (cloud.Instance, error) {
+	localIP, err := s.localResolver.GetLocalIP(ctx)
 	if err != nil {
 		return cloud.Instance{}, fmt.Errorf("unable to lookup local IP: %w", err)
 	}
-	instances, err := s.GetInstances()
+	instances, err := s.GetInstances(ctx)
 	if err != nil {
 		return cloud.Instance{}, err
 	}
-	instanceAddrs, err := s.lookupInstanceAddresses(instances)
+	instanceAddrs, err := s.lookupInstanceAddresses(ctx, instances)
 	if err != nil {
 		return cloud.Instance{}, fmt.Errorf("unable to lookup SRV targets: %w", err)
 	}
@@ -134,9 +153,9 @@ func (s *SRV) findLocalInstance() (cloud.Instance, error) {
 }
 
 // GetLocalInstance will return the unique name and endpoint of the local instance using the SRV record.
-func (s *SRV) GetLocalInstance() (cloud.Instance, error) {
+func (s *SRV) GetLocalInstance(ctx context.Context) (cloud.Instance, error) {
 	if s.localInstance == nil {
-		instance, err := s.findLocalInstance()
+		instance, err := s.findLocalInstance(ctx)
 		if err != nil {
 			return cloud.Instance{}, err
 		}
@@ -146,6 +165,15 @@ func (s *SRV) GetLocalInstance() (cloud.Instance, error) {
 }
 
 // GetLocalIP returns the local IP delegating to the LocalResolver.
-func (s *SRV) GetLocalIP() (string, error) {
-	return s.localResolver.GetLocalIP()
+func (s *SRV) GetLocalIP(ctx context.Context) (string, error) {
+	return s.localResolver.GetLocalIP(ctx)
+}
+
+// do calls fn with a timeout for each attempt, retrying DNS timeouts and temporary failures according to the policy.
+func (s *SRV) do(ctx context.Context, name string, fn func(context.Context) error) error {
+	return retry.Do(ctx, s.retryPolicy, name, retry.Network, func(ctx context.Context) error {
+		ctx, cancelFn := context.WithTimeout(ctx, timeout)
+		defer cancelFn()
+		return fn(ctx)
+	})
 }
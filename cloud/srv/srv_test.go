@@ -4,9 +4,11 @@ import (
 	"context"
 	"net"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/sky-uk/etcd-bootstrap/retry"
 )
 
 func TestSRV(t *testing.T) {
@@ -27,16 +29,19 @@ var _ = Describe("SRV Instances", func() {
 
 	BeforeEach(func() {
 		domainName = "my-etcd-cluster.example.com"
-		service = "etcd-server-ssl"
+		service = "etcd-client-ssl"
 		addrs = []*net.SRV{
 			&net.SRV{
 				Target: "etcd-1",
+				Port:   2379,
 			},
 			&net.SRV{
 				Target: "etcd-2",
+				Port:   2379,
 			},
 			&net.SRV{
 				Target: "etcd-3",
+				Port:   12379,
 			},
 		}
 		sentTXTs = make(map[string][]string)
@@ -58,20 +63,20 @@ var _ = Describe("SRV Instances", func() {
 		localResolver = &stubLocalResolver{
 			sentIP: "10.10.10.2",
 		}
-		srv = New(domainName, service, localResolver)
+		srv = New(domainName, service, localResolver, retry.Policy{MaxAttempts: 3, InitialInterval: time.Millisecond})
 		srv.resolver = resolver
 	})
 
 	It("should request the correct SRV record", func() {
-		_, err := srv.GetInstances()
+		_, err := srv.GetInstances(context.Background())
 		Expect(err).To(Succeed())
-		Expect(resolver.receivedService).To(Equal("etcd-server-ssl"))
+		Expect(resolver.receivedService).To(Equal("etcd-client-ssl"))
 		Expect(resolver.receivedProto).To(Equal("tcp"))
 		Expect(resolver.receivedName).To(Equal("my-etcd-cluster.example.com"))
 	})
 
 	It("should return the instances in the SRV record", func() {
-		instances, err := srv.GetInstances()
+		instances, err := srv.GetInstances(context.Background())
 		Expect(err).To(Succeed())
 		Expect(instances).To(HaveLen(3))
 		Expect(instances[0].Endpoint).To(Equal("etcd-1"))
@@ -79,8 +84,35 @@ var _ = Describe("SRV Instances", func() {
 		Expect(instances[2].Endpoint).To(Equal("etcd-3"))
 	})
 
+	It("should use the SRV port as the client port", func() {
+		instances, err := srv.GetInstances(context.Background())
+		Expect(err).To(Succeed())
+		Expect(instances).To(HaveLen(3))
+		Expect(instances[0].ClientPort).To(Equal(2379))
+		Expect(instances[1].ClientPort).To(Equal(2379))
+		Expect(instances[2].ClientPort).To(Equal(12379))
+	})
+
+	Context("with etcd's server SRV service", func() {
+		BeforeEach(func() {
+			service = "etcd-server-ssl"
+			for _, addr := range addrs {
+				addr.Port = 2380
+			}
+		})
+
+		It("should not use the peer port as the client port", func() {
+			instances, err := srv.GetInstances(context.Background())
+			Expect(err).To(Succeed())
+			Expect(instances).To(HaveLen(3))
+			for _, instance := range instances {
+				Expect(instance.ClientPort).To(Equal(0))
+			}
+		})
+	})
+
 	It("should return unique instance IDs", func() {
-		instances, err := srv.GetInstances()
+		instances, err := srv.GetInstances(context.Background())
 		Expect(err).To(Succeed())
 		Expect(instances).To(HaveLen(3))
 		Expect(instances[0].Name).To(Equal("i-abc1"))
@@ -89,11 +121,26 @@ var _ = Describe("SRV Instances", func() {
 	})
 
 	It("should discover its local instance information via the SRV record", func() {
-		local, err := srv.GetLocalInstance()
+		local, err := srv.GetLocalInstance(context.Background())
 		Expect(err).To(Succeed())
 		Expect(local.Name).To(Equal("i-abc2"))
 		Expect(local.Endpoint).To(Equal("etcd-2"))
 	})
+
+	It("should retry lookups which time out", func() {
+		resolver.sentErrs = []error{&net.DNSError{Err: "i/o timeout", IsTimeout: true}}
+		instances, err := srv.GetInstances(context.Background())
+		Expect(err).To(Succeed())
+		Expect(instances).To(HaveLen(3))
+		Expect(resolver.srvLookups).To(Equal(2))
+	})
+
+	It("should not retry lookups of names which don't exist", func() {
+		resolver.sentErrs = []error{&net.DNSError{Err: "no such host", IsNotFound: true}}
+		_, err := srv.GetInstances(context.Background())
+		Expect(err).ToNot(Succeed())
+		Expect(resolver.srvLookups).To(Equal(1))
+	})
 })
 
 type stubResolver struct {
@@ -101,6 +148,8 @@ type stubResolver struct {
 	sentCname                                    string
 	sentAddrs                                    []*net.SRV
 	sentErr                                      error
+	sentErrs                                     []error
+	srvLookups                                   int
 	sentTXTs                                     map[string][]string
 	sentTXTerr                                   error
 	sentHostAddrs                                map[string][]string
@@ -111,6 +160,11 @@ func (r *stubResolver) LookupSRV(ctx context.Context, service, proto, name strin
 	r.receivedService = service
 	r.receivedProto = proto
 	r.receivedName = name
+	r.srvLookups++
+	if len(r.sentErrs) > 0 {
+		err, r.sentErrs = r.sentErrs[0], r.sentErrs[1:]
+		return "", nil, err
+	}
 	return r.sentCname, r.sentAddrs, r.sentErr
 }
 
@@ -127,6 +181,6 @@ type stubLocalResolver struct {
 	sentErr error
 }
 
-func (r *stubLocalResolver) GetLocalIP() (string, error) {
+func (r *stubLocalResolver) GetLocalIP(context.Context) (string, error) {
 	return r.sentIP, r.sentErr
 }
@@ -0,0 +1,221 @@
+package static
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the configuration for a fixed list of instances.
+type Config struct {
+	// Instances in the cluster.
+	Instances []cloud.Instance
+	// File is the path to a YAML or JSON file listing more instances.
+	File string
+	// Name of the local instance. If empty, the local instance is found by the hostname or interface IPs.
+	Name string
+}
+
+// fileConfig is the format of the instances file.
+type fileConfig struct {
+	Instances []struct {
+		Name       string `yaml:"name"`
+		Endpoint   string `yaml:"endpoint"`
+		ClientPort int    `yaml:"clientPort"`
+	} `yaml:"instances"`
+}
+
+// host looks up details of the local host. It's replaced in tests.
+type host struct {
+	hostname       func() (string, error)
+	interfaceAddrs func() ([]net.Addr, error)
+	lookupHost     func(string) ([]string, error)
+}
+
+// Static returns instance information from a fixed list of instances.
+type Static struct {
+	instances []cloud.Instance
+	local     cloud.Instance
+	localIP   string
+}
+
+// New returns the static instances, finding the local instance amongst them.
+func New(cfg *Config) (*Static, error) {
+	return newStatic(cfg, host{
+		hostname:       os.Hostname,
+		interfaceAddrs: net.InterfaceAddrs,
+		lookupHost:     net.LookupHost,
+	})
+}
+
+func newStatic(cfg *Config, h host) (*Static, error) {
+	instances := append([]cloud.Instance{}, cfg.Instances...)
+	if cfg.File != "" {
+		fileInstances, err := readFile(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, fileInstances...)
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("no instances were provided")
+	}
+	names := make(map[string]bool)
+	for _, instance := range instances {
+		if instance.Name == "" || instance.Endpoint == "" {
+			return nil, fmt.Errorf("instance %+v must have a name and endpoint", instance)
+		}
+		if names[instance.Name] {
+			return nil, fmt.Errorf("instance name %s is used more than once", instance.Name)
+		}
+		names[instance.Name] = true
+	}
+
+	s := &Static{instances: instances}
+	if err := s.findLocalInstance(cfg.Name, h); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func readFile(file string) ([]cloud.Instance, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read instances file: %w", err)
+	}
+	// YAML is a superset of JSON, so this handles both.
+	var config fileConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("unable to parse instances file %s: %w", file, err)
+	}
+	var instances []cloud.Instance
+	for _, i := range config.Instances {
+		instances = append(instances, cloud.Instance{Name: i.Name, Endpoint: i.Endpoint, ClientPort: i.ClientPort})
+	}
+	return instances, nil
+}
+
+// findLocalInstance looks for the local instance by name, then by hostname, and finally by matching the
+// instance endpoints against the local interface IPs.
+func (s *Static) findLocalInstance(name string, h host) error {
+	localIPs, err := localIPs(h)
+	if err != nil {
+		return err
+	}
+
+	if name != "" {
+		for _, instance := range s.instances {
+			if instance.Name == name {
+				return s.setLocalInstance(instance, localIPs, h)
+			}
+		}
+		return fmt.Errorf("no instance named %s", name)
+	}
+
+	hostname, err := h.hostname()
+	if err != nil {
+		return fmt.Errorf("unable to get hostname: %w", err)
+	}
+	shortHostname := strings.SplitN(hostname, ".", 2)[0]
+	for _, instance := range s.instances {
+		if instance.Name == hostname || instance.Name == shortHostname || instance.Endpoint == hostname {
+			return s.setLocalInstance(instance, localIPs, h)
+		}
+	}
+
+	for _, instance := range s.instances {
+		if ip := localEndpointIP(instance, localIPs, h); ip != "" {
+			s.local = instance
+			s.localIP = ip
+			return nil
+		}
+	}
+	return fmt.Errorf("none of the instances match the hostname %s or local IPs %v, use the name to choose one",
+		hostname, localIPs)
+}
+
+// setLocalInstance sets the local instance, and the IP it should listen on.
+func (s *Static) setLocalInstance(instance cloud.Instance, localIPs []string, h host) error {
+	ip := localEndpointIP(instance, localIPs, h)
+	if ip == "" {
+		return fmt.Errorf("local instance %s endpoint %s doesn't resolve to any of the local IPs %v",
+			instance.Name, instance.Endpoint, localIPs)
+	}
+	s.local = instance
+	s.localIP = ip
+	return nil
+}
+
+// localEndpointIP returns the local IP the instance's endpoint resolves to, or empty if it isn't local.
+func localEndpointIP(instance cloud.Instance, localIPs []string, h host) string {
+	addrs := []string{instance.Endpoint}
+	if net.ParseIP(instance.Endpoint) == nil {
+		resolved, err := h.lookupHost(instance.Endpoint)
+		if err != nil {
+			return ""
+		}
+		addrs = resolved
+	}
+	for _, addr := range addrs {
+		for _, ip := range localIPs {
+			if net.ParseIP(addr).Equal(net.ParseIP(ip)) {
+				return ip
+			}
+		}
+	}
+	return ""
+}
+
+func localIPs(h host) ([]string, error) {
+	addrs, err := h.interfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get local interface addresses: %w", err)
+	}
+	var ips []string
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP.String())
+		}
+	}
+	return ips, nil
+}
+
+// GetInstances returns the static instances.
+func (s *Static) GetInstances(context.Context) ([]cloud.Instance, error) {
+	return s.instances, nil
+}
+
+// GetLocalInstance returns the instance running on this host.
+func (s *Static) GetLocalInstance(context.Context) (cloud.Instance, error) {
+	return s.local, nil
+}
+
+// GetLocalIP returns the local interface IP that the local instance's endpoint resolves to.
+func (s *Static) GetLocalIP(context.Context) (string, error) {
+	return s.localIP, nil
+}
+
+// ParseInstance parses an instance in the form name=endpoint, or name=endpoint:clientPort.
+func ParseInstance(value string) (cloud.Instance, error) {
+	split := strings.SplitN(value, "=", 2)
+	if len(split) != 2 || split[0] == "" || split[1] == "" {
+		return cloud.Instance{}, fmt.Errorf("instance %q must be of the form name=endpoint[:clientPort]", value)
+	}
+	instance := cloud.Instance{Name: split[0], Endpoint: split[1]}
+	if host, port, err := net.SplitHostPort(split[1]); err == nil {
+		clientPort, err := strconv.Atoi(port)
+		if err != nil || clientPort < 1 || clientPort > 65535 {
+			return cloud.Instance{}, fmt.Errorf("instance %q has an invalid client port %s", value, port)
+		}
+		instance.Endpoint = host
+		instance.ClientPort = clientPort
+	}
+	return instance, nil
+}
@@ -0,0 +1,146 @@
+package static
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestStatic(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Static Suite")
+}
+
+var _ = Describe("Static Instances", func() {
+	var (
+		cfg      *Config
+		hostname string
+		localIPs []string
+		hosts    map[string][]string
+		h        host
+	)
+
+	BeforeEach(func() {
+		cfg = &Config{
+			Instances: []cloud.Instance{
+				{Name: "etcd-1", Endpoint: "10.0.0.1"},
+				{Name: "etcd-2", Endpoint: "etcd-2.example.com"},
+				{Name: "etcd-3", Endpoint: "10.0.0.3"},
+			},
+		}
+		hostname = "unknown"
+		localIPs = []string{"127.0.0.1", "10.0.0.2"}
+		hosts = map[string][]string{"etcd-2.example.com": {"10.0.0.2"}}
+		h = host{
+			hostname: func() (string, error) { return hostname, nil },
+			interfaceAddrs: func() ([]net.Addr, error) {
+				var addrs []net.Addr
+				for _, ip := range localIPs {
+					addrs = append(addrs, &net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(24, 32)})
+				}
+				return addrs, nil
+			},
+			lookupHost: func(name string) ([]string, error) {
+				if addrs, ok := hosts[name]; ok {
+					return addrs, nil
+				}
+				return nil, fmt.Errorf("no such host %s", name)
+			},
+		}
+	})
+
+	It("finds the local instance by name", func() {
+		cfg.Name = "etcd-2"
+		s, err := newStatic(cfg, h)
+		Expect(err).To(BeNil())
+		Expect(s.GetLocalInstance(context.Background())).To(Equal(cloud.Instance{Name: "etcd-2", Endpoint: "etcd-2.example.com"}))
+		Expect(s.GetLocalIP(context.Background())).To(Equal("10.0.0.2"))
+		Expect(s.GetInstances(context.Background())).To(Equal(cfg.Instances))
+	})
+
+	It("fails if the named instance isn't local", func() {
+		cfg.Name = "etcd-1"
+		_, err := newStatic(cfg, h)
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("finds the local instance by hostname", func() {
+		hostname = "etcd-2.example.com"
+		s, err := newStatic(cfg, h)
+		Expect(err).To(BeNil())
+		Expect(s.GetLocalInstance(context.Background())).To(Equal(cloud.Instance{Name: "etcd-2", Endpoint: "etcd-2.example.com"}))
+	})
+
+	It("finds the local instance by interface IP", func() {
+		localIPs = []string{"127.0.0.1", "10.0.0.3"}
+		s, err := newStatic(cfg, h)
+		Expect(err).To(BeNil())
+		Expect(s.GetLocalInstance(context.Background())).To(Equal(cloud.Instance{Name: "etcd-3", Endpoint: "10.0.0.3"}))
+		Expect(s.GetLocalIP(context.Background())).To(Equal("10.0.0.3"))
+	})
+
+	It("fails if no instance is local", func() {
+		localIPs = []string{"127.0.0.1"}
+		_, err := newStatic(cfg, h)
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("rejects duplicate names", func() {
+		cfg.Instances = append(cfg.Instances, cloud.Instance{Name: "etcd-1", Endpoint: "10.0.0.4"})
+		_, err := newStatic(cfg, h)
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("reads instances from a file", func() {
+		dir, err := ioutil.TempDir("", "static")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		By("Reading YAML")
+		cfg.File = filepath.Join(dir, "instances.yaml")
+		Expect(ioutil.WriteFile(cfg.File, []byte(`instances:
+- name: etcd-4
+  endpoint: 10.0.0.4
+  clientPort: 12379
+`), 0644)).To(Succeed())
+		s, err := newStatic(cfg, h)
+		Expect(err).To(BeNil())
+		Expect(s.GetInstances(context.Background())).To(ContainElement(cloud.Instance{Name: "etcd-4", Endpoint: "10.0.0.4", ClientPort: 12379}))
+
+		By("Reading JSON")
+		cfg.Instances = nil
+		cfg.File = filepath.Join(dir, "instances.json")
+		Expect(ioutil.WriteFile(cfg.File, []byte(`{"instances": [{"name": "etcd-2", "endpoint": "10.0.0.2"}]}`), 0644)).
+			To(Succeed())
+		s, err = newStatic(cfg, h)
+		Expect(err).To(BeNil())
+		Expect(s.GetInstances(context.Background())).To(Equal([]cloud.Instance{{Name: "etcd-2", Endpoint: "10.0.0.2"}}))
+
+		By("Rejecting unknown fields")
+		Expect(ioutil.WriteFile(cfg.File, []byte(`{"instances": [{"nmae": "etcd-2"}]}`), 0644)).To(Succeed())
+		_, err = newStatic(cfg, h)
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("parses instances from flags", func() {
+		Expect(ParseInstance("etcd-1=10.0.0.1")).To(Equal(cloud.Instance{Name: "etcd-1", Endpoint: "10.0.0.1"}))
+		Expect(ParseInstance("etcd-1=etcd-1.example.com:12379")).To(
+			Equal(cloud.Instance{Name: "etcd-1", Endpoint: "etcd-1.example.com", ClientPort: 12379}))
+		Expect(ParseInstance("etcd-1=fd00::1")).To(Equal(cloud.Instance{Name: "etcd-1", Endpoint: "fd00::1"}))
+		Expect(ParseInstance("etcd-1=[fd00::1]:12379")).To(
+			Equal(cloud.Instance{Name: "etcd-1", Endpoint: "fd00::1", ClientPort: 12379}))
+		_, err := ParseInstance("10.0.0.1")
+		Expect(err).ToNot(BeNil())
+		_, err = ParseInstance("etcd-1=10.0.0.1:http")
+		Expect(err).ToNot(BeNil())
+	})
+})
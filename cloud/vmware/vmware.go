@@ -45,27 +45,23 @@ type Members struct {
 }
 
 // GetInstances will return the vmware etcd instances
-func (m *Members) GetInstances() ([]cloud.Instance, error) {
+func (m *Members) GetInstances(context.Context) ([]cloud.Instance, error) {
 	return m.instances, nil
 }
 
 // GetLocalInstance will get the vmware instance etcd bootstrap is running on
-func (m *Members) GetLocalInstance() (cloud.Instance, error) {
+func (m *Members) GetLocalInstance(context.Context) (cloud.Instance, error) {
 	return m.instance, nil
 }
 
 // GetLocalIP returns the same value as the GetLocalInstance() endpoint.
-func (m *Members) GetLocalIP() (string, error) {
-	localInstance, _ := m.GetLocalInstance()
+func (m *Members) GetLocalIP(ctx context.Context) (string, error) {
+	localInstance, _ := m.GetLocalInstance(ctx)
 	return localInstance.Endpoint, nil
 }
 
 // NewVMware returns the Members this local instance belongs to.
-func NewVMware(cfg *Config) (*Members, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-
-	defer cancel()
-
+func NewVMware(ctx context.Context, cfg *Config) (*Members, error) {
 	c, err := newClient(ctx, cfg)
 	if err != nil {
 		return nil, err
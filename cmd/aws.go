@@ -1,8 +1,10 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/sky-uk/etcd-bootstrap/bootstrap"
 	"github.com/sky-uk/etcd-bootstrap/cloud"
@@ -12,6 +14,8 @@ import (
 	aws_cloud "github.com/sky-uk/etcd-bootstrap/cloud/aws"
 	"github.com/sky-uk/etcd-bootstrap/cloud/noop"
 	"github.com/sky-uk/etcd-bootstrap/cloud/srv"
+	"github.com/sky-uk/etcd-bootstrap/metrics"
+	"github.com/sky-uk/etcd-bootstrap/watch"
 	"github.com/spf13/cobra"
 )
 
@@ -20,13 +24,29 @@ var awsCmd = &cobra.Command{
 	Use:   "aws",
 	Short: "Generates config for an AWS etcd cluster",
 	Run:   aws,
+	// Persistent so the provider's subcommands are validated too.
+	PersistentPreRun: checkAWSParams,
 }
 
 var (
 	awsRegistrationProvider string
 	route53ZoneID           string
 	dnsHostname             string
+	dnsTTL                  int64
+	dnsWaitForSync          bool
+	route53NodeRecords      bool
+	route53SRVRecords       bool
+	route53HealthyOnly      bool
+	route53HealthCheck      string
 	lbTargetGroupName       string
+	lbTargetGroupARN        string
+	lbTargetPort            int
+	lbTargetAllZones        bool
+	lbWaitForHealthy        time.Duration
+	lbMaxDeregistrations    int
+	lbForceDeregister       bool
+	lbManagedCIDRs          []string
+	lbManagedPorts          []int
 	instanceLookupMethod    string
 	srvDomainName           string
 	srvService              string
@@ -41,17 +61,50 @@ var (
 
 func init() {
 	RootCmd.AddCommand(awsCmd)
-	f := awsCmd.Flags()
+	awsCmd.AddCommand(newPromoteCmd(newAWSBootstrapper))
+	awsCmd.AddCommand(newOperatorCmds(newAWSBootstrapper)...)
+	awsCmd.AddCommand(newWatchCmd(newAWSWatcher))
+	f := awsCmd.PersistentFlags()
 	f.StringVarP(&awsRegistrationProvider, "registration-provider", "r", "noop", fmt.Sprintf(
-		"automatic registration provider to use, options are: noop, lb, route53"))
+		"automatic registration provider to use, options are: noop, lb, route53, consul"))
 	f.StringVar(&route53ZoneID, "r53-zone-id", "",
 		"zone id for automatic registration for registration-provider=route53")
 	f.StringVar(&dnsHostname, "dns-hostname", "",
 		"hostname to set to the etcd cluster when registration-provider=route53")
+	f.Int64Var(&dnsTTL, "dns-ttl", 300, "TTL in seconds of the records when registration-provider=route53")
+	f.BoolVar(&dnsWaitForSync, "dns-wait-for-sync", false,
+		"wait for the records to reach all the name servers when registration-provider=route53")
+	f.BoolVar(&route53NodeRecords, "r53-node-records", false,
+		"also publish an A and a name TXT record for each instance under the dns-hostname when "+
+			"registration-provider=route53")
+	f.BoolVar(&route53SRVRecords, "r53-srv-records", false,
+		"also publish etcd's SRV records under the dns-hostname when registration-provider=route53, "+
+			"implies --r53-node-records")
+	f.BoolVar(&route53HealthyOnly, "r53-healthy-only", false,
+		"only publish instances which are healthy etcd members when registration-provider=route53")
+	f.StringVar(&route53HealthCheck, "r53-health-check", "none",
+		"publish multivalue answer records with a Route53 health check of each instance's client port when "+
+			"registration-provider=route53, options are: none, tcp, http, https")
 	f.StringVar(&lbTargetGroupName, "lb-target-group-name", "",
 		"loadbalancer target group name to use when --registration-provider=lb")
+	f.StringVar(&lbTargetGroupARN, "lb-target-group-arn", "",
+		"loadbalancer target group ARN to use instead of the name when --registration-provider=lb")
+	f.IntVar(&lbTargetPort, "lb-target-port", 0,
+		"port to register the targets on when --registration-provider=lb, defaults to the target group's port")
+	f.BoolVar(&lbTargetAllZones, "lb-target-all-zones", false,
+		"register the targets in all availability zones when --registration-provider=lb, for IPs outside the VPC")
+	f.DurationVar(&lbWaitForHealthy, "lb-wait-for-healthy", 0,
+		"how long to wait for the local target to be healthy when --registration-provider=lb, 0 to not wait")
+	f.IntVar(&lbMaxDeregistrations, "lb-max-deregistrations", 1,
+		"most targets to deregister at a time when --registration-provider=lb, 0 for no limit")
+	f.BoolVar(&lbForceDeregister, "lb-force-deregister", false,
+		"deregister targets which aren't instances even if they're healthy when --registration-provider=lb")
+	f.StringSliceVar(&lbManagedCIDRs, "lb-managed-cidr", nil,
+		"only deregister targets in these CIDRs when --registration-provider=lb, for shared target groups")
+	f.IntSliceVar(&lbManagedPorts, "lb-managed-port", nil,
+		"only deregister targets on these ports when --registration-provider=lb, for shared target groups")
 	f.StringVar(&instanceLookupMethod, "instance-lookup-method", "asg",
-		"method for looking up instances in the cluster, options are: asg, srv")
+		"method for looking up instances in the cluster, options are: asg, srv, consul")
 	f.StringVar(&srvDomainName, "srv-domain-name", "", "domain name to use for instance-lookup-method=srv")
 	f.StringVar(&srvService, "srv-service", "etcd-bootstrap", "service to use for instance-lookup-method=srv")
 	f.BoolVar(&enableTLS, "enable-tls", false, "enable TLS")
@@ -61,31 +114,86 @@ func init() {
 	f.StringVar(&peerCA, "tls-peer-ca", "", "path to peer CA")
 	f.StringVar(&peerCert, "tls-peer-cert", "", "path to peer certificate")
 	f.StringVar(&peerKey, "tls-peer-key", "", "path to peer key")
+	addConsulFlags(f)
 }
 
 func aws(cmd *cobra.Command, args []string) {
-	aws, err := aws_cloud.NewAWS()
+	ctx := context.Background()
+	cloudAPI := createCloudAPI(newAWS())
+	bootstrapper := createAWSBootstrapper(cloudAPI)
+	if dryRun {
+		printPlan(ctx, bootstrapper)
+		log.Infof("Dry run, so not updating the %s registration provider", awsRegistrationProvider)
+		return
+	}
+
+	if err := bootstrapper.GenerateEtcdFlagsFile(ctx, outputFilename); err != nil {
+		log.Fatalf("Failed to generate etcd flags file: %v", err)
+	}
+
+	var healthyFrom watch.EtcdAPI
+	if awsRegistrationProvider == "route53" && route53HealthyOnly {
+		healthyFrom = createEtcdClusterAPI(cloudAPI)
+	}
+	registerInstances(ctx, cloudAPI, awsRegistrationProvider, initialiseAWSRegistrationProvider(), healthyFrom)
+}
+
+func newAWS() *aws_cloud.AWS {
+	aws, err := aws_cloud.NewAWS(retryPolicy())
 	if err != nil {
 		log.Fatalf("Failed to create AWS provider: %v", err)
 	}
+	return aws
+}
 
-	cloudAPI := createCloudAPI(aws)
+func newAWSBootstrapper() *bootstrap.Bootstrapper {
+	return createAWSBootstrapper(createCloudAPI(newAWS()))
+}
+
+func createAWSBootstrapper(cloudAPI bootstrap.CloudAPI) *bootstrap.Bootstrapper {
 	etcdClusterAPI := createEtcdClusterAPI(cloudAPI)
 
-	var opts []bootstrap.Option
+	opts := bootstrapOptions()
 	if enableTLS {
-		opts = []bootstrap.Option{bootstrap.WithTLS(serverCA, serverCert, serverKey, peerCA, peerCert, peerKey)}
+		opts = append(opts, bootstrap.WithTLS(serverCA, serverCert, serverKey, peerCA, peerCert, peerKey))
 	}
 	bootstrapper, err := bootstrap.New(cloudAPI, etcdClusterAPI, opts...)
 	if err != nil {
 		log.Fatalf("Failed to create etcd bootstrapper: %v", err)
 	}
+	return bootstrapper
+}
+
+func newAWSWatcher(opts ...watch.Option) *watch.Watcher {
+	if awsRegistrationProvider == "route53" && route53HealthyOnly {
+		opts = append(opts, watch.WithHealthyOnly())
+	}
+	watcher, err := watch.New(newAWSWatchAPIs, initialiseAWSRegistrationProvider(), opts...)
+	if err != nil {
+		log.Fatalf("Failed to create watcher: %v", err)
+	}
+	return watcher
+}
 
-	if err := bootstrapper.GenerateEtcdFlagsFile(outputFilename); err != nil {
-		log.Fatalf("Failed to generate etcd flags file: %v", err)
+// newAWSWatchAPIs creates a new AWS provider and etcd client for each sync, as they keep the instances they first
+// look up.
+func newAWSWatchAPIs(context.Context) (watch.CloudAPI, watch.EtcdAPI, func(), error) {
+	aws, err := aws_cloud.NewAWS(retryPolicy())
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("unable to create AWS provider: %w", err)
 	}
+	cloudAPI := createCloudAPI(aws)
+	etcdCluster := createEtcdClusterAPI(cloudAPI)
+	return cloudAPI, etcdCluster, closeEtcdClusterAPI(etcdCluster), nil
+}
 
-	registerInstances(cloudAPI)
+// closeEtcdClusterAPI returns a function to close the etcd client, logging any error.
+func closeEtcdClusterAPI(etcdCluster *etcd.ClusterAPI) func() {
+	return func() {
+		if err := etcdCluster.Close(); err != nil {
+			log.Warnf("Failed to close etcd client: %v", err)
+		}
+	}
 }
 
 type localIPResolver struct {
@@ -93,7 +201,7 @@ type localIPResolver struct {
 }
 
 func (l *localIPResolver) LookupLocalIP() (net.IP, error) {
-	localInstance, err := l.aws.GetLocalInstance()
+	localInstance, err := l.aws.GetLocalInstance(context.Background())
 	if err != nil {
 		return net.IP{}, err
 	}
@@ -109,41 +217,57 @@ func createCloudAPI(aws *aws_cloud.AWS) bootstrap.CloudAPI {
 	switch instanceLookupMethod {
 	case "asg":
 		log.Info("Using ASG for looking up cluster instances")
-		return aws
+		return metrics.InstrumentCloudAPI("aws", aws)
 	case "srv":
 		log.Info("Using SRV record for looking up cluster instances")
-		if srvDomainName == "" {
-			log.Fatalf("srv-domain-name must be provided")
-		}
-		if srvService == "" {
-			log.Fatalf("srv-service must be provided")
-		}
-		return srv.New(srvDomainName, srvService, aws)
+		return metrics.InstrumentCloudAPI("srv", srv.New(srvDomainName, srvService, aws, retryPolicy()))
+	case "consul":
+		return createConsulCloudAPI(aws)
 	default:
 		log.Fatalf("Unsupported cluster lookup method %q", instanceLookupMethod)
 		return nil
 	}
 }
 
-func registerInstances(cloudInstances bootstrap.CloudAPI) {
-	instances, err := cloudInstances.GetInstances()
+// registerInstances updates the registration provider with the cloud instances, or only those which are healthy
+// etcd members if healthyFrom is set. The registration provider is left alone if none of them are healthy.
+func registerInstances(ctx context.Context, cloudInstances bootstrap.CloudAPI, name string,
+	registrator registrationProvider, healthyFrom watch.EtcdAPI) {
+	instances, err := cloudInstances.GetInstances(ctx)
 	if err != nil {
 		log.Fatalf("Failed to retrieve instances: %v", err)
 	}
-	registrator := initialiseAWSRegistrationProvider()
-	if err := registrator.Update(instances); err != nil {
+	if healthyFrom != nil {
+		healthy, unhealthy, err := watch.HealthyInstances(ctx, healthyFrom, instances)
+		if err != nil {
+			log.Fatalf("Failed to check the health of instances: %v", err)
+		}
+		if len(healthy) == 0 {
+			log.Warnf("None of the instances are healthy etcd members yet, so not updating the %s registration "+
+				"provider", name)
+			return
+		}
+		if len(unhealthy) > 0 {
+			log.Infof("Not registering instances which aren't healthy etcd members: %v", unhealthy)
+		}
+		instances = healthy
+	}
+	start := time.Now()
+	err = registrator.Update(ctx, instances)
+	runReport.AddRegistration(name, instances, start, err)
+	if err != nil {
 		log.Fatalf("Failed to register etcd cluster data with cloud registration provider: %v", err)
 	}
 }
 
 type registrationProvider interface {
-	Update([]cloud.Instance) error
+	Update(context.Context, []cloud.Instance) error
 }
 
 func createEtcdClusterAPI(instances etcd.CloudAPI) *etcd.ClusterAPI {
-	var etcdOpts []etcd.Option
+	etcdOpts := etcdOptions()
 	if enableTLS {
-		etcdOpts = []etcd.Option{etcd.WithTLS(peerCA, peerCert, peerKey)}
+		etcdOpts = append(etcdOpts, etcd.WithTLS(peerCA, peerCert, peerKey))
 	}
 	etcdCluster, err := etcd.New(instances, etcdOpts...)
 	if err != nil {
@@ -156,34 +280,101 @@ func initialiseAWSRegistrationProvider() registrationProvider {
 	switch awsRegistrationProvider {
 	case "noop":
 		log.Info("Using noop cloud registration provider")
-		return noop.RegistrationProvider{}
+		return metrics.InstrumentRegistrationProvider("noop", noop.RegistrationProvider{})
 	case "route53":
-		checkRequiredFlag(route53ZoneID, "--r53-zone-id")
-		checkRequiredFlag(dnsHostname, "--dns-hostname")
-
-		registrator, err := aws_cloud.NewRoute53RegistrationProvider(&aws_cloud.Route53RegistrationProviderConfig{
-			ZoneID:   route53ZoneID,
-			Hostname: dnsHostname,
-		})
+		registrator, err := aws_cloud.NewRoute53RegistrationProvider(context.Background(),
+			&aws_cloud.Route53RegistrationProviderConfig{
+				ZoneID:          route53ZoneID,
+				Hostname:        dnsHostname,
+				TTL:             dnsTTL,
+				WaitForSync:     dnsWaitForSync,
+				NodeRecords:     route53NodeRecords,
+				SRVRecords:      route53SRVRecords,
+				TLS:             enableTLS,
+				PeerPort:        peerPort,
+				ClientPort:      clientPort,
+				HealthCheckType: aws_cloud.HealthCheckTypes[route53HealthCheck],
+				RetryPolicy:     retryPolicy(),
+			})
 		if err != nil {
 			log.Fatalf("Failed to create route53 registration client: %v", err)
 		}
 		log.Info("Using route53 cloud registration provider")
-		return registrator
+		return metrics.InstrumentRegistrationProvider("route53", registrator)
 	case "lb":
-		checkRequiredFlag(lbTargetGroupName, "--lb-target-group-name")
-
-		registrator, err := aws_cloud.NewLBTargetGroupRegistrationProvider(&aws_cloud.LBTargetGroupRegistrationProviderConfig{
-			TargetGroupName: lbTargetGroupName,
-		})
+		registrator, err := aws_cloud.NewLBTargetGroupRegistrationProvider(context.Background(),
+			&aws_cloud.LBTargetGroupRegistrationProviderConfig{
+				TargetGroupName:      lbTargetGroupName,
+				TargetGroupARN:       lbTargetGroupARN,
+				Port:                 lbTargetPort,
+				AllAvailabilityZones: lbTargetAllZones,
+				WaitForHealthy:       lbWaitForHealthy,
+				MaxDeregistrations:   lbMaxDeregistrations,
+				ForceDeregistration:  lbForceDeregister,
+				ManagedCIDRs:         lbManagedCIDRs,
+				ManagedPorts:         lbManagedPorts,
+				RetryPolicy:          retryPolicy(),
+			})
 		if err != nil {
 			log.Fatalf("Failed to create loadbalancer registration client: %v", err)
 		}
 
 		log.Info("Using loadbalancer target group cloud registration provider")
-		return registrator
+		return metrics.InstrumentRegistrationProvider("lb", registrator)
+	case "consul":
+		scheme := "http"
+		if enableTLS {
+			scheme = "https"
+		}
+		return createConsulRegistrationProvider(scheme)
 	default:
 		log.Fatalf("Unsupported registration type: %v", awsRegistrationProvider)
 		return nil
 	}
 }
+
+// checkRoute53HealthCheck checks the Route53 health checks can pass. With TLS, etcd requires client certificates,
+// which Route53's health checkers can't present, so only tcp checks work.
+func checkRoute53HealthCheck(healthCheck string, tls bool) error {
+	if _, ok := aws_cloud.HealthCheckTypes[healthCheck]; !ok && healthCheck != "none" {
+		return fmt.Errorf("unsupported --r53-health-check %q, options are: none, tcp, http, https", healthCheck)
+	}
+	if tls && (healthCheck == "http" || healthCheck == "https") {
+		return fmt.Errorf("--r53-health-check=%s always fails with --enable-tls, as etcd requires client "+
+			"certificates which Route53 can't present, use tcp instead", healthCheck)
+	}
+	return nil
+}
+
+func checkAWSParams(cmd *cobra.Command, args []string) {
+	var missing requiredValues
+	if instanceLookupMethod == "srv" {
+		missing.flag(srvDomainName, "--srv-domain-name")
+		missing.flag(srvService, "--srv-service")
+	}
+	switch awsRegistrationProvider {
+	case "route53":
+		missing.flag(route53ZoneID, "--r53-zone-id")
+		missing.flag(dnsHostname, "--dns-hostname")
+		if dnsTTL <= 0 {
+			log.Fatalf("--dns-ttl must be positive, but was %d", dnsTTL)
+		}
+		if err := checkRoute53HealthCheck(route53HealthCheck, enableTLS); err != nil {
+			log.Fatal(err)
+		}
+	case "lb":
+		if lbTargetGroupName == "" && lbTargetGroupARN == "" {
+			missing.add("--lb-target-group-name ($ETCD_BOOTSTRAP_LB_TARGET_GROUP_NAME) or " +
+				"--lb-target-group-arn ($ETCD_BOOTSTRAP_LB_TARGET_GROUP_ARN)")
+		}
+	}
+	if enableTLS {
+		missing.flag(serverCA, "--tls-ca")
+		missing.flag(serverCert, "--tls-cert")
+		missing.flag(serverKey, "--tls-key")
+		missing.flag(peerCA, "--tls-peer-ca")
+		missing.flag(peerCert, "--tls-peer-cert")
+		missing.flag(peerKey, "--tls-peer-key")
+	}
+	missing.check()
+}
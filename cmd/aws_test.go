@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Route53 health check", func() {
+	It("allows every type without TLS", func() {
+		for _, healthCheck := range []string{"none", "tcp", "http", "https"} {
+			Expect(checkRoute53HealthCheck(healthCheck, false)).To(Succeed())
+		}
+	})
+
+	It("only allows tcp with TLS, as Route53 can't present a client certificate", func() {
+		Expect(checkRoute53HealthCheck("tcp", true)).To(Succeed())
+		Expect(checkRoute53HealthCheck("none", true)).To(Succeed())
+		Expect(checkRoute53HealthCheck("https", true)).To(MatchError(ContainSubstring("use tcp instead")))
+		Expect(checkRoute53HealthCheck("http", true)).ToNot(Succeed())
+	})
+
+	It("rejects unknown types", func() {
+		Expect(checkRoute53HealthCheck("icmp", false)).To(MatchError(ContainSubstring("unsupported")))
+	})
+})
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/bootstrap"
+	"github.com/sky-uk/etcd-bootstrap/cloud/consul"
+	"github.com/sky-uk/etcd-bootstrap/metrics"
+	"github.com/spf13/pflag"
+)
+
+var (
+	consulAddress       string
+	consulDatacenter    string
+	consulService       string
+	consulTags          []string
+	consulCheckInterval time.Duration
+)
+
+// addConsulFlags adds the flags for the consul instance lookup method and registration provider.
+func addConsulFlags(f *pflag.FlagSet) {
+	f.StringVar(&consulAddress, "consul-address", "",
+		"address of the Consul agent, defaults to $CONSUL_HTTP_ADDR or the local agent")
+	f.StringVar(&consulDatacenter, "consul-datacenter", "",
+		"Consul datacenter, defaults to the agent's datacenter")
+	f.StringVar(&consulService, "consul-service", "etcd",
+		"Consul service for instance-lookup-method=consul and registration-provider=consul")
+	f.StringSliceVar(&consulTags, "consul-tag", nil,
+		"tag the Consul service must have for instance-lookup-method=consul, and to register it with, can be repeated")
+	f.DurationVar(&consulCheckInterval, "consul-check-interval", 10*time.Second,
+		"how often Consul checks etcd's health for registration-provider=consul")
+}
+
+func consulConfig() consul.Config {
+	return consul.Config{
+		Address:     consulAddress,
+		Datacenter:  consulDatacenter,
+		Service:     consulService,
+		Tags:        consulTags,
+		RetryPolicy: retryPolicy(),
+	}
+}
+
+func createConsulCloudAPI(localResolver consul.LocalResolver) bootstrap.CloudAPI {
+	log.Info("Using Consul for looking up cluster instances")
+	cfg := consulConfig()
+	c, err := consul.New(&cfg, localResolver)
+	if err != nil {
+		log.Fatalf("Failed to create Consul instance lookup: %v", err)
+	}
+	return metrics.InstrumentCloudAPI("consul", c)
+}
+
+func createConsulRegistrationProvider(scheme string) registrationProvider {
+	registrator, err := consul.NewRegistrationProvider(&consul.RegistrationProviderConfig{
+		Config:        consulConfig(),
+		Scheme:        scheme,
+		ClientPort:    clientPort,
+		CheckInterval: consulCheckInterval,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create Consul registration client: %v", err)
+	}
+	log.Info("Using Consul registration provider")
+	return metrics.InstrumentRegistrationProvider("consul", registrator)
+}
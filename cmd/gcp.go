@@ -1,19 +1,23 @@
 package cmd
 
 import (
+	"context"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/sky-uk/etcd-bootstrap/bootstrap"
 	gcp_provider "github.com/sky-uk/etcd-bootstrap/cloud/gcp"
 	"github.com/sky-uk/etcd-bootstrap/etcd"
+	"github.com/sky-uk/etcd-bootstrap/metrics"
 	"github.com/spf13/cobra"
 )
 
 // gcpCmd represents the generate config command for GCP etcd clusters
 var gcpCmd = &cobra.Command{
-	Use:    "gcp",
-	Short:  "Generates config for a GCP etcd cluster",
-	Run:    gcp,
-	PreRun: checkGCPParams,
+	Use:   "gcp",
+	Short: "Generates config for a GCP etcd cluster",
+	Run:   gcp,
+	// Persistent so the provider's subcommands are validated too.
+	PersistentPreRun: checkGCPParams,
 }
 
 var (
@@ -24,41 +28,57 @@ var (
 
 func init() {
 	RootCmd.AddCommand(gcpCmd)
+	gcpCmd.AddCommand(newPromoteCmd(newGCPBootstrapper))
+	gcpCmd.AddCommand(newOperatorCmds(newGCPBootstrapper)...)
 
-	gcpCmd.Flags().StringVar(&gcpProjectID, "project-id", "",
+	gcpCmd.PersistentFlags().StringVar(&gcpProjectID, "project-id", "",
 		"value of the GCP 'project id' to query")
-	gcpCmd.Flags().StringVar(&gcpEnvironment, "environment", "",
+	gcpCmd.PersistentFlags().StringVar(&gcpEnvironment, "environment", "",
 		"value of the 'environment' label in GCP nodes to filter them by")
-	gcpCmd.Flags().StringVar(&gcpRole, "role", "",
+	gcpCmd.PersistentFlags().StringVar(&gcpRole, "role", "",
 		"value of the 'role' label in GCP nodes to filter them by")
 }
 
 func gcp(cmd *cobra.Command, args []string) {
-	gcpProvider, err := gcp_provider.NewGCP(&gcp_provider.Config{
+	ctx := context.Background()
+	bootstrapper := newGCPBootstrapper()
+	if dryRun {
+		printPlan(ctx, bootstrapper)
+		return
+	}
+
+	if err := bootstrapper.GenerateEtcdFlagsFile(ctx, outputFilename); err != nil {
+		log.Fatalf("Failed to generate etcd flags file: %v", err)
+	}
+}
+
+func newGCPBootstrapper() *bootstrap.Bootstrapper {
+	gcpProvider, err := gcp_provider.NewGCP(context.Background(), &gcp_provider.Config{
 		ProjectID:   gcpProjectID,
 		Environment: gcpEnvironment,
 		Role:        gcpRole,
+		RetryPolicy: retryPolicy(),
 	})
 	if err != nil {
 		log.Fatalf("Failed to create GCP provider: %v", err)
 	}
 
-	etcdCluster, err := etcd.New(gcpProvider)
+	cloudAPI := metrics.InstrumentCloudAPI("gcp", gcpProvider)
+	etcdCluster, err := etcd.New(cloudAPI, etcdOptions()...)
 	if err != nil {
 		log.Fatalf("Failed to create etcd cluster API: %v", err)
 	}
-	bootstrapper, err := bootstrap.New(gcpProvider, etcdCluster)
+	bootstrapper, err := bootstrap.New(cloudAPI, etcdCluster, bootstrapOptions()...)
 	if err != nil {
 		log.Fatalf("Failed to create etcd bootstrapper: %v", err)
 	}
-
-	if err := bootstrapper.GenerateEtcdFlagsFile(outputFilename); err != nil {
-		log.Fatalf("Failed to generate etcd flags file: %v", err)
-	}
+	return bootstrapper
 }
 
 func checkGCPParams(cmd *cobra.Command, args []string) {
-	checkRequiredFlag(gcpProjectID, "--project-id")
-	checkRequiredFlag(gcpEnvironment, "--environment")
-	checkRequiredFlag(gcpRole, "--role")
+	var missing requiredValues
+	missing.flag(gcpProjectID, "--project-id")
+	missing.flag(gcpEnvironment, "--environment")
+	missing.flag(gcpRole, "--role")
+	missing.check()
 }
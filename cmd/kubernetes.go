@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"context"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/bootstrap"
+	kubernetes_provider "github.com/sky-uk/etcd-bootstrap/cloud/kubernetes"
+	"github.com/sky-uk/etcd-bootstrap/etcd"
+	"github.com/sky-uk/etcd-bootstrap/metrics"
+	"github.com/spf13/cobra"
+)
+
+const (
+	podNameEnvironmentVariable      = "POD_NAME"
+	podNamespaceEnvironmentVariable = "POD_NAMESPACE"
+	podIPEnvironmentVariable        = "POD_IP"
+)
+
+// kubernetesCmd represents the generate config command for etcd clusters running in Kubernetes
+var kubernetesCmd = &cobra.Command{
+	Use:   "kubernetes",
+	Short: "Generates config for an etcd cluster running as Kubernetes pods",
+	Run:   kubernetes,
+	// Persistent so the provider's subcommands are validated too.
+	PersistentPreRun: checkKubernetesParams,
+}
+
+var (
+	kubernetesNamespace     string
+	kubernetesStatefulSet   string
+	kubernetesLabelSelector string
+	kubernetesServiceName   string
+	kubernetesClusterDomain string
+	kubernetesPodName       string
+	kubernetesPodIP         string
+)
+
+func init() {
+	RootCmd.AddCommand(kubernetesCmd)
+	kubernetesCmd.AddCommand(newPromoteCmd(newKubernetesBootstrapper))
+	kubernetesCmd.AddCommand(newOperatorCmds(newKubernetesBootstrapper)...)
+
+	hostname, _ := os.Hostname()
+	podName := os.Getenv(podNameEnvironmentVariable)
+	if podName == "" {
+		podName = hostname
+	}
+
+	kubernetesCmd.PersistentFlags().StringVar(&kubernetesNamespace, "namespace",
+		os.Getenv(podNamespaceEnvironmentVariable), "namespace of the etcd pods, defaults to $"+podNamespaceEnvironmentVariable)
+	kubernetesCmd.PersistentFlags().StringVar(&kubernetesStatefulSet, "statefulset", "",
+		"StatefulSet the etcd pods belong to")
+	kubernetesCmd.PersistentFlags().StringVar(&kubernetesLabelSelector, "label-selector", "",
+		"label selector for the etcd pods, defaults to the StatefulSet's selector")
+	kubernetesCmd.PersistentFlags().StringVar(&kubernetesServiceName, "service-name", "",
+		"headless service for the etcd pods, defaults to the StatefulSet's service name")
+	kubernetesCmd.PersistentFlags().StringVar(&kubernetesClusterDomain, "cluster-domain", "cluster.local",
+		"DNS domain of the Kubernetes cluster")
+	kubernetesCmd.PersistentFlags().StringVar(&kubernetesPodName, "pod-name", podName,
+		"name of the local pod, defaults to $"+podNameEnvironmentVariable+" or the hostname")
+	kubernetesCmd.PersistentFlags().StringVar(&kubernetesPodIP, "pod-ip", os.Getenv(podIPEnvironmentVariable),
+		"IP of the local pod, defaults to $"+podIPEnvironmentVariable)
+}
+
+func kubernetes(cmd *cobra.Command, args []string) {
+	ctx := context.Background()
+	bootstrapper := newKubernetesBootstrapper()
+	if dryRun {
+		printPlan(ctx, bootstrapper)
+		return
+	}
+
+	if err := bootstrapper.GenerateEtcdFlagsFile(ctx, outputFilename); err != nil {
+		log.Fatalf("Failed to generate etcd flags file: %v", err)
+	}
+}
+
+func newKubernetesBootstrapper() *bootstrap.Bootstrapper {
+	kubernetesProvider, err := kubernetes_provider.New(context.Background(), &kubernetes_provider.Config{
+		Namespace:     kubernetesNamespace,
+		StatefulSet:   kubernetesStatefulSet,
+		LabelSelector: kubernetesLabelSelector,
+		ServiceName:   kubernetesServiceName,
+		ClusterDomain: kubernetesClusterDomain,
+		PodName:       kubernetesPodName,
+		PodIP:         kubernetesPodIP,
+		RetryPolicy:   retryPolicy(),
+	})
+	if err != nil {
+		log.Fatalf("Failed to create Kubernetes provider: %v", err)
+	}
+
+	cloudAPI := metrics.InstrumentCloudAPI("kubernetes", kubernetesProvider)
+	etcdCluster, err := etcd.New(cloudAPI, etcdOptions()...)
+	if err != nil {
+		log.Fatalf("Failed to create etcd cluster API: %v", err)
+	}
+	bootstrapper, err := bootstrap.New(cloudAPI, etcdCluster, bootstrapOptions()...)
+	if err != nil {
+		log.Fatalf("Failed to create etcd bootstrapper: %v", err)
+	}
+	return bootstrapper
+}
+
+func checkKubernetesParams(cmd *cobra.Command, args []string) {
+	var missing requiredValues
+	missing.flag(kubernetesNamespace, "--namespace")
+	missing.flag(kubernetesPodName, "--pod-name")
+	missing.flag(kubernetesPodIP, "--pod-ip")
+	if kubernetesStatefulSet == "" && kubernetesLabelSelector == "" {
+		missing.add("either --statefulset or --label-selector")
+	}
+	missing.check()
+}
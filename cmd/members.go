@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/bootstrap"
+	"github.com/spf13/cobra"
+)
+
+var (
+	operatorJSON bool
+	removeForce  bool
+)
+
+const (
+	memberNameFlag   = "member-name"
+	instanceNameFlag = "instance-name"
+)
+
+// newOperatorCmds creates the commands for inspecting and changing the members of a provider's cluster, so
+// drift between the members and the cloud instances can be diagnosed without etcdctl and the cloud's own CLI.
+// Cobra commands can only have a single parent, so each provider gets its own instances.
+//
+// The member and instance flags have names, and values, of their own, so they can't clash with the provider's flags,
+// e.g. the static provider's --name and --instance.
+func newOperatorCmds(newBootstrapper func() *bootstrap.Bootstrapper) []*cobra.Command {
+	membersCmd := &cobra.Command{
+		Use:   "members",
+		Short: "Lists the etcd members along with their cloud instance, health and the leader",
+		Run: func(cmd *cobra.Command, args []string) {
+			status := clusterStatus(newBootstrapper())
+			if operatorJSON {
+				printJSON(status.Members)
+				return
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tID\tPEER URL\tINSTANCE\tHEALTHY\tLEARNER\tLEADER")
+			for _, member := range status.Members {
+				name := member.Name
+				if name == "" {
+					name = "<not started>"
+				}
+				instance := "<none>"
+				if member.Instance != nil {
+					instance = member.Instance.Endpoint
+				}
+				fmt.Fprintf(w, "%s\t%x\t%s\t%s\t%t\t%t\t%t\n", name, member.ID, member.PeerURL, instance,
+					member.Healthy, member.IsLearner, member.Leader)
+			}
+			if err := w.Flush(); err != nil {
+				log.Fatalf("Failed to print members: %v", err)
+			}
+		},
+	}
+	membersCmd.Flags().BoolVar(&operatorJSON, "json", false, "print the members as JSON")
+
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Shows the quorum and leader, and which instances aren't members and vice versa",
+		Run: func(cmd *cobra.Command, args []string) {
+			status := clusterStatus(newBootstrapper())
+			if operatorJSON {
+				printJSON(status)
+				return
+			}
+			fmt.Print(status)
+		},
+	}
+	statusCmd.Flags().BoolVar(&operatorJSON, "json", false, "print the status as JSON")
+
+	removeCmd := &cobra.Command{
+		Use:   "remove [name]",
+		Short: "Removes a member from the etcd cluster",
+		Long: "Removes a member from the etcd cluster, while holding the membership lock. Members which are still " +
+			"cloud instances, or whose removal would leave the cluster without a healthy quorum, are only removed " +
+			"with --force.",
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			name, err := argOrFlag(cmd, args, memberNameFlag)
+			if err != nil {
+				log.Fatal(err)
+			}
+			bootstrapper := newBootstrapper()
+			if err := bootstrapper.RemoveMember(context.Background(), name, removeForce); err != nil {
+				log.Fatalf("Failed to remove member: %v", err)
+			}
+		},
+	}
+	removeCmd.Flags().String(memberNameFlag, "", "name of the member to remove")
+	removeCmd.Flags().BoolVar(&removeForce, "force", false,
+		"remove the member even if it's still a cloud instance or the cluster would lose quorum")
+
+	addCmd := &cobra.Command{
+		Use:   "add [instance]",
+		Short: "Adds a cloud instance to the etcd cluster",
+		Long: "Adds a cloud instance's peer URL to the etcd cluster, as a learner with --learner, while holding the " +
+			"membership lock. The instance's etcd then needs to start and join the cluster.",
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			name, err := argOrFlag(cmd, args, instanceNameFlag)
+			if err != nil {
+				log.Fatal(err)
+			}
+			bootstrapper := newBootstrapper()
+			if err := bootstrapper.AddInstance(context.Background(), name); err != nil {
+				log.Fatalf("Failed to add instance: %v", err)
+			}
+		},
+	}
+	addCmd.Flags().String(instanceNameFlag, "", "name of the cloud instance to add")
+
+	return []*cobra.Command{membersCmd, statusCmd, removeCmd, addCmd}
+}
+
+// argOrFlag returns the argument if given, otherwise the value of the command's flag. Exactly one of them is
+// required.
+func argOrFlag(cmd *cobra.Command, args []string, flagName string) (string, error) {
+	value, err := cmd.Flags().GetString(flagName)
+	if err != nil {
+		return "", err
+	}
+	if len(args) > 0 {
+		if value != "" {
+			return "", fmt.Errorf("either an argument or the --%s flag can be given, not both", flagName)
+		}
+		return args[0], nil
+	}
+	if strings.TrimSpace(value) == "" {
+		return "", fmt.Errorf("either an argument or the --%s flag is required", flagName)
+	}
+	return value, nil
+}
+
+func clusterStatus(bootstrapper *bootstrap.Bootstrapper) *bootstrap.ClusterStatus {
+	status, err := bootstrapper.ClusterStatus(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to get cluster status: %v", err)
+	}
+	return status
+}
+
+func printJSON(v interface{}) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode JSON: %v", err)
+	}
+	fmt.Println(string(out))
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/spf13/cobra"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// TestCmd to register the test suite
+func TestCmd(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cmd")
+}
+
+var _ = Describe("Operator commands", func() {
+	AfterEach(func() {
+		staticName = ""
+		staticInstances = nil
+	})
+
+	// parse finds the static provider's subcommand and parses its flags, like running it would.
+	parse := func(subcommand string, args ...string) *cobra.Command {
+		cmd, _, err := RootCmd.Find([]string{"static", subcommand})
+		Expect(err).To(BeNil())
+		Expect(cmd.Name()).To(Equal(subcommand))
+		Expect(cmd.ParseFlags(args)).To(Succeed())
+		return cmd
+	}
+
+	It("removes the member named by its own flag, not the static provider's --name", func() {
+		cmd := parse("remove", "--name=local", "--member-name=etcd-2")
+		Expect(argOrFlag(cmd, cmd.Flags().Args(), memberNameFlag)).To(Equal("etcd-2"))
+		Expect(staticName).To(Equal("local"))
+	})
+
+	It("adds the instance named by its own flag, not the static provider's --instance", func() {
+		cmd := parse("add", "--instance=etcd-1=10.0.0.1", "--instance-name=etcd-3")
+		Expect(argOrFlag(cmd, cmd.Flags().Args(), instanceNameFlag)).To(Equal("etcd-3"))
+		Expect(staticInstances).To(Equal([]string{"etcd-1=10.0.0.1"}))
+	})
+
+	It("takes the member as an argument", func() {
+		cmd := parse("remove", "--member-name=")
+		Expect(argOrFlag(cmd, []string{"etcd-2"}, memberNameFlag)).To(Equal("etcd-2"))
+	})
+
+	It("requires exactly one of the argument and the flag", func() {
+		cmd := parse("add", "--instance-name=")
+		_, err := argOrFlag(cmd, nil, instanceNameFlag)
+		Expect(err).To(MatchError(ContainSubstring("--instance-name flag is required")))
+
+		cmd = parse("add", "--instance-name=etcd-3")
+		_, err = argOrFlag(cmd, []string{"etcd-4"}, instanceNameFlag)
+		Expect(err).To(MatchError(ContainSubstring("not both")))
+	})
+})
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/bootstrap"
+	"github.com/spf13/cobra"
+)
+
+const (
+	defaultPromoteTimeout  = 30 * time.Minute
+	defaultPromoteInterval = 10 * time.Second
+)
+
+var (
+	promoteTimeout  time.Duration
+	promoteInterval time.Duration
+)
+
+// newPromoteCmd creates the promote command for a provider. Cobra commands can only have a single parent,
+// so each provider gets its own instance.
+func newPromoteCmd(newBootstrapper func() *bootstrap.Bootstrapper) *cobra.Command {
+	promoteCmd := &cobra.Command{
+		Use:   "promote",
+		Short: "Promotes the local learner to a voting member once it has caught up with the leader",
+		Long: "Promotes the local learner to a voting member once it has caught up with the leader. " +
+			"This is intended to run alongside etcd after bootstrapping with --learner.",
+		Run: func(cmd *cobra.Command, args []string) {
+			bootstrapper := newBootstrapper()
+			if err := bootstrapper.PromoteLocalInstance(context.Background(), promoteTimeout, promoteInterval); err != nil {
+				log.Fatalf("Failed to promote local instance: %v", err)
+			}
+		},
+	}
+	promoteCmd.Flags().DurationVar(&promoteTimeout, "timeout", defaultPromoteTimeout,
+		"how long to wait for the learner to catch up before giving up")
+	promoteCmd.Flags().DurationVar(&promoteInterval, "interval", defaultPromoteInterval,
+		"how often to check whether the learner has caught up")
+	return promoteCmd
+}
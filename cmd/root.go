@@ -1,16 +1,34 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"os/user"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/bootstrap"
+	"github.com/sky-uk/etcd-bootstrap/etcd"
+	"github.com/sky-uk/etcd-bootstrap/flagconfig"
+	"github.com/sky-uk/etcd-bootstrap/metrics"
+	"github.com/sky-uk/etcd-bootstrap/report"
+	"github.com/sky-uk/etcd-bootstrap/retry"
+	"github.com/sky-uk/etcd-bootstrap/snapshot"
 	"github.com/spf13/cobra"
 )
 
 const (
 	defaultOutputFilename = "/var/run/etcd-bootstrap.conf"
+	defaultPeerPort       = 2380
+	defaultClientPort     = 2379
+
+	// envPrefix is the prefix of the environment variables which set each flag, e.g. ETCD_BOOTSTRAP_OUTPUT_FILE.
+	envPrefix = "ETCD_BOOTSTRAP_"
 )
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -34,33 +52,398 @@ var (
 	// injected by "go tool link -X"
 	buildTime string
 
+	configFile     string
 	debugLogging   bool
+	logFormat      string
 	outputFilename string
+	peerPort       int
+	clientPort     int
+	learner        bool
+	maxRemovals    int
+	removeHealthy  bool
+	lockTimeout    time.Duration
+	lockTTL        time.Duration
+	dryRun         bool
+	outputFormat   string
+	outputMode     string
+	outputOwner    string
+	outputBackup   bool
+
+	preflightTimeout       time.Duration
+	preflightRetryInterval time.Duration
+	clusterSize            int
+	forcePartialCluster    bool
+	dataDir                string
+	staleDataAction        string
+	restoreSnapshot        string
+	restoreSnapshotSHA256  string
+	snapshotS3Endpoint     string
+	snapshotS3Region       string
+
+	retryAttempts        int
+	retryMaxElapsed      time.Duration
+	retryInitialInterval time.Duration
+	retryMaxInterval     time.Duration
+
+	metricsTextfile    string
+	metricsPushgateway string
+	metricsPushJob     string
+
+	reportFile    string
+	runReport     *report.Report
+	finishRunOnce sync.Once
 )
 
 func init() {
-	cobra.OnInitialize(initLogs)
+	cobra.OnInitialize(initConfig, initLogs, initReport, initFinish)
+	RootCmd.PersistentPostRun = func(cmd *cobra.Command, args []string) {
+		finishRun(true)
+	}
 	RootCmd.Version = fmt.Sprintf("%s (%s)", version, buildTime)
+	RootCmd.PersistentFlags().StringVar(&configFile, "config", "",
+		"YAML or JSON file of flag values, see Configuration in the README")
 	RootCmd.PersistentFlags().BoolVarP(&debugLogging, "debug", "X", false,
 		"enable debug logging")
+	RootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text",
+		"format of the logs, options are: text, json")
+	RootCmd.PersistentFlags().StringVar(&reportFile, "report-file", "",
+		"file to write a JSON summary of the run to when the command finishes")
 	RootCmd.PersistentFlags().StringVarP(&outputFilename, "output-file", "o", defaultOutputFilename,
 		"location to write environment variables for etcd to use")
+	RootCmd.PersistentFlags().StringVar(&outputFormat, "output-format", string(bootstrap.EnvFormat), fmt.Sprintf(
+		"format of the output file, options are: %v", bootstrap.OutputFormats))
+	RootCmd.PersistentFlags().StringVar(&outputMode, "output-file-mode", "0644",
+		"permissions of the output file, in octal")
+	RootCmd.PersistentFlags().StringVar(&outputOwner, "output-file-owner", "",
+		"user[:group] to own the output file, by name or id, defaults to the current user")
+	RootCmd.PersistentFlags().BoolVar(&outputBackup, "output-file-backup", false,
+		"keep the previous output file with a .bak suffix")
+	RootCmd.PersistentFlags().IntVar(&peerPort, "peer-port", defaultPeerPort,
+		"port etcd uses for peer communication")
+	RootCmd.PersistentFlags().IntVar(&clientPort, "client-port", defaultClientPort,
+		"port etcd uses for client communication, unless the instance lookup provides its own")
+	RootCmd.PersistentFlags().BoolVar(&learner, "learner", false,
+		"join an existing cluster as a non-voting learner, which must then be promoted with the promote command")
+	RootCmd.PersistentFlags().IntVar(&maxRemovals, "max-member-removals", bootstrap.DefaultRemovalPolicy.MaxRemovals,
+		"maximum number of old etcd members to remove in a single run, 0 for no limit")
+	RootCmd.PersistentFlags().BoolVar(&removeHealthy, "remove-healthy-members", false,
+		"remove old etcd members even if they are still reachable")
+	RootCmd.PersistentFlags().DurationVar(&lockTimeout, "membership-lock-timeout", bootstrap.DefaultLockPolicy.Timeout,
+		"how long to wait for the lock held in etcd while changing the members, 0 to change them without locking")
+	RootCmd.PersistentFlags().DurationVar(&lockTTL, "membership-lock-ttl", bootstrap.DefaultLockPolicy.TTL,
+		"how long the membership lock outlives its holder if it dies without releasing it")
+	RootCmd.PersistentFlags().DurationVar(&preflightTimeout, "preflight-timeout",
+		bootstrap.DefaultPreflightPolicy.Timeout,
+		"how long to wait to confirm there is no existing cluster before starting a new one")
+	RootCmd.PersistentFlags().DurationVar(&preflightRetryInterval, "preflight-retry-interval",
+		bootstrap.DefaultPreflightPolicy.RetryInterval,
+		"how often to check for an existing cluster while waiting")
+	RootCmd.PersistentFlags().IntVar(&clusterSize, "cluster-size", 0,
+		"number of instances expected when starting a new cluster, 0 for any number")
+	RootCmd.PersistentFlags().BoolVar(&forcePartialCluster, "force-partial-new-cluster", false,
+		"start a new cluster even if some instances can't be checked or there are fewer than --cluster-size")
+	RootCmd.PersistentFlags().StringVar(&dataDir, "data-dir", "",
+		"etcd data dir to check against the live cluster before joining it")
+	RootCmd.PersistentFlags().StringVar(&staleDataAction, "stale-data-action", string(bootstrap.StaleDataFail),
+		fmt.Sprintf("what to do if the data dir belongs to a removed member or another cluster, options are: %v",
+			bootstrap.StaleDataActions))
+	RootCmd.PersistentFlags().StringVar(&restoreSnapshot, "restore-snapshot", "",
+		"etcd snapshot to restore a new cluster from, a local path or s3:// or gs:// URL, requires --data-dir")
+	RootCmd.PersistentFlags().StringVar(&restoreSnapshotSHA256, "restore-snapshot-sha256", "",
+		"expected SHA-256 of the whole snapshot file")
+	RootCmd.PersistentFlags().StringVar(&snapshotS3Endpoint, "snapshot-s3-endpoint", "",
+		"S3 endpoint to download the snapshot from, e.g. for MinIO")
+	RootCmd.PersistentFlags().StringVar(&snapshotS3Region, "snapshot-s3-region", "",
+		"region of the S3 bucket to download the snapshot from, defaults to $AWS_REGION or us-east-1")
+	RootCmd.PersistentFlags().IntVar(&retryAttempts, "retry-attempts", retry.DefaultPolicy.MaxAttempts,
+		"maximum number of attempts at each cloud and etcd API call which fails with a transient error, 1 to not retry")
+	RootCmd.PersistentFlags().DurationVar(&retryMaxElapsed, "retry-max-elapsed", retry.DefaultPolicy.MaxElapsed,
+		"how long to keep retrying each cloud and etcd API call, 0 for no limit")
+	RootCmd.PersistentFlags().DurationVar(&retryInitialInterval, "retry-initial-interval",
+		retry.DefaultPolicy.InitialInterval,
+		"how long to wait before the first retry, doubling for each retry after that")
+	RootCmd.PersistentFlags().DurationVar(&retryMaxInterval, "retry-max-interval", retry.DefaultPolicy.MaxInterval,
+		"longest wait between retries, 0 for no limit")
+	RootCmd.PersistentFlags().StringVar(&metricsTextfile, "metrics-textfile", "",
+		"file to write metrics to when the command finishes, for node-exporter's textfile collector, e.g. "+
+			"/var/lib/node_exporter/etcd-bootstrap.prom")
+	RootCmd.PersistentFlags().StringVar(&metricsPushgateway, "metrics-pushgateway", "",
+		"URL of a Pushgateway to push metrics to when the command finishes")
+	RootCmd.PersistentFlags().StringVar(&metricsPushJob, "metrics-push-job", "etcd-bootstrap",
+		"job to push metrics under, they're grouped by the hostname as the instance")
+	RootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false,
+		"print the membership changes and etcd flags without applying them, as text to stderr and JSON to stdout")
+}
+
+// initConfig sets the flags which weren't given on the command line from ETCD_BOOTSTRAP_* environment variables,
+// and then from the --config file.
+func initConfig() {
+	flags := executingCommand().Flags()
+	if err := flagconfig.ApplyEnv(flags, envPrefix, os.LookupEnv); err != nil {
+		log.Fatalf("Invalid environment variables: %v", err)
+	}
+	if configFile != "" {
+		if err := flagconfig.ApplyFile(flags, configFile, isFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// executingCommand returns the command being run.
+func executingCommand() *cobra.Command {
+	cmd, _, err := RootCmd.Find(os.Args[1:])
+	if err != nil {
+		return RootCmd
+	}
+	return cmd
+}
+
+// isFlag checks if any command has the flag.
+func isFlag(name string) bool {
+	var found bool
+	var visit func(*cobra.Command)
+	visit = func(cmd *cobra.Command) {
+		if cmd.Flags().Lookup(name) != nil || cmd.PersistentFlags().Lookup(name) != nil {
+			found = true
+		}
+		for _, child := range cmd.Commands() {
+			visit(child)
+		}
+	}
+	visit(RootCmd)
+	return found
 }
 
 func initLogs() {
 	if debugLogging {
 		log.SetLevel(log.DebugLevel)
 	}
+	switch logFormat {
+	case "text":
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		log.Fatalf("Invalid --log-format %q, options are: text, json", logFormat)
+	}
 }
 
-func checkRequiredFlag(value, flagName string) {
-	if strings.TrimSpace(value) == "" {
-		log.Fatalf("The %s flag is required", flagName)
+// initReport starts the run report, if one was asked for. The report records why the command failed from the
+// log.Fatal message.
+func initReport() {
+	if reportFile == "" {
+		return
+	}
+	runReport = report.New(executingCommand().CommandPath())
+	log.AddHook(runReport.ErrorHook())
+}
+
+// initFinish exports the metrics and report if the command fails. Commands fail with log.Fatal, which runs the exit
+// handlers.
+func initFinish() {
+	log.RegisterExitHandler(func() {
+		finishRun(false)
+	})
+}
+
+// finishRun records the outcome of the command, and exports the metrics and report if configured. Failing to
+// export them doesn't fail the command.
+func finishRun(success bool) {
+	finishRunOnce.Do(func() {
+		exportMetrics(success)
+		if reportFile != "" {
+			runReport.Finish(success)
+			if err := runReport.Write(reportFile); err != nil {
+				log.Warnf("Failed to write report: %v", err)
+			}
+		}
+	})
+}
+
+// exportMetrics writes or pushes the metrics, if configured.
+func exportMetrics(success bool) {
+	metrics.RunFinished(success)
+	if metricsTextfile != "" {
+		if err := metrics.WriteTextfile(metricsTextfile); err != nil {
+			log.Warnf("Failed to write metrics: %v", err)
+		}
+	}
+	if metricsPushgateway != "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Warnf("Failed to get hostname to push metrics: %v", err)
+			return
+		}
+		err = metrics.Push(metricsPushgateway, metricsPushJob, map[string]string{"instance": hostname})
+		if err != nil {
+			log.Warnf("Failed to push metrics: %v", err)
+		}
+	}
+}
+
+// bootstrapOptions returns the bootstrap options common to all providers.
+func bootstrapOptions() []bootstrap.Option {
+	format, err := bootstrap.ParseOutputFormat(outputFormat)
+	if err != nil {
+		log.Fatalf("Invalid --output-format: %v", err)
+	}
+	opts := []bootstrap.Option{
+		bootstrap.WithOutputFormat(format),
+		bootstrap.WithFileOptions(fileOptions()),
+		bootstrap.WithPeerPort(peerPort),
+		bootstrap.WithClientPort(clientPort),
+		bootstrap.WithReport(runReport),
+		bootstrap.WithRemovalPolicy(bootstrap.RemovalPolicy{
+			MaxRemovals:      maxRemovals,
+			RequireUnhealthy: !removeHealthy,
+		}),
+		bootstrap.WithLockPolicy(bootstrap.LockPolicy{
+			Timeout: lockTimeout,
+			TTL:     lockTTL,
+		}),
+		bootstrap.WithPreflightPolicy(bootstrap.PreflightPolicy{
+			Timeout:       preflightTimeout,
+			RetryInterval: preflightRetryInterval,
+			ClusterSize:   clusterSize,
+			Force:         forcePartialCluster,
+		}),
+	}
+	if learner {
+		opts = append(opts, bootstrap.WithLearner())
+	}
+	if dataDir != "" {
+		action, err := bootstrap.ParseStaleDataAction(staleDataAction)
+		if err != nil {
+			log.Fatalf("Invalid --stale-data-action: %v", err)
+		}
+		opts = append(opts, bootstrap.WithDataDir(dataDir, action))
+	}
+	if restoreSnapshot != "" {
+		if dataDir == "" {
+			log.Fatal("The --data-dir flag is required to restore a snapshot")
+		}
+		source, err := snapshot.NewSource(restoreSnapshot, &snapshot.SourceConfig{
+			S3Endpoint: snapshotS3Endpoint,
+			S3Region:   snapshotS3Region,
+		})
+		if err != nil {
+			log.Fatalf("Invalid --restore-snapshot: %v", err)
+		}
+		opts = append(opts, bootstrap.WithSnapshotRestore(snapshot.NewRestorer(source, restoreSnapshotSHA256)))
+	}
+	return opts
+}
+
+// fileOptions parses the output file flags.
+func fileOptions() bootstrap.FileOptions {
+	opts := bootstrap.DefaultFileOptions
+	opts.Backup = outputBackup
+
+	mode, err := strconv.ParseUint(outputMode, 8, 32)
+	if err != nil {
+		log.Fatalf("Invalid --output-file-mode %q: %v", outputMode, err)
+	}
+	opts.Mode = os.FileMode(mode)
+
+	if outputOwner != "" {
+		parts := strings.SplitN(outputOwner, ":", 2)
+		u, err := lookupID(parts[0], func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			log.Fatalf("Invalid --output-file-owner user %q: %v", parts[0], err)
+		}
+		opts.UID = u
+		if len(parts) == 2 {
+			g, err := lookupID(parts[1], func(name string) (string, error) {
+				g, err := user.LookupGroup(name)
+				if err != nil {
+					return "", err
+				}
+				return g.Gid, nil
+			})
+			if err != nil {
+				log.Fatalf("Invalid --output-file-owner group %q: %v", parts[1], err)
+			}
+			opts.GID = g
+		}
+	}
+	return opts
+}
+
+// lookupID returns the numeric id, looking up the name if it isn't one already.
+func lookupID(nameOrID string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		return id, nil
+	}
+	id, err := lookup(nameOrID)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// retryPolicy parses the retry flags, which apply to all cloud and etcd API calls.
+func retryPolicy() retry.Policy {
+	policy := retry.Policy{
+		MaxAttempts:     retryAttempts,
+		MaxElapsed:      retryMaxElapsed,
+		InitialInterval: retryInitialInterval,
+		MaxInterval:     retryMaxInterval,
+	}
+	if err := policy.Validate(); err != nil {
+		log.Fatalf("Invalid retry flags: %v", err)
+	}
+	return policy
+}
+
+// etcdOptions returns the etcd cluster API options common to all providers.
+func etcdOptions() []etcd.Option {
+	return []etcd.Option{
+		etcd.WithPeerPort(peerPort),
+		etcd.WithClientPort(clientPort),
+		etcd.WithRetryPolicy(retryPolicy()),
 	}
 }
 
-func checkRequiredEnvironmentVariable(value, envName string) {
+// printPlan prints what the bootstrapper would do, for --dry-run. The plan goes to stderr for people to read,
+// and to stdout as JSON for tooling.
+func printPlan(ctx context.Context, bootstrapper *bootstrap.Bootstrapper) {
+	plan, err := bootstrapper.Plan(ctx)
+	if err != nil {
+		log.Fatalf("Failed to plan etcd flags: %v", err)
+	}
+	fmt.Fprint(os.Stderr, plan)
+	out, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode plan: %v", err)
+	}
+	fmt.Println(string(out))
+}
+
+// requiredValues collects the required values which are missing, so they can all be reported at once.
+type requiredValues []string
+
+// flag records the flag as missing if its value is empty.
+func (r *requiredValues) flag(value, flagName string) {
 	if strings.TrimSpace(value) == "" {
-		log.Fatalf("The %s environment variable is required", envName)
+		*r = append(*r, fmt.Sprintf("%s ($%s)", flagName,
+			flagconfig.EnvName(envPrefix, strings.TrimPrefix(flagName, "--"))))
+	}
+}
+
+// add records a missing value which isn't a single flag.
+func (r *requiredValues) add(description string) {
+	*r = append(*r, description)
+}
+
+// check fails if any required values are missing.
+func (r requiredValues) check() {
+	if len(r) > 0 {
+		log.Fatalf("Missing required values, set them with flags, environment variables or --config: %s",
+			strings.Join(r, ", "))
 	}
 }
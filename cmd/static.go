@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/bootstrap"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	static_provider "github.com/sky-uk/etcd-bootstrap/cloud/static"
+	"github.com/sky-uk/etcd-bootstrap/etcd"
+	"github.com/sky-uk/etcd-bootstrap/metrics"
+	"github.com/spf13/cobra"
+)
+
+// staticCmd represents the generate config command for etcd clusters with a fixed list of instances
+var staticCmd = &cobra.Command{
+	Use:   "static",
+	Short: "Generates config for an etcd cluster with a fixed list of instances",
+	Long: "Generates config for an etcd cluster with a fixed list of instances, such as on bare metal " +
+		"or when testing locally.",
+	Run: static,
+	// Persistent so the provider's subcommands are validated too.
+	PersistentPreRun: checkStaticParams,
+}
+
+var (
+	staticInstances     []string
+	staticInstancesFile string
+	staticName          string
+)
+
+func init() {
+	RootCmd.AddCommand(staticCmd)
+	staticCmd.AddCommand(newPromoteCmd(newStaticBootstrapper))
+
+	staticCmd.PersistentFlags().StringArrayVar(&staticInstances, "instance", nil,
+		"instance in the cluster, in the form name=endpoint[:clientPort], can be repeated")
+	staticCmd.PersistentFlags().StringVar(&staticInstancesFile, "instances-file", "",
+		"YAML or JSON file listing the instances in the cluster")
+	staticCmd.PersistentFlags().StringVar(&staticName, "name", "",
+		"name of the local instance, by default it's found by the hostname or local interface IPs")
+	staticCmd.AddCommand(newOperatorCmds(newStaticBootstrapper)...)
+}
+
+func static(cmd *cobra.Command, args []string) {
+	ctx := context.Background()
+	bootstrapper := newStaticBootstrapper()
+	if dryRun {
+		printPlan(ctx, bootstrapper)
+		return
+	}
+
+	if err := bootstrapper.GenerateEtcdFlagsFile(ctx, outputFilename); err != nil {
+		log.Fatalf("Failed to generate etcd flags file: %v", err)
+	}
+}
+
+func newStaticBootstrapper() *bootstrap.Bootstrapper {
+	var instances []cloud.Instance
+	for _, value := range staticInstances {
+		instance, err := static_provider.ParseInstance(value)
+		if err != nil {
+			log.Fatalf("Invalid --instance: %v", err)
+		}
+		instances = append(instances, instance)
+	}
+	staticProvider, err := static_provider.New(&static_provider.Config{
+		Instances: instances,
+		File:      staticInstancesFile,
+		Name:      staticName,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create static provider: %v", err)
+	}
+
+	cloudAPI := metrics.InstrumentCloudAPI("static", staticProvider)
+	etcdCluster, err := etcd.New(cloudAPI, etcdOptions()...)
+	if err != nil {
+		log.Fatalf("Failed to create etcd cluster API: %v", err)
+	}
+	bootstrapper, err := bootstrap.New(cloudAPI, etcdCluster, bootstrapOptions()...)
+	if err != nil {
+		log.Fatalf("Failed to create etcd bootstrapper: %v", err)
+	}
+	return bootstrapper
+}
+
+func checkStaticParams(cmd *cobra.Command, args []string) {
+	var missing requiredValues
+	if len(staticInstances) == 0 && staticInstancesFile == "" {
+		missing.add("either --instance or --instances-file")
+	}
+	missing.check()
+}
@@ -1,12 +1,17 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"os"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/sky-uk/etcd-bootstrap/bootstrap"
+	"github.com/sky-uk/etcd-bootstrap/cloud/noop"
 	vmware_provider "github.com/sky-uk/etcd-bootstrap/cloud/vmware"
 	"github.com/sky-uk/etcd-bootstrap/etcd"
+	"github.com/sky-uk/etcd-bootstrap/metrics"
+	"github.com/sky-uk/etcd-bootstrap/watch"
 	"github.com/spf13/cobra"
 )
 
@@ -20,10 +25,11 @@ const (
 
 // vmwareCmd represents the generate config command for VMware etcd clusters
 var vmwareCmd = &cobra.Command{
-	Use:    "vmware",
-	Short:  "Generates config for a VMware etcd cluster",
-	Run:    vmware,
-	PreRun: checkVMwareParams,
+	Use:   "vmware",
+	Short: "Generates config for a VMware etcd cluster",
+	Run:   vmware,
+	// Persistent so the provider's subcommands are validated too.
+	PersistentPreRun: checkVMwareParams,
 }
 
 var (
@@ -36,35 +42,63 @@ var (
 	vmwareVMName             string
 	vmwareEnvironment        string
 	vmwareRole               string
+	vmwareLookupMethod       string
+	vmwareRegistration       string
 )
 
 func init() {
 	RootCmd.AddCommand(vmwareCmd)
+	vmwareCmd.AddCommand(newPromoteCmd(newVMwareBootstrapper))
+	vmwareCmd.AddCommand(newOperatorCmds(newVMwareBootstrapper)...)
+	vmwareCmd.AddCommand(newWatchCmd(newVMwareWatcher))
 
 	// vmware flags
-	vmwareCmd.Flags().StringVar(&vmwareUsername, "vsphere-username", "",
+	vmwareCmd.PersistentFlags().StringVar(&vmwareUsername, "vsphere-username", "",
 		"username for vSphere API")
-	vmwareCmd.Flags().StringVar(&vmwareHost, "vsphere-host", "",
+	// Not defaulted from the environment here, as the default would be shown in the help.
+	vmwareCmd.PersistentFlags().StringVar(&vmwarePassword, "vsphere-password", "",
+		"password for vSphere API, defaults to $"+vmwarePasswordEnvironmentVariable+
+			", avoid passing it on the command line where other users can see it")
+	vmwareCmd.PersistentFlags().StringVar(&vmwareHost, "vsphere-host", "",
 		"host address for vSphere API")
-	vmwareCmd.Flags().UintVar(&vmwarePort, "vsphere-port", defaultVMWarePort,
+	vmwareCmd.PersistentFlags().UintVar(&vmwarePort, "vsphere-port", defaultVMWarePort,
 		"port for vSphere API")
-	vmwareCmd.Flags().BoolVar(&vmwareInsecureSkipVerify, "insecure-skip-verify",
+	vmwareCmd.PersistentFlags().BoolVar(&vmwareInsecureSkipVerify, "insecure-skip-verify",
 		defaultVMwareInsecureSkipVerify, "skip SSL verification when communicating with the vSphere host")
-	vmwareCmd.Flags().UintVar(&vmwareAttempts, "max-api-attempts", defaultVMwareAttempts,
+	vmwareCmd.PersistentFlags().UintVar(&vmwareAttempts, "max-api-attempts", defaultVMwareAttempts,
 		"number of attempts to make against the vSphere SOAP API (in case of temporary failure)")
-	vmwareCmd.Flags().StringVar(&vmwareVMName, "vm-name", "",
+	vmwareCmd.PersistentFlags().StringVar(&vmwareVMName, "vm-name", "",
 		"node name in vSphere of this VM")
-	vmwareCmd.Flags().StringVar(&vmwareEnvironment, "environment", "",
+	vmwareCmd.PersistentFlags().StringVar(&vmwareEnvironment, "environment", "",
 		"value of the 'tags_environment' extra configuration option in vSphere to filter nodes by")
-	vmwareCmd.Flags().StringVar(&vmwareRole, "role", "",
+	vmwareCmd.PersistentFlags().StringVar(&vmwareRole, "role", "",
 		"value of the 'tags_role' extra configuration option in vSphere to filter nodes by")
-
-	// vmware environment variables
-	vmwarePassword = os.Getenv(vmwarePasswordEnvironmentVariable)
+	vmwareCmd.PersistentFlags().StringVar(&vmwareLookupMethod, "instance-lookup-method", "vmware",
+		"method for looking up instances in the cluster, options are: vmware, consul")
+	vmwareCmd.PersistentFlags().StringVarP(&vmwareRegistration, "registration-provider", "r", "noop",
+		"automatic registration provider to use, options are: noop, consul")
+	addConsulFlags(vmwareCmd.PersistentFlags())
 }
 
 func vmware(cmd *cobra.Command, args []string) {
-	vmwareProvider, err := vmware_provider.NewVMware(&vmware_provider.Config{
+	ctx := context.Background()
+	cloudAPI := createVMwareCloudAPI()
+	bootstrapper := createVMwareBootstrapper(cloudAPI)
+	if dryRun {
+		printPlan(ctx, bootstrapper)
+		log.Infof("Dry run, so not updating the %s registration provider", vmwareRegistration)
+		return
+	}
+
+	if err := bootstrapper.GenerateEtcdFlagsFile(ctx, outputFilename); err != nil {
+		log.Fatalf("Failed to generate etcd flags file: %v", err)
+	}
+
+	registerInstances(ctx, cloudAPI, vmwareRegistration, initialiseVMwareRegistrationProvider(), nil)
+}
+
+func createVMware(ctx context.Context) (*vmware_provider.Members, error) {
+	return vmware_provider.NewVMware(ctx, &vmware_provider.Config{
 		User:              vmwareUsername,
 		Password:          vmwarePassword,
 		VCenterHost:       vmwareHost,
@@ -75,29 +109,109 @@ func vmware(cmd *cobra.Command, args []string) {
 		Environment:       vmwareEnvironment,
 		Role:              vmwareRole,
 	})
-	if err != nil {
-		log.Fatalf("Failed to create VMware provider: %v", err)
-	}
+}
 
-	etcdCluster, err := etcd.New(vmwareProvider)
+func newVMwareBootstrapper() *bootstrap.Bootstrapper {
+	return createVMwareBootstrapper(createVMwareCloudAPI())
+}
+
+func createVMwareBootstrapper(cloudAPI bootstrap.CloudAPI) *bootstrap.Bootstrapper {
+	etcdCluster, err := etcd.New(cloudAPI, etcdOptions()...)
 	if err != nil {
 		log.Fatalf("Failed to create etcd cluster API: %v", err)
 	}
-	bootstrapper, err := bootstrap.New(vmwareProvider, etcdCluster)
+	bootstrapper, err := bootstrap.New(cloudAPI, etcdCluster, bootstrapOptions()...)
 	if err != nil {
 		log.Fatalf("Failed to create etcd bootstrapper: %v", err)
 	}
+	return bootstrapper
+}
 
-	if err := bootstrapper.GenerateEtcdFlagsFile(outputFilename); err != nil {
-		log.Fatalf("Failed to generate etcd flags file: %v", err)
+func newVMwareWatcher(opts ...watch.Option) *watch.Watcher {
+	watcher, err := watch.New(newVMwareWatchAPIs, initialiseVMwareRegistrationProvider(), opts...)
+	if err != nil {
+		log.Fatalf("Failed to create watcher: %v", err)
+	}
+	return watcher
+}
+
+// newVMwareWatchAPIs creates a new VMware provider and etcd client for each sync, as the VMs are only listed when
+// the provider is created.
+func newVMwareWatchAPIs(ctx context.Context) (watch.CloudAPI, watch.EtcdAPI, func(), error) {
+	cloudAPI, err := vmwareCloudAPI(ctx)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("unable to create VMware provider: %w", err)
+	}
+	etcdCluster, err := etcd.New(cloudAPI, etcdOptions()...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return cloudAPI, etcdCluster, closeEtcdClusterAPI(etcdCluster), nil
+}
+
+func createVMwareCloudAPI() bootstrap.CloudAPI {
+	cloudAPI, err := vmwareCloudAPI(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to create VMware provider: %v", err)
 	}
+	return cloudAPI
+}
+
+func vmwareCloudAPI(ctx context.Context) (bootstrap.CloudAPI, error) {
+	switch vmwareLookupMethod {
+	case "vmware":
+		vmwareProvider, err := createVMware(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return metrics.InstrumentCloudAPI("vmware", vmwareProvider), nil
+	case "consul":
+		if !usesVSphere() {
+			// The local instance is found from the interface IPs instead.
+			return createConsulCloudAPI(nil), nil
+		}
+		vmwareProvider, err := createVMware(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return createConsulCloudAPI(vmwareProvider), nil
+	default:
+		return nil, fmt.Errorf("unsupported cluster lookup method %q", vmwareLookupMethod)
+	}
+}
+
+func initialiseVMwareRegistrationProvider() registrationProvider {
+	switch vmwareRegistration {
+	case "noop":
+		log.Info("Using noop cloud registration provider")
+		return metrics.InstrumentRegistrationProvider("noop", noop.RegistrationProvider{})
+	case "consul":
+		return createConsulRegistrationProvider("http")
+	default:
+		log.Fatalf("Unsupported registration type: %v", vmwareRegistration)
+		return nil
+	}
+}
+
+// usesVSphere is true unless the instances are looked up in Consul without a vSphere host to resolve the local IP,
+// e.g. for on-premise clusters which aren't on vSphere.
+func usesVSphere() bool {
+	return vmwareLookupMethod != "consul" || vmwareHost != ""
 }
 
 func checkVMwareParams(cmd *cobra.Command, args []string) {
-	checkRequiredFlag(vmwareUsername, "--vsphere-username")
-	checkRequiredFlag(vmwareHost, "--vsphere-host")
-	checkRequiredFlag(vmwareVMName, "--vm-name")
-	checkRequiredFlag(vmwareEnvironment, "--environment")
-	checkRequiredFlag(vmwareRole, "--role")
-	checkRequiredEnvironmentVariable(vmwarePassword, vmwarePasswordEnvironmentVariable)
+	if vmwarePassword == "" {
+		vmwarePassword = os.Getenv(vmwarePasswordEnvironmentVariable)
+	}
+	if !usesVSphere() {
+		return
+	}
+	var missing requiredValues
+	missing.flag(vmwareUsername, "--vsphere-username")
+	missing.flag(vmwarePassword, "--vsphere-password")
+	missing.flag(vmwareHost, "--vsphere-host")
+	missing.flag(vmwareVMName, "--vm-name")
+	missing.flag(vmwareEnvironment, "--environment")
+	missing.flag(vmwareRole, "--role")
+	missing.check()
 }
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/metrics"
+	"github.com/sky-uk/etcd-bootstrap/watch"
+	"github.com/spf13/cobra"
+)
+
+const (
+	defaultWatchInterval = time.Minute
+	defaultWatchJitter   = 0.1
+	defaultHealthAddress = ":8080"
+	shutdownTimeout      = 5 * time.Second
+)
+
+var (
+	watchInterval time.Duration
+	watchJitter   float64
+	healthAddress string
+)
+
+// newWatchCmd creates the watch command for a provider. Cobra commands can only have a single parent,
+// so each provider gets its own instance.
+func newWatchCmd(newWatcher func(opts ...watch.Option) *watch.Watcher) *cobra.Command {
+	watchCmd := &cobra.Command{
+		Use:     "watch",
+		Aliases: []string{"sidecar"},
+		Short:   "Keeps the registration provider in sync with the cluster instances",
+		Long: "Keeps the registration provider in sync with the cluster instances. This is intended to run " +
+			"alongside etcd, so registration is updated when other nodes are replaced. Send SIGHUP to sync immediately.",
+		Run: func(cmd *cobra.Command, args []string) {
+			watcher := newWatcher(watch.WithInterval(watchInterval), watch.WithJitter(watchJitter))
+			runWatcher(watcher)
+		},
+	}
+	watchCmd.Flags().DurationVar(&watchInterval, "interval", defaultWatchInterval,
+		"how often to update the registration provider")
+	watchCmd.Flags().Float64Var(&watchJitter, "jitter", defaultWatchJitter,
+		"fraction of the interval to randomly vary it by, so nodes don't all update at once")
+	watchCmd.Flags().StringVar(&healthAddress, "health-address", defaultHealthAddress,
+		"address to serve the /healthz and /metrics endpoints on, or empty to disable them")
+	return watchCmd
+}
+
+func runWatcher(watcher *watch.Watcher) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	resync := make(chan struct{})
+	go func() {
+		for sig := range signals {
+			if sig != syscall.SIGHUP {
+				log.Infof("Received %v, shutting down", sig)
+				cancel()
+				return
+			}
+			select {
+			case resync <- struct{}{}:
+			default:
+				log.Info("Already syncing, ignoring SIGHUP")
+			}
+		}
+	}()
+
+	var server *http.Server
+	if healthAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", watcher)
+		mux.Handle("/metrics", metrics.Handler())
+		server = &http.Server{Addr: healthAddress, Handler: mux}
+		go func() {
+			log.Infof("Serving /healthz and /metrics on %s", healthAddress)
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Failed to serve health endpoint: %v", err)
+			}
+		}()
+	}
+
+	watcher.Run(ctx, resync)
+
+	if server != nil {
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancelShutdown()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Warnf("Failed to shut down health endpoint: %v", err)
+		}
+	}
+}
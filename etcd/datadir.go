@@ -0,0 +1,60 @@
+package etcd
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/server/v3/wal"
+	"go.etcd.io/etcd/server/v3/wal/walpb"
+	"go.uber.org/zap"
+)
+
+// ErrNoData is returned by ReadDataDir if the data dir doesn't contain a WAL, e.g. etcd has never started.
+var ErrNoData = errors.New("no etcd data found")
+
+// DataDir is the identity of the member whose data is stored in an etcd data dir.
+type DataDir struct {
+	MemberID  uint64 `json:"memberID"`
+	ClusterID uint64 `json:"clusterID"`
+}
+
+// ReadDataDir reads the member and cluster IDs from the WAL in an etcd data dir. The WAL is opened read only, from
+// its latest snapshot, with etcd's own WAL reader, so the records' checksums are verified. It doesn't need etcd to be
+// running.
+func ReadDataDir(dataDir string) (DataDir, error) {
+	walDir := filepath.Join(dataDir, "member", "wal")
+	if !wal.Exist(walDir) {
+		return DataDir{}, ErrNoData
+	}
+	lg := zap.NewNop()
+
+	// Older WAL files may have been purged, so it's read from the latest snapshot like etcd does when starting.
+	snaps, err := wal.ValidSnapshotEntries(lg, walDir)
+	if err != nil {
+		return DataDir{}, fmt.Errorf("unable to read WAL snapshots in %s: %w", walDir, err)
+	}
+	var snap walpb.Snapshot
+	if len(snaps) > 0 {
+		snap = snaps[len(snaps)-1]
+	}
+	w, err := wal.OpenForRead(lg, walDir, snap)
+	if err != nil {
+		return DataDir{}, fmt.Errorf("unable to open WAL in %s: %w", walDir, err)
+	}
+	defer w.Close()
+
+	data, _, _, err := w.ReadAll()
+	if err != nil {
+		return DataDir{}, fmt.Errorf("unable to read WAL in %s: %w", walDir, err)
+	}
+	if data == nil {
+		return DataDir{}, fmt.Errorf("WAL in %s has no metadata", walDir)
+	}
+	var metadata etcdserverpb.Metadata
+	if err := metadata.Unmarshal(data); err != nil {
+		return DataDir{}, fmt.Errorf("unable to decode WAL metadata in %s: %w", walDir, err)
+	}
+	return DataDir{MemberID: metadata.NodeID, ClusterID: metadata.ClusterID}, nil
+}
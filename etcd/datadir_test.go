@@ -0,0 +1,83 @@
+package etcd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/raft/v3/raftpb"
+	"go.etcd.io/etcd/server/v3/wal"
+	"go.etcd.io/etcd/server/v3/wal/walpb"
+	"go.uber.org/zap"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ReadDataDir()", func() {
+	var (
+		dataDir         string
+		walDir          string
+		metadata        []byte
+		segmentSize     int64
+		expectedDataDir = DataDir{MemberID: 0x8e9e05c52164694d, ClusterID: 0xcdf818194e3a8c32}
+	)
+
+	// createWAL writes a WAL with the metadata, some entries and a snapshot, the way etcd does.
+	createWAL := func() {
+		w, err := wal.Create(zap.NewNop(), walDir, metadata)
+		Expect(err).To(BeNil())
+		Expect(w.Save(raftpb.HardState{Term: 1, Commit: 2},
+			[]raftpb.Entry{{Term: 1, Index: 1}, {Term: 1, Index: 2}})).To(Succeed())
+		confState := &raftpb.ConfState{Voters: []uint64{expectedDataDir.MemberID}}
+		Expect(w.SaveSnapshot(walpb.Snapshot{Term: 1, Index: 2, ConfState: confState})).To(Succeed())
+		Expect(w.Close()).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "datadir-test")
+		Expect(err).To(BeNil())
+		walDir = filepath.Join(dataDir, "member", "wal")
+		Expect(os.MkdirAll(filepath.Dir(walDir), 0700)).To(Succeed())
+		metadata, err = (&etcdserverpb.Metadata{NodeID: expectedDataDir.MemberID, ClusterID: expectedDataDir.ClusterID}).Marshal()
+		Expect(err).To(BeNil())
+		// Avoid preallocating 64MB WAL files.
+		segmentSize = wal.SegmentSizeBytes
+		wal.SegmentSizeBytes = 16 * 1024
+	})
+
+	AfterEach(func() {
+		wal.SegmentSizeBytes = segmentSize
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	It("reads the member and cluster IDs from the WAL metadata", func() {
+		createWAL()
+		Expect(ReadDataDir(dataDir)).To(Equal(expectedDataDir))
+	})
+
+	It("returns ErrNoData if there is no WAL", func() {
+		_, err := ReadDataDir(dataDir)
+		Expect(err).To(Equal(ErrNoData))
+	})
+
+	It("fails if the WAL is corrupt", func() {
+		createWAL()
+		walFiles, err := filepath.Glob(filepath.Join(walDir, "*.wal"))
+		Expect(err).To(BeNil())
+		Expect(walFiles).To(HaveLen(1))
+		data, err := ioutil.ReadFile(walFiles[0])
+		Expect(err).To(BeNil())
+		i := bytes.Index(data, metadata)
+		Expect(i).To(BeNumerically(">", 0))
+		data[i+len(metadata)-1] ^= 0xff
+		Expect(ioutil.WriteFile(walFiles[0], data, 0600)).To(Succeed())
+
+		_, err = ReadDataDir(dataDir)
+		Expect(err).ToNot(BeNil())
+		Expect(err).ToNot(Equal(ErrNoData))
+	})
+})
@@ -1,49 +1,82 @@
 package etcd
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
-	"github.com/coreos/etcd/client"
 	log "github.com/sirupsen/logrus"
 	"github.com/sky-uk/etcd-bootstrap/cloud"
-	"golang.org/x/net/context"
+	"github.com/sky-uk/etcd-bootstrap/retry"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-const timeout = 5 * time.Second
+const (
+	timeout           = 5 * time.Second
+	defaultPeerPort   = 2380
+	defaultClientPort = 2379
+)
+
+// etcdClusterClient is the subset of the v3 cluster API used for managing members.
+type etcdClusterClient interface {
+	MemberList(ctx context.Context) (*clientv3.MemberListResponse, error)
+	MemberAdd(ctx context.Context, peerAddrs []string) (*clientv3.MemberAddResponse, error)
+	MemberAddAsLearner(ctx context.Context, peerAddrs []string) (*clientv3.MemberAddResponse, error)
+	MemberRemove(ctx context.Context, id uint64) (*clientv3.MemberRemoveResponse, error)
+	MemberPromote(ctx context.Context, id uint64) (*clientv3.MemberPromoteResponse, error)
+}
 
-type etcdMembersAPI interface {
-	List(ctx context.Context) ([]client.Member, error)
-	Add(ctx context.Context, peerURL string) (*client.Member, error)
-	Remove(ctx context.Context, mID string) error
+// etcdMaintenanceClient is the subset of the v3 maintenance API used for checking member progress.
+type etcdMaintenanceClient interface {
+	Status(ctx context.Context, endpoint string) (*clientv3.StatusResponse, error)
 }
 
 // ClusterAPI represents an etcd cluster API.
 type ClusterAPI struct {
-	cloudAPI  CloudAPI
-	protocol  string
-	transport client.CancelableTransport
-	// membersAPIClient is the cached API client. Don't use it directly, use list/add/remove instead.
-	membersAPIClient etcdMembersAPI
+	cloudAPI   CloudAPI
+	protocol   string
+	peerPort   int
+	clientPort int
+	tlsConfig  *tls.Config
+	// retryPolicy is for calls which change or read the cluster, other than listing the members.
+	retryPolicy retry.Policy
+	// clusterClient and maintenanceClient are the cached API clients. Don't use them directly, use clients instead.
+	clusterClient     etcdClusterClient
+	maintenanceClient etcdMaintenanceClient
+	// client is the underlying client, for the concurrency API. It's only set once clients has created it.
+	client *clientv3.Client
+	// probeClient is the cached HTTP client for probing instances. Use httpClient instead.
+	probeClient *http.Client
 }
 
 // CloudAPI returns the cloud instances in the cluster.
 type CloudAPI interface {
 	// GetInstances returns all the non-terminated instances that will be part of the etcd cluster.
-	GetInstances() ([]cloud.Instance, error)
+	GetInstances(context.Context) ([]cloud.Instance, error)
 }
 
 // Member represents a node in the etcd cluster.
 type Member struct {
-	Name    string
-	PeerURL string
+	ID      uint64 `json:"id"`
+	Name    string `json:"name"`
+	PeerURL string `json:"peerURL"`
+	// ClientURLs are empty until the member has started.
+	ClientURLs []string `json:"clientURLs,omitempty"`
+	// IsLearner is true if the member is a non-voting learner.
+	IsLearner bool `json:"isLearner,omitempty"`
 }
 
 // Option for New.
@@ -95,33 +128,46 @@ func WithTLS(peerCA, peerCert, peerKey string) Option {
 			caCertPool.AddCert(cert)
 		}
 
-		tlsConfig := &tls.Config{
+		c.tlsConfig = &tls.Config{
 			Certificates: []tls.Certificate{cert},
 			RootCAs:      caCertPool,
 		}
-		tlsConfig.BuildNameToCertificate()
-
-		// Base settings are copied from client.DefaultTransport.
-		c.transport = &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			Dial: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).Dial,
-			TLSHandshakeTimeout: 10 * time.Second,
-			TLSClientConfig:     tlsConfig,
-		}
 		c.protocol = "https"
 		return nil
 	}
 }
 
+// WithClientPort sets the port used to reach the etcd cluster's client API. Instances which publish their own
+// client port take precedence over this.
+func WithClientPort(port int) Option {
+	return func(c *ClusterAPI) error {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid client port: %d is not between 1 and 65535", port)
+		}
+		c.clientPort = port
+		return nil
+	}
+}
+
+// WithRetryPolicy sets how calls to the cluster are retried, which defaults to retry.DefaultPolicy.
+func WithRetryPolicy(policy retry.Policy) Option {
+	return func(c *ClusterAPI) error {
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+		c.retryPolicy = policy
+		return nil
+	}
+}
+
 // New returns a cluster object for interacting with the etcd cluster API.
 func New(cloudAPI CloudAPI, opts ...Option) (*ClusterAPI, error) {
 	c := &ClusterAPI{
-		cloudAPI:  cloudAPI,
-		protocol:  "http",
-		transport: client.DefaultTransport,
+		cloudAPI:    cloudAPI,
+		protocol:    "http",
+		peerPort:    defaultPeerPort,
+		clientPort:  defaultClientPort,
+		retryPolicy: retry.DefaultPolicy,
 	}
 	for _, opt := range opts {
 		if err := opt(c); err != nil {
@@ -131,82 +177,130 @@ func New(cloudAPI CloudAPI, opts ...Option) (*ClusterAPI, error) {
 	return c, nil
 }
 
-func (c *ClusterAPI) createEtcdClientConfig() (client.Config, error) {
-	instances, err := c.cloudAPI.GetInstances()
+// endpoints returns the client URLs of all the cloud instances.
+func (c *ClusterAPI) endpoints(ctx context.Context) ([]string, error) {
+	instances, err := c.cloudAPI.GetInstances(ctx)
 	if err != nil {
-		return client.Config{}, err
+		return nil, err
 	}
 
 	var endpoints []string
 	for _, instance := range instances {
-		endpoints = append(endpoints, fmt.Sprintf("%s://%s:2379", c.protocol, instance.Endpoint))
+		port := c.clientPort
+		if instance.ClientPort != 0 {
+			port = instance.ClientPort
+		}
+		endpoints = append(endpoints, c.url(instance.Endpoint, port))
 	}
+	return endpoints, nil
+}
 
-	return client.Config{
-		Endpoints: endpoints,
-		Transport: c.transport,
+func (c *ClusterAPI) createEtcdClientConfig(ctx context.Context) (clientv3.Config, error) {
+	endpoints, err := c.endpoints(ctx)
+	if err != nil {
+		return clientv3.Config{}, err
+	}
+
+	return clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: timeout,
+		TLS:         c.tlsConfig,
+		// Errors are returned to the caller, so the client's own logging is just noise.
+		Logger: zap.NewNop(),
 	}, nil
 }
 
-func (c *ClusterAPI) membersAPI() (etcdMembersAPI, error) {
-	if c.membersAPIClient == nil {
-		conf, err := c.createEtcdClientConfig()
+// clients returns the cached API clients, creating them if needed. Creating the client doesn't connect
+// to the cluster, so this only fails if the configuration is invalid.
+func (c *ClusterAPI) clients(ctx context.Context) (etcdClusterClient, etcdMaintenanceClient, error) {
+	if c.clusterClient == nil || c.maintenanceClient == nil {
+		conf, err := c.createEtcdClientConfig(ctx)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		cl, err := client.New(conf)
+		cl, err := clientv3.New(conf)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		c.membersAPIClient = client.NewMembersAPI(cl)
+		c.clusterClient = cl
+		c.maintenanceClient = cl
+		c.client = cl
 	}
-	return c.membersAPIClient, nil
+	return c.clusterClient, c.maintenanceClient, nil
 }
 
-func (c *ClusterAPI) list(ctx context.Context) ([]client.Member, error) {
-	api, err := c.membersAPI()
-	if err != nil {
-		return nil, err
+// Close closes the etcd client, if one has been created.
+func (c *ClusterAPI) Close() error {
+	if c.client == nil {
+		return nil
 	}
-	return api.List(ctx)
+	err := c.client.Close()
+	c.client, c.clusterClient, c.maintenanceClient = nil, nil, nil
+	return err
 }
 
-func (c *ClusterAPI) add(ctx context.Context, peerURL string) (*client.Member, error) {
-	api, err := c.membersAPI()
+func (c *ClusterAPI) list(ctx context.Context) ([]*etcdserverpb.Member, error) {
+	resp, err := c.memberList(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return api.Add(ctx, peerURL)
+	return resp.Members, nil
 }
 
-func (c *ClusterAPI) remove(ctx context.Context, mID string) error {
-	api, err := c.membersAPI()
+func (c *ClusterAPI) memberList(ctx context.Context) (*clientv3.MemberListResponse, error) {
+	cluster, _, err := c.clients(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return api.Remove(ctx, mID)
+	return cluster.MemberList(ctx)
 }
 
+// isTLSError checks for certificate errors. gRPC only surfaces these as part of the connection error
+// description, so fall back to checking the message if they aren't wrapped.
 func isTLSError(err error) bool {
-	if cerr, ok := err.(*client.ClusterError); ok {
-		for _, clusterErr := range cerr.Errors {
-			if _, ok := clusterErr.(x509.CertificateInvalidError); ok {
-				return true
-			}
-			if _, ok := clusterErr.(x509.UnknownAuthorityError); ok {
-				return true
-			}
-			if _, ok := clusterErr.(x509.HostnameError); ok {
-				return true
-			}
-		}
+	var invalidErr x509.CertificateInvalidError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &invalidErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) {
+		return true
 	}
-	return false
+	msg := err.Error()
+	return strings.Contains(msg, "x509: ") || strings.Contains(msg, "authentication handshake failed")
 }
 
-// Members returns the cluster members.
-func (c *ClusterAPI) Members() ([]Member, error) {
-	ctx, cancelFn := context.WithTimeout(context.Background(), timeout)
+// isRetryable checks for errors which are likely to be transient, such as a leader election in progress or
+// a member being unreachable.
+func isRetryable(err error) bool {
+	if isTLSError(err) {
+		return false
+	}
+	var etcdErr rpctypes.EtcdError
+	if errors.As(err, &etcdErr) {
+		return retryableCode(etcdErr.Code())
+	}
+	if s, ok := status.FromError(err); ok && s.Code() != codes.Unknown {
+		return retryableCode(s.Code())
+	}
+	return retry.Network(err)
+}
+
+func retryableCode(code codes.Code) bool {
+	return code == codes.Unavailable || code == codes.ResourceExhausted || code == codes.DeadlineExceeded
+}
+
+// do calls fn with a timeout for each attempt, retrying transient errors according to the retry policy.
+func (c *ClusterAPI) do(ctx context.Context, name string, fn func(context.Context) error) error {
+	return retry.Do(ctx, c.retryPolicy, name, isRetryable, func(ctx context.Context) error {
+		ctx, cancelFn := context.WithTimeout(ctx, timeout)
+		defer cancelFn()
+		return fn(ctx)
+	})
+}
+
+// Members returns the cluster members. It isn't retried, as the cluster being unreachable is expected when
+// bootstrapping a new one. Callers which need it wait for the cluster themselves.
+func (c *ClusterAPI) Members(ctx context.Context) ([]Member, error) {
+	ctx, cancelFn := context.WithTimeout(ctx, timeout)
 	defer cancelFn()
 	etcdMembers, err := c.list(ctx)
 	if err != nil {
@@ -224,45 +318,157 @@ func (c *ClusterAPI) Members() ([]Member, error) {
 		}
 
 		members = append(members, Member{
-			Name:    etcdMember.Name,
-			PeerURL: etcdMember.PeerURLs[0],
+			ID:         etcdMember.ID,
+			Name:       etcdMember.Name,
+			PeerURL:    etcdMember.PeerURLs[0],
+			ClientURLs: etcdMember.ClientURLs,
+			IsLearner:  etcdMember.IsLearner,
 		})
 	}
 
 	return members, nil
 }
 
+// ClusterID returns the ID of the live cluster.
+func (c *ClusterAPI) ClusterID(ctx context.Context) (uint64, error) {
+	var resp *clientv3.MemberListResponse
+	err := c.do(ctx, "get the cluster ID", func(ctx context.Context) error {
+		var err error
+		resp, err = c.memberList(ctx)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if resp.Header == nil {
+		return 0, fmt.Errorf("member list response has no header")
+	}
+	return resp.Header.ClusterId, nil
+}
+
 // AddMemberByPeerURL adds a new member to the cluster by its peer URL.
 // etcd bootstraps by requiring the peer URL to be first added. Then the new node informs etcd of its name.
-func (c *ClusterAPI) AddMemberByPeerURL(peerURL string) error {
-	ctx, cancelFn := context.WithTimeout(context.Background(), timeout)
-	defer cancelFn()
-	_, err := c.add(ctx, peerURL)
-	return err
+func (c *ClusterAPI) AddMemberByPeerURL(ctx context.Context, peerURL string) error {
+	cluster, _, err := c.clients(ctx)
+	if err != nil {
+		return err
+	}
+	return c.addMember(ctx, "add member "+peerURL, peerURL, cluster.MemberAdd)
+}
+
+// addMember adds the member, retrying if needed. If an earlier attempt timed out but succeeded, a retry finds
+// the member already exists, which is also a success.
+func (c *ClusterAPI) addMember(ctx context.Context, name, peerURL string,
+	add func(context.Context, []string) (*clientv3.MemberAddResponse, error)) error {
+	retried := false
+	return c.do(ctx, name, func(ctx context.Context) error {
+		_, err := add(ctx, []string{peerURL})
+		if retried && errors.Is(err, rpctypes.ErrPeerURLExist) {
+			log.Infof("%s was added by an earlier attempt", peerURL)
+			return nil
+		}
+		retried = true
+		return err
+	})
 }
 
 // RemoveMemberByName removes a member of the cluster by its name.
-func (c *ClusterAPI) RemoveMemberByName(name string) error {
-	ctx, cancelFn := context.WithTimeout(context.Background(), timeout)
-	defer cancelFn()
-	members, err := c.list(ctx)
+// Each attempt lists the members again, so a retry after a removal which timed out but succeeded does nothing.
+func (c *ClusterAPI) RemoveMemberByName(ctx context.Context, name string) error {
+	cluster, _, err := c.clients(ctx)
 	if err != nil {
 		return err
 	}
+	return c.do(ctx, "remove member "+name, func(ctx context.Context) error {
+		members, err := c.list(ctx)
+		if err != nil {
+			return err
+		}
 
-	for _, member := range members {
-		if member.Name == name {
-			return c.remove(ctx, member.ID)
+		for _, member := range members {
+			if member.Name == name {
+				_, err := cluster.MemberRemove(ctx, member.ID)
+				return err
+			}
+		}
+
+		log.Infof("%s has already been removed", name)
+		return nil
+	})
+}
+
+// RemoveMember removes a member of the cluster by its ID. Unlike removing by name, this can't remove the wrong
+// member when several haven't started yet, and so have no name.
+// Each attempt lists the members again, so a retry after a removal which timed out but succeeded does nothing.
+func (c *ClusterAPI) RemoveMember(ctx context.Context, id uint64) error {
+	cluster, _, err := c.clients(ctx)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, fmt.Sprintf("remove member %x", id), func(ctx context.Context) error {
+		members, err := c.list(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, member := range members {
+			if member.ID == id {
+				_, err := cluster.MemberRemove(ctx, member.ID)
+				return err
+			}
 		}
+
+		log.Infof("Member %x has already been removed", id)
+		return nil
+	})
+}
+
+// MemberHealthy returns true if any of the member's client URLs respond to a status request.
+func (c *ClusterAPI) MemberHealthy(ctx context.Context, member Member) bool {
+	_, maintenance, err := c.clients(ctx)
+	if err != nil {
+		log.Warnf("Unable to create etcd client to check health of %s: %v", member.Name, err)
+		return false
 	}
+	for _, clientURL := range member.ClientURLs {
+		ctx, cancelFn := context.WithTimeout(ctx, timeout)
+		_, err := maintenance.Status(ctx, clientURL)
+		cancelFn()
+		if err == nil {
+			return true
+		}
+		log.Debugf("%s is unreachable at %s: %v", member.Name, clientURL, err)
+	}
+	return false
+}
 
-	log.Infof("%s has already been removed", name)
-	return nil
+// Leader returns the ID of the cluster leader, as reported by the first of the members' client URLs to respond.
+func (c *ClusterAPI) Leader(ctx context.Context, members []Member) (uint64, error) {
+	_, maintenance, err := c.clients(ctx)
+	if err != nil {
+		return 0, err
+	}
+	err = fmt.Errorf("no members have started")
+	for _, member := range members {
+		for _, clientURL := range member.ClientURLs {
+			ctx, cancelFn := context.WithTimeout(ctx, timeout)
+			var resp *clientv3.StatusResponse
+			resp, err = maintenance.Status(ctx, clientURL)
+			cancelFn()
+			if err == nil {
+				if resp.Leader == 0 {
+					return 0, fmt.Errorf("%s has no leader", member.Name)
+				}
+				return resp.Leader, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unable to find the leader: %w", err)
 }
 
-func assertSinglePeerURL(member client.Member) error {
+func assertSinglePeerURL(member *etcdserverpb.Member) error {
 	if len(member.PeerURLs) != 1 {
-		return fmt.Errorf("expected a single peer URL, but found %v for %s", member.PeerURLs, member.ID)
+		return fmt.Errorf("expected a single peer URL, but found %v for %x", member.PeerURLs, member.ID)
 	}
 	return nil
 }
@@ -1,17 +1,20 @@
 package etcd
 
 import (
+	"context"
 	"crypto/x509"
 	"fmt"
-	"net/http"
 	"testing"
+	"time"
 
-	"github.com/coreos/etcd/client"
 	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/retry"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
-	"golang.org/x/net/context"
 )
 
 // TestEtcd to register the test suite
@@ -21,77 +24,88 @@ func TestEtcd(t *testing.T) {
 }
 
 var _ = Describe("Etcd client", func() {
-	var membersAPIClient MockMembersAPI
+	var (
+		clusterClient     *mockClusterClient
+		maintenanceClient *mockMaintenanceClient
+		etcdCluster       *ClusterAPI
+	)
 
 	BeforeEach(func() {
 		By("Creating dummy client responses")
-		membersAPIClient = MockMembersAPI{
-			MockList: List{
-				ListOutput: []client.Member{
-					{
-						ID:         "test-good-response-id-1",
-						Name:       "test-good-response-name-1",
-						PeerURLs:   []string{"http://192.168.0.1:2380"},
-						ClientURLs: []string{"http://192.168.0.1:2379"},
-					},
-					{
-						ID:         "test-good-response-id-2",
-						Name:       "test-good-response-name-2",
-						PeerURLs:   []string{"http://192.168.0.2:2380"},
-						ClientURLs: []string{"http://192.168.0.2:2379"},
-					},
+		clusterClient = &mockClusterClient{
+			members: []*etcdserverpb.Member{
+				{
+					ID:         1,
+					Name:       "test-good-response-name-1",
+					PeerURLs:   []string{"http://192.168.0.1:2380"},
+					ClientURLs: []string{"http://192.168.0.1:2379"},
+				},
+				{
+					ID:         2,
+					Name:       "test-good-response-name-2",
+					PeerURLs:   []string{"http://192.168.0.2:2380"},
+					ClientURLs: []string{"http://192.168.0.2:2379"},
+					IsLearner:  true,
 				},
 			},
-			MockAdd:    Add{},
-			MockRemove: Remove{},
 		}
+		maintenanceClient = &mockMaintenanceClient{
+			statuses: map[string]*clientv3.StatusResponse{
+				"http://192.168.0.1:2379": {},
+			},
+		}
+		etcdCluster = &ClusterAPI{clusterClient: clusterClient, maintenanceClient: maintenanceClient}
 	})
 
 	Context("Members()", func() {
-		It("can list when the etcd members api client responds with expected results", func() {
+		It("can list when the etcd cluster client responds with expected results", func() {
 			By("Returning all expected responses")
-			etcdCluster := &ClusterAPI{membersAPIClient: membersAPIClient}
-			memberList, err := etcdCluster.Members()
+			memberList, err := etcdCluster.Members(context.Background())
 			Expect(err).To(BeNil())
 			Expect(memberList).To(Equal([]Member{
 				{
-					Name:    "test-good-response-name-1",
-					PeerURL: "http://192.168.0.1:2380",
+					ID:         1,
+					Name:       "test-good-response-name-1",
+					PeerURL:    "http://192.168.0.1:2380",
+					ClientURLs: []string{"http://192.168.0.1:2379"},
 				},
 				{
-					Name:    "test-good-response-name-2",
-					PeerURL: "http://192.168.0.2:2380",
+					ID:         2,
+					Name:       "test-good-response-name-2",
+					PeerURL:    "http://192.168.0.2:2380",
+					ClientURLs: []string{"http://192.168.0.2:2379"},
+					IsLearner:  true,
 				},
 			}))
 		})
 
-		It("continues even if the etcd members api client errors on List()", func() {
-			membersAPIClient.MockList.Err = fmt.Errorf("failed to list members")
+		It("continues even if the etcd cluster client errors on MemberList()", func() {
+			clusterClient.listErr = fmt.Errorf("failed to list members")
 
 			By("Return a client that isn't able to list etcd members")
-			etcdCluster := &ClusterAPI{membersAPIClient: membersAPIClient}
-			_, err := etcdCluster.Members()
+			_, err := etcdCluster.Members(context.Background())
 			Expect(err).To(BeNil())
 		})
 
 		It("fails if a TLS error occurred", func() {
-			certErrors := []error{x509.CertificateInvalidError{}, x509.UnknownAuthorityError{}, x509.HostnameError{}}
+			certErrors := []error{
+				x509.CertificateInvalidError{},
+				x509.UnknownAuthorityError{},
+				x509.HostnameError{},
+				fmt.Errorf("rpc error: code = Unavailable desc = connection error: desc = \"transport: authentication handshake failed: remote error\""),
+			}
 			for _, certErr := range certErrors {
-				clusterErr := client.ClusterError{
-					Errors: []error{certErr},
-				}
-				membersAPIClient.MockList.Err = &clusterErr
+				clusterClient.listErr = fmt.Errorf("failed to list members: %w", certErr)
 
-				etcdCluster := &ClusterAPI{membersAPIClient: membersAPIClient}
-				_, err := etcdCluster.Members()
+				_, err := etcdCluster.Members(context.Background())
 				Expect(err).To(Not(Succeed()), "should fail on %v", certErr)
 			}
 		})
 
-		It("fails when the etcd members api response contains a member with more than one peer url", func() {
-			membersAPIClient.MockList.ListOutput = []client.Member{
+		It("fails when the etcd cluster response contains a member with more than one peer url", func() {
+			clusterClient.members = []*etcdserverpb.Member{
 				{
-					ID:   "test-complex-response-id-1",
+					ID:   3,
 					Name: "test-complex-response-id-1",
 					PeerURLs: []string{
 						"http://192.168.0.1:2380",
@@ -105,61 +119,146 @@ var _ = Describe("Etcd client", func() {
 			}
 
 			By("Returning an etcd client that returns complex members")
-			etcdCluster := &ClusterAPI{membersAPIClient: membersAPIClient}
-			_, err := etcdCluster.Members()
+			_, err := etcdCluster.Members(context.Background())
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Context("ClusterID()", func() {
+		It("returns the cluster ID from the member list", func() {
+			Expect(etcdCluster.ClusterID(context.Background())).To(Equal(uint64(0xc1)))
+		})
+
+		It("fails when the client errors", func() {
+			clusterClient.listErr = fmt.Errorf("failed to list members")
+			_, err := etcdCluster.ClusterID(context.Background())
 			Expect(err).ToNot(BeNil())
 		})
 	})
 
 	Context("AddMemberByPeerURL()", func() {
 		It("can add a member when the client doesn't error", func() {
-			membersAPIClient.MockAdd.ExpectedPeerURL = "http://192.168.0.100"
-
 			By("Returning all expected responses")
-			etcdCluster := &ClusterAPI{membersAPIClient: membersAPIClient}
-			Expect(etcdCluster.AddMemberByPeerURL("http://192.168.0.100")).To(BeNil())
+			Expect(etcdCluster.AddMemberByPeerURL(context.Background(), "http://192.168.0.100")).To(BeNil())
+			Expect(clusterClient.added).To(Equal([]string{"http://192.168.0.100"}))
+		})
+
+		It("fails when the client errors", func() {
+			clusterClient.addErr = fmt.Errorf("failed to add member")
+			Expect(etcdCluster.AddMemberByPeerURL(context.Background(), "http://192.168.0.100")).ToNot(Succeed())
+		})
+
+		Context("with retries", func() {
+			BeforeEach(func() {
+				etcdCluster.retryPolicy = retry.Policy{MaxAttempts: 3, InitialInterval: time.Millisecond}
+			})
+
+			It("retries while there is no leader", func() {
+				clusterClient.addErrs = []error{rpctypes.ErrNoLeader, rpctypes.ErrNoLeader}
+				Expect(etcdCluster.AddMemberByPeerURL(context.Background(), "http://192.168.0.100")).To(Succeed())
+				Expect(clusterClient.addCalls).To(Equal(3))
+			})
+
+			It("succeeds if a timed out attempt added the member", func() {
+				clusterClient.addErrs = []error{context.DeadlineExceeded, rpctypes.ErrPeerURLExist}
+				Expect(etcdCluster.AddMemberByPeerURL(context.Background(), "http://192.168.0.100")).To(Succeed())
+				Expect(clusterClient.addCalls).To(Equal(2))
+			})
+
+			It("doesn't retry errors which aren't transient", func() {
+				clusterClient.addErr = rpctypes.ErrPeerURLExist
+				Expect(etcdCluster.AddMemberByPeerURL(context.Background(), "http://192.168.0.100")).ToNot(Succeed())
+				Expect(clusterClient.addCalls).To(Equal(1))
+			})
+
+			It("doesn't retry TLS errors", func() {
+				clusterClient.addErr = fmt.Errorf("connection error: %w", x509.UnknownAuthorityError{})
+				Expect(etcdCluster.AddMemberByPeerURL(context.Background(), "http://192.168.0.100")).ToNot(Succeed())
+				Expect(clusterClient.addCalls).To(Equal(1))
+			})
 		})
 	})
 
 	Context("RemoveMemberByName()", func() {
-		It("can use the etcd members api client to remove a member", func() {
-			membersAPIClient.MockList.ListOutput = []client.Member{
-				{
-					ID:         "test-remove-instance-id",
-					Name:       "test-remove-instance-name",
-					PeerURLs:   []string{"http://192.168.0.1:2379"},
-					ClientURLs: []string{"http://192.168.0.1:2380"},
-				},
-			}
-			membersAPIClient.MockRemove.ExpectedMID = "test-remove-instance-id"
-
+		It("can use the etcd cluster client to remove a member", func() {
 			By("Returning all expected responses")
-			etcdCluster := &ClusterAPI{membersAPIClient: membersAPIClient}
-			Expect(etcdCluster.RemoveMemberByName("test-remove-instance-name")).To(BeNil())
+			Expect(etcdCluster.RemoveMemberByName(context.Background(), "test-good-response-name-2")).To(BeNil())
+			Expect(clusterClient.removed).To(Equal([]uint64{2}))
 		})
 
-		It("fails if it is unable to list members using the etcd members api client", func() {
-			membersAPIClient.MockList.Err = fmt.Errorf("failed to list members")
+		It("fails if it is unable to list members using the etcd cluster client", func() {
+			clusterClient.listErr = fmt.Errorf("failed to list members")
 
 			By("Returning a client that isn't able to list etcd members")
-			etcdCluster := &ClusterAPI{membersAPIClient: membersAPIClient}
-			Expect(etcdCluster.RemoveMemberByName("test-remove-instance-name")).ToNot(BeNil())
+			Expect(etcdCluster.RemoveMemberByName(context.Background(), "test-good-response-name-1")).ToNot(BeNil())
 		})
 
 		It("does nothing if the member has already been removed", func() {
-			By("Expecting the Remove() call not to be made as we allow only blank PeerURL's")
-			membersAPIClient.MockList.ListOutput = []client.Member{
-				{
-					ID:         "test-other-instance-id",
-					Name:       "test-other-instance-name",
-					PeerURLs:   []string{"http://192.168.0.1:2379"},
-					ClientURLs: []string{"http://192.168.0.1:2380"},
-				},
-			}
+			By("Expecting the MemberRemove() call not to be made")
+			Expect(etcdCluster.RemoveMemberByName(context.Background(), "test-remove-instance-name")).To(BeNil())
+			Expect(clusterClient.removed).To(BeEmpty())
+		})
+	})
 
-			By("Returning an etcd member list containing irrelevant members")
-			etcdCluster := &ClusterAPI{membersAPIClient: membersAPIClient}
-			Expect(etcdCluster.RemoveMemberByName("test-remove-instance-name")).To(BeNil())
+	Context("RemoveMember()", func() {
+		It("removes the member with the ID", func() {
+			Expect(etcdCluster.RemoveMember(context.Background(), 2)).To(Succeed())
+			Expect(clusterClient.removed).To(Equal([]uint64{2}))
+		})
+
+		It("does nothing if the member has already been removed", func() {
+			Expect(etcdCluster.RemoveMember(context.Background(), 9)).To(Succeed())
+			Expect(clusterClient.removed).To(BeEmpty())
+		})
+	})
+
+	Context("Close()", func() {
+		It("does nothing if no client has been created", func() {
+			Expect((&ClusterAPI{}).Close()).To(Succeed())
+		})
+	})
+
+	Context("MemberHealthy()", func() {
+		It("is healthy if any client URL responds", func() {
+			Expect(etcdCluster.MemberHealthy(context.Background(), Member{
+				Name:       "test-good-response-name-1",
+				ClientURLs: []string{"http://192.168.0.9:2379", "http://192.168.0.1:2379"},
+			})).To(BeTrue())
+		})
+
+		It("is unhealthy if no client URLs respond", func() {
+			Expect(etcdCluster.MemberHealthy(context.Background(), Member{
+				Name:       "test-good-response-name-2",
+				ClientURLs: []string{"http://192.168.0.2:2379"},
+			})).To(BeFalse())
+		})
+
+		It("is unhealthy if the member hasn't started", func() {
+			Expect(etcdCluster.MemberHealthy(context.Background(), Member{Name: "test-good-response-name-3"})).To(BeFalse())
+		})
+	})
+
+	Context("Leader()", func() {
+		It("returns the leader reported by the first member to respond", func() {
+			maintenanceClient.statuses["http://192.168.0.1:2379"] = &clientv3.StatusResponse{Leader: 1}
+			members, err := etcdCluster.Members(context.Background())
+			Expect(err).To(BeNil())
+			Expect(etcdCluster.Leader(context.Background(), members)).To(Equal(uint64(1)))
+		})
+
+		It("fails if the cluster has no leader", func() {
+			members, err := etcdCluster.Members(context.Background())
+			Expect(err).To(BeNil())
+			_, err = etcdCluster.Leader(context.Background(), members)
+			Expect(err).To(MatchError(ContainSubstring("has no leader")))
+		})
+
+		It("fails if no members respond", func() {
+			_, err := etcdCluster.Leader(context.Background(), []Member{{
+				Name:       "test-good-response-name-2",
+				ClientURLs: []string{"http://192.168.0.2:2379"},
+			}})
+			Expect(err).To(MatchError(ContainSubstring("unreachable endpoint")))
 		})
 	})
 
@@ -177,8 +276,8 @@ var _ = Describe("Etcd client", func() {
 			cluster := &ClusterAPI{}
 			Expect(WithTLS(peerCA, peerCert, peerKey)(cluster)).To(Succeed())
 			Expect(cluster.protocol).To(Equal("https"))
-			transport := (cluster.transport).(*http.Transport)
-			Expect(transport.TLSClientConfig).To(Not(BeNil()), "tls client config should be set")
+			Expect(cluster.tlsConfig).To(Not(BeNil()), "tls client config should be set")
+			Expect(cluster.tlsConfig.Certificates).To(HaveLen(1))
 		})
 	})
 
@@ -197,77 +296,127 @@ var _ = Describe("Etcd client", func() {
 		})
 
 		It("adds the correct endponts", func() {
-			cluster := &ClusterAPI{cloudAPI: cloudAPI, protocol: "pigeon"}
-			conf, err := cluster.createEtcdClientConfig()
+			cluster := &ClusterAPI{cloudAPI: cloudAPI, protocol: "pigeon", clientPort: 2379}
+			conf, err := cluster.createEtcdClientConfig(context.Background())
 			Expect(err).To(BeNil())
 			Expect(conf.Endpoints).To(ContainElement("pigeon://etcd-1:2379"))
 		})
 
-		It("sets the configured transport", func() {
-			transport := client.DefaultTransport
-			cluster := &ClusterAPI{cloudAPI: cloudAPI, transport: transport}
-			conf, err := cluster.createEtcdClientConfig()
+		It("uses the configured client port", func() {
+			cluster := &ClusterAPI{cloudAPI: cloudAPI, protocol: "http"}
+			Expect(WithClientPort(12379)(cluster)).To(Succeed())
+			conf, err := cluster.createEtcdClientConfig(context.Background())
 			Expect(err).To(BeNil())
-			Expect(conf.Transport).To(Equal(transport))
+			Expect(conf.Endpoints).To(ContainElement("http://etcd-1:12379"))
+		})
+
+		It("prefers the client port published by the instance", func() {
+			cloudAPI = &mockCloudAPI{
+				instances: []cloud.Instance{
+					{
+						Name:       "i-123",
+						Endpoint:   "etcd-1",
+						ClientPort: 22379,
+					},
+				},
+			}
+			cluster := &ClusterAPI{cloudAPI: cloudAPI, protocol: "http", clientPort: 2379}
+			conf, err := cluster.createEtcdClientConfig(context.Background())
+			Expect(err).To(BeNil())
+			Expect(conf.Endpoints).To(ContainElement("http://etcd-1:22379"))
+		})
+
+		It("sets the configured TLS config", func() {
+			cluster := &ClusterAPI{cloudAPI: cloudAPI}
+			Expect(WithTLS("test-ca.pem", "test.pem", "test-key.pem")(cluster)).To(Succeed())
+			conf, err := cluster.createEtcdClientConfig(context.Background())
+			Expect(err).To(BeNil())
+			Expect(conf.TLS).To(Equal(cluster.tlsConfig))
 		})
 	})
 })
 
-// EtcdMembersAPI for mocking calls to the coreos etcd client
-type MockMembersAPI struct {
-	MockList   List
-	MockAdd    Add
-	MockRemove Remove
+func expectContextToHaveDeadline(ctx context.Context) {
+	_, ok := ctx.Deadline()
+	Expect(ok).To(BeTrue(), "context should have a deadline")
+}
+
+// mockClusterClient mocks the etcd v3 cluster client
+type mockClusterClient struct {
+	members       []*etcdserverpb.Member
+	listErr       error
+	added         []string
+	addCalls      int
+	addErrs       []error
+	addErr        error
+	addedLearners []string
+	removed       []uint64
+	promoted      []uint64
+	promoteErr    error
 }
 
-// List sets the expected input and output for List() on EtcdMembersAPI
-type List struct {
-	ListOutput []client.Member
-	Err        error
+func (m *mockClusterClient) MemberList(ctx context.Context) (*clientv3.MemberListResponse, error) {
+	expectContextToHaveDeadline(ctx)
+	if m.listErr != nil {
+		return nil, m.listErr
+	}
+	return &clientv3.MemberListResponse{Header: &etcdserverpb.ResponseHeader{ClusterId: 0xc1}, Members: m.members}, nil
 }
 
-func expectContextToHaveDeadline(ctx context.Context) {
-	_, ok := ctx.Deadline()
-	Expect(ok).To(BeTrue(), "context should have a deadline")
+func (m *mockClusterClient) MemberAdd(ctx context.Context, peerAddrs []string) (*clientv3.MemberAddResponse, error) {
+	expectContextToHaveDeadline(ctx)
+	m.addCalls++
+	if len(m.addErrs) > 0 {
+		err := m.addErrs[0]
+		m.addErrs = m.addErrs[1:]
+		return nil, err
+	}
+	if m.addErr != nil {
+		return nil, m.addErr
+	}
+	m.added = append(m.added, peerAddrs...)
+	return &clientv3.MemberAddResponse{}, nil
 }
 
-// List mocks the coreos etcd client
-func (t MockMembersAPI) List(ctx context.Context) ([]client.Member, error) {
+func (m *mockClusterClient) MemberAddAsLearner(ctx context.Context, peerAddrs []string) (*clientv3.MemberAddResponse, error) {
 	expectContextToHaveDeadline(ctx)
-	return t.MockList.ListOutput, t.MockList.Err
+	m.addedLearners = append(m.addedLearners, peerAddrs...)
+	return &clientv3.MemberAddResponse{}, nil
 }
 
-// Add sets the expected input and output for Add() on EtcdMembersAPI
-type Add struct {
-	ExpectedPeerURL string
-	AddOutput       *client.Member
-	Err             error
+func (m *mockClusterClient) MemberRemove(ctx context.Context, id uint64) (*clientv3.MemberRemoveResponse, error) {
+	expectContextToHaveDeadline(ctx)
+	m.removed = append(m.removed, id)
+	return &clientv3.MemberRemoveResponse{}, nil
 }
 
-// Add mocks the coreos etcd client
-func (t MockMembersAPI) Add(ctx context.Context, peerURL string) (*client.Member, error) {
+func (m *mockClusterClient) MemberPromote(ctx context.Context, id uint64) (*clientv3.MemberPromoteResponse, error) {
 	expectContextToHaveDeadline(ctx)
-	Expect(peerURL).To(Equal(t.MockAdd.ExpectedPeerURL))
-	return t.MockAdd.AddOutput, t.MockAdd.Err
+	if m.promoteErr != nil {
+		return nil, m.promoteErr
+	}
+	m.promoted = append(m.promoted, id)
+	return &clientv3.MemberPromoteResponse{}, nil
 }
 
-// Remove sets the expected input and output for Remove() on EtcdMembersAPI
-type Remove struct {
-	ExpectedMID string
-	Err         error
+// mockMaintenanceClient mocks the etcd v3 maintenance client, returning the status for each endpoint
+type mockMaintenanceClient struct {
+	statuses map[string]*clientv3.StatusResponse
 }
 
-// Remove mocks the coreos etcd client
-func (t MockMembersAPI) Remove(ctx context.Context, mID string) error {
+func (m *mockMaintenanceClient) Status(ctx context.Context, endpoint string) (*clientv3.StatusResponse, error) {
 	expectContextToHaveDeadline(ctx)
-	Expect(mID).To(Equal(t.MockRemove.ExpectedMID))
-	return t.MockRemove.Err
+	status, ok := m.statuses[endpoint]
+	if !ok {
+		return nil, fmt.Errorf("unreachable endpoint %s", endpoint)
+	}
+	return status, nil
 }
 
 type mockCloudAPI struct {
 	instances []cloud.Instance
 }
 
-func (m *mockCloudAPI) GetInstances() ([]cloud.Instance, error) {
+func (m *mockCloudAPI) GetInstances(context.Context) ([]cloud.Instance, error) {
 	return m.instances, nil
 }
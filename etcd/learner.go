@@ -0,0 +1,104 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+)
+
+// learnerReadyPercent is how far through the leader's raft log a learner must be before it's promoted.
+// This matches the threshold etcd itself uses to reject promotion of a learner that isn't in sync.
+const learnerReadyPercent = 0.9
+
+// ErrLearnerNotReady is returned when a learner can't be promoted yet because it hasn't caught up with the leader.
+var ErrLearnerNotReady = errors.New("learner has not caught up with the leader")
+
+// AddLearnerByPeerURL adds a new non-voting learner member to the cluster by its peer URL. The learner
+// doesn't count towards quorum until it is promoted with PromoteLearnerByPeerURL.
+func (c *ClusterAPI) AddLearnerByPeerURL(ctx context.Context, peerURL string) error {
+	cluster, _, err := c.clients(ctx)
+	if err != nil {
+		return err
+	}
+	return c.addMember(ctx, "add learner "+peerURL, peerURL, cluster.MemberAddAsLearner)
+}
+
+// PromoteLearnerByPeerURL promotes the learner with the given peer URL to a voting member. It returns
+// ErrLearnerNotReady if the learner hasn't started or its raft log hasn't caught up with the leader yet.
+// Promoting a member that is already a voting member does nothing. It isn't retried, as callers poll it until
+// the learner is ready.
+func (c *ClusterAPI) PromoteLearnerByPeerURL(ctx context.Context, peerURL string) error {
+	cluster, maintenance, err := c.clients(ctx)
+	if err != nil {
+		return err
+	}
+	ctx, cancelFn := context.WithTimeout(ctx, timeout)
+	defer cancelFn()
+
+	resp, err := cluster.MemberList(ctx)
+	if err != nil {
+		return err
+	}
+	learner := findMemberByPeerURL(resp.Members, peerURL)
+	if learner == nil {
+		return fmt.Errorf("no member found with peer URL %s", peerURL)
+	}
+	if !learner.IsLearner {
+		log.Infof("%s (%s) is already a voting member", learner.Name, peerURL)
+		return nil
+	}
+	if len(learner.ClientURLs) == 0 {
+		return fmt.Errorf("%w: %s has not started yet", ErrLearnerNotReady, peerURL)
+	}
+
+	learnerStatus, err := maintenance.Status(ctx, learner.ClientURLs[0])
+	if err != nil {
+		return fmt.Errorf("unable to get status of learner %s: %w", learner.Name, err)
+	}
+	leader := findMemberByID(resp.Members, learnerStatus.Leader)
+	if leader == nil || len(leader.ClientURLs) == 0 {
+		return fmt.Errorf("%w: %s does not know of a leader yet", ErrLearnerNotReady, learner.Name)
+	}
+	leaderStatus, err := maintenance.Status(ctx, leader.ClientURLs[0])
+	if err != nil {
+		return fmt.Errorf("unable to get status of leader %s: %w", leader.Name, err)
+	}
+	if float64(learnerStatus.RaftIndex) < float64(leaderStatus.RaftIndex)*learnerReadyPercent {
+		return fmt.Errorf("%w: %s is at raft index %d but leader %s is at %d", ErrLearnerNotReady,
+			learner.Name, learnerStatus.RaftIndex, leader.Name, leaderStatus.RaftIndex)
+	}
+
+	log.Infof("Promoting learner %s (%s) at raft index %d, leader is at %d", learner.Name, peerURL,
+		learnerStatus.RaftIndex, leaderStatus.RaftIndex)
+	if _, err := cluster.MemberPromote(ctx, learner.ID); err != nil {
+		if errors.Is(err, rpctypes.ErrMemberLearnerNotReady) {
+			return fmt.Errorf("%w: %v", ErrLearnerNotReady, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func findMemberByPeerURL(members []*etcdserverpb.Member, peerURL string) *etcdserverpb.Member {
+	for _, member := range members {
+		for _, url := range member.PeerURLs {
+			if url == peerURL {
+				return member
+			}
+		}
+	}
+	return nil
+}
+
+func findMemberByID(members []*etcdserverpb.Member, id uint64) *etcdserverpb.Member {
+	for _, member := range members {
+		if member.ID == id {
+			return member
+		}
+	}
+	return nil
+}
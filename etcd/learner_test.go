@@ -0,0 +1,89 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var _ = Describe("Learners", func() {
+	var (
+		clusterClient     *mockClusterClient
+		maintenanceClient *mockMaintenanceClient
+		etcdCluster       *ClusterAPI
+	)
+
+	BeforeEach(func() {
+		clusterClient = &mockClusterClient{
+			members: []*etcdserverpb.Member{
+				{
+					ID:         1,
+					Name:       "test-leader",
+					PeerURLs:   []string{"http://192.168.0.1:2380"},
+					ClientURLs: []string{"http://192.168.0.1:2379"},
+				},
+				{
+					ID:         2,
+					Name:       "test-learner",
+					PeerURLs:   []string{"http://192.168.0.2:2380"},
+					ClientURLs: []string{"http://192.168.0.2:2379"},
+					IsLearner:  true,
+				},
+			},
+		}
+		maintenanceClient = &mockMaintenanceClient{
+			statuses: map[string]*clientv3.StatusResponse{
+				"http://192.168.0.1:2379": {Leader: 1, RaftIndex: 1000},
+				"http://192.168.0.2:2379": {Leader: 1, RaftIndex: 950, IsLearner: true},
+			},
+		}
+		etcdCluster = &ClusterAPI{clusterClient: clusterClient, maintenanceClient: maintenanceClient}
+	})
+
+	Context("AddLearnerByPeerURL()", func() {
+		It("adds the peer URL as a learner", func() {
+			Expect(etcdCluster.AddLearnerByPeerURL(context.Background(), "http://192.168.0.3:2380")).To(Succeed())
+			Expect(clusterClient.addedLearners).To(Equal([]string{"http://192.168.0.3:2380"}))
+		})
+	})
+
+	Context("PromoteLearnerByPeerURL()", func() {
+		It("promotes a learner that has caught up with the leader", func() {
+			Expect(etcdCluster.PromoteLearnerByPeerURL(context.Background(), "http://192.168.0.2:2380")).To(Succeed())
+			Expect(clusterClient.promoted).To(Equal([]uint64{2}))
+		})
+
+		It("does not promote a learner that is behind the leader", func() {
+			maintenanceClient.statuses["http://192.168.0.2:2379"].RaftIndex = 10
+			err := etcdCluster.PromoteLearnerByPeerURL(context.Background(), "http://192.168.0.2:2380")
+			Expect(errors.Is(err, ErrLearnerNotReady)).To(BeTrue(), "expected not ready but was %v", err)
+			Expect(clusterClient.promoted).To(BeEmpty())
+		})
+
+		It("does not promote a learner that has not started", func() {
+			clusterClient.members[1].ClientURLs = nil
+			err := etcdCluster.PromoteLearnerByPeerURL(context.Background(), "http://192.168.0.2:2380")
+			Expect(errors.Is(err, ErrLearnerNotReady)).To(BeTrue(), "expected not ready but was %v", err)
+		})
+
+		It("treats etcd rejecting the promotion as not ready", func() {
+			clusterClient.promoteErr = rpctypes.ErrMemberLearnerNotReady
+			err := etcdCluster.PromoteLearnerByPeerURL(context.Background(), "http://192.168.0.2:2380")
+			Expect(errors.Is(err, ErrLearnerNotReady)).To(BeTrue(), "expected not ready but was %v", err)
+		})
+
+		It("does nothing for a voting member", func() {
+			Expect(etcdCluster.PromoteLearnerByPeerURL(context.Background(), "http://192.168.0.1:2380")).To(Succeed())
+			Expect(clusterClient.promoted).To(BeEmpty())
+		})
+
+		It("fails for an unknown peer URL", func() {
+			Expect(etcdCluster.PromoteLearnerByPeerURL(context.Background(), "http://192.168.0.9:2380")).ToNot(Succeed())
+		})
+	})
+})
@@ -0,0 +1,101 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+const (
+	// lockPrefix is where the membership lock is held in etcd.
+	lockPrefix = "/etcd-bootstrap/membership-lock"
+	// lockHolderPrefix is where each session waiting for the lock records who it's for, keyed by its lease.
+	lockHolderPrefix = "/etcd-bootstrap/membership-lock-holders/"
+)
+
+// lockRetryInterval is how often to try acquiring the lock while waiting.
+var lockRetryInterval = 2 * time.Second
+
+// Lock acquires a lock held in etcd, so that only one node changes the cluster membership at a time. It waits
+// up to the timeout, logging who holds the lock. The lock is tied to a lease with the given TTL, so it's released
+// if the holder dies. The returned function releases the lock.
+func (c *ClusterAPI) Lock(ctx context.Context, holder string, timeout, ttl time.Duration) (func() error, error) {
+	if _, _, err := c.clients(ctx); err != nil {
+		return nil, err
+	}
+	if c.client == nil {
+		return nil, fmt.Errorf("etcd client doesn't support locking")
+	}
+
+	ctx, cancelFn := context.WithTimeout(ctx, timeout)
+	defer cancelFn()
+	// Grant the lease here rather than in the session, so it times out if there's no quorum.
+	lease, err := c.client.Grant(ctx, int64(ttl.Seconds()))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create lease for the membership lock: %w", err)
+	}
+	session, err := concurrency.NewSession(c.client, concurrency.WithLease(lease.ID))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create session for the membership lock: %w", err)
+	}
+	holderKey := fmt.Sprintf("%s%x", lockHolderPrefix, lease.ID)
+	if _, err := c.client.Put(ctx, holderKey, holder, clientv3.WithLease(lease.ID)); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("unable to record the membership lock holder: %w", err)
+	}
+
+	mutex := concurrency.NewMutex(session, lockPrefix)
+	for {
+		err := mutex.TryLock(ctx)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, concurrency.ErrLocked) {
+			session.Close()
+			return nil, fmt.Errorf("unable to acquire the membership lock: %w", err)
+		}
+		owner := c.lockOwner(ctx)
+		if deadline, _ := ctx.Deadline(); time.Now().Add(lockRetryInterval).After(deadline) {
+			session.Close()
+			return nil, fmt.Errorf("gave up waiting for the membership lock held by %s after %v", owner, timeout)
+		}
+		log.Infof("Waiting for the membership lock held by %s", owner)
+		select {
+		case <-ctx.Done():
+			session.Close()
+			return nil, fmt.Errorf("stopped waiting for the membership lock held by %s: %w", owner, ctx.Err())
+		case <-time.After(lockRetryInterval):
+		}
+	}
+	log.Infof("Acquired the membership lock for %s", holder)
+
+	return func() error {
+		ctx, cancelFn := context.WithTimeout(context.Background(), timeout)
+		defer cancelFn()
+		err := mutex.Unlock(ctx)
+		// Closing the session revokes the lease, which releases the lock even if unlocking failed.
+		if closeErr := session.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}, nil
+}
+
+// lockOwner returns who holds the lock, which is the session that created the earliest key under the lock prefix.
+func (c *ClusterAPI) lockOwner(ctx context.Context) string {
+	resp, err := c.client.Get(ctx, lockPrefix+"/", clientv3.WithFirstCreate()...)
+	if err != nil || len(resp.Kvs) == 0 {
+		return "an unknown holder"
+	}
+	lease := resp.Kvs[0].Lease
+	resp, err = c.client.Get(ctx, fmt.Sprintf("%s%x", lockHolderPrefix, lease))
+	if err != nil || len(resp.Kvs) == 0 {
+		return fmt.Sprintf("lease %x", lease)
+	}
+	return string(resp.Kvs[0].Value)
+}
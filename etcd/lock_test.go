@@ -0,0 +1,90 @@
+package etcd
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"go.etcd.io/etcd/server/v3/embed"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Lock()", func() {
+	var (
+		dataDir string
+		server  *embed.Etcd
+		newAPI  func() *ClusterAPI
+	)
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "lock-test")
+		Expect(err).To(BeNil())
+
+		cfg := embed.NewConfig()
+		cfg.Dir = dataDir
+		cfg.LogLevel = "error"
+		peerURL, _ := url.Parse("http://127.0.0.1:0")
+		clientURL, _ := url.Parse("http://127.0.0.1:0")
+		cfg.ListenPeerUrls = []url.URL{*peerURL}
+		cfg.ListenClientUrls = []url.URL{*clientURL}
+		server, err = embed.StartEtcd(cfg)
+		Expect(err).To(BeNil())
+		Eventually(server.Server.ReadyNotify(), 10*time.Second).Should(BeClosed())
+
+		port := server.Clients[0].Addr().(*net.TCPAddr).Port
+		newAPI = func() *ClusterAPI {
+			api, err := New(&staticCloud{instances: []cloud.Instance{{Name: "etcd-1", Endpoint: "127.0.0.1", ClientPort: port}}})
+			Expect(err).To(BeNil())
+			return api
+		}
+		lockRetryInterval = 50 * time.Millisecond
+	})
+
+	AfterEach(func() {
+		server.Close()
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	It("only lets one holder have the lock at a time", func() {
+		unlock, err := newAPI().Lock(context.Background(), "etcd-1", time.Second, 10*time.Second)
+		Expect(err).To(BeNil())
+
+		_, err = newAPI().Lock(context.Background(), "etcd-2", 300*time.Millisecond, 10*time.Second)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("held by etcd-1"))
+
+		Expect(unlock()).To(Succeed())
+		unlock, err = newAPI().Lock(context.Background(), "etcd-2", time.Second, 10*time.Second)
+		Expect(err).To(BeNil())
+		Expect(unlock()).To(Succeed())
+	})
+
+	It("waits for the lock to be released", func() {
+		unlock, err := newAPI().Lock(context.Background(), "etcd-1", time.Second, 10*time.Second)
+		Expect(err).To(BeNil())
+		go func() {
+			defer GinkgoRecover()
+			time.Sleep(200 * time.Millisecond)
+			Expect(unlock()).To(Succeed())
+		}()
+
+		unlock, err = newAPI().Lock(context.Background(), "etcd-2", 5*time.Second, 10*time.Second)
+		Expect(err).To(BeNil())
+		Expect(unlock()).To(Succeed())
+	})
+})
+
+type staticCloud struct {
+	instances []cloud.Instance
+}
+
+func (s *staticCloud) GetInstances(context.Context) ([]cloud.Instance, error) {
+	return s.instances, nil
+}
@@ -0,0 +1,116 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+)
+
+// clusterVersionNotDecided is the cluster version etcd reports until the cluster has formed.
+const clusterVersionNotDecided = "not_decided"
+
+// InstanceStatus is the result of probing an instance for a running etcd.
+type InstanceStatus struct {
+	// Reachable is false if it's unknown whether etcd is running, e.g. the instance timed out or its name didn't
+	// resolve. A refused connection is reachable, as the instance is up but etcd isn't running.
+	Reachable bool `json:"reachable"`
+	// Running is true if etcd responded on either its client or peer URL.
+	Running bool `json:"running"`
+	// Healthy is true if the client /health endpoint reports the member is healthy.
+	Healthy bool `json:"healthy"`
+	// HasData is true if the member has been part of a formed cluster, i.e. it has decided the cluster version.
+	HasData bool `json:"hasData"`
+	// Err is why the instance is unreachable.
+	Err error `json:"-"`
+}
+
+// WithPeerPort sets the port used to reach etcd's peer API when probing instances.
+func WithPeerPort(port int) Option {
+	return func(c *ClusterAPI) error {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid peer port: %d is not between 1 and 65535", port)
+		}
+		c.peerPort = port
+		return nil
+	}
+}
+
+// ProbeInstance checks whether etcd is running on the instance and whether it holds cluster data, without needing
+// a working cluster. It uses the client /health endpoint, and the peer /version endpoint which is served even
+// before the cluster has a quorum.
+func (c *ClusterAPI) ProbeInstance(ctx context.Context, instance cloud.Instance) InstanceStatus {
+	clientPort := c.clientPort
+	if instance.ClientPort != 0 {
+		clientPort = instance.ClientPort
+	}
+
+	var health struct {
+		Health string `json:"health"`
+	}
+	healthResponded, healthErr := c.probe(ctx, c.url(instance.Endpoint, clientPort)+"/health", &health)
+	var version struct {
+		Cluster string `json:"etcdcluster"`
+	}
+	versionResponded, versionErr := c.probe(ctx, c.url(instance.Endpoint, c.peerPort)+"/version", &version)
+
+	status := InstanceStatus{
+		Running: healthResponded || versionResponded,
+		Healthy: healthResponded && healthErr == nil && health.Health == "true",
+		HasData: versionResponded && versionErr == nil &&
+			version.Cluster != "" && version.Cluster != clusterVersionNotDecided,
+	}
+	status.Reachable = status.Running || (isRefused(healthErr) && isRefused(versionErr))
+	if !status.Reachable {
+		status.Err = healthErr
+		if status.Err == nil {
+			status.Err = versionErr
+		}
+	}
+	return status
+}
+
+// probe gets the url and decodes the JSON response into v. It returns whether there was a response at all, as
+// etcd reports problems with error statuses that still have a JSON body.
+func (c *ClusterAPI) probe(ctx context.Context, url string, v interface{}) (bool, error) {
+	ctx, cancelFn := context.WithTimeout(ctx, timeout)
+	defer cancelFn()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v); err != nil {
+		return true, fmt.Errorf("unable to decode %s response with status %s: %w", url, resp.Status, err)
+	}
+	return true, nil
+}
+
+func (c *ClusterAPI) httpClient() *http.Client {
+	if c.probeClient == nil {
+		c.probeClient = &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{TLSClientConfig: c.tlsConfig},
+		}
+	}
+	return c.probeClient
+}
+
+func (c *ClusterAPI) url(host string, port int) string {
+	return fmt.Sprintf("%s://%s", c.protocol, net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+func isRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
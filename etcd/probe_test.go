@@ -0,0 +1,106 @@
+package etcd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ProbeInstance()", func() {
+	var (
+		etcdCluster  *ClusterAPI
+		clientServer *httptest.Server
+		peerServer   *httptest.Server
+		health       string
+		version      string
+	)
+
+	port := func(server *httptest.Server) int {
+		_, p, err := net.SplitHostPort(server.Listener.Addr().String())
+		Expect(err).To(BeNil())
+		n, err := strconv.Atoi(p)
+		Expect(err).To(BeNil())
+		return n
+	}
+
+	// closedPort returns a local port nothing is listening on.
+	closedPort := func() int {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		p := l.Addr().(*net.TCPAddr).Port
+		Expect(l.Close()).To(Succeed())
+		return p
+	}
+
+	BeforeEach(func() {
+		health = `{"health":"true","reason":""}`
+		version = `{"etcdserver":"3.5.17","etcdcluster":"3.5.0"}`
+		clientServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.URL.Path).To(Equal("/health"))
+			if health != `{"health":"true","reason":""}` {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			_, _ = w.Write([]byte(health))
+		}))
+		peerServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.URL.Path).To(Equal("/version"))
+			_, _ = w.Write([]byte(version))
+		}))
+		etcdCluster = &ClusterAPI{
+			protocol:   "http",
+			clientPort: port(clientServer),
+			peerPort:   port(peerServer),
+		}
+	})
+
+	AfterEach(func() {
+		clientServer.Close()
+		peerServer.Close()
+	})
+
+	It("reports a healthy member with data", func() {
+		Expect(etcdCluster.ProbeInstance(context.Background(), cloud.Instance{Endpoint: "127.0.0.1"})).To(Equal(
+			InstanceStatus{Reachable: true, Running: true, Healthy: true, HasData: true}))
+	})
+
+	It("reports a member without quorum which still has data", func() {
+		health = `{"health":"false","reason":"RAFT NO LEADER"}`
+		Expect(etcdCluster.ProbeInstance(context.Background(), cloud.Instance{Endpoint: "127.0.0.1"})).To(Equal(
+			InstanceStatus{Reachable: true, Running: true, HasData: true}))
+	})
+
+	It("reports a member of a cluster that hasn't formed yet as having no data", func() {
+		etcdCluster.clientPort = closedPort()
+		version = `{"etcdserver":"3.5.17","etcdcluster":"not_decided"}`
+		Expect(etcdCluster.ProbeInstance(context.Background(), cloud.Instance{Endpoint: "127.0.0.1"})).To(Equal(
+			InstanceStatus{Reachable: true, Running: true}))
+	})
+
+	It("uses the client port published by the instance", func() {
+		clientPort := etcdCluster.clientPort
+		etcdCluster.clientPort = closedPort()
+		status := etcdCluster.ProbeInstance(context.Background(), cloud.Instance{Endpoint: "127.0.0.1", ClientPort: clientPort})
+		Expect(status.Healthy).To(BeTrue())
+	})
+
+	It("reports an instance which refuses connections as reachable but not running", func() {
+		etcdCluster.clientPort = closedPort()
+		etcdCluster.peerPort = closedPort()
+		Expect(etcdCluster.ProbeInstance(context.Background(), cloud.Instance{Endpoint: "127.0.0.1"})).To(Equal(
+			InstanceStatus{Reachable: true}))
+	})
+
+	It("reports an instance which can't be resolved as unreachable", func() {
+		status := etcdCluster.ProbeInstance(context.Background(), cloud.Instance{Endpoint: "does-not-exist.invalid"})
+		Expect(status.Reachable).To(BeFalse())
+		Expect(status.Running).To(BeFalse())
+		Expect(status.Err).ToNot(BeNil())
+	})
+})
@@ -0,0 +1,135 @@
+// Package flagconfig sets command line flags from environment variables and a config file, so every flag can be
+// configured the same way whichever suits the deployment. Flags given on the command line take precedence over
+// environment variables, which take precedence over the config file, which takes precedence over the defaults.
+package flagconfig
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvName returns the environment variable for the flag, e.g. ETCD_BOOTSTRAP_OUTPUT_FILE for output-file.
+func EnvName(prefix, flag string) string {
+	return prefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// ApplyEnv sets the flags which haven't been set yet from environment variables named after them with the prefix.
+// List flags are split on commas.
+func ApplyEnv(flags *pflag.FlagSet, prefix string, lookupEnv func(string) (string, bool)) error {
+	var errs []string
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Changed || f.Name == "help" {
+			return
+		}
+		name := EnvName(prefix, f.Name)
+		value, ok := lookupEnv(name)
+		if !ok {
+			return
+		}
+		var err error
+		if _, isSlice := f.Value.(pflag.SliceValue); isSlice {
+			err = setList(f, strings.Split(value, ","))
+		} else {
+			err = flags.Set(f.Name, value)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("$%s: %v", name, err))
+		}
+	})
+	return combine(errs)
+}
+
+// ApplyFile sets the flags which haven't been set yet from a YAML or JSON file, which maps flag names to their
+// values. Lists are used for flags which can be repeated. Keys which aren't known flags are rejected, to catch typos,
+// while known flags which the command doesn't have are ignored, so a file can be shared by several commands.
+func ApplyFile(flags *pflag.FlagSet, filename string, known func(string) bool) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("unable to read config file: %w", err)
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("unable to parse config file %s: %w", filename, err)
+	}
+
+	// Sorted so errors are reported in a consistent order.
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []string
+	for _, name := range names {
+		f := flags.Lookup(name)
+		if f == nil {
+			if !known(name) {
+				errs = append(errs, fmt.Sprintf("%s: unknown flag", name))
+			}
+			continue
+		}
+		if f.Changed {
+			continue
+		}
+		if err := setValue(flags, f, values[name]); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if err := combine(errs); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", filename, err)
+	}
+	return nil
+}
+
+func setValue(flags *pflag.FlagSet, f *pflag.Flag, value interface{}) error {
+	switch v := value.(type) {
+	case []interface{}:
+		if _, isSlice := f.Value.(pflag.SliceValue); !isSlice {
+			return fmt.Errorf("expected a single value, but got a list")
+		}
+		var items []string
+		for _, item := range v {
+			if _, ok := item.(map[interface{}]interface{}); ok {
+				return fmt.Errorf("expected a list of values, but got a map")
+			}
+			items = append(items, fmt.Sprint(item))
+		}
+		return setList(f, items)
+	case map[interface{}]interface{}:
+		return fmt.Errorf("expected a value, but got a map")
+	case nil:
+		return nil
+	default:
+		if _, isSlice := f.Value.(pflag.SliceValue); isSlice {
+			return setList(f, []string{fmt.Sprint(v)})
+		}
+		return flags.Set(f.Name, fmt.Sprint(v))
+	}
+}
+
+// setList replaces the list flag's values, rather than appending to the defaults.
+func setList(f *pflag.Flag, items []string) error {
+	var trimmed []string
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			trimmed = append(trimmed, item)
+		}
+	}
+	if err := f.Value.(pflag.SliceValue).Replace(trimmed); err != nil {
+		return err
+	}
+	f.Changed = true
+	return nil
+}
+
+func combine(errs []string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(errs, "; "))
+}
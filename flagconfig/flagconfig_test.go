@@ -0,0 +1,153 @@
+package flagconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestFlagConfig(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Flag Config Suite")
+}
+
+var _ = Describe("Flag config", func() {
+	var (
+		flags     *pflag.FlagSet
+		output    string
+		port      int
+		timeout   time.Duration
+		tls       bool
+		tags      []string
+		instances []string
+		dir       string
+	)
+
+	BeforeEach(func() {
+		flags = pflag.NewFlagSet("test", pflag.ContinueOnError)
+		flags.StringVar(&output, "output-file", "/var/run/etcd-bootstrap.conf", "")
+		flags.IntVar(&port, "peer-port", 2380, "")
+		flags.DurationVar(&timeout, "lock-timeout", time.Minute, "")
+		flags.BoolVar(&tls, "enable-tls", false, "")
+		flags.StringSliceVar(&tags, "consul-tag", []string{"default"}, "")
+		flags.StringArrayVar(&instances, "instance", nil, "")
+
+		var err error
+		dir, err = ioutil.TempDir("", "flagconfig")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	env := func(vars map[string]string) func(string) (string, bool) {
+		return func(name string) (string, bool) {
+			value, ok := vars[name]
+			return value, ok
+		}
+	}
+
+	writeConfig := func(contents string) string {
+		filename := filepath.Join(dir, "config.yaml")
+		Expect(ioutil.WriteFile(filename, []byte(contents), 0644)).To(Succeed())
+		return filename
+	}
+
+	known := func(name string) bool { return name == "r53-zone-id" }
+
+	It("names environment variables after the flags", func() {
+		Expect(EnvName("ETCD_BOOTSTRAP_", "tls-peer-ca")).To(Equal("ETCD_BOOTSTRAP_TLS_PEER_CA"))
+	})
+
+	It("sets flags from environment variables", func() {
+		Expect(ApplyEnv(flags, "ETCD_BOOTSTRAP_", env(map[string]string{
+			"ETCD_BOOTSTRAP_OUTPUT_FILE": "/tmp/etcd.conf",
+			"ETCD_BOOTSTRAP_PEER_PORT":   "12380",
+			"ETCD_BOOTSTRAP_ENABLE_TLS":  "true",
+			"ETCD_BOOTSTRAP_CONSUL_TAG":  "a, b",
+			"ETCD_BOOTSTRAP_INSTANCE":    "etcd-1=10.0.0.1,etcd-2=10.0.0.2",
+		}))).To(Succeed())
+		Expect(output).To(Equal("/tmp/etcd.conf"))
+		Expect(port).To(Equal(12380))
+		Expect(tls).To(BeTrue())
+		Expect(tags).To(Equal([]string{"a", "b"}))
+		Expect(instances).To(Equal([]string{"etcd-1=10.0.0.1", "etcd-2=10.0.0.2"}))
+	})
+
+	It("doesn't override flags given on the command line", func() {
+		Expect(flags.Parse([]string{"--peer-port=22380"})).To(Succeed())
+		Expect(ApplyEnv(flags, "ETCD_BOOTSTRAP_", env(map[string]string{
+			"ETCD_BOOTSTRAP_PEER_PORT": "12380",
+		}))).To(Succeed())
+		Expect(port).To(Equal(22380))
+	})
+
+	It("reports all invalid environment variables", func() {
+		err := ApplyEnv(flags, "ETCD_BOOTSTRAP_", env(map[string]string{
+			"ETCD_BOOTSTRAP_PEER_PORT":    "abc",
+			"ETCD_BOOTSTRAP_LOCK_TIMEOUT": "forever",
+		}))
+		Expect(err).To(MatchError(And(
+			ContainSubstring("$ETCD_BOOTSTRAP_PEER_PORT"),
+			ContainSubstring("$ETCD_BOOTSTRAP_LOCK_TIMEOUT"))))
+	})
+
+	It("sets flags from a YAML config file", func() {
+		filename := writeConfig(`
+output-file: /tmp/etcd.conf
+peer-port: 12380
+lock-timeout: 30s
+enable-tls: true
+consul-tag: [a, b]
+instance:
+  - etcd-1=10.0.0.1
+r53-zone-id: Z123
+`)
+		Expect(ApplyFile(flags, filename, known)).To(Succeed())
+		Expect(output).To(Equal("/tmp/etcd.conf"))
+		Expect(port).To(Equal(12380))
+		Expect(timeout).To(Equal(30 * time.Second))
+		Expect(tls).To(BeTrue())
+		Expect(tags).To(Equal([]string{"a", "b"}))
+		Expect(instances).To(Equal([]string{"etcd-1=10.0.0.1"}))
+	})
+
+	It("sets flags from a JSON config file", func() {
+		filename := writeConfig(`{"peer-port": 12380, "consul-tag": "a"}`)
+		Expect(ApplyFile(flags, filename, known)).To(Succeed())
+		Expect(port).To(Equal(12380))
+		Expect(tags).To(Equal([]string{"a"}))
+	})
+
+	It("prefers environment variables to the config file", func() {
+		Expect(ApplyEnv(flags, "ETCD_BOOTSTRAP_", env(map[string]string{
+			"ETCD_BOOTSTRAP_PEER_PORT": "12380",
+		}))).To(Succeed())
+		Expect(ApplyFile(flags, writeConfig("peer-port: 22380"), known)).To(Succeed())
+		Expect(port).To(Equal(12380))
+	})
+
+	It("reports all invalid values and unknown flags", func() {
+		err := ApplyFile(flags, writeConfig(`
+peer-port: abc
+enable-tls: [true]
+unknown-flag: 1
+`), known)
+		Expect(err).To(MatchError(And(
+			ContainSubstring("peer-port"),
+			ContainSubstring("enable-tls: expected a single value"),
+			ContainSubstring("unknown-flag: unknown flag"))))
+	})
+
+	It("fails if the config file doesn't exist", func() {
+		Expect(ApplyFile(flags, filepath.Join(dir, "missing.yaml"), known)).ToNot(Succeed())
+	})
+})
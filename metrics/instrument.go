@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+)
+
+// CloudAPI returns instance information for the etcd cluster from cloud APIs.
+type CloudAPI interface {
+	GetInstances(context.Context) ([]cloud.Instance, error)
+	GetLocalInstance(context.Context) (cloud.Instance, error)
+	GetLocalIP(context.Context) (string, error)
+}
+
+// RegistrationProvider publishes the cluster instances, e.g. to DNS or a loadbalancer.
+type RegistrationProvider interface {
+	Update(context.Context, []cloud.Instance) error
+}
+
+// InstrumentCloudAPI returns a CloudAPI which records the latency and errors of each call to the underlying one,
+// labelled with the provider name.
+func InstrumentCloudAPI(provider string, cloudAPI CloudAPI) CloudAPI {
+	return &instrumentedCloudAPI{provider: provider, cloudAPI: cloudAPI}
+}
+
+type instrumentedCloudAPI struct {
+	provider string
+	cloudAPI CloudAPI
+}
+
+func (i *instrumentedCloudAPI) GetInstances(ctx context.Context) ([]cloud.Instance, error) {
+	start := time.Now()
+	instances, err := i.cloudAPI.GetInstances(ctx)
+	ObserveCall(i.provider, "GetInstances", start, err)
+	return instances, err
+}
+
+func (i *instrumentedCloudAPI) GetLocalInstance(ctx context.Context) (cloud.Instance, error) {
+	start := time.Now()
+	instance, err := i.cloudAPI.GetLocalInstance(ctx)
+	ObserveCall(i.provider, "GetLocalInstance", start, err)
+	return instance, err
+}
+
+func (i *instrumentedCloudAPI) GetLocalIP(ctx context.Context) (string, error) {
+	start := time.Now()
+	ip, err := i.cloudAPI.GetLocalIP(ctx)
+	ObserveCall(i.provider, "GetLocalIP", start, err)
+	return ip, err
+}
+
+// InstrumentRegistrationProvider returns a RegistrationProvider which records the latency and errors of each
+// update, labelled with the provider name.
+func InstrumentRegistrationProvider(provider string, registrator RegistrationProvider) RegistrationProvider {
+	return &instrumentedRegistrationProvider{provider: provider, registrator: registrator}
+}
+
+type instrumentedRegistrationProvider struct {
+	provider    string
+	registrator RegistrationProvider
+}
+
+func (i *instrumentedRegistrationProvider) Update(ctx context.Context, instances []cloud.Instance) error {
+	start := time.Now()
+	err := i.registrator.Update(ctx, instances)
+	ObserveCall(i.provider, "Update", start, err)
+	return err
+}
@@ -0,0 +1,159 @@
+// Package metrics records Prometheus metrics about bootstrapping and registering etcd clusters, and exports them.
+// Bootstrapping usually runs once in an init container, so the metrics can be written to a node-exporter textfile or
+// pushed to a Pushgateway, as well as served by long-running commands.
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+const namespace = "etcd_bootstrap"
+
+// Decision is how the local node was bootstrapped.
+type Decision string
+
+const (
+	// NewCluster is when no cluster was found, so the node starts a new one.
+	NewCluster Decision = "new"
+	// ExistingCluster is when the node joins an existing cluster as a new member.
+	ExistingCluster Decision = "existing"
+	// Rejoin is when the node is already a member of the cluster, e.g. after a restart.
+	Rejoin Decision = "rejoin"
+)
+
+// registry holds only etcd-bootstrap's own metrics, so the exported metrics don't include the Go runtime.
+var registry = prometheus.NewRegistry()
+
+var (
+	decisions = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "decisions_total",
+		Help:      "How the local node was bootstrapped: a new cluster, joining an existing cluster, or rejoining it.",
+	}, []string{"decision"})
+	membersRemoved = promauto.With(registry).NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "members_removed_total",
+		Help:      "Old etcd members removed because they're no longer cloud instances.",
+	})
+	memberRemovalsSkipped = promauto.With(registry).NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "member_removals_skipped_total",
+		Help:      "Old etcd members which weren't removed, because it wasn't safe to.",
+	})
+	membersAdded = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "members_added_total",
+		Help:      "Local instances added to the etcd members, by whether they were added as a learner.",
+	}, []string{"learner"})
+	generateDuration = promauto.With(registry).NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "generate_duration_seconds",
+		Help:      "Time taken to generate the etcd config, by result.",
+		Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600},
+	}, []string{"result"})
+	apiDuration = promauto.With(registry).NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_call_duration_seconds",
+		Help:      "Latency of calls to instance lookup and registration providers, including retries.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"provider", "call"})
+	apiErrors = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_call_errors_total",
+		Help:      "Failed calls to instance lookup and registration providers, after retries.",
+	}, []string{"provider", "call"})
+	lastRunSuccess = promauto.With(registry).NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_run_success",
+		Help:      "1 if the last run succeeded, 0 if it failed.",
+	})
+	lastRunTimestamp = promauto.With(registry).NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_run_timestamp_seconds",
+		Help:      "Unix time the last run finished.",
+	})
+)
+
+// RecordDecision records how the local node was bootstrapped.
+func RecordDecision(decision Decision) {
+	decisions.WithLabelValues(string(decision)).Inc()
+}
+
+// RecordMemberRemoved records an old member being removed from the cluster.
+func RecordMemberRemoved() {
+	membersRemoved.Inc()
+}
+
+// RecordMemberRemovalSkipped records an old member being kept, because it wasn't safe to remove.
+func RecordMemberRemovalSkipped() {
+	memberRemovalsSkipped.Inc()
+}
+
+// RecordMemberAdded records the local instance being added to the cluster.
+func RecordMemberAdded(learner bool) {
+	membersAdded.WithLabelValues(fmt.Sprint(learner)).Inc()
+}
+
+// ObserveGenerate records the time taken to generate the etcd config since start.
+func ObserveGenerate(start time.Time, err error) {
+	generateDuration.WithLabelValues(result(err)).Observe(time.Since(start).Seconds())
+}
+
+// ObserveCall records the latency of a provider call since start, and whether it failed.
+func ObserveCall(provider, call string, start time.Time, err error) {
+	apiDuration.WithLabelValues(provider, call).Observe(time.Since(start).Seconds())
+	if err != nil {
+		apiErrors.WithLabelValues(provider, call).Inc()
+	}
+}
+
+// RunFinished records the outcome of the run, before the metrics are exported.
+func RunFinished(success bool) {
+	if success {
+		lastRunSuccess.Set(1)
+	} else {
+		lastRunSuccess.Set(0)
+	}
+	lastRunTimestamp.SetToCurrentTime()
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// Handler serves the metrics, for long-running commands.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// WriteTextfile writes the metrics for node-exporter's textfile collector. The file is replaced atomically, so the
+// collector never reads a partial file.
+func WriteTextfile(filename string) error {
+	if err := prometheus.WriteToTextfile(filename, registry); err != nil {
+		return fmt.Errorf("unable to write metrics to %s: %w", filename, err)
+	}
+	return nil
+}
+
+// Push pushes the metrics to a Pushgateway under the job, replacing any metrics in the same group. The grouping
+// labels distinguish the metrics from each node.
+func Push(url, job string, grouping map[string]string) error {
+	pusher := push.New(url, job).Gatherer(registry)
+	for name, value := range grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	if err := pusher.Push(); err != nil {
+		return fmt.Errorf("unable to push metrics to %s: %w", url, err)
+	}
+	return nil
+}
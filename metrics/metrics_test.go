@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestMetrics(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Metrics Suite")
+}
+
+var _ = Describe("Instrumented providers", func() {
+	It("records calls and errors by provider", func() {
+		stub := &stubCloudAPI{instances: []cloud.Instance{{Name: "etcd-1"}}, err: errors.New("throttled")}
+		cloudAPI := InstrumentCloudAPI("test-cloud", stub)
+
+		_, err := cloudAPI.GetInstances(context.Background())
+		Expect(err).To(Equal(stub.err))
+		stub.err = nil
+		Expect(cloudAPI.GetInstances(context.Background())).To(Equal(stub.instances))
+
+		Expect(testutil.CollectAndCount(apiDuration, namespace+"_api_call_duration_seconds")).To(BeNumerically(">=", 1))
+		Expect(testutil.ToFloat64(apiErrors.WithLabelValues("test-cloud", "GetInstances"))).To(Equal(1.0))
+	})
+
+	It("records registration updates", func() {
+		registrator := InstrumentRegistrationProvider("test-registration", &stubRegistrationProvider{
+			err: errors.New("access denied"),
+		})
+		Expect(registrator.Update(context.Background(), nil)).ToNot(Succeed())
+		Expect(testutil.ToFloat64(apiErrors.WithLabelValues("test-registration", "Update"))).To(Equal(1.0))
+	})
+})
+
+var _ = Describe("Exporting", func() {
+	BeforeEach(func() {
+		RecordDecision(ExistingCluster)
+		RunFinished(true)
+	})
+
+	It("writes a textfile", func() {
+		dir, err := ioutil.TempDir("", "metrics")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		filename := filepath.Join(dir, "etcd-bootstrap.prom")
+
+		Expect(WriteTextfile(filename)).To(Succeed())
+		data, err := ioutil.ReadFile(filename)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring(`etcd_bootstrap_decisions_total{decision="existing"}`))
+		Expect(string(data)).To(ContainSubstring("etcd_bootstrap_last_run_success 1"))
+		files, _ := ioutil.ReadDir(dir)
+		Expect(files).To(HaveLen(1), "temporary file should be renamed")
+	})
+
+	It("pushes to a Pushgateway", func() {
+		var method, path string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			method, path = r.Method, r.URL.Path
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		Expect(Push(server.URL, "etcd-bootstrap", map[string]string{"instance": "etcd-1"})).To(Succeed())
+		Expect(method).To(Equal(http.MethodPut))
+		Expect(path).To(Equal("/metrics/job/etcd-bootstrap/instance/etcd-1"))
+	})
+
+	It("fails if the Pushgateway rejects the metrics", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer server.Close()
+
+		Expect(Push(server.URL, "etcd-bootstrap", nil)).ToNot(Succeed())
+	})
+})
+
+type stubCloudAPI struct {
+	instances []cloud.Instance
+	err       error
+}
+
+func (s *stubCloudAPI) GetInstances(context.Context) ([]cloud.Instance, error) {
+	return s.instances, s.err
+}
+
+func (s *stubCloudAPI) GetLocalInstance(context.Context) (cloud.Instance, error) {
+	return cloud.Instance{}, s.err
+}
+
+func (s *stubCloudAPI) GetLocalIP(context.Context) (string, error) {
+	return "", s.err
+}
+
+type stubRegistrationProvider struct {
+	err error
+}
+
+func (s *stubRegistrationProvider) Update(context.Context, []cloud.Instance) error {
+	return s.err
+}
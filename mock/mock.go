@@ -1,8 +1,12 @@
 package mock
 
 import (
+	"context"
 	"errors"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/elbv2"
@@ -31,14 +35,14 @@ type DescribeAutoScalingGroups struct {
 	Err                             error
 }
 
-// DescribeAutoScalingInstances mocks the aws autoscaling group client
-func (t AWSASGClient) DescribeAutoScalingInstances(a *autoscaling.DescribeAutoScalingInstancesInput) (*autoscaling.DescribeAutoScalingInstancesOutput, error) {
+// DescribeAutoScalingInstancesWithContext mocks the aws autoscaling group client
+func (t AWSASGClient) DescribeAutoScalingInstancesWithContext(_ context.Context, a *autoscaling.DescribeAutoScalingInstancesInput, _ ...request.Option) (*autoscaling.DescribeAutoScalingInstancesOutput, error) {
 	gomega.Expect(a).To(gomega.Equal(t.MockDescribeAutoScalingInstances.ExpectedInput))
 	return t.MockDescribeAutoScalingInstances.DescribeAutoScalingInstancesOutput, t.MockDescribeAutoScalingInstances.Err
 }
 
-// DescribeAutoScalingGroups mocks the aws autoscaling group client
-func (t AWSASGClient) DescribeAutoScalingGroups(a *autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+// DescribeAutoScalingGroupsWithContext mocks the aws autoscaling group client
+func (t AWSASGClient) DescribeAutoScalingGroupsWithContext(_ context.Context, a *autoscaling.DescribeAutoScalingGroupsInput, _ ...request.Option) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
 	gomega.Expect(a).To(gomega.Equal(t.MockDescribeAutoScalingGroups.ExpectedInput))
 	return t.MockDescribeAutoScalingGroups.DescribeAutoScalingGroupsOutput, t.MockDescribeAutoScalingGroups.Err
 }
@@ -55,8 +59,8 @@ type DescribeInstances struct {
 	Err                     error
 }
 
-// DescribeInstances mocks the aws ec2 client
-func (t AWSEC2Client) DescribeInstances(e *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+// DescribeInstancesWithContext mocks the aws ec2 client
+func (t AWSEC2Client) DescribeInstancesWithContext(_ context.Context, e *ec2.DescribeInstancesInput, _ ...request.Option) (*ec2.DescribeInstancesOutput, error) {
 	gomega.Expect(e).To(gomega.Equal(t.MockDescribeInstances.ExpectedInput))
 	return t.MockDescribeInstances.DescribeInstancesOutput, t.MockDescribeInstances.Err
 }
@@ -67,6 +71,7 @@ type AWSELBClient struct {
 	MockRegisterTargets      RegisterTargets
 	MockDescribeTargetHealth DescribeTargetHealth
 	MockDeregisterTargets    DeregisterTargets
+	MockWaitUntilInService   WaitUntilInService
 }
 
 // DescribeTargetGroups sets the expected input and output for DescribeTargetGroups() on AWSELBClient
@@ -76,8 +81,8 @@ type DescribeTargetGroups struct {
 	Err                        error
 }
 
-// DescribeTargetGroups mocks the aws elb client
-func (t AWSELBClient) DescribeTargetGroups(e *elbv2.DescribeTargetGroupsInput) (*elbv2.DescribeTargetGroupsOutput, error) {
+// DescribeTargetGroupsWithContext mocks the aws elb client
+func (t AWSELBClient) DescribeTargetGroupsWithContext(_ context.Context, e *elbv2.DescribeTargetGroupsInput, _ ...request.Option) (*elbv2.DescribeTargetGroupsOutput, error) {
 	gomega.Expect(e).To(gomega.Equal(t.MockDescribeTargetGroups.ExpectedInput))
 	return t.MockDescribeTargetGroups.DescribeTargetGroupsOutput, t.MockDescribeTargetGroups.Err
 }
@@ -87,11 +92,16 @@ type RegisterTargets struct {
 	ExpectedInput         *elbv2.RegisterTargetsInput
 	RegisterTargetsOutput *elbv2.RegisterTargetsOutput
 	Err                   error
+	// Registered is appended with the targets when RegisterTargets() is called, if it isn't nil.
+	Registered *[]*elbv2.TargetDescription
 }
 
-// RegisterTargets mocks the aws elb client
-func (t AWSELBClient) RegisterTargets(e *elbv2.RegisterTargetsInput) (*elbv2.RegisterTargetsOutput, error) {
+// RegisterTargetsWithContext mocks the aws elb client
+func (t AWSELBClient) RegisterTargetsWithContext(_ context.Context, e *elbv2.RegisterTargetsInput, _ ...request.Option) (*elbv2.RegisterTargetsOutput, error) {
 	gomega.Expect(e).To(gomega.Equal(t.MockRegisterTargets.ExpectedInput))
+	if t.MockRegisterTargets.Registered != nil && t.MockRegisterTargets.Err == nil {
+		*t.MockRegisterTargets.Registered = append(*t.MockRegisterTargets.Registered, e.Targets...)
+	}
 	return t.MockRegisterTargets.RegisterTargetsOutput, t.MockRegisterTargets.Err
 }
 
@@ -100,12 +110,23 @@ type DescribeTargetHealth struct {
 	ExpectedInput              *elbv2.DescribeTargetHealthInput
 	DescribeTargetHealthOutput *elbv2.DescribeTargetHealthOutput
 	Err                        error
+	// Registered targets are described along with the output, if it isn't nil, like the registered targets of a
+	// real target group.
+	Registered *[]*elbv2.TargetDescription
 }
 
-// DescribeTargetHealth mocks the aws elb client
-func (t AWSELBClient) DescribeTargetHealth(e *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+// DescribeTargetHealthWithContext mocks the aws elb client
+func (t AWSELBClient) DescribeTargetHealthWithContext(_ context.Context, e *elbv2.DescribeTargetHealthInput, _ ...request.Option) (*elbv2.DescribeTargetHealthOutput, error) {
 	gomega.Expect(e).To(gomega.Equal(t.MockDescribeTargetHealth.ExpectedInput))
-	return t.MockDescribeTargetHealth.DescribeTargetHealthOutput, t.MockDescribeTargetHealth.Err
+	if t.MockDescribeTargetHealth.Registered == nil || t.MockDescribeTargetHealth.Err != nil {
+		return t.MockDescribeTargetHealth.DescribeTargetHealthOutput, t.MockDescribeTargetHealth.Err
+	}
+	descriptions := append([]*elbv2.TargetHealthDescription{},
+		t.MockDescribeTargetHealth.DescribeTargetHealthOutput.TargetHealthDescriptions...)
+	for _, target := range *t.MockDescribeTargetHealth.Registered {
+		descriptions = append(descriptions, &elbv2.TargetHealthDescription{Target: target})
+	}
+	return &elbv2.DescribeTargetHealthOutput{TargetHealthDescriptions: descriptions}, nil
 }
 
 // DeregisterTargets sets the expected input and output for DeregisterTargets() on AWSELBClient
@@ -113,21 +134,42 @@ type DeregisterTargets struct {
 	ExpectedInput           *elbv2.DeregisterTargetsInput
 	DeregisterTargetsOutput *elbv2.DeregisterTargetsOutput
 	Err                     error
+	// Called is set when DeregisterTargets() is called, if it isn't nil.
+	Called *bool
 }
 
-// DeregisterTargets mocks the aws elb client
-func (t AWSELBClient) DeregisterTargets(e *elbv2.DeregisterTargetsInput) (*elbv2.DeregisterTargetsOutput, error) {
+// DeregisterTargetsWithContext mocks the aws elb client
+func (t AWSELBClient) DeregisterTargetsWithContext(_ context.Context, e *elbv2.DeregisterTargetsInput, _ ...request.Option) (*elbv2.DeregisterTargetsOutput, error) {
 	if len(e.Targets) == 0 {
 		return nil, errors.New("ValidationError: Targets must be specified")
 	}
 	gomega.Expect(e).To(gomega.Equal(t.MockDeregisterTargets.ExpectedInput))
+	if t.MockDeregisterTargets.Called != nil {
+		*t.MockDeregisterTargets.Called = true
+	}
 	return t.MockDeregisterTargets.DeregisterTargetsOutput, t.MockDeregisterTargets.Err
 }
 
+// WaitUntilInService sets the expected input and output for WaitUntilTargetInService() on AWSELBClient
+type WaitUntilInService struct {
+	ExpectedInput *elbv2.DescribeTargetHealthInput
+	Err           error
+}
+
+// WaitUntilTargetInServiceWithContext mocks the aws elb client
+func (t AWSELBClient) WaitUntilTargetInServiceWithContext(_ context.Context, e *elbv2.DescribeTargetHealthInput, _ ...request.WaiterOption) error {
+	gomega.Expect(e).To(gomega.Equal(t.MockWaitUntilInService.ExpectedInput))
+	return t.MockWaitUntilInService.Err
+}
+
 // AWSR53Client for mocking calls to the aws route53 client
 type AWSR53Client struct {
 	MockGetHostedZone            GetHostedZone
 	MockChangeResourceRecordSets ChangeResourceRecordSets
+	MockListResourceRecordSets   ListResourceRecordSets
+	MockCreateHealthCheck        CreateHealthCheck
+	MockDeleteHealthCheck        DeleteHealthCheck
+	MockWaitUntilChanged         WaitUntilChanged
 }
 
 // GetHostedZone sets the expected input and output for GetHostedZone() on AWSR53Client
@@ -137,8 +179,8 @@ type GetHostedZone struct {
 	Err                 error
 }
 
-// GetHostedZone mocks the aws route53 client
-func (t AWSR53Client) GetHostedZone(r *route53.GetHostedZoneInput) (*route53.GetHostedZoneOutput, error) {
+// GetHostedZoneWithContext mocks the aws route53 client
+func (t AWSR53Client) GetHostedZoneWithContext(_ context.Context, r *route53.GetHostedZoneInput, _ ...request.Option) (*route53.GetHostedZoneOutput, error) {
 	gomega.Expect(r).To(gomega.Equal(t.MockGetHostedZone.ExpectedInput))
 	return t.MockGetHostedZone.GetHostedZoneOutput, t.MockGetHostedZone.Err
 }
@@ -150,8 +192,83 @@ type ChangeResourceRecordSets struct {
 	Err                            error
 }
 
-// ChangeResourceRecordSets mocks the aws route53 client
-func (t AWSR53Client) ChangeResourceRecordSets(r *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error) {
+// ChangeResourceRecordSetsWithContext mocks the aws route53 client
+func (t AWSR53Client) ChangeResourceRecordSetsWithContext(_ context.Context, r *route53.ChangeResourceRecordSetsInput, _ ...request.Option) (*route53.ChangeResourceRecordSetsOutput, error) {
 	gomega.Expect(r).To(gomega.Equal(t.MockChangeResourceRecordSets.ExpectedInput))
 	return t.MockChangeResourceRecordSets.ChangeResourceRecordSetsOutput, t.MockChangeResourceRecordSets.Err
 }
+
+// ListResourceRecordSets sets the expected input and output for ListResourceRecordSets() on AWSR53Client. The first
+// page of Outputs is returned when no start record type is given, otherwise the page which starts at the given record.
+type ListResourceRecordSets struct {
+	ExpectedInput *route53.ListResourceRecordSetsInput
+	Outputs       []*route53.ListResourceRecordSetsOutput
+	Err           error
+}
+
+// ListResourceRecordSetsWithContext mocks the aws route53 client
+func (t AWSR53Client) ListResourceRecordSetsWithContext(_ context.Context, r *route53.ListResourceRecordSetsInput, _ ...request.Option) (*route53.ListResourceRecordSetsOutput, error) {
+	gomega.Expect(r.HostedZoneId).To(gomega.Equal(t.MockListResourceRecordSets.ExpectedInput.HostedZoneId))
+	if t.MockListResourceRecordSets.Err != nil {
+		return nil, t.MockListResourceRecordSets.Err
+	}
+	if r.StartRecordType == nil {
+		gomega.Expect(r).To(gomega.Equal(t.MockListResourceRecordSets.ExpectedInput))
+		return t.MockListResourceRecordSets.Outputs[0], nil
+	}
+	for _, output := range t.MockListResourceRecordSets.Outputs[1:] {
+		first := output.ResourceRecordSets[0]
+		if *first.Name == *r.StartRecordName && *first.Type == *r.StartRecordType {
+			return output, nil
+		}
+	}
+	return nil, errors.New("no page starting at " + *r.StartRecordName + " " + *r.StartRecordType)
+}
+
+// CreateHealthCheck sets the expected health check configs and the IDs of the created health checks for
+// CreateHealthCheck() on AWSR53Client, keyed by IP address.
+type CreateHealthCheck struct {
+	ExpectedConfigs map[string]*route53.HealthCheckConfig
+	IDs             map[string]string
+	Err             error
+}
+
+// CreateHealthCheckWithContext mocks the aws route53 client
+func (t AWSR53Client) CreateHealthCheckWithContext(_ context.Context, r *route53.CreateHealthCheckInput, _ ...request.Option) (*route53.CreateHealthCheckOutput, error) {
+	gomega.Expect(r.CallerReference).ToNot(gomega.BeNil())
+	if t.MockCreateHealthCheck.Err != nil {
+		return nil, t.MockCreateHealthCheck.Err
+	}
+	ip := *r.HealthCheckConfig.IPAddress
+	gomega.Expect(r.HealthCheckConfig).To(gomega.Equal(t.MockCreateHealthCheck.ExpectedConfigs[ip]))
+	return &route53.CreateHealthCheckOutput{
+		HealthCheck: &route53.HealthCheck{Id: aws.String(t.MockCreateHealthCheck.IDs[ip])},
+	}, nil
+}
+
+// DeleteHealthCheck records the IDs of the health checks deleted by DeleteHealthCheck() on AWSR53Client.
+type DeleteHealthCheck struct {
+	Deleted *[]string
+	Err     error
+}
+
+// DeleteHealthCheckWithContext mocks the aws route53 client
+func (t AWSR53Client) DeleteHealthCheckWithContext(_ context.Context, r *route53.DeleteHealthCheckInput, _ ...request.Option) (*route53.DeleteHealthCheckOutput, error) {
+	if t.MockDeleteHealthCheck.Err != nil {
+		return nil, t.MockDeleteHealthCheck.Err
+	}
+	*t.MockDeleteHealthCheck.Deleted = append(*t.MockDeleteHealthCheck.Deleted, *r.HealthCheckId)
+	return &route53.DeleteHealthCheckOutput{}, nil
+}
+
+// WaitUntilChanged sets the expected input and output for WaitUntilResourceRecordSetsChanged() on AWSR53Client
+type WaitUntilChanged struct {
+	ExpectedInput *route53.GetChangeInput
+	Err           error
+}
+
+// WaitUntilResourceRecordSetsChangedWithContext mocks the aws route53 client
+func (t AWSR53Client) WaitUntilResourceRecordSetsChangedWithContext(_ context.Context, r *route53.GetChangeInput, _ ...request.WaiterOption) error {
+	gomega.Expect(r).To(gomega.Equal(t.MockWaitUntilChanged.ExpectedInput))
+	return t.MockWaitUntilChanged.Err
+}
@@ -0,0 +1,225 @@
+// Package report records a machine-readable summary of a run, so automation can check what bootstrapping did rather
+// than parse the logs.
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/etcd"
+)
+
+// ActionType is a change made while bootstrapping.
+type ActionType string
+
+const (
+	// RemoveMember is removing an old member which is no longer a cloud instance.
+	RemoveMember ActionType = "remove-member"
+	// SkipRemoval is keeping an old member, because it wasn't safe to remove it.
+	SkipRemoval ActionType = "skip-removal"
+	// AddMember is adding the local instance as a voting member.
+	AddMember ActionType = "add-member"
+	// AddLearner is adding the local instance as a learner.
+	AddLearner ActionType = "add-learner"
+	// MoveDataDir is moving a stale data dir aside.
+	MoveDataDir ActionType = "move-data-dir"
+	// RemoveDataDir is deleting a stale data dir.
+	RemoveDataDir ActionType = "remove-data-dir"
+	// RestoreSnapshot is restoring a snapshot into the data dir.
+	RestoreSnapshot ActionType = "restore-snapshot"
+)
+
+// Action is a change made, or deliberately not made, while bootstrapping.
+type Action struct {
+	Type ActionType `json:"type"`
+	// Target is what was changed, such as a member's name or the data dir.
+	Target string `json:"target"`
+	// Detail explains why the action was taken or skipped.
+	Detail string `json:"detail,omitempty"`
+	// Error is set if the action failed.
+	Error string `json:"error,omitempty"`
+}
+
+// Registration is the result of updating a registration provider.
+type Registration struct {
+	Provider  string   `json:"provider"`
+	Instances []string `json:"instances"`
+	Seconds   float64  `json:"seconds"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// Config is the etcd config written by the run.
+type Config struct {
+	File   string `json:"file"`
+	Format string `json:"format"`
+	// Contents of the file.
+	Contents string `json:"contents"`
+}
+
+// Report summarises a run. Its methods are safe to call on a nil report, which records nothing, so callers don't
+// need to check whether a report was asked for.
+type Report struct {
+	mu sync.Mutex
+
+	Command string    `json:"command"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Success bool      `json:"success"`
+	// Error is the message the run failed with.
+	Error string `json:"error,omitempty"`
+	// Decision is how the local node was bootstrapped: new, existing or rejoin.
+	Decision      string           `json:"decision,omitempty"`
+	Instances     []cloud.Instance `json:"instances"`
+	LocalInstance *cloud.Instance  `json:"localInstance,omitempty"`
+	MembersBefore []etcd.Member    `json:"membersBefore"`
+	MembersAfter  []etcd.Member    `json:"membersAfter"`
+	Actions       []Action         `json:"actions"`
+	Registrations []Registration   `json:"registrations"`
+	// Timings are how long each step took, in seconds.
+	Timings map[string]float64 `json:"timings"`
+	Config  *Config            `json:"config,omitempty"`
+}
+
+// New starts a report for the command.
+func New(command string) *Report {
+	return &Report{
+		Command:       command,
+		Start:         time.Now(),
+		Instances:     []cloud.Instance{},
+		MembersBefore: []etcd.Member{},
+		MembersAfter:  []etcd.Member{},
+		Actions:       []Action{},
+		Registrations: []Registration{},
+		Timings:       make(map[string]float64),
+	}
+}
+
+// SetDecision records how the local node was bootstrapped.
+func (r *Report) SetDecision(decision string) {
+	r.update(func() { r.Decision = decision })
+}
+
+// SetInstances records the instances found by the cloud provider.
+func (r *Report) SetInstances(instances []cloud.Instance) {
+	r.update(func() { r.Instances = append([]cloud.Instance{}, instances...) })
+}
+
+// SetLocalInstance records the local instance.
+func (r *Report) SetLocalInstance(instance cloud.Instance) {
+	r.update(func() { r.LocalInstance = &instance })
+}
+
+// SetMembersBefore records the members before any changes were made.
+func (r *Report) SetMembersBefore(members []etcd.Member) {
+	r.update(func() { r.MembersBefore = append([]etcd.Member{}, members...) })
+}
+
+// SetMembersAfter records the members once any changes have been made.
+func (r *Report) SetMembersAfter(members []etcd.Member) {
+	r.update(func() { r.MembersAfter = append([]etcd.Member{}, members...) })
+}
+
+// AddAction records a change.
+func (r *Report) AddAction(action Action) {
+	r.update(func() { r.Actions = append(r.Actions, action) })
+}
+
+// AddRegistration records the result of updating a registration provider with the instances, since start.
+func (r *Report) AddRegistration(provider string, instances []cloud.Instance, start time.Time, err error) {
+	registration := Registration{
+		Provider:  provider,
+		Instances: []string{},
+		Seconds:   time.Since(start).Seconds(),
+	}
+	for _, instance := range instances {
+		registration.Instances = append(registration.Instances, instance.Name)
+	}
+	if err != nil {
+		registration.Error = err.Error()
+	}
+	r.update(func() { r.Registrations = append(r.Registrations, registration) })
+}
+
+// Time records how long the step took since start.
+func (r *Report) Time(step string, start time.Time) {
+	d := time.Since(start)
+	r.update(func() { r.Timings[step] = d.Seconds() })
+}
+
+// SetConfig records the etcd config written to the file.
+func (r *Report) SetConfig(file, format, contents string) {
+	r.update(func() { r.Config = &Config{File: file, Format: format, Contents: contents} })
+}
+
+// Finish records the outcome of the run.
+func (r *Report) Finish(success bool) {
+	r.update(func() {
+		r.Success = success
+		r.End = time.Now()
+	})
+}
+
+func (r *Report) update(fn func()) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn()
+}
+
+// Write writes the report as JSON. The file is replaced atomically, so readers never see a partial report.
+func (r *Report) Write(filename string) error {
+	r.mu.Lock()
+	data, err := json.MarshalIndent(r, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("unable to encode report: %w", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create report file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write report file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write report file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("unable to set report file permissions: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return fmt.Errorf("unable to replace report file %s: %w", filename, err)
+	}
+	return nil
+}
+
+// ErrorHook returns a logrus hook which records the message the run fails with. Commands fail with log.Fatal, so
+// this captures the reason without every caller having to record it.
+func (r *Report) ErrorHook() log.Hook {
+	return &errorHook{report: r}
+}
+
+type errorHook struct {
+	report *Report
+}
+
+func (h *errorHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel}
+}
+
+func (h *errorHook) Fire(entry *log.Entry) error {
+	h.report.update(func() { h.report.Error = entry.Message })
+	return nil
+}
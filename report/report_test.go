@@ -0,0 +1,109 @@
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/etcd"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestReport(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Report Suite")
+}
+
+var _ = Describe("Report", func() {
+	var (
+		dir      string
+		filename string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "report")
+		Expect(err).ToNot(HaveOccurred())
+		filename = filepath.Join(dir, "report.json")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	read := func() map[string]interface{} {
+		data, err := ioutil.ReadFile(filename)
+		Expect(err).ToNot(HaveOccurred())
+		var out map[string]interface{}
+		Expect(json.Unmarshal(data, &out)).To(Succeed())
+		return out
+	}
+
+	It("records nothing on a nil report", func() {
+		var r *Report
+		r.SetDecision("new")
+		r.AddAction(Action{Type: RemoveMember, Target: "etcd-1"})
+		r.AddRegistration("route53", nil, time.Now(), nil)
+		r.Time("generate", time.Now())
+		r.Finish(true)
+	})
+
+	It("writes the run as JSON", func() {
+		r := New("etcd-bootstrap aws")
+		r.SetInstances([]cloud.Instance{{Name: "etcd-1", Endpoint: "10.0.0.1"}})
+		r.SetLocalInstance(cloud.Instance{Name: "etcd-1", Endpoint: "10.0.0.1"})
+		r.SetMembersBefore([]etcd.Member{{Name: "etcd-0"}})
+		r.SetMembersAfter([]etcd.Member{{Name: "etcd-1"}})
+		r.SetDecision("existing")
+		r.AddAction(Action{Type: RemoveMember, Target: "etcd-0"})
+		r.AddRegistration("route53", []cloud.Instance{{Name: "etcd-1"}}, time.Now(), errors.New("access denied"))
+		r.Time("generate", time.Now())
+		r.SetConfig("/var/run/etcd-bootstrap.conf", "env", "ETCD_NAME=etcd-1\n")
+		r.Finish(true)
+
+		Expect(r.Write(filename)).To(Succeed())
+		out := read()
+		Expect(out).To(HaveKeyWithValue("command", "etcd-bootstrap aws"))
+		Expect(out).To(HaveKeyWithValue("success", true))
+		Expect(out).To(HaveKeyWithValue("decision", "existing"))
+		Expect(out["instances"]).To(HaveLen(1))
+		Expect(out["localInstance"]).To(HaveKeyWithValue("name", "etcd-1"))
+		Expect(out["membersBefore"]).To(HaveLen(1))
+		Expect(out["actions"]).To(ConsistOf(HaveKeyWithValue("type", "remove-member")))
+		Expect(out["registrations"]).To(ConsistOf(And(
+			HaveKeyWithValue("provider", "route53"),
+			HaveKeyWithValue("error", "access denied"))))
+		Expect(out["timings"]).To(HaveKey("generate"))
+		Expect(out["config"]).To(HaveKeyWithValue("contents", "ETCD_NAME=etcd-1\n"))
+
+		files, _ := ioutil.ReadDir(dir)
+		Expect(files).To(HaveLen(1), "temporary file should be renamed")
+	})
+
+	It("writes empty lists rather than null", func() {
+		Expect(New("etcd-bootstrap aws").Write(filename)).To(Succeed())
+		out := read()
+		Expect(out["instances"]).To(BeEmpty())
+		Expect(out["actions"]).To(BeEmpty())
+	})
+
+	It("records the message the run fails with", func() {
+		r := New("etcd-bootstrap aws")
+		logger := log.New()
+		logger.SetOutput(ioutil.Discard)
+		logger.AddHook(r.ErrorHook())
+
+		logger.Error("not recorded")
+		Expect(r.Error).To(BeEmpty())
+		Expect(func() { logger.Panic("failed to list instances") }).To(Panic())
+		Expect(r.Error).To(Equal("failed to list instances"))
+	})
+})
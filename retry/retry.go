@@ -0,0 +1,115 @@
+// Package retry retries calls to cloud and etcd APIs with exponential backoff.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// jitter randomly varies each wait by up to this fraction, so instances started together don't retry in lockstep.
+const jitter = 0.2
+
+// Policy controls how failed calls are retried. The wait between attempts starts at InitialInterval and doubles
+// after each attempt, up to MaxInterval.
+type Policy struct {
+	// MaxAttempts is the most times a call is made. Zero or one means it isn't retried.
+	MaxAttempts int
+	// MaxElapsed stops retrying once this long has passed since the first attempt. Zero means no limit.
+	MaxElapsed time.Duration
+	// InitialInterval is how long to wait after the first failed attempt.
+	InitialInterval time.Duration
+	// MaxInterval is the longest wait between attempts. Zero means no limit.
+	MaxInterval time.Duration
+}
+
+// DefaultPolicy makes up to five attempts within a minute.
+var DefaultPolicy = Policy{
+	MaxAttempts:     5,
+	MaxElapsed:      time.Minute,
+	InitialInterval: 500 * time.Millisecond,
+	MaxInterval:     10 * time.Second,
+}
+
+// Validate checks the policy is usable.
+func (p Policy) Validate() error {
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("retry attempts must not be negative, but was %d", p.MaxAttempts)
+	}
+	if p.MaxElapsed < 0 || p.InitialInterval < 0 || p.MaxInterval < 0 {
+		return fmt.Errorf("retry durations must not be negative")
+	}
+	if p.MaxInterval > 0 && p.MaxInterval < p.InitialInterval {
+		return fmt.Errorf("max retry interval %v must not be less than the initial interval %v",
+			p.MaxInterval, p.InitialInterval)
+	}
+	return nil
+}
+
+// Retryable classifies errors which are worth retrying, such as throttling or a timeout. Each provider
+// has its own, as they report these differently.
+type Retryable func(error) bool
+
+// Do calls fn until it succeeds, it returns an error which isn't retryable, or the policy gives up. The name
+// describes the call for logging. Waiting between attempts stops early if ctx is done.
+func Do(ctx context.Context, policy Policy, name string, retryable Retryable, fn func(context.Context) error) error {
+	start := time.Now()
+	interval := policy.InitialInterval
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || !retryable(err) {
+			return err
+		}
+		if attempt >= policy.MaxAttempts {
+			if attempt > 1 {
+				return fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+			}
+			return err
+		}
+
+		wait := interval + time.Duration((rand.Float64()*2-1)*jitter*float64(interval))
+		if policy.MaxElapsed > 0 && time.Since(start)+wait > policy.MaxElapsed {
+			return fmt.Errorf("gave up after %d attempts in %v: %w", attempt, time.Since(start).Round(time.Millisecond), err)
+		}
+		log.Warnf("Unable to %s, retrying in %v: %v", name, wait.Round(time.Millisecond), err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("gave up after %d attempts: %v: %w", attempt, ctx.Err(), err)
+		case <-timer.C:
+		}
+
+		interval *= 2
+		if policy.MaxInterval > 0 && interval > policy.MaxInterval {
+			interval = policy.MaxInterval
+		}
+	}
+}
+
+// Network classifies network errors which are likely to be transient, such as timeouts and refused or reset
+// connections. It doesn't retry if the caller's context is done.
+func Network(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
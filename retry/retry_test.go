@@ -0,0 +1,111 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestRetry(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Retry Suite")
+}
+
+var _ = Describe("Do", func() {
+	var (
+		policy    Policy
+		attempts  int
+		errs      []error
+		transient = errors.New("transient")
+		fatal     = errors.New("fatal")
+		retryable = func(err error) bool { return errors.Is(err, transient) }
+	)
+
+	BeforeEach(func() {
+		policy = Policy{MaxAttempts: 3, InitialInterval: time.Millisecond}
+		attempts = 0
+		errs = nil
+	})
+
+	call := func(ctx context.Context) error {
+		return Do(ctx, policy, "test", retryable, func(context.Context) error {
+			attempts++
+			if len(errs) == 0 {
+				return nil
+			}
+			err := errs[0]
+			errs = errs[1:]
+			return err
+		})
+	}
+
+	It("retries retryable errors until the call succeeds", func() {
+		errs = []error{transient, transient}
+		Expect(call(context.Background())).To(Succeed())
+		Expect(attempts).To(Equal(3))
+	})
+
+	It("gives up after the maximum attempts", func() {
+		errs = []error{transient, transient, transient, transient}
+		err := call(context.Background())
+		Expect(errors.Is(err, transient)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("gave up after 3 attempts"))
+		Expect(attempts).To(Equal(3))
+	})
+
+	It("doesn't retry errors which aren't retryable", func() {
+		errs = []error{fatal}
+		Expect(call(context.Background())).To(Equal(fatal))
+		Expect(attempts).To(Equal(1))
+	})
+
+	It("makes a single attempt with the zero policy", func() {
+		policy = Policy{}
+		errs = []error{transient}
+		Expect(call(context.Background())).To(Equal(transient))
+		Expect(attempts).To(Equal(1))
+	})
+
+	It("gives up once the maximum elapsed time would be exceeded", func() {
+		policy = Policy{MaxAttempts: 10, InitialInterval: 50 * time.Millisecond, MaxElapsed: 100 * time.Millisecond}
+		errs = []error{transient, transient, transient, transient}
+		err := call(context.Background())
+		Expect(errors.Is(err, transient)).To(BeTrue())
+		Expect(attempts).To(Equal(2))
+	})
+
+	It("stops waiting when the context is done", func() {
+		policy = Policy{MaxAttempts: 10, InitialInterval: time.Hour}
+		errs = []error{transient}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := call(ctx)
+		Expect(errors.Is(err, transient)).To(BeTrue())
+		Expect(attempts).To(Equal(1))
+	})
+
+	It("rejects invalid policies", func() {
+		Expect(Policy{MaxAttempts: -1}.Validate()).ToNot(Succeed())
+		Expect(Policy{InitialInterval: time.Second, MaxInterval: time.Millisecond}.Validate()).ToNot(Succeed())
+		Expect(DefaultPolicy.Validate()).To(Succeed())
+	})
+})
+
+var _ = Describe("Network", func() {
+	It("retries transient network errors", func() {
+		Expect(Network(&net.OpError{Op: "dial", Err: errors.New("connection refused")})).To(BeTrue())
+		Expect(Network(&net.DNSError{IsTimeout: true})).To(BeTrue())
+		Expect(Network(context.DeadlineExceeded)).To(BeTrue())
+	})
+
+	It("doesn't retry other errors", func() {
+		Expect(Network(&net.DNSError{IsNotFound: true})).To(BeFalse())
+		Expect(Network(context.Canceled)).To(BeFalse())
+		Expect(Network(errors.New("access denied"))).To(BeFalse())
+	})
+})
@@ -0,0 +1,145 @@
+package snapshot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	etcdsnapshot "go.etcd.io/etcd/etcdutl/v3/snapshot"
+	"go.uber.org/zap"
+)
+
+// Info identifies a downloaded snapshot.
+type Info struct {
+	// SHA256 is the hex encoded SHA-256 of the whole snapshot file.
+	SHA256   string `json:"sha256"`
+	Revision int64  `json:"revision"`
+}
+
+// RestoreConfig is the member to restore a snapshot as.
+type RestoreConfig struct {
+	// DataDir is etcd's data dir. It must not contain a member dir already.
+	DataDir string
+	Name    string
+	PeerURL string
+	// InitialCluster is the etcd initial cluster, name=peerURL pairs separated by commas.
+	InitialCluster string
+	ClusterToken   string
+}
+
+// Restorer downloads a snapshot and restores it into an etcd data dir, like etcdutl snapshot restore.
+type Restorer struct {
+	source         Source
+	expectedSHA256 string
+	// path is the downloaded snapshot.
+	path string
+	info Info
+}
+
+// NewRestorer returns a Restorer for the snapshot at source. If expectedSHA256 is set, the snapshot must match it.
+func NewRestorer(source Source, expectedSHA256 string) *Restorer {
+	return &Restorer{source: source, expectedSHA256: strings.ToLower(expectedSHA256)}
+}
+
+// Fetch downloads the snapshot to a temporary file and verifies it, returning its hash and revision. It only
+// downloads the snapshot once.
+func (r *Restorer) Fetch() (Info, error) {
+	if r.path != "" {
+		return r.info, nil
+	}
+	log.Infof("Downloading snapshot %s", r.source)
+	in, err := r.source.Open()
+	if err != nil {
+		return Info{}, err
+	}
+	defer in.Close()
+	f, err := ioutil.TempFile("", "etcd-snapshot-*.db")
+	if err != nil {
+		return Info{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), in); err != nil {
+		os.Remove(f.Name())
+		return Info{}, fmt.Errorf("unable to download snapshot %s: %w", r.source, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return Info{}, err
+	}
+	info := Info{SHA256: hex.EncodeToString(h.Sum(nil))}
+	if r.expectedSHA256 != "" && info.SHA256 != r.expectedSHA256 {
+		os.Remove(f.Name())
+		return Info{}, fmt.Errorf("snapshot %s has SHA-256 %s, but expected %s", r.source, info.SHA256, r.expectedSHA256)
+	}
+
+	status, err := etcdsnapshot.NewV3(zap.NewNop()).Status(f.Name())
+	if err != nil {
+		os.Remove(f.Name())
+		return Info{}, fmt.Errorf("snapshot %s is invalid: %w", r.source, err)
+	}
+	info.Revision = status.Revision
+	log.Infof("Downloaded snapshot %s at revision %d with SHA-256 %s", r.source, info.Revision, info.SHA256)
+	r.path = f.Name()
+	r.info = info
+	return info, nil
+}
+
+// Restore restores the fetched snapshot into the data dir, after checking its integrity hash. The snapshot is
+// restored alongside any other files already in the data dir, such as lost+found at the root of a volume.
+func (r *Restorer) Restore(cfg RestoreConfig) error {
+	if _, err := r.Fetch(); err != nil {
+		return err
+	}
+	defer r.Close()
+
+	memberDir := filepath.Join(cfg.DataDir, "member")
+	if _, err := os.Stat(memberDir); err == nil {
+		return fmt.Errorf("unable to restore snapshot, %s already exists", memberDir)
+	}
+	if err := os.MkdirAll(cfg.DataDir, 0700); err != nil {
+		return err
+	}
+	// etcdutl refuses to restore into a data dir which isn't empty, so restore into a temporary dir first.
+	restoreDir := filepath.Join(cfg.DataDir, "restore.tmp")
+	if err := os.RemoveAll(restoreDir); err != nil {
+		return err
+	}
+	defer os.RemoveAll(restoreDir)
+
+	log.Infof("Restoring snapshot %s into %s as %s", r.source, cfg.DataDir, cfg.Name)
+	err := etcdsnapshot.NewV3(zap.NewNop()).Restore(etcdsnapshot.RestoreConfig{
+		SnapshotPath:        r.path,
+		Name:                cfg.Name,
+		OutputDataDir:       restoreDir,
+		PeerURLs:            []string{cfg.PeerURL},
+		InitialCluster:      cfg.InitialCluster,
+		InitialClusterToken: cfg.ClusterToken,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to restore snapshot %s: %w", r.source, err)
+	}
+	return os.Rename(filepath.Join(restoreDir, "member"), memberDir)
+}
+
+// Close removes the downloaded snapshot.
+func (r *Restorer) Close() error {
+	if r.path == "" {
+		return nil
+	}
+	err := os.Remove(r.path)
+	r.path = ""
+	return err
+}
+
+// String returns the snapshot location.
+func (r *Restorer) String() string {
+	return r.source.String()
+}
@@ -0,0 +1,199 @@
+package snapshot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sky-uk/etcd-bootstrap/etcd"
+	"go.etcd.io/etcd/server/v3/lease"
+	"go.etcd.io/etcd/server/v3/mvcc"
+	"go.etcd.io/etcd/server/v3/mvcc/backend"
+	"go.uber.org/zap"
+	"google.golang.org/api/option"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestSnapshot(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Snapshot Suite")
+}
+
+// writeSnapshot creates a snapshot with a single key, with the integrity hash etcdctl snapshot save appends.
+// It returns the SHA-256 of the whole file.
+func writeSnapshot(path string) string {
+	be := backend.NewDefaultBackend(path)
+	store := mvcc.NewStore(zap.NewNop(), be, &lease.FakeLessor{}, mvcc.StoreConfig{})
+	store.Put([]byte("foo"), []byte("bar"), lease.NoLease)
+	store.Commit()
+	Expect(store.Close()).To(Succeed())
+	Expect(be.Close()).To(Succeed())
+
+	db, err := ioutil.ReadFile(path)
+	Expect(err).To(BeNil())
+	integrity := sha256.Sum256(db)
+	db = append(db, integrity[:]...)
+	Expect(ioutil.WriteFile(path, db, 0600)).To(Succeed())
+	sum := sha256.Sum256(db)
+	return hex.EncodeToString(sum[:])
+}
+
+var _ = Describe("Restorer", func() {
+	var (
+		tmpDir       string
+		snapshotPath string
+		snapshotHash string
+		dataDir      string
+		restoreCfg   RestoreConfig
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "snapshot-test")
+		Expect(err).To(BeNil())
+		snapshotPath = filepath.Join(tmpDir, "snapshot.db")
+		snapshotHash = writeSnapshot(snapshotPath)
+		dataDir = filepath.Join(tmpDir, "data")
+		restoreCfg = RestoreConfig{
+			DataDir:        dataDir,
+			Name:           "etcd-1",
+			PeerURL:        "http://127.0.0.1:2380",
+			InitialCluster: "etcd-1=http://127.0.0.1:2380,etcd-2=http://127.0.0.2:2380",
+			ClusterToken:   "test-token",
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("fetches and verifies the snapshot", func() {
+		r := NewRestorer(&fileSource{path: snapshotPath}, snapshotHash)
+		defer r.Close()
+		Expect(r.Fetch()).To(Equal(Info{SHA256: snapshotHash, Revision: 2}))
+	})
+
+	It("fails if the snapshot doesn't have the expected SHA-256", func() {
+		r := NewRestorer(&fileSource{path: snapshotPath}, "0000")
+		_, err := r.Fetch()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("expected 0000"))
+	})
+
+	It("restores the snapshot into the data dir", func() {
+		Expect(os.MkdirAll(filepath.Join(dataDir, "lost+found"), 0700)).To(Succeed())
+		r := NewRestorer(&fileSource{path: snapshotPath}, "")
+		Expect(r.Restore(restoreCfg)).To(Succeed())
+
+		data, err := etcd.ReadDataDir(dataDir)
+		Expect(err).To(BeNil())
+		Expect(data.MemberID).ToNot(BeZero())
+		Expect(data.ClusterID).ToNot(BeZero())
+		Expect(filepath.Join(dataDir, "restore.tmp")).ToNot(BeADirectory())
+		Expect(r.path).To(BeEmpty())
+	})
+
+	It("restores the same cluster ID on every member", func() {
+		Expect(NewRestorer(&fileSource{path: snapshotPath}, "").Restore(restoreCfg)).To(Succeed())
+		data1, err := etcd.ReadDataDir(dataDir)
+		Expect(err).To(BeNil())
+
+		restoreCfg.DataDir = filepath.Join(tmpDir, "data-2")
+		restoreCfg.Name = "etcd-2"
+		restoreCfg.PeerURL = "http://127.0.0.2:2380"
+		Expect(NewRestorer(&fileSource{path: snapshotPath}, "").Restore(restoreCfg)).To(Succeed())
+		data2, err := etcd.ReadDataDir(restoreCfg.DataDir)
+		Expect(err).To(BeNil())
+
+		Expect(data2.ClusterID).To(Equal(data1.ClusterID))
+		Expect(data2.MemberID).ToNot(Equal(data1.MemberID))
+	})
+
+	It("fails if the snapshot has no integrity hash", func() {
+		db, err := ioutil.ReadFile(snapshotPath)
+		Expect(err).To(BeNil())
+		Expect(ioutil.WriteFile(snapshotPath, db[:len(db)-sha256.Size], 0600)).To(Succeed())
+		Expect(NewRestorer(&fileSource{path: snapshotPath}, "").Restore(restoreCfg)).ToNot(Succeed())
+	})
+
+	It("won't overwrite existing data", func() {
+		Expect(os.MkdirAll(filepath.Join(dataDir, "member"), 0700)).To(Succeed())
+		Expect(NewRestorer(&fileSource{path: snapshotPath}, "").Restore(restoreCfg)).ToNot(Succeed())
+	})
+})
+
+var _ = Describe("Sources", func() {
+	var (
+		server   *httptest.Server
+		contents string
+		paths    []string
+	)
+
+	BeforeEach(func() {
+		contents = "snapshot contents"
+		paths = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.URL.Path)
+			_, _ = fmt.Fprint(w, contents)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	read := func(source Source) string {
+		in, err := source.Open()
+		Expect(err).To(BeNil())
+		defer in.Close()
+		out, err := ioutil.ReadAll(in)
+		Expect(err).To(BeNil())
+		return string(out)
+	}
+
+	It("treats paths as local files", func() {
+		source, err := NewSource("/var/backups/etcd.db", &SourceConfig{})
+		Expect(err).To(BeNil())
+		Expect(source).To(Equal(&fileSource{path: "/var/backups/etcd.db"}))
+		source, err = NewSource("file:///var/backups/etcd.db", &SourceConfig{})
+		Expect(err).To(BeNil())
+		Expect(source).To(Equal(&fileSource{path: "/var/backups/etcd.db"}))
+	})
+
+	It("downloads from an S3 compatible endpoint such as MinIO", func() {
+		os.Setenv("AWS_ACCESS_KEY_ID", "minio")
+		os.Setenv("AWS_SECRET_ACCESS_KEY", "minio123")
+		defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+		defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+		source, err := NewSource("s3://backups/etcd/snapshot.db", &SourceConfig{S3Endpoint: server.URL})
+		Expect(err).To(BeNil())
+		Expect(source.String()).To(Equal("s3://backups/etcd/snapshot.db"))
+		Expect(read(source)).To(Equal(contents))
+		Expect(paths).To(Equal([]string{"/backups/etcd/snapshot.db"}))
+	})
+
+	It("downloads from GCS", func() {
+		source, err := newGCSSource("backups", "etcd/snapshot.db",
+			option.WithEndpoint(server.URL+"/storage/v1/"), option.WithoutAuthentication())
+		Expect(err).To(BeNil())
+		Expect(source.String()).To(Equal("gs://backups/etcd/snapshot.db"))
+		Expect(read(source)).To(Equal(contents))
+		Expect(paths).To(Equal([]string{"/storage/v1/b/backups/o/etcd/snapshot.db"}))
+	})
+
+	It("rejects unsupported locations", func() {
+		_, err := NewSource("ftp://backups/etcd.db", &SourceConfig{})
+		Expect(err).ToNot(BeNil())
+		_, err = NewSource("s3://backups", &SourceConfig{})
+		Expect(err).ToNot(BeNil())
+	})
+})
@@ -0,0 +1,136 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"google.golang.org/api/option"
+	"google.golang.org/api/storage/v1"
+)
+
+const defaultS3Region = "us-east-1"
+
+// Source is where a snapshot is downloaded from.
+type Source interface {
+	// Open returns the snapshot contents.
+	Open() (io.ReadCloser, error)
+	String() string
+}
+
+// SourceConfig is the configuration for the object store sources.
+type SourceConfig struct {
+	// S3Endpoint overrides the S3 endpoint, e.g. for MinIO. Path style addressing is used with it.
+	S3Endpoint string
+	// S3Region is the region of the bucket. It defaults to the AWS_REGION environment variable, or us-east-1.
+	S3Region string
+}
+
+// NewSource returns the source for a snapshot location, which is either a local path, or an s3://bucket/key or
+// gs://bucket/object URL.
+func NewSource(location string, cfg *SourceConfig) (Source, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme == "" {
+		return &fileSource{path: location}, nil
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	switch u.Scheme {
+	case "file":
+		return &fileSource{path: u.Path}, nil
+	case "s3":
+		if u.Host == "" || key == "" {
+			return nil, fmt.Errorf("%s must be of the form s3://bucket/key", location)
+		}
+		return newS3Source(u.Host, key, cfg)
+	case "gs":
+		if u.Host == "" || key == "" {
+			return nil, fmt.Errorf("%s must be of the form gs://bucket/object", location)
+		}
+		return newGCSSource(u.Host, key)
+	default:
+		return nil, fmt.Errorf("unsupported snapshot location %s, must be a path, s3:// or gs:// URL", location)
+	}
+}
+
+type fileSource struct {
+	path string
+}
+
+func (f *fileSource) Open() (io.ReadCloser, error) {
+	return os.Open(f.path)
+}
+
+func (f *fileSource) String() string {
+	return f.path
+}
+
+// s3API is the subset of the S3 API used for downloading snapshots.
+type s3API interface {
+	GetObject(*s3.GetObjectInput) (*s3.GetObjectOutput, error)
+}
+
+type s3Source struct {
+	bucket, key string
+	s3          s3API
+}
+
+func newS3Source(bucket, key string, cfg *SourceConfig) (*s3Source, error) {
+	awsSession, err := session.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new AWS session: %v", err)
+	}
+	config := &aws.Config{}
+	if cfg.S3Region != "" {
+		config.Region = aws.String(cfg.S3Region)
+	} else if aws.StringValue(awsSession.Config.Region) == "" {
+		config.Region = aws.String(defaultS3Region)
+	}
+	if cfg.S3Endpoint != "" {
+		config.Endpoint = aws.String(cfg.S3Endpoint)
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	return &s3Source{bucket: bucket, key: key, s3: s3.New(awsSession, config)}, nil
+}
+
+func (s *s3Source) Open() (io.ReadCloser, error) {
+	out, err := s.s3.GetObject(&s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(s.key)})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get %s: %w", s, err)
+	}
+	return out.Body, nil
+}
+
+func (s *s3Source) String() string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.key)
+}
+
+type gcsSource struct {
+	bucket, object string
+	storage        *storage.Service
+}
+
+func newGCSSource(bucket, object string, opts ...option.ClientOption) (*gcsSource, error) {
+	service, err := storage.NewService(context.Background(), append(opts, option.WithScopes(storage.DevstorageReadOnlyScope))...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create GCS API client: %v", err)
+	}
+	return &gcsSource{bucket: bucket, object: object, storage: service}, nil
+}
+
+func (g *gcsSource) Open() (io.ReadCloser, error) {
+	resp, err := g.storage.Objects.Get(g.bucket, g.object).Download()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get %s: %w", g, err)
+	}
+	return resp.Body, nil
+}
+
+func (g *gcsSource) String() string {
+	return fmt.Sprintf("gs://%s/%s", g.bucket, g.object)
+}
@@ -0,0 +1,243 @@
+package watch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/etcd"
+)
+
+const (
+	defaultInterval = time.Minute
+	defaultJitter   = 0.1
+)
+
+// CloudAPI returns the cloud instances in the cluster.
+type CloudAPI interface {
+	// GetInstances returns all the non-terminated instances that will be part of the etcd cluster.
+	GetInstances(context.Context) ([]cloud.Instance, error)
+}
+
+// EtcdAPI returns information from the etcd cluster API.
+type EtcdAPI interface {
+	Members(context.Context) ([]etcd.Member, error)
+	// MemberHealthy returns true if the member's client endpoint is reachable.
+	MemberHealthy(context.Context, etcd.Member) bool
+}
+
+// RegistrationProvider publishes the cluster instances, e.g. to DNS or a loadbalancer.
+type RegistrationProvider interface {
+	Update(context.Context, []cloud.Instance) error
+}
+
+// NewAPIs creates the cloud and etcd APIs for a single sync, and a function to release them afterwards. Cloud
+// providers and etcd clients keep the instances and endpoints they first look up, so each sync needs new ones to
+// see nodes which have been replaced or scaled.
+type NewAPIs func(context.Context) (CloudAPI, EtcdAPI, func(), error)
+
+// Watcher keeps a registration provider in sync with the cloud instances.
+type Watcher struct {
+	newAPIs     NewAPIs
+	registrator RegistrationProvider
+	interval    time.Duration
+	jitter      float64
+	healthyOnly bool
+
+	mu     sync.Mutex
+	status Status
+}
+
+// Status is the outcome of the most recent sync.
+type Status struct {
+	LastSync time.Time `json:"lastSync"`
+	Error    string    `json:"error,omitempty"`
+	// Instances are the instances passed to the registration provider.
+	Instances []cloud.Instance `json:"instances"`
+	// Unhealthy are the instances which aren't healthy etcd members.
+	Unhealthy []string `json:"unhealthy,omitempty"`
+}
+
+// Option for New.
+type Option func(*Watcher) error
+
+// WithInterval sets how often to sync, which defaults to a minute.
+func WithInterval(interval time.Duration) Option {
+	return func(w *Watcher) error {
+		if interval <= 0 {
+			return fmt.Errorf("interval must be positive, but was %v", interval)
+		}
+		w.interval = interval
+		return nil
+	}
+}
+
+// WithJitter randomly varies each interval by up to the given fraction of it, so instances started together
+// don't all sync at the same time. It defaults to 0.1.
+func WithJitter(jitter float64) Option {
+	return func(w *Watcher) error {
+		if jitter < 0 || jitter >= 1 {
+			return fmt.Errorf("jitter must be between 0 and 1, but was %v", jitter)
+		}
+		w.jitter = jitter
+		return nil
+	}
+}
+
+// WithHealthyOnly only publishes the instances which are healthy etcd members, so clients aren't sent to instances
+// which are stopped, still booting or have yet to join the cluster. Syncs fail if there are none, rather than
+// unpublishing the whole cluster.
+func WithHealthyOnly() Option {
+	return func(w *Watcher) error {
+		w.healthyOnly = true
+		return nil
+	}
+}
+
+// New creates a watcher, which creates new APIs for each sync.
+func New(newAPIs NewAPIs, registrator RegistrationProvider, opts ...Option) (*Watcher, error) {
+	w := &Watcher{
+		newAPIs:     newAPIs,
+		registrator: registrator,
+		interval:    defaultInterval,
+		jitter:      defaultJitter,
+	}
+	for _, opt := range opts {
+		if err := opt(w); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Run syncs immediately, then every interval or whenever resync receives, until the context is cancelled.
+// Failed syncs are logged and retried on the next interval.
+func (w *Watcher) Run(ctx context.Context, resync <-chan struct{}) {
+	for {
+		if err := w.Sync(ctx); err != nil {
+			log.Warnf("Failed to sync registration provider, will retry: %v", err)
+		}
+
+		timer := time.NewTimer(w.nextInterval())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Info("Stopping watch")
+			return
+		case <-resync:
+			log.Info("Resyncing on request")
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (w *Watcher) nextInterval() time.Duration {
+	jitter := (rand.Float64()*2 - 1) * w.jitter * float64(w.interval)
+	return w.interval + time.Duration(jitter)
+}
+
+// Sync updates the registration provider with the current cloud instances.
+func (w *Watcher) Sync(ctx context.Context) error {
+	status, err := w.sync(ctx)
+	status.LastSync = time.Now()
+	if err != nil {
+		status.Error = err.Error()
+	}
+	w.mu.Lock()
+	w.status = status
+	w.mu.Unlock()
+	return err
+}
+
+func (w *Watcher) sync(ctx context.Context) (Status, error) {
+	var status Status
+	cloudAPI, etcdAPI, release, err := w.newAPIs(ctx)
+	if err != nil {
+		return status, fmt.Errorf("unable to create APIs: %w", err)
+	}
+	defer release()
+
+	instances, err := cloudAPI.GetInstances(ctx)
+	if err != nil {
+		return status, fmt.Errorf("unable to get instances: %w", err)
+	}
+	status.Instances = instances
+
+	// Unless only healthy instances are wanted, the instances are registered regardless of their health, same as
+	// when bootstrapping, but report any which aren't working etcd members.
+	healthy, unhealthy, err := HealthyInstances(ctx, etcdAPI, instances)
+	if err != nil {
+		return status, err
+	}
+	status.Unhealthy = unhealthy
+	if len(status.Unhealthy) > 0 {
+		log.Warnf("Instances which aren't healthy etcd members: %v", status.Unhealthy)
+	}
+	if w.healthyOnly {
+		if len(healthy) == 0 {
+			return status, fmt.Errorf("none of the instances are healthy etcd members, so not updating the " +
+				"registration provider")
+		}
+		instances = healthy
+		status.Instances = healthy
+	}
+
+	if err := w.registrator.Update(ctx, instances); err != nil {
+		return status, fmt.Errorf("unable to update registration provider: %w", err)
+	}
+	log.Infof("Registered %d instances", len(instances))
+	return status, nil
+}
+
+// HealthyInstances splits the instances into those which are healthy etcd members, i.e. they've joined the cluster
+// and their client endpoint is reachable, and the names of those which aren't.
+func HealthyInstances(ctx context.Context, etcdAPI EtcdAPI, instances []cloud.Instance) ([]cloud.Instance,
+	[]string, error) {
+	members, err := etcdAPI.Members(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get etcd members: %w", err)
+	}
+	healthyMembers := make(map[string]bool)
+	for _, member := range members {
+		if member.Name != "" && etcdAPI.MemberHealthy(ctx, member) {
+			healthyMembers[member.Name] = true
+		}
+	}
+	var healthy []cloud.Instance
+	var unhealthy []string
+	for _, instance := range instances {
+		if healthyMembers[instance.Name] {
+			healthy = append(healthy, instance)
+		} else {
+			unhealthy = append(unhealthy, instance.Name)
+		}
+	}
+	return healthy, unhealthy, nil
+}
+
+// Status returns the outcome of the most recent sync.
+func (w *Watcher) Status() Status {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.status
+}
+
+// ServeHTTP reports the status of the most recent sync. It responds with 503 until the first successful sync,
+// and if the most recent one failed.
+func (w *Watcher) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	status := w.Status()
+	rw.Header().Set("Content-Type", "application/json")
+	if status.LastSync.IsZero() || status.Error != "" {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(rw).Encode(status); err != nil {
+		log.Warnf("Unable to write health response: %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+package watch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/etcd"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// TestWatch to register the test suite
+func TestWatch(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Watch")
+}
+
+var _ = Describe("Watcher", func() {
+	var (
+		cloudAPI    *mockCloudAPI
+		etcdAPI     *mockEtcdAPI
+		registrator *mockRegistrator
+		watcher     *Watcher
+	)
+
+	BeforeEach(func() {
+		cloudAPI = &mockCloudAPI{instances: []cloud.Instance{
+			{Name: "node-1", Endpoint: "10.0.0.1"},
+			{Name: "node-2", Endpoint: "10.0.0.2"},
+		}}
+		etcdAPI = &mockEtcdAPI{members: []etcd.Member{
+			{Name: "node-1", PeerURL: "http://10.0.0.1:2380"},
+			{Name: "node-2", PeerURL: "http://10.0.0.2:2380"},
+		}}
+		registrator = &mockRegistrator{}
+		var err error
+		watcher, err = New(apis(cloudAPI, etcdAPI), registrator, WithInterval(time.Hour))
+		Expect(err).To(BeNil())
+	})
+
+	It("registers the instances", func() {
+		Expect(watcher.Sync(context.Background())).To(Succeed())
+		Expect(registrator.updates()).To(Equal([][]cloud.Instance{cloudAPI.instances}))
+		Expect(watcher.Status().Unhealthy).To(BeEmpty())
+	})
+
+	It("reports instances which aren't healthy members", func() {
+		etcdAPI.unhealthy = "http://10.0.0.2:2380"
+		Expect(watcher.Sync(context.Background())).To(Succeed())
+		Expect(watcher.Status().Unhealthy).To(Equal([]string{"node-2"}))
+		By("Still registering all instances")
+		Expect(registrator.updates()[0]).To(HaveLen(2))
+	})
+
+	It("only registers healthy members when configured to", func() {
+		watcher, err := New(apis(cloudAPI, etcdAPI), registrator, WithHealthyOnly())
+		Expect(err).To(BeNil())
+		etcdAPI.unhealthy = "http://10.0.0.2:2380"
+		etcdAPI.members = append(etcdAPI.members, etcd.Member{PeerURL: "http://10.0.0.3:2380"})
+		cloudAPI.instances = append(cloudAPI.instances, cloud.Instance{Name: "node-3", Endpoint: "10.0.0.3"})
+
+		Expect(watcher.Sync(context.Background())).To(Succeed())
+		Expect(registrator.updates()).To(Equal([][]cloud.Instance{{cloudAPI.instances[0]}}))
+		Expect(watcher.Status().Instances).To(Equal([]cloud.Instance{cloudAPI.instances[0]}))
+		Expect(watcher.Status().Unhealthy).To(Equal([]string{"node-2", "node-3"}))
+	})
+
+	It("fails without updating the registration provider if no members are healthy", func() {
+		watcher, err := New(apis(cloudAPI, etcdAPI), registrator, WithHealthyOnly())
+		Expect(err).To(BeNil())
+		etcdAPI.members = nil
+
+		Expect(watcher.Sync(context.Background())).ToNot(Succeed())
+		Expect(registrator.updates()).To(BeEmpty())
+		Expect(watcher.Status().Error).To(ContainSubstring("none of the instances are healthy"))
+	})
+
+	It("fails without updating the registration provider if it can't get instances", func() {
+		cloudAPI.err = fmt.Errorf("throttled")
+		Expect(watcher.Sync(context.Background())).ToNot(Succeed())
+		Expect(registrator.updates()).To(BeEmpty())
+		Expect(watcher.Status().Error).To(ContainSubstring("throttled"))
+	})
+
+	It("serves the status for health checks", func() {
+		rec := httptest.NewRecorder()
+		watcher.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		Expect(rec.Code).To(Equal(http.StatusServiceUnavailable))
+
+		Expect(watcher.Sync(context.Background())).To(Succeed())
+		rec = httptest.NewRecorder()
+		watcher.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		var status Status
+		Expect(json.Unmarshal(rec.Body.Bytes(), &status)).To(Succeed())
+		Expect(status.Instances).To(HaveLen(2))
+
+		registrator.err = fmt.Errorf("route53 is down")
+		Expect(watcher.Sync(context.Background())).ToNot(Succeed())
+		rec = httptest.NewRecorder()
+		watcher.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		Expect(rec.Code).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("resyncs on request until cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		resync := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			watcher.Run(ctx, resync)
+			close(done)
+		}()
+
+		Eventually(func() int { return len(registrator.updates()) }).Should(Equal(1))
+		resync <- struct{}{}
+		Eventually(func() int { return len(registrator.updates()) }).Should(Equal(2))
+		cancel()
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("varies the interval by the jitter", func() {
+		w, err := New(apis(cloudAPI, etcdAPI), registrator, WithInterval(time.Minute), WithJitter(0.5))
+		Expect(err).To(BeNil())
+		for i := 0; i < 100; i++ {
+			interval := w.nextInterval()
+			Expect(interval).To(BeNumerically(">=", 30*time.Second))
+			Expect(interval).To(BeNumerically("<=", 90*time.Second))
+		}
+	})
+
+	It("uses new APIs for each sync, so it sees replaced instances", func() {
+		var created, released int
+		newAPIs := func(context.Context) (CloudAPI, EtcdAPI, func(), error) {
+			created++
+			// Like the cloud providers, each API returns the instances as they were when it was created.
+			api := &mockCloudAPI{instances: []cloud.Instance{{Name: fmt.Sprintf("node-%d", created)}}}
+			return api, etcdAPI, func() { released++ }, nil
+		}
+		watcher, err := New(newAPIs, registrator)
+		Expect(err).To(BeNil())
+
+		Expect(watcher.Sync(context.Background())).To(Succeed())
+		Expect(watcher.Sync(context.Background())).To(Succeed())
+		Expect(registrator.updates()).To(Equal([][]cloud.Instance{{{Name: "node-1"}}, {{Name: "node-2"}}}))
+		Expect(released).To(Equal(2))
+	})
+
+	It("fails without updating the registration provider if it can't create the APIs", func() {
+		newAPIs := func(context.Context) (CloudAPI, EtcdAPI, func(), error) {
+			return nil, nil, nil, fmt.Errorf("vSphere is down")
+		}
+		watcher, err := New(newAPIs, registrator)
+		Expect(err).To(BeNil())
+		Expect(watcher.Sync(context.Background())).ToNot(Succeed())
+		Expect(registrator.updates()).To(BeEmpty())
+		Expect(watcher.Status().Error).To(ContainSubstring("vSphere is down"))
+	})
+
+	It("rejects invalid options", func() {
+		_, err := New(apis(cloudAPI, etcdAPI), registrator, WithInterval(0))
+		Expect(err).ToNot(BeNil())
+		_, err = New(apis(cloudAPI, etcdAPI), registrator, WithJitter(1))
+		Expect(err).ToNot(BeNil())
+	})
+})
+
+// apis always returns the same APIs.
+func apis(cloudAPI CloudAPI, etcdAPI EtcdAPI) NewAPIs {
+	return func(context.Context) (CloudAPI, EtcdAPI, func(), error) {
+		return cloudAPI, etcdAPI, func() {}, nil
+	}
+}
+
+type mockCloudAPI struct {
+	instances []cloud.Instance
+	err       error
+}
+
+func (m *mockCloudAPI) GetInstances(context.Context) ([]cloud.Instance, error) {
+	return m.instances, m.err
+}
+
+type mockEtcdAPI struct {
+	members   []etcd.Member
+	unhealthy string
+}
+
+func (m *mockEtcdAPI) Members(context.Context) ([]etcd.Member, error) {
+	return m.members, nil
+}
+
+func (m *mockEtcdAPI) MemberHealthy(_ context.Context, member etcd.Member) bool {
+	return member.PeerURL != m.unhealthy
+}
+
+type mockRegistrator struct {
+	mu      sync.Mutex
+	updated [][]cloud.Instance
+	err     error
+}
+
+func (m *mockRegistrator) Update(_ context.Context, instances []cloud.Instance) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.updated = append(m.updated, instances)
+	return nil
+}
+
+func (m *mockRegistrator) updates() [][]cloud.Instance {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.updated
+}